@@ -284,7 +284,11 @@ var orphanAccountsFixer = &cobra.Command{
 
 var thumbnailsFixer = &cobra.Command{
 	Use:   "thumbnails [domain]",
-	Short: "Rebuild thumbnails image for images files",
+	Short: "Rebuild thumbnails image for images and PDF files",
+	Long: `Rebuild the missing thumbnails of the images and of the PDF files.
+
+The thumbnail trigger of an instance created before the previews of the PDFs
+is also updated, so that the thumbnails of the new PDF files are generated.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) != 1 {
 			return cmd.Usage()
@@ -16,7 +16,7 @@ import (
 
 	"github.com/cozy/afero"
 	"github.com/cozy/cozy-stack/pkg/magic"
-	web_utils "github.com/cozy/cozy-stack/web/utils"
+	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/swift"
 )
 
@@ -102,7 +102,7 @@ func (s *swiftServer) ServeFileContent(w http.ResponseWriter, req *http.Request,
 
 	if checkETag := req.Header.Get("Cache-Control") == ""; checkETag {
 		etag := fmt.Sprintf(`"%s"`, h["Etag"][:10])
-		if web_utils.CheckPreconditions(w, req, etag) {
+		if utils.CheckPreconditions(w, req, etag) {
 			return nil
 		}
 		w.Header().Set("Etag", etag)
@@ -139,7 +139,7 @@ func (s *swiftServer) ServeFileContent(w http.ResponseWriter, req *http.Request,
 	}
 
 	size, _ := strconv.ParseInt(contentLength, 10, 64)
-	web_utils.ServeContent(w, req, contentType, size, r)
+	utils.ServeContent(w, req, contentType, size, r)
 	return nil
 }
 
@@ -228,7 +228,7 @@ func (s *aferoServer) serveFileContent(w http.ResponseWriter, req *http.Request,
 			return err
 		}
 		etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(h.Sum(nil)))
-		if web_utils.CheckPreconditions(w, req, etag) {
+		if utils.CheckPreconditions(w, req, etag) {
 			return nil
 		}
 		w.Header().Set("Etag", etag)
@@ -270,7 +270,7 @@ func (s *aferoServer) serveFileContent(w http.ResponseWriter, req *http.Request,
 	if contentType == "text/html" {
 		contentType = "text/html; charset=utf-8"
 	}
-	web_utils.ServeContent(w, req, contentType, size, content)
+	utils.ServeContent(w, req, contentType, size, content)
 	return nil
 }
 
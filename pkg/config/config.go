@@ -107,6 +107,7 @@ type Config struct {
 
 	CredentialsEncryptorKey string
 	CredentialsDecryptorKey string
+	FilesEncryptionKey      string
 
 	RemoteAssets map[string]string
 
@@ -117,6 +118,7 @@ type Config struct {
 	Mail          *gomail.DialerOptions
 	AutoUpdates   AutoUpdates
 	Notifications Notifications
+	Pagination    Pagination
 	Logger        logger.Options
 
 	Cache                       RedisConfig
@@ -138,6 +140,7 @@ type Config struct {
 type Vault struct {
 	credsEncryptor *keymgmt.NACLKey
 	credsDecryptor *keymgmt.NACLKey
+	filesKey       []byte
 }
 
 // CredentialsEncryptorKey returns the key used to encrypt credentials values,
@@ -152,10 +155,119 @@ func (v *Vault) CredentialsDecryptorKey() *keymgmt.NACLKey {
 	return v.credsDecryptor
 }
 
+// FilesEncryptionKey returns the master key used to derive the keys for the
+// encryption of the files content, or nil if the encryption is disabled.
+func (v *Vault) FilesEncryptionKey() []byte {
+	return v.filesKey
+}
+
 // Fs contains the configuration values of the file-system
 type Fs struct {
 	Auth *url.Userinfo
 	URL  *url.URL
+	// MaxNameLength is the maximal length (in bytes) of the name of a file or
+	// directory. 0 means no limit.
+	MaxNameLength int
+	// MaxDepth is the maximal depth of a directory in the tree (the number of
+	// segments of its path). 0 means no limit.
+	MaxDepth int
+	// MaxUploadSize is the maximal size (in bytes) of a file. 0 means no
+	// limit, except the disk quota.
+	MaxUploadSize int64
+	// IllegalChars is a list of characters that are not allowed in the name
+	// of a file or directory, in addition to the ones always forbidden.
+	IllegalChars string
+	// PreserveUnicodeNames can be used to keep the names of the files and
+	// directories as given, instead of normalizing them to the NFC form.
+	PreserveUnicodeNames bool
+	// Dedup enables the deduplication of the contents of the files: when the
+	// same content is uploaded twice, it is stored only once. It is only
+	// supported by the swift layout v2.
+	Dedup bool
+	// Audit enables the audit trail: a record is saved in CouchDB for each
+	// mutation of a file or directory.
+	Audit bool
+	// AuditRetention is how long the records of the audit trail are kept.
+	AuditRetention time.Duration
+	// Compressible is the list of the classes or mime types (text/csv, or
+	// text/* for a family) of the files that are compressed on the fly when
+	// they are downloaded by a client that accepts it.
+	Compressible []string
+	// UnsafeInlineTypes is the list of the classes or mime types of the files
+	// that can run scripts in a browser (HTML, SVG, etc.). When they are
+	// served inline, the response is sandboxed with a Content-Security-Policy.
+	UnsafeInlineTypes []string
+	// CORSOrigins is the list of the origins (like https://tool.example.com),
+	// in addition to the apps of the instance, that can call the files API
+	// from a browser. The cookies are not sent for them.
+	CORSOrigins []string
+	// TempDir is the directory used as scratch space for the uploads and the
+	// archives being built. It is the cozy-stack directory of the system
+	// temporary directory by default.
+	TempDir string
+	// TempTTL is the age from which the files left in TempDir, like the ones
+	// of an interrupted upload, are removed by the sweeper.
+	TempTTL time.Duration
+	// ImportSchemes is the list of the URL schemes that can be used to
+	// import a file from an URL (https only by default).
+	ImportSchemes []string
+	// ImportAllowedHosts is the list of the hosts from which the files can
+	// be imported. An empty list means that all the hosts are allowed. A
+	// host starting with *. also matches the sub-domains.
+	ImportAllowedHosts []string
+	// ImportDeniedHosts is the list of the hosts from which the files can't
+	// be imported, even if they are in ImportAllowedHosts.
+	ImportDeniedHosts []string
+	// ImportTimeout is the maximal duration of the download of a file
+	// imported from an URL.
+	ImportTimeout time.Duration
+	// ImportMaxSize is the maximal size (in bytes) of a file imported from
+	// an URL. 0 means no limit, except the one of the uploads.
+	ImportMaxSize int64
+	// PreloadThumbnails is the maximal number of images of a page of a
+	// directory listing for which a Link header is sent to preload their
+	// small thumbnails. 0 disables these headers.
+	PreloadThumbnails int
+	// PermanentDelete allows the clients to destroy a file or a directory
+	// directly, without putting it in the trash, with
+	// DELETE /files/:file-id?permanent=true.
+	PermanentDelete bool
+	// Transforms associates the classes or mime types of the files to the
+	// names of the transforms applied to their content when they are
+	// uploaded (like strip_exif). There is no transform by default.
+	Transforms map[string][]string
+	// ConflictPattern is the format used to add a number to the name of a
+	// file or directory in conflict, with the name (without its extension)
+	// and the number as arguments. The default is "%s (%d)".
+	ConflictPattern string
+	// ThumbsCacheMaxSize is the maximal size in bytes of the local cache for
+	// the thumbnails, in the temporary directory. 0 means no limit on the
+	// size, and the cache is disabled when both limits are 0.
+	ThumbsCacheMaxSize int64
+	// ThumbsCacheMaxCount is the maximal number of thumbnails in the local
+	// cache. 0 means no limit on the number.
+	ThumbsCacheMaxCount int
+	// SoftQuota is a percentage of the disk quota: when the disk usage of an
+	// instance is above it after an upload, a warning is added to the
+	// response. 0 disables the warning.
+	SoftQuota int
+	// RestoreFallbackDir is the path of the directory where the files and
+	// directories are restored from the trash when their original directory
+	// no longer exists. It is created on demand. When it is empty, the
+	// original directory is re-created instead.
+	RestoreFallbackDir string
+	// TrashMaxSize is the maximal size in bytes of the files in the trash:
+	// when a file or directory is put in the trash, the oldest items of the
+	// trash are destroyed until it is under this limit. 0 means no limit.
+	TrashMaxSize int64
+	// TrashMaxCount is the maximal number of files and directories in the
+	// trash, with the same eviction as TrashMaxSize. 0 means no limit.
+	TrashMaxCount int
+	// TrustedProxies is the list of the IP addresses or CIDR ranges of the
+	// reverse proxies in front of the stack. The X-Forwarded-For header is
+	// used to know the address of a client only for the requests coming
+	// from them.
+	TrustedProxies []string
 }
 
 // CouchDB contains the configuration values of the database
@@ -186,6 +298,17 @@ type AutoUpdates struct {
 	Schedule  string
 }
 
+// Pagination contains the configuration of the size of the pages for the
+// listings (directories, trash, search and changes feeds)
+type Pagination struct {
+	// DefaultPageSize is the number of items in a page when the client has
+	// not asked for a limit.
+	DefaultPageSize int
+	// MaxPageSize is the maximal number of items in a page: a client asking
+	// for more gets this number of items.
+	MaxPageSize int
+}
+
 // Notifications contains the configuration for the mobile push-notification
 // center, for Android and iOS
 type Notifications struct {
@@ -312,6 +435,38 @@ func GetVault() *Vault {
 
 var defaultPasswordResetInterval = 15 * time.Minute
 
+var defaultAuditRetention = 90 * 24 * time.Hour
+
+var defaultTempTTL = 24 * time.Hour
+
+var defaultImportTimeout = 10 * time.Minute
+
+var defaultImportMaxSize int64 = 1 << 30 // 1 GiB
+
+const defaultPreloadThumbnails = 20
+
+const defaultMaxDepth = 256
+
+const defaultPageSize = 30
+
+const defaultMaxPageSize = 1000
+
+var defaultCompressible = []string{
+	"code",
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"image/svg+xml",
+}
+
+var defaultUnsafeInlineTypes = []string{
+	"text/html",
+	"application/xhtml+xml",
+	"image/svg+xml",
+	"text/xml",
+	"application/xml",
+}
+
 // PasswordResetInterval returns the minimal delay between two password reset
 func PasswordResetInterval() time.Duration {
 	return config.PasswordResetInterval
@@ -379,6 +534,18 @@ func Setup(cfgFile string) (err error) {
 func applyDefaults(v *viper.Viper) {
 	v.SetDefault("password_reset_interval", defaultPasswordResetInterval)
 	v.SetDefault("jobs.imagemagick_convert_cmd", "convert")
+	v.SetDefault("fs.audit_retention", defaultAuditRetention)
+	v.SetDefault("fs.compressible", defaultCompressible)
+	v.SetDefault("fs.unsafe_inline_types", defaultUnsafeInlineTypes)
+	v.SetDefault("fs.temp_dir", filepath.Join(os.TempDir(), "cozy-stack"))
+	v.SetDefault("fs.temp_ttl", defaultTempTTL)
+	v.SetDefault("fs.import_schemes", []string{"https"})
+	v.SetDefault("fs.import_timeout", defaultImportTimeout)
+	v.SetDefault("fs.import_max_size", defaultImportMaxSize)
+	v.SetDefault("fs.preload_thumbnails", defaultPreloadThumbnails)
+	v.SetDefault("fs.max_depth", defaultMaxDepth)
+	v.SetDefault("pagination.default_page_size", defaultPageSize)
+	v.SetDefault("pagination.max_page_size", defaultMaxPageSize)
 }
 
 func envMap() map[string]string {
@@ -405,6 +572,9 @@ func UseViper(v *viper.Viper) error {
 			return fmt.Errorf("Filesystem path should not be root, was: %q", fsPath)
 		}
 	}
+	if v.GetBool("fs.dedup") && fsURL.Scheme != SchemeSwift {
+		return fmt.Errorf("The deduplication is only supported by the swift filesystem, was: %q", fsURL.Scheme)
+	}
 
 	couchURL, couchAuth, err := parseURL(v.GetString("couchdb.url"))
 	if err != nil {
@@ -575,9 +745,40 @@ func UseViper(v *viper.Viper) error {
 
 		CredentialsEncryptorKey: v.GetString("vault.credentials_encryptor_key"),
 		CredentialsDecryptorKey: v.GetString("vault.credentials_decryptor_key"),
+		FilesEncryptionKey:      v.GetString("vault.files_encryption_key"),
 
 		Fs: Fs{
-			URL: fsURL,
+			URL:           fsURL,
+			MaxNameLength: v.GetInt("fs.max_name_length"),
+			MaxDepth:      v.GetInt("fs.max_depth"),
+			MaxUploadSize: v.GetInt64("fs.max_upload_size"),
+			IllegalChars:  v.GetString("fs.illegal_chars"),
+
+			PreserveUnicodeNames: v.GetBool("fs.preserve_unicode_names"),
+			Dedup:                v.GetBool("fs.dedup"),
+			Audit:                v.GetBool("fs.audit"),
+			AuditRetention:       v.GetDuration("fs.audit_retention"),
+			Compressible:         v.GetStringSlice("fs.compressible"),
+			UnsafeInlineTypes:    v.GetStringSlice("fs.unsafe_inline_types"),
+			CORSOrigins:          v.GetStringSlice("fs.cors_origins"),
+			TempDir:              v.GetString("fs.temp_dir"),
+			TempTTL:              v.GetDuration("fs.temp_ttl"),
+			ImportSchemes:        v.GetStringSlice("fs.import_schemes"),
+			ImportAllowedHosts:   v.GetStringSlice("fs.import_allowed_hosts"),
+			ImportDeniedHosts:    v.GetStringSlice("fs.import_denied_hosts"),
+			ImportTimeout:        v.GetDuration("fs.import_timeout"),
+			ImportMaxSize:        v.GetInt64("fs.import_max_size"),
+			PreloadThumbnails:    v.GetInt("fs.preload_thumbnails"),
+			PermanentDelete:      v.GetBool("fs.permanent_delete"),
+			Transforms:           v.GetStringMapStringSlice("fs.transforms"),
+			ConflictPattern:      v.GetString("fs.conflict_pattern"),
+			ThumbsCacheMaxSize:   v.GetInt64("fs.thumbs_cache_max_size"),
+			ThumbsCacheMaxCount:  v.GetInt("fs.thumbs_cache_max_count"),
+			SoftQuota:            v.GetInt("fs.soft_quota"),
+			RestoreFallbackDir:   v.GetString("fs.restore_fallback_dir"),
+			TrashMaxSize:         v.GetInt64("fs.trash_max_size"),
+			TrashMaxCount:        v.GetInt("fs.trash_max_count"),
+			TrustedProxies:       v.GetStringSlice("fs.trusted_proxies"),
 		},
 		CouchDB: CouchDB{
 			Auth: couchAuth,
@@ -591,6 +792,10 @@ func UseViper(v *viper.Viper) error {
 			Activated: v.GetString("auto_updates.schedule") != "",
 			Schedule:  v.GetString("auto_updates.schedule"),
 		},
+		Pagination: Pagination{
+			DefaultPageSize: v.GetInt("pagination.default_page_size"),
+			MaxPageSize:     v.GetInt("pagination.max_page_size"),
+		},
 		Notifications: Notifications{
 			Development: v.GetBool("notifications.development"),
 
@@ -656,9 +861,22 @@ func MakeVault(c *Config) error {
 		}
 	}
 
+	var filesKey []byte
+	if filesEncryptionKey := config.FilesEncryptionKey; filesEncryptionKey != "" {
+		keyBytes, err := ioutil.ReadFile(filesEncryptionKey)
+		if err != nil {
+			return err
+		}
+		if len(keyBytes) < 32 {
+			return fmt.Errorf("config: the key %q for the files encryption is too short", filesEncryptionKey)
+		}
+		filesKey = keyBytes
+	}
+
 	vault = &Vault{
 		credsEncryptor: credsEncryptor,
 		credsDecryptor: credsDecryptor,
+		filesKey:       filesKey,
 	}
 	return nil
 }
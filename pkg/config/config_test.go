@@ -16,6 +16,10 @@ func TestUseViper(t *testing.T) {
 	cfg.Set("couchdb.url", "http://db:1234")
 	UseViper(cfg)
 	assert.Equal(t, "http://db:1234/", CouchURL().String())
+
+	cfg.Set("fs.url", "file:///var/lib/cozy")
+	cfg.Set("fs.dedup", true)
+	assert.Error(t, UseViper(cfg))
 }
 
 func TestSetup(t *testing.T) {
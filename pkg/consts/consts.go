@@ -16,6 +16,27 @@ const (
 	KonnectorLogs = "io.cozy.konnectors.logs"
 	// Archives doc type for zip archives with files and directories
 	Archives = "io.cozy.files.archives"
+	// FilesJobs doc type for the status of the asynchronous operations on files
+	FilesJobs = "io.cozy.files.jobs"
+	// FilesExif doc type for the EXIF metadata of an image
+	FilesExif = "io.cozy.files.exif"
+	// FilesBlobs doc type for the contents shared by several files, when the
+	// deduplication is enabled
+	FilesBlobs = "io.cozy.files.blobs"
+	// FilesAudit doc type for the audit trail of the mutations of files
+	FilesAudit = "io.cozy.files.audit"
+	// FilesVerifications doc type for the verification of the content of files
+	FilesVerifications = "io.cozy.files.verifications"
+	// FilesConflicts doc type for the revisions of a file in conflict
+	FilesConflicts = "io.cozy.files.conflicts"
+	// FilesTags doc type for the tags of the files, with their counts
+	FilesTags = "io.cozy.files.tags"
+	// FilesPublicLinks doc type for the public links of files, valid until
+	// revoked
+	FilesPublicLinks = "io.cozy.files.public_links"
+	// FilesPublicAccesses doc type for the accesses to files via their public
+	// links
+	FilesPublicAccesses = "io.cozy.files.public_accesses"
 	// Exports doc type for global exports archives
 	Exports = "io.cozy.exports"
 	// Doctypes doc type for doctype list
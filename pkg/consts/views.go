@@ -7,7 +7,7 @@ import (
 
 // IndexViewsVersion is the version of current definition of views & indexes.
 // This number should be incremented when this file changes.
-const IndexViewsVersion int = 17
+const IndexViewsVersion int = 30
 
 // GlobalIndexes is the index list required on the global databases to run
 // properly.
@@ -26,6 +26,26 @@ var Indexes = []*mango.Index{
 	mango.IndexOnFields(Files, "dir-children", []string{"dir_id", "_id"}),
 	// Used to lookup a directory given its path
 	mango.IndexOnFields(Files, "dir-by-path", []string{"path"}),
+	// Used to filter the children of a directory on their dates
+	mango.IndexOnFields(Files, "dir-children-by-updated-at", []string{"dir_id", "updated_at"}),
+	// Used to sort the content of the trash on the date of the deletion
+	mango.IndexOnFields(Files, "dir-children-by-trashed-at", []string{"dir_id", "trashed_at"}),
+	// Used to list the starred files and directories
+	mango.IndexOnFields(Files, "by-starred", []string{"starred", "updated_at"}),
+	// Used to list the most recently updated files
+	mango.IndexOnFields(Files, "by-type-trashed-and-updated-at", []string{"type", "trashed", "updated_at"}),
+	// Used to find the files with a given content, from its hash
+	mango.IndexOnFields(Files, "by-md5sum", []string{"md5sum"}),
+	mango.IndexOnFields(Files, "by-sha256sum", []string{"sha256sum"}),
+
+	// Used to lookup the audit trail of a file, and to prune the old records
+	mango.IndexOnFields(FilesAudit, "by-file-id", []string{"file_id", "created_at"}),
+	mango.IndexOnFields(FilesAudit, "by-created-at", []string{"created_at"}),
+
+	// Used to lookup a public link by its token, and the accesses to a file
+	// via its public link
+	mango.IndexOnFields(FilesPublicLinks, "by-token", []string{"token"}),
+	mango.IndexOnFields(FilesPublicAccesses, "by-file-id", []string{"file_id", "created_at"}),
 
 	// Used to lookup a queued and running jobs
 	mango.IndexOnFields(Jobs, "by-worker-and-state", []string{"worker", "state"}),
@@ -102,6 +122,93 @@ function(doc) {
 	Reduce: "_count",
 }
 
+// FilesByParentTrashedView is the view used for fetching the children of a
+// directory that are trashed (or not trashed)
+var FilesByParentTrashedView = &couchdb.View{
+	Name:    "by-parent-trashed-type-name",
+	Doctype: Files,
+	Map: `
+function(doc) {
+  emit([doc.dir_id, !!doc.trashed, doc.type, doc.name])
+}`,
+	Reduce: "_count",
+}
+
+// FilesByPHashView is the view used for fetching the images by their
+// perceptual hash, to find the images that look alike
+var FilesByPHashView = &couchdb.View{
+	Name:    "by-phash",
+	Doctype: Files,
+	Map: `
+function(doc) {
+  if (doc.type === 'file' && !doc.trashed && doc.metadata && doc.metadata.phash) {
+    emit(doc.metadata.phash);
+  }
+}`,
+}
+
+// FilesByTagView is the view used for fetching the files and directories
+// with a given tag
+var FilesByTagView = &couchdb.View{
+	Name:    "by-tag",
+	Doctype: Files,
+	Map: `
+function(doc) {
+  if (isArray(doc.tags)) {
+    for (var i = 0; i < doc.tags.length; i++) {
+      emit(doc.tags[i]);
+    }
+  }
+}`,
+	Reduce: "_count",
+}
+
+// FilesTagsView is the view used for counting the files for each tag, with
+// the trashed files apart
+var FilesTagsView = &couchdb.View{
+	Name:    "files-tags",
+	Doctype: Files,
+	Map: `
+function(doc) {
+  if (doc.type === 'file' && isArray(doc.tags)) {
+    for (var i = 0; i < doc.tags.length; i++) {
+      emit([!!doc.trashed, doc.tags[i]]);
+    }
+  }
+}`,
+	Reduce: "_count",
+}
+
+// FilesBlobsSavingsView is the view used for computing the number of bytes
+// saved by the deduplication of the contents of the files
+var FilesBlobsSavingsView = &couchdb.View{
+	Name:    "dedup-savings",
+	Doctype: FilesBlobs,
+	Map: `
+function(doc) {
+  if (doc.refs > 1) {
+    emit(doc._id, doc.size * (doc.refs - 1));
+  }
+}`,
+	Reduce: "_sum",
+}
+
+// FilesTrashSummaryView is the view used for counting the files and
+// directories in the trash, and the number of bytes of these files
+var FilesTrashSummaryView = &couchdb.View{
+	Name:    "trash-summary",
+	Doctype: Files,
+	Map: `
+function(doc) {
+  if (doc.type === 'file' && doc.trashed) {
+    emit(doc.type, +doc.size);
+  } else if (doc.type === 'directory' && (doc.path || '').indexOf('/.cozy_trash/') === 0) {
+    emit(doc.type, 0);
+  }
+}`,
+	Reduce: "_stats",
+}
+
 // PermissionsShareByCView is the view for fetching the permissions associated
 // to a document via a token code.
 var PermissionsShareByCView = &couchdb.View{
@@ -190,6 +297,12 @@ var Views = []*couchdb.View{
 	FilesReferencedByView,
 	ReferencedBySortedByDatetimeView,
 	FilesByParentView,
+	FilesByParentTrashedView,
+	FilesByPHashView,
+	FilesByTagView,
+	FilesTagsView,
+	FilesBlobsSavingsView,
+	FilesTrashSummaryView,
 	PermissionsShareByCView,
 	PermissionsShareByDocView,
 	PermissionsByDoctype,
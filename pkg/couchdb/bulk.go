@@ -181,8 +181,16 @@ func BulkGetDocs(db Database, doctype string, payload []IDRev) ([]map[string]int
 // BulkUpdateDocs is used to update several docs in one call, as a bulk.
 // olddocs parameter is used for realtime / event triggers.
 func BulkUpdateDocs(db Database, doctype string, docs, olddocs []interface{}) error {
+	_, err := BulkUpdateDocsWithResults(db, doctype, docs, olddocs)
+	return err
+}
+
+// BulkUpdateDocsWithResults is like BulkUpdateDocs, but it also returns the
+// response of CouchDB for each document. The documents that have not been
+// updated (a conflict for example) have their Error field filled.
+func BulkUpdateDocsWithResults(db Database, doctype string, docs, olddocs []interface{}) ([]UpdateResponse, error) {
 	if len(docs) == 0 {
-		return nil
+		return nil, nil
 	}
 	body := struct {
 		Docs []interface{} `json:"docs"`
@@ -191,12 +199,15 @@ func BulkUpdateDocs(db Database, doctype string, docs, olddocs []interface{}) er
 	}
 	var res []UpdateResponse
 	if err := makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, &res); err != nil {
-		return err
+		return nil, err
 	}
 	if len(res) != len(docs) {
-		return errors.New("BulkUpdateDoc receive an unexpected number of responses")
+		return nil, errors.New("BulkUpdateDoc receive an unexpected number of responses")
 	}
 	for i, doc := range docs {
+		if res[i].Error != "" {
+			continue
+		}
 		if d, ok := doc.(Doc); ok {
 			d.SetRev(res[i].Rev)
 			if old, ok := olddocs[i].(Doc); ok {
@@ -206,7 +217,7 @@ func BulkUpdateDocs(db Database, doctype string, docs, olddocs []interface{}) er
 			}
 		}
 	}
-	return nil
+	return res, nil
 }
 
 // BulkDeleteDocs is used to delete serveral documents in one call.
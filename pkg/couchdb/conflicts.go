@@ -0,0 +1,72 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// GetConflicts returns the revisions of a document that are in conflict with
+// its winning revision. They are the leaves of the revision tree that are not
+// deleted, except the winning one.
+func GetConflicts(db Database, doctype, id string) ([]string, error) {
+	id, err := validateDocID(id)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("Missing ID for GetConflicts")
+	}
+	var res struct {
+		Conflicts []string `json:"_conflicts"`
+	}
+	path := url.PathEscape(id) + "?conflicts=true"
+	if err = makeRequest(db, doctype, http.MethodGet, path, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Conflicts, nil
+}
+
+// DeleteConflicts deletes the given conflicting revisions of a document, to
+// keep only its winning revision. No realtime event is sent, as the document
+// itself is not deleted.
+func DeleteConflicts(db Database, doctype, id string, revs []string) error {
+	if len(revs) == 0 {
+		return nil
+	}
+	id, err := validateDocID(id)
+	if err != nil {
+		return err
+	}
+	body := struct {
+		Docs []json.RawMessage `json:"docs"`
+	}{
+		Docs: make([]json.RawMessage, 0, len(revs)),
+	}
+	for _, rev := range revs {
+		doc, err := json.Marshal(map[string]interface{}{
+			"_id":      id,
+			"_rev":     rev,
+			"_deleted": true,
+		})
+		if err != nil {
+			return err
+		}
+		body.Docs = append(body.Docs, json.RawMessage(doc))
+	}
+	var res []UpdateResponse
+	if err = makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, &res); err != nil {
+		return err
+	}
+	for _, r := range res {
+		if r.Error != "" {
+			return &Error{
+				StatusCode: http.StatusConflict,
+				Name:       r.Error,
+				Reason:     r.Reason,
+			}
+		}
+	}
+	return nil
+}
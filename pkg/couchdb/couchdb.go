@@ -817,9 +817,11 @@ type IndexCreationResponse struct {
 
 // UpdateResponse is the response from couchdb when updating documents
 type UpdateResponse struct {
-	ID  string `json:"id"`
-	Rev string `json:"rev"`
-	Ok  bool   `json:"ok"`
+	ID     string `json:"id"`
+	Rev    string `json:"rev"`
+	Ok     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
 }
 
 type findResponse struct {
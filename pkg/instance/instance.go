@@ -1,6 +1,8 @@
 package instance
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
@@ -227,6 +229,9 @@ func (i *Instance) makeVFS() error {
 		if i.SwiftCluster > 0 {
 			i.vfs, err = vfsswift.NewV2(i.Domain, index, disk, mutex)
 		} else {
+			if config.GetConfig().Fs.Dedup {
+				i.Logger().Warnf("The deduplication is not supported by the swift layout v1")
+			}
 			i.vfs, err = vfsswift.New(i.Domain, index, disk, mutex)
 		}
 	default:
@@ -291,19 +296,20 @@ func (i *Instance) KonnectorsFileServer() apps.FileServer {
 }
 
 // ThumbsFS returns the hidden filesystem for storing the thumbnails of the
-// photos/image
+// photos/image. They are served through the local cache of the thumbnails
+// when it is enabled in the config.
 func (i *Instance) ThumbsFS() vfs.Thumbser {
 	fsURL := config.FsURL()
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
 		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
 			path.Join(fsURL.Path, i.DirName(), vfs.ThumbsDirName))
-		return vfsafero.NewThumbsFs(baseFS)
+		return vfs.CachedThumbs(vfsafero.NewThumbsFs(baseFS), i.Domain)
 	case config.SchemeSwift:
 		if i.SwiftCluster > 0 {
-			return vfsswift.NewThumbsFsV2(config.GetSwiftConnection(), i.Domain)
+			return vfs.CachedThumbs(vfsswift.NewThumbsFsV2(config.GetSwiftConnection(), i.Domain), i.Domain)
 		}
-		return vfsswift.NewThumbsFs(config.GetSwiftConnection(), i.Domain)
+		return vfs.CachedThumbs(vfsswift.NewThumbsFs(config.GetSwiftConnection(), i.Domain), i.Domain)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -361,6 +367,72 @@ func (i *Instance) Registries() ([]*url.URL, error) {
 	return regs, nil
 }
 
+// FileClassRules returns the custom rules, configured in the context of the
+// instance, used to associate a class to the mime type of a file. They take
+// precedence over the built-in rules of the vfs.
+func (i *Instance) FileClassRules() map[string]string {
+	ctx, err := i.Context()
+	if err != nil {
+		return nil
+	}
+	m, ok := ctx["file_classes"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	rules := make(map[string]string, len(m))
+	for mime, class := range m {
+		if c, ok := class.(string); ok && c != "" {
+			rules[mime] = c
+		}
+	}
+	return rules
+}
+
+// PublicAccessSecret returns the key used to hash the IP addresses of the
+// visitors of the public links. It is derived from the OAuth secret, that
+// doesn't change with the passphrase, so that a visitor keeps the same hash.
+func (i *Instance) PublicAccessSecret() []byte {
+	mac := hmac.New(sha256.New, i.OAuthSecret)
+	mac.Write([]byte("public-access")) // #nosec
+	return mac.Sum(nil)
+}
+
+// UploadPolicy returns the rules, configured in the context of the instance,
+// used to restrict the types of the files that can be uploaded. It returns nil
+// when there is no restriction.
+func (i *Instance) UploadPolicy() *vfs.UploadPolicy {
+	ctx, err := i.Context()
+	if err != nil {
+		return nil
+	}
+	m, ok := ctx["upload_policy"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	policy := &vfs.UploadPolicy{
+		Allow: stringsFromContext(m["allow"]),
+		Deny:  stringsFromContext(m["deny"]),
+	}
+	if len(policy.Allow) == 0 && len(policy.Deny) == 0 {
+		return nil
+	}
+	return policy
+}
+
+func stringsFromContext(v interface{}) []string {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	strs := make([]string, 0, len(list))
+	for _, item := range list {
+		if s, ok := item.(string); ok && s != "" {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
+
 // DiskQuota returns the number of bytes allowed on the disk to the user.
 func (i *Instance) DiskQuota() int64 {
 	return i.BytesDiskQuota
@@ -6,13 +6,57 @@ import (
 
 // Triggers returns the list of the triggers to add when an instance is created
 func Triggers(domain string) []jobs.TriggerInfos {
-	// Create/update/remove thumbnails when an image is created/updated/removed
+	// Create/update/remove thumbnails when an image or a PDF is
+	// created/updated/removed
 	return []jobs.TriggerInfos{
 		{
 			Domain:     domain,
 			Type:       "@event",
 			WorkerType: "thumbnail",
-			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:image:class",
+			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:image,pdf:class",
 		},
 	}
 }
+
+// UpdateTriggers migrates the triggers of an instance created with an older
+// version of the stack: a trigger with the same type and worker as one of the
+// default triggers, but other arguments (like the thumbnail trigger for the
+// images only, before the previews of the PDFs), is replaced by the default
+// one, and the missing default triggers are added. It returns the triggers
+// that have been added.
+func UpdateTriggers(domain string) ([]jobs.TriggerInfos, error) {
+	sched := jobs.System()
+	existing, err := sched.GetAllTriggers(domain)
+	if err != nil {
+		return nil, err
+	}
+	var added []jobs.TriggerInfos
+	for _, trigger := range Triggers(domain) {
+		found := false
+		for _, t := range existing {
+			infos := t.Infos()
+			if infos.Type != trigger.Type || infos.WorkerType != trigger.WorkerType {
+				continue
+			}
+			if infos.Arguments == trigger.Arguments {
+				found = true
+				continue
+			}
+			if err = sched.DeleteTrigger(domain, infos.TID); err != nil {
+				return added, err
+			}
+		}
+		if found {
+			continue
+		}
+		t, err := jobs.NewTrigger(&trigger)
+		if err != nil {
+			return added, err
+		}
+		if err = sched.AddTrigger(t); err != nil {
+			return added, err
+		}
+		added = append(added, trigger)
+	}
+	return added, nil
+}
@@ -72,6 +72,7 @@ var prefixTable = []prefixEntry{
 	{0, []byte("{rtf"), "text/rtf1"},
 	{0, []byte("BEGIN:VCARD\x0D\x0A"), "text/vcard"},
 	{0, []byte("Return-Path: "), "message/rfc822"},
+	{0, []byte{'M', 'Z', 0x90, 0}, "application/x-msdownload"},
 
 	// Definition data extracted automatically from the file utility source code.
 	// See: http://darwinsys.com/file/ (version used: 5.19)
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// FilesTransferUpload is the direction label for the uploads
+	FilesTransferUpload = "upload"
+	// FilesTransferDownload is the direction label for the downloads
+	FilesTransferDownload = "download"
+)
+
+// FilesOperationsCounter is a counter number of the operations on the files
+// (create, overwrite, upload_part, trash, download), labelled by operation and
+// status code.
+var FilesOperationsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "files",
+		Subsystem: "operations",
+		Name:      "count",
+
+		Help: "Number of the operations on the files, labelled by operation and status code.",
+	},
+	[]string{"operation", "code"},
+)
+
+// FilesOperationsDurations is a histogram metric of the durations in seconds
+// of the operations on the files, labelled by operation and status code.
+var FilesOperationsDurations = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "files",
+		Subsystem: "operations",
+		Name:      "durations",
+
+		Help: "Durations in seconds of the operations on the files, labelled by operation and status code.",
+
+		// From 5ms to about 20 minutes, for the uploads of the large files
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 10),
+	},
+	[]string{"operation", "code"},
+)
+
+// FilesTransferSizes is a histogram metric of the number of bytes of the
+// uploads and downloads of the files, labelled by operation.
+var FilesTransferSizes = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "files",
+		Subsystem: "transfers",
+		Name:      "sizes",
+
+		Help: "Number of bytes of the uploads and downloads of the files, labelled by operation.",
+
+		// From 1KB to 4GB
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+	},
+	[]string{"operation"},
+)
+
+// FilesActiveTransfers is a gauge metric of the number of uploads and
+// downloads in progress, labelled by direction.
+var FilesActiveTransfers = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "files",
+		Subsystem: "transfers",
+		Name:      "active",
+
+		Help: "Number of uploads and downloads in progress, labelled by direction.",
+	},
+	[]string{"direction"},
+)
+
+func init() {
+	prometheus.MustRegister(
+		FilesOperationsCounter,
+		FilesOperationsDurations,
+		FilesTransferSizes,
+		FilesActiveTransfers,
+	)
+}
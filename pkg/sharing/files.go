@@ -178,7 +178,8 @@ func EnsureSharedWithMeDir(inst *instance.Instance) (*vfs.DirDoc, error) {
 
 	if dir.RestorePath != "" {
 		_, err = vfs.RestoreDir(fs, dir)
-		if err != nil {
+		// The children are put back in the trash just after
+		if _, ok := err.(*vfs.PartialTrashError); err != nil && !ok {
 			return nil, err
 		}
 		children, err := fs.DirBatch(dir, &couchdb.SkipCursor{})
@@ -292,7 +293,8 @@ func (s *Sharing) GetNoLongerSharedDir(inst *instance.Instance) (*vfs.DirDoc, er
 
 	if dir.RestorePath != "" {
 		_, err = vfs.RestoreDir(fs, dir)
-		if err != nil {
+		// The children are put back in the trash just after
+		if _, ok := err.(*vfs.PartialTrashError); err != nil && !ok {
 			return nil, err
 		}
 		children, err := fs.DirBatch(dir, &couchdb.SkipCursor{})
@@ -125,6 +125,18 @@ func (s *sharingIndexer) DiskUsage() (int64, error) {
 	return s.indexer.DiskUsage()
 }
 
+func (s *sharingIndexer) AcquireBlob(md5sum []byte, size int64) (string, bool, error) {
+	return s.indexer.AcquireBlob(md5sum, size)
+}
+
+func (s *sharingIndexer) ReleaseBlob(key string) (bool, error) {
+	return s.indexer.ReleaseBlob(key)
+}
+
+func (s *sharingIndexer) DedupSavings() (int64, error) {
+	return s.indexer.DedupSavings()
+}
+
 func (s *sharingIndexer) CreateFileDoc(doc *vfs.FileDoc) error {
 	return ErrInternalServerError
 }
@@ -140,7 +152,11 @@ func (s *sharingIndexer) CreateNamedFileDoc(doc *vfs.FileDoc) error {
 	stash := s.StashRevision(true)
 	err := s.bulkForceUpdateDoc(doc)
 	s.UnstashRevision(stash)
-	return err
+	if err != nil {
+		return err
+	}
+	vfs.AddDiskUsage(s.db, doc.ByteSize)
+	return nil
 }
 
 func (s *sharingIndexer) UpdateFileDoc(olddoc, doc *vfs.FileDoc) error {
@@ -151,6 +167,11 @@ func (s *sharingIndexer) UpdateFileDoc(olddoc, doc *vfs.FileDoc) error {
 	if err := s.bulkForceUpdateDoc(doc); err != nil {
 		return err
 	}
+	if olddoc != nil {
+		vfs.AddDiskUsage(s.db, doc.ByteSize-olddoc.ByteSize)
+	} else {
+		vfs.AddDiskUsage(s.db, doc.ByteSize)
+	}
 
 	if s.shared != nil {
 		if err := UpdateFileShared(s.db, s.shared, s.bulkRevs.Revisions); err != nil {
@@ -196,6 +217,9 @@ func (s *sharingIndexer) bulkForceUpdateDoc(doc *vfs.FileDoc) error {
 	if doc.Metadata != nil {
 		docs[0]["metadata"] = doc.Metadata
 	}
+	if doc.SHA256Sum != nil {
+		docs[0]["sha256sum"] = doc.SHA256Sum
+	}
 	doc.SetRev(s.bulkRevs.Rev)
 	docs[0]["_rev"] = s.bulkRevs.Rev
 	docs[0]["_revisions"] = s.bulkRevs.Revisions
@@ -207,6 +231,14 @@ func (s *sharingIndexer) DeleteFileDoc(doc *vfs.FileDoc) error {
 	return s.indexer.DeleteFileDoc(doc)
 }
 
+func (s *sharingIndexer) FileConflicts(doc *vfs.FileDoc) ([]*vfs.FileDoc, error) {
+	return s.indexer.FileConflicts(doc)
+}
+
+func (s *sharingIndexer) DeleteFileConflicts(doc *vfs.FileDoc, revs []string) error {
+	return s.indexer.DeleteFileConflicts(doc, revs)
+}
+
 func (s *sharingIndexer) CreateDirDoc(doc *vfs.DirDoc) error {
 	return ErrInternalServerError
 }
@@ -273,6 +305,10 @@ func (s *sharingIndexer) DirByPath(name string) (*vfs.DirDoc, error) {
 	return s.indexer.DirByPath(name)
 }
 
+func (s *sharingIndexer) SubdirsDepth(doc *vfs.DirDoc) (int, error) {
+	return s.indexer.SubdirsDepth(doc)
+}
+
 func (s *sharingIndexer) FileByID(fileID string) (*vfs.FileDoc, error) {
 	return s.indexer.FileByID(fileID)
 }
@@ -305,6 +341,18 @@ func (s *sharingIndexer) DirLength(doc *vfs.DirDoc) (int, error) {
 	return s.indexer.DirLength(doc)
 }
 
+func (s *sharingIndexer) DirBatchTrashed(doc *vfs.DirDoc, trashed bool, cursor couchdb.Cursor) ([]vfs.DirOrFileDoc, error) {
+	return s.indexer.DirBatchTrashed(doc, trashed, cursor)
+}
+
+func (s *sharingIndexer) DirLengthTrashed(doc *vfs.DirDoc, trashed bool) (int, error) {
+	return s.indexer.DirLengthTrashed(doc, trashed)
+}
+
+func (s *sharingIndexer) DirBatchFiltered(doc *vfs.DirDoc, filter *vfs.DirFilter, cursor *couchdb.SkipCursor) ([]vfs.DirOrFileDoc, error) {
+	return s.indexer.DirBatchFiltered(doc, filter, cursor)
+}
+
 func (s *sharingIndexer) DirChildExists(dirID, name string) (bool, error) {
 	return s.indexer.DirChildExists(dirID, name)
 }
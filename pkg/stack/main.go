@@ -8,11 +8,13 @@ import (
 
 	"github.com/cozy/checkup"
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/sessions"
 	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 
 	"github.com/google/gops/agent"
 	"github.com/sirupsen/logrus"
@@ -115,12 +117,20 @@ security features. Please do not use this binary as your production server.
 	}
 
 	sessionSweeper := sessions.SweepLoginRegistrations()
+	tempSweeper := vfs.SweepTempDir()
+	usageReconciler := vfs.ReconcileDiskUsages(func(fn func(couchdb.Database) error) error {
+		return instance.ForeachInstances(func(i *instance.Instance) error {
+			return fn(i)
+		})
+	})
 
 	// Global shutdowner that composes all the running processes of the stack
 	processes = utils.NewGroupShutdown(
 		jobs.System(),
 		cronUpdates,
 		sessionSweeper,
+		tempSweeper,
+		usageReconciler,
 		gopAgent{},
 	)
 	return
@@ -2,11 +2,15 @@ package vfs
 
 import (
 	"archive/zip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -16,12 +20,78 @@ import (
 // ZipMime is the content-type for zip archives
 const ZipMime = "application/zip"
 
+// The size of a zip archive can't be known before it is generated, so the
+// number of files is sent in a header, and the trailers give what has really
+// been written, for the clients to detect a truncated download.
+const (
+	// ArchiveFilesHeader is the header with the number of files planned in
+	// the archive.
+	ArchiveFilesHeader = "X-Archive-Files"
+	// ArchiveBytesTrailer is the trailer with the size of the archive.
+	ArchiveBytesTrailer = "X-Archive-Bytes"
+	// ArchiveWrittenTrailer is the trailer with the number of files written
+	// in the archive.
+	ArchiveWrittenTrailer = "X-Archive-Files-Written"
+	// ArchiveManifestTrailer is the trailer with the list of the files
+	// written in the archive and their sizes, in JSON encoded in base64.
+	ArchiveManifestTrailer = "X-Archive-Manifest"
+)
+
+// maxArchiveManifestSize is the maximal size of the manifest trailer: for a
+// larger archive, the manifest is not sent.
+const maxArchiveManifestSize = 64 * 1024
+
+// ArchiveManifestEntry is a file written in an archive, for the manifest.
+type ArchiveManifestEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// errWriter keeps the first error for writing to w, to stop the generation
+// of an archive when the client has gone.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err := e.w.Write(p)
+	e.err = err
+	return n, err
+}
+
+// The compression methods for the files in an archive
+const (
+	// ArchiveDeflate is the default method: the files are compressed
+	ArchiveDeflate = "deflate"
+	// ArchiveStore is used to store the files without compression. The
+	// archive is then the same each time it is generated, and it can be
+	// downloaded by ranges.
+	ArchiveStore = "store"
+)
+
 // Archive is the data to create a zip archive
 type Archive struct {
-	Name   string   `json:"name"`
-	Secret string   `json:"-"`
-	IDs    []string `json:"ids"`
-	Files  []string `json:"files"`
+	Name        string   `json:"name"`
+	Secret      string   `json:"-"`
+	IDs         []string `json:"ids"`
+	Files       []string `json:"files"`
+	Compression string   `json:"compression,omitempty"`
 
 	// archiveEntries cache
 	entries []ArchiveEntry
@@ -37,7 +107,10 @@ type ArchiveEntry struct {
 
 var plusEscaper = strings.NewReplacer("+", "%20")
 
-// ContentDisposition creates an HTTP header value for Content-Disposition
+// ContentDisposition creates an HTTP header value for Content-Disposition.
+// When the filename is not a plain ASCII token, the header has both a
+// filename parameter with an ASCII fallback and a filename* parameter with
+// the UTF-8 encoded name (RFC 5987).
 func ContentDisposition(disposition, filename string) string {
 	// RFC2616 §2.2 - syntax of quoted strings
 	escaped := strings.Map(func(r rune) rune {
@@ -105,36 +178,151 @@ func (a *Archive) GetEntries(fs VFS) ([]ArchiveEntry, error) {
 	return a.entries, nil
 }
 
-// Serve creates on the fly the zip archive and streams in a http response
-func (a *Archive) Serve(fs VFS, w http.ResponseWriter) error {
+// countFiles returns the number of files that will be put in the archive.
+// It fails only if the context is canceled.
+func (a *Archive) countFiles(ctx context.Context, fs VFS, entries []ArchiveEntry) (int, error) {
+	count := 0
+	for _, entry := range entries {
+		WalkContext(ctx, fs, entry.root, nil, func(_ string, dir *DirDoc, _ *FileDoc, err error) error {
+			if err == nil && dir == nil {
+				count++
+			}
+			return err
+		})
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// entryName returns the name in the zip archive of the file with the given
+// path, for an entry of the archive that is in the base directory.
+func (a *Archive) entryName(base, name string) (string, error) {
+	rel, err := filepath.Rel(base, name)
+	if err != nil {
+		return "", fmt.Errorf("Invalid filepath <%s>: %s", name, err)
+	}
+	return a.Name + "/" + rel, nil
+}
+
+// ArchiveFile is a file that will be put in an archive, with its name in the
+// archive.
+type ArchiveFile struct {
+	Name string
+	File *FileDoc
+}
+
+// ManifestFiles returns the files that will be put in the archive, in the
+// same order as in the zip, without generating it. It allows a client to
+// check what it has already downloaded before asking for the archive.
+func (a *Archive) ManifestFiles(ctx context.Context, fs VFS) ([]ArchiveFile, error) {
+	entries, err := a.GetEntries(fs)
+	if err != nil {
+		return nil, err
+	}
+	var files []ArchiveFile
+	for _, entry := range entries {
+		base := filepath.Dir(entry.root)
+		err = WalkContext(ctx, fs, entry.root, nil, func(name string, dir *DirDoc, file *FileDoc, err error) error {
+			if err != nil || dir != nil {
+				return err
+			}
+			name, err = a.entryName(base, name)
+			if err != nil {
+				return err
+			}
+			files = append(files, ArchiveFile{Name: name, File: file})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Serve creates on the fly the zip archive and streams in a http response.
+// The number of files is sent in a header. For a compressed archive, the size
+// of the archive and the manifest of the files are sent in the trailers. For
+// an archive with stored files, the generation is deterministic, and the
+// archive can be downloaded by ranges (see serveResumable). The generation is
+// stopped if the context of the request is canceled.
+func (a *Archive) Serve(fs VFS, w http.ResponseWriter, req *http.Request) error {
+	entries, err := a.GetEntries(fs)
+	if err != nil {
+		return err
+	}
+	ctx := req.Context()
+	count, err := a.countFiles(ctx, fs, entries)
+	if err != nil {
+		return err
+	}
+
 	header := w.Header()
 	header.Set("Content-Type", ZipMime)
 	header.Set("Content-Disposition", ContentDisposition("attachment", a.Name+".zip"))
+	header.Set(ArchiveFilesHeader, strconv.Itoa(count))
+	if a.Compression == ArchiveStore {
+		return a.serveResumable(fs, w, req, entries)
+	}
 
-	zw := zip.NewWriter(w)
-	defer zw.Close()
+	// The compressed zip is generated on the fly, and can't be served by
+	// ranges
+	header.Set("Accept-Ranges", "none")
+	header.Set("Trailer", strings.Join([]string{
+		ArchiveBytesTrailer,
+		ArchiveWrittenTrailer,
+		ArchiveManifestTrailer,
+	}, ", "))
 
-	entries, err := a.GetEntries(fs)
+	cw := &countingWriter{w: w}
+	manifest, err := a.writeZip(ctx, fs, cw, entries, nil)
 	if err != nil {
 		return err
 	}
+	header.Set(ArchiveBytesTrailer, strconv.FormatInt(cw.n, 10))
+	header.Set(ArchiveWrittenTrailer, strconv.Itoa(len(manifest)))
+	if encoded, err := json.Marshal(manifest); err == nil {
+		value := base64.StdEncoding.EncodeToString(encoded)
+		if len(value) <= maxArchiveManifestSize {
+			header.Set(ArchiveManifestTrailer, value)
+		}
+	}
+	return nil
+}
+
+// writeZip writes the zip archive to w, and returns the manifest of the files
+// written in it. An error on a file stops the walk of its entry, but not the
+// archive, except if it is an error for writing to w or if the context is
+// canceled. With a sizer, the content of the files is not read: zeros are
+// written instead, which gives an archive of the same size for the stored
+// files.
+func (a *Archive) writeZip(ctx context.Context, fs VFS, w io.Writer, entries []ArchiveEntry, sizer *archiveSizer) ([]ArchiveManifestEntry, error) {
+	ew := &errWriter{w: w}
+	zw := zip.NewWriter(ew)
+	method := zip.Deflate
+	if a.Compression == ArchiveStore {
+		method = zip.Store
+	}
+	var manifest []ArchiveManifestEntry
 
 	for _, entry := range entries {
 		base := filepath.Dir(entry.root)
-		walk(fs, entry.root, entry.Dir, entry.File, func(name string, dir *DirDoc, file *FileDoc, err error) error {
+		WalkContext(ctx, fs, entry.root, nil, func(name string, dir *DirDoc, file *FileDoc, err error) error {
 			if err != nil {
 				return err
 			}
 			if dir != nil {
 				return nil
 			}
-			name, err = filepath.Rel(base, name)
+			name, err = a.entryName(base, name)
 			if err != nil {
-				return fmt.Errorf("Invalid filepath <%s>: %s", name, err)
+				return err
 			}
 			header := &zip.FileHeader{
-				Name:   a.Name + "/" + name,
-				Method: zip.Deflate,
+				Name:   name,
+				Method: method,
 				Flags:  0x800, // bit 11 set to force utf-8
 			}
 			header.SetModTime(file.UpdatedAt) // nolint: megacheck
@@ -142,17 +330,33 @@ func (a *Archive) Serve(fs VFS, w http.ResponseWriter) error {
 			if err != nil {
 				return fmt.Errorf("Can't create zip entry <%s>: %s", name, err)
 			}
-			f, err := fs.OpenFile(file)
-			if err != nil {
-				return fmt.Errorf("Can't open file <%s>: %s", name, err)
+			var content io.Reader
+			if sizer != nil {
+				sizer.addFile(file)
+				content = io.LimitReader(zeroReader{}, file.ByteSize)
+			} else {
+				f, err := fs.OpenFile(file)
+				if err != nil {
+					return fmt.Errorf("Can't open file <%s>: %s", name, err)
+				}
+				defer f.Close()
+				content = f
+			}
+			size, err := io.Copy(ze, content)
+			if err == nil {
+				manifest = append(manifest, ArchiveManifestEntry{Name: header.Name, Size: size})
 			}
-			defer f.Close()
-			_, err = io.Copy(ze, f)
 			return err
-		}, 0)
+		})
+		if ew.err != nil {
+			return manifest, ew.err
+		}
+		if err := ctx.Err(); err != nil {
+			return manifest, err
+		}
 	}
 
-	return nil
+	return manifest, zw.Close()
 }
 
 // ID makes Archive a jsonapi.Object
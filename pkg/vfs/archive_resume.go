@@ -0,0 +1,136 @@
+package vfs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// archiveSizer computes the size of an archive with stored files, and an
+// etag for it, without reading the content of the files: the etag is a hash
+// of the generated bytes (names, dates and sizes of the files) and of the
+// md5sums of the files.
+type archiveSizer struct {
+	size int64
+	hash hash.Hash
+}
+
+func newArchiveSizer() *archiveSizer {
+	return &archiveSizer{hash: md5.New()} // #nosec
+}
+
+func (s *archiveSizer) Write(p []byte) (int, error) {
+	s.size += int64(len(p))
+	return s.hash.Write(p)
+}
+
+func (s *archiveSizer) addFile(file *FileDoc) {
+	s.hash.Write(file.MD5Sum) // #nosec
+}
+
+func (s *archiveSizer) etag() string {
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+// zeroReader is an infinite reader of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// archiveReader is a seekable reader for an archive with stored files. The
+// archive is generated again when the reader goes backward, and the bytes
+// before the position are skipped, as the generation is deterministic.
+type archiveReader struct {
+	ctx     context.Context
+	archive *Archive
+	fs      VFS
+	entries []ArchiveEntry
+	size    int64
+	offset  int64 // the position asked by the last Seek
+	pos     int64 // the position in the current generation
+	pipe    *io.PipeReader
+}
+
+func (r *archiveReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("vfs: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("vfs: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *archiveReader) Read(p []byte) (int, error) {
+	if r.pipe == nil || r.pos > r.offset {
+		r.Close()
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := r.archive.writeZip(r.ctx, r.fs, pw, r.entries, nil)
+			pw.CloseWithError(err)
+		}()
+		r.pipe = pr
+		r.pos = 0
+	}
+	if r.pos < r.offset {
+		n, err := io.CopyN(ioutil.Discard, r.pipe, r.offset-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.pipe.Read(p)
+	r.pos += int64(n)
+	r.offset = r.pos
+	return n, err
+}
+
+// Close stops the generation of the archive, if any.
+func (r *archiveReader) Close() error {
+	if r.pipe == nil {
+		return nil
+	}
+	err := r.pipe.Close()
+	r.pipe = nil
+	return err
+}
+
+// serveResumable serves an archive with stored files. Its size and etag are
+// computed first, and it is then generated for the range asked by the client
+// (the If-Range header can be used with the etag, to resume a download only
+// if the archive has not changed).
+func (a *Archive) serveResumable(fs VFS, w http.ResponseWriter, req *http.Request, entries []ArchiveEntry) error {
+	ctx := req.Context()
+	sizer := newArchiveSizer()
+	if _, err := a.writeZip(ctx, fs, sizer, entries, sizer); err != nil {
+		return err
+	}
+	r := &archiveReader{
+		ctx:     ctx,
+		archive: a,
+		fs:      fs,
+		entries: entries,
+		size:    sizer.size,
+	}
+	defer r.Close()
+	ServeContent(w, req, a.Name+".zip", time.Time{}, sizer.etag(), r)
+	return nil
+}
@@ -0,0 +1,109 @@
+package vfs
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// maxAuditPrunedByCall is the maximal number of old records of the audit
+// trail that are deleted after a new record has been written.
+const maxAuditPrunedByCall = 100
+
+// AuditEntry is a record of the audit trail: it says who has made an
+// operation on a file or directory, and when.
+type AuditEntry struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	Operation string    `json:"operation"`
+	FileID    string    `json:"file_id"`
+	Subject   string    `json:"subject,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ID returns the audit entry qualified identifier
+func (a *AuditEntry) ID() string { return a.DocID }
+
+// Rev returns the audit entry revision
+func (a *AuditEntry) Rev() string { return a.DocRev }
+
+// DocType returns the audit entry document type
+func (a *AuditEntry) DocType() string { return consts.FilesAudit }
+
+// Clone implements couchdb.Doc
+func (a *AuditEntry) Clone() couchdb.Doc {
+	cloned := *a
+	return &cloned
+}
+
+// SetID changes the audit entry qualified identifier
+func (a *AuditEntry) SetID(id string) { a.DocID = id }
+
+// SetRev changes the audit entry revision
+func (a *AuditEntry) SetRev(rev string) { a.DocRev = rev }
+
+// AuditEnabled returns true if the audit trail is enabled in the config.
+func AuditEnabled() bool {
+	return config.GetConfig().Fs.Audit
+}
+
+// WriteAuditEntry saves a new record in the audit trail, and deletes the
+// records older than the retention period.
+func WriteAuditEntry(db couchdb.Database, entry *AuditEntry) error {
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	if err := couchdb.CreateDoc(db, entry); err != nil {
+		return err
+	}
+	retention := config.GetConfig().Fs.AuditRetention
+	if retention <= 0 {
+		return nil
+	}
+	return pruneAuditEntries(db, time.Now().Add(-retention))
+}
+
+func pruneAuditEntries(db couchdb.Database, before time.Time) error {
+	var entries []*AuditEntry
+	req := &couchdb.FindRequest{
+		UseIndex: "by-created-at",
+		Selector: mango.Lt("created_at", before),
+		Limit:    maxAuditPrunedByCall,
+	}
+	if err := couchdb.FindDocs(db, consts.FilesAudit, req, &entries); err != nil {
+		return err
+	}
+	docs := make([]couchdb.Doc, len(entries))
+	for i, entry := range entries {
+		docs[i] = entry
+	}
+	return couchdb.BulkDeleteDocs(db, consts.FilesAudit, docs)
+}
+
+// AuditEntries returns the most recent records of the audit trail for the
+// given file or directory, the newest first.
+func AuditEntries(db couchdb.Database, fileID string, limit int) ([]*AuditEntry, error) {
+	var entries []*AuditEntry
+	req := &couchdb.FindRequest{
+		UseIndex: "by-file-id",
+		Selector: mango.Equal("file_id", fileID),
+		Sort: mango.SortBy{
+			{Field: "file_id", Direction: mango.Desc},
+			{Field: "created_at", Direction: mango.Desc},
+		},
+		Limit: limit,
+	}
+	err := couchdb.FindDocs(db, consts.FilesAudit, req, &entries)
+	if couchdb.IsNoDatabaseError(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+var _ couchdb.Doc = &AuditEntry{}
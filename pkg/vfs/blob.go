@@ -0,0 +1,49 @@
+package vfs
+
+import (
+	"encoding/hex"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// Blob is a content shared by several files, when the deduplication is
+// enabled. It is identified by the md5sum and the size of the content, and
+// it keeps a count of the files that reference it, so that the content is
+// deleted only when the last of these files is destroyed.
+type Blob struct {
+	BlobID  string `json:"_id,omitempty"`
+	BlobRev string `json:"_rev,omitempty"`
+	Size    int64  `json:"size"`
+	Refs    int    `json:"refs"`
+}
+
+// ID returns the blob qualified identifier
+func (b *Blob) ID() string { return b.BlobID }
+
+// Rev returns the blob revision
+func (b *Blob) Rev() string { return b.BlobRev }
+
+// DocType returns the blob document type
+func (b *Blob) DocType() string { return consts.FilesBlobs }
+
+// Clone implements couchdb.Doc
+func (b *Blob) Clone() couchdb.Doc {
+	cloned := *b
+	return &cloned
+}
+
+// SetID changes the blob qualified identifier
+func (b *Blob) SetID(id string) { b.BlobID = id }
+
+// SetRev changes the blob revision
+func (b *Blob) SetRev(rev string) { b.BlobRev = rev }
+
+// BlobKey returns the key of the blob for a content with the given md5sum and
+// size.
+func BlobKey(md5sum []byte, size int64) string {
+	return hex.EncodeToString(md5sum) + "-" + strconv.FormatInt(size, 10)
+}
+
+var _ couchdb.Doc = &Blob{}
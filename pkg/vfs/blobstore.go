@@ -0,0 +1,43 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// BlobStore is the storage used for the content of the files. The VFS keeps
+// the tree of files and directories, and delegates the bytes of the files to
+// the blob store. The afero VFS uses a store backed by its afero.Fs, where
+// the blobs are named by their path: an object storage would need a VFS that
+// names them by their id, as the swift layout v2 does.
+type BlobStore interface {
+	// Create opens a new blob for writing. It returns os.ErrExist if a blob
+	// already exists with this name. The mode is ignored by the stores that
+	// don't have permissions, like an object storage.
+	Create(name string, mode os.FileMode) (io.WriteCloser, error)
+	// Open opens a blob for reading. Seeking in the blob and reading at an
+	// offset are done with ranged reads on the backend, so that the range
+	// requests don't have to fetch the whole blob.
+	Open(name string) (BlobReader, error)
+	// Remove deletes a blob. It returns an error for which os.IsNotExist is
+	// true if the blob does not exist.
+	Remove(name string) error
+	// Stat returns the informations about a blob.
+	Stat(name string) (*BlobInfo, error)
+}
+
+// BlobReader is a blob of a BlobStore opened for reading.
+type BlobReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// BlobInfo is the informations about a blob of a BlobStore.
+type BlobInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
@@ -0,0 +1,42 @@
+package vfs
+
+import (
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// The algorithms of the hashes that can be used to find the files with a
+// given content.
+const (
+	HashMD5    = "md5"
+	HashSHA256 = "sha256"
+)
+
+// FilesByHash returns the files that are not in the trash and whose content
+// has the given hash. The sha256 is only known for the files written since
+// it is computed, so the older files can only be found by their md5.
+func FilesByHash(db couchdb.Database, algo string, sum []byte, limit int) ([]*FileDoc, error) {
+	var field, index string
+	switch algo {
+	case HashMD5:
+		field, index = "md5sum", "by-md5sum"
+	case HashSHA256:
+		field, index = "sha256sum", "by-sha256sum"
+	default:
+		return nil, ErrUnknownHashAlgo
+	}
+	var files []*FileDoc
+	req := &couchdb.FindRequest{
+		UseIndex: index,
+		Selector: mango.And(
+			mango.Equal(field, sum),
+			mango.Equal("trashed", false),
+		),
+		Limit: limit,
+	}
+	if err := couchdb.FindDocs(db, consts.Files, req, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
@@ -0,0 +1,129 @@
+package vfs
+
+import (
+	"sort"
+	"strings"
+)
+
+// mimeClasses is the list of the built-in rules used to associate a class to
+// a mime type. The mime types that are not listed here get the first segment
+// of their type as class (image/png -> image).
+var mimeClasses = map[string]string{
+	DefaultContentType: "files",
+
+	"application/x-apple-diskimage": "binary",
+	"application/x-msdownload":      "binary",
+
+	"text/html":          "code",
+	"text/css":           "code",
+	"text/xml":           "code",
+	"application/js":     "code",
+	"text/x-c":           "code",
+	"text/x-go":          "code",
+	"text/x-python":      "code",
+	"application/x-ruby": "code",
+
+	"application/pdf": "pdf",
+
+	"application/vnd.ms-powerpoint":                                             "slide",
+	"application/x-iwork-keynote-sffkey":                                        "slide",
+	"application/vnd.oasis.opendocument.graphics":                               "slide",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": "slide",
+
+	"application/vnd.ms-excel":                                          "spreadsheet",
+	"application/x-iwork-numbers-sffnumbers":                            "spreadsheet",
+	"application/vnd.oasis.opendocument.spreadsheet":                    "spreadsheet",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": "spreadsheet",
+
+	"application/msword":                                                      "text",
+	"application/x-iwork-pages-sffpages":                                      "text",
+	"application/vnd.oasis.opendocument.text":                                 "text",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": "text",
+
+	"application/x-7z-compressed":  "zip",
+	"application/x-rar-compressed": "zip",
+	"application/zip":              "zip",
+	"application/gzip":             "zip",
+	"application/x-tar":            "zip",
+}
+
+// genericClasses are the classes obtained from the first segment of a mime
+// type, when no rule is matching it.
+var genericClasses = []string{"application", "audio", "image", "text", "video"}
+
+// ClassRules returns a copy of the built-in rules used to associate a class
+// to a mime type.
+func ClassRules() map[string]string {
+	rules := make(map[string]string, len(mimeClasses))
+	for mime, class := range mimeClasses {
+		rules[mime] = class
+	}
+	return rules
+}
+
+// Classes returns the sorted list of the classes known by the stack, from the
+// built-in rules and the given custom ones.
+func Classes(rules map[string]string) []string {
+	seen := make(map[string]struct{})
+	for _, class := range genericClasses {
+		seen[class] = struct{}{}
+	}
+	for _, class := range mimeClasses {
+		seen[class] = struct{}{}
+	}
+	for _, class := range rules {
+		if class != "" {
+			seen[class] = struct{}{}
+		}
+	}
+	classes := make([]string, 0, len(seen))
+	for class := range seen {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// UploadPolicy is a set of rules used to restrict the types of the files that
+// can be uploaded. An entry can be a mime type (image/png), a family of mime
+// types (image/*) or a class (binary). A file is refused if it matches an
+// entry of the deny list, or if the allow list is not empty and the file
+// doesn't match any of its entries.
+type UploadPolicy struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Check returns ErrForbiddenMimeType if a file with the given mime type and
+// class can't be uploaded.
+func (p *UploadPolicy) Check(mime, class string) error {
+	if p == nil {
+		return nil
+	}
+	for _, entry := range p.Deny {
+		if matchPolicyEntry(entry, mime, class) {
+			return ErrForbiddenMimeType
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, entry := range p.Allow {
+		if matchPolicyEntry(entry, mime, class) {
+			return nil
+		}
+	}
+	return ErrForbiddenMimeType
+}
+
+func matchPolicyEntry(entry, mime, class string) bool {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	mime = strings.ToLower(mime)
+	if strings.HasSuffix(entry, "/*") {
+		return strings.HasPrefix(mime, strings.TrimSuffix(entry, "*"))
+	}
+	if strings.Contains(entry, "/") {
+		return entry == mime
+	}
+	return entry == class
+}
@@ -0,0 +1,122 @@
+package vfs
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// minCompressedSize is the size under which a file is not worth compressing.
+const minCompressedSize = 1024
+
+// Content-codings that can be used for the downloads, by order of preference
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+// isCompressible returns true if the file has a class or mime type listed in
+// the compressible entries of the config.
+func isCompressible(doc *FileDoc) bool {
+	if doc.ByteSize < minCompressedSize {
+		return false
+	}
+	for _, entry := range config.GetConfig().Fs.Compressible {
+		if matchPolicyEntry(entry, doc.Mime, doc.Class) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptedEncoding returns the content-coding to use for the response, from
+// the Accept-Encoding header of the request: gzip, deflate, or an empty string
+// for the identity.
+func acceptedEncoding(req *http.Request) string {
+	qvalues := make(map[string]float64)
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qvalues[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range []string{encodingGzip, encodingDeflate} {
+		q, ok := qvalues[coding]
+		if !ok {
+			q, ok = qvalues["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// serveCompressedContent replies with the content of the file compressed
+// with the given content-coding. The ETag is the one of the content with a
+// suffix for the coding, as the compressed representation is not the same as
+// the identity one. For a HEAD request, only the headers are sent: the size
+// of the compressed content is not known without compressing it, so there is
+// no Content-Length.
+func serveCompressedContent(fs VFS, doc *FileDoc, encoding string, req *http.Request, w http.ResponseWriter) error {
+	header := w.Header()
+	etag := fmt.Sprintf(`"%s-%s"`, base64.StdEncoding.EncodeToString(doc.MD5Sum), encoding)
+	header.Set("Etag", etag)
+	if utils.CheckPreconditions(w, req, etag) {
+		return nil
+	}
+
+	var content File
+	if req.Method != http.MethodHead {
+		var err error
+		content, err = fs.OpenFile(doc)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+	}
+
+	header.Set("Content-Encoding", encoding)
+	header.Del("Content-Length")
+	if !doc.UpdatedAt.IsZero() {
+		header.Set("Last-Modified", doc.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+	if content == nil {
+		return nil
+	}
+
+	var cw io.WriteCloser
+	if encoding == encodingGzip {
+		cw = gzip.NewWriter(w)
+	} else {
+		cw = zlib.NewWriter(w)
+	}
+	// The headers have already been sent, so an error can't be reported to
+	// the client
+	if _, err := io.Copy(cw, content); err == nil {
+		cw.Close()
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// ConflictStrategy tells what to do when a file or a directory is created
+// with the name of an existing one.
+type ConflictStrategy string
+
+const (
+	// ConflictError rejects the creation, with ErrConflict (or os.ErrExist)
+	ConflictError ConflictStrategy = "error"
+	// ConflictRename uses a unique name for the new file or directory, by
+	// adding a number to its name (see UniqueName)
+	ConflictRename ConflictStrategy = "rename"
+	// ConflictReplace overwrites the content of the existing file
+	ConflictReplace ConflictStrategy = "replace"
+)
+
+// ErrInvalidConflictStrategy is used when the strategy for the name
+// conflicts is not known.
+var ErrInvalidConflictStrategy = errors.New("Invalid strategy for the name conflicts")
+
+// ParseConflictStrategy returns the strategy with the given name. The empty
+// string is the default strategy, ConflictError.
+func ParseConflictStrategy(name string) (ConflictStrategy, error) {
+	switch ConflictStrategy(name) {
+	case "", ConflictError:
+		return ConflictError, nil
+	case ConflictRename:
+		return ConflictRename, nil
+	case ConflictReplace:
+		return ConflictReplace, nil
+	}
+	return "", ErrInvalidConflictStrategy
+}
+
+// defaultConflictPattern is the pattern used to add a number to a name in
+// conflict, when the fs.conflict_pattern parameter of the config is empty.
+const defaultConflictPattern = "%s (%d)"
+
+// maxUniqueNameTries is the maximal number of names tried by UniqueName.
+const maxUniqueNameTries = 100
+
+// conflictName returns the name with the number n, like "photo (2).jpg". The
+// extension is kept at the end of the name.
+func conflictName(name string, n int) string {
+	pattern := defaultConflictPattern
+	if conf := config.GetConfig(); conf != nil && conf.Fs.ConflictPattern != "" {
+		pattern = conf.Fs.ConflictPattern
+	}
+	ext := path.Ext(name)
+	if ext == name {
+		// A name like .bashrc has no extension
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	newname := fmt.Sprintf(pattern, base, n)
+	if strings.Contains(newname, "%!") {
+		newname = fmt.Sprintf(defaultConflictPattern, base, n)
+	}
+	return newname + ext
+}
+
+// UniqueName returns a name for a new child of the given directory, that is
+// not already used by a file or a directory. It is the given name if it is
+// free, or else the name with a number, starting at 2: "photo (2).jpg",
+// "photo (3).jpg", etc. The pattern for the number can be changed with the
+// fs.conflict_pattern parameter of the config.
+//
+// The name can still be taken by a concurrent request before the new file or
+// directory is created: the callers should retry on os.ErrExist.
+func UniqueName(fs Indexer, dirID, name string) (string, error) {
+	exists, err := fs.DirChildExists(dirID, name)
+	if err != nil || !exists {
+		return name, err
+	}
+	for n := 2; n < maxUniqueNameTries+2; n++ {
+		newname := conflictName(name, n)
+		exists, err = fs.DirChildExists(dirID, newname)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return newname, nil
+		}
+	}
+	return "", ErrConflict
+}
+
+// tryOrUseUniqueName calls the do function with the given name, and, if it
+// fails because the name is already taken, with a unique name in the
+// directory (see UniqueName).
+func tryOrUseUniqueName(fs Indexer, dirID, name string, do func(name string) error) error {
+	err := do(name)
+	for i := 0; i < 10 && os.IsExist(err); i++ {
+		var newname string
+		newname, err = UniqueName(fs, dirID, name)
+		if err != nil {
+			return err
+		}
+		err = do(newname)
+	}
+	return err
+}
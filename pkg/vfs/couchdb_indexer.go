@@ -11,6 +11,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/logger"
 	multierror "github.com/hashicorp/go-multierror"
 )
 
@@ -53,21 +54,86 @@ func (c *couchdbIndexer) InitIndex() error {
 	if err != nil && !couchdb.IsConflictError(err) {
 		return err
 	}
-	return nil
+	// A counter may have been left by a previous instance with the same
+	// domain: the new file system starts empty.
+	return GetStore().SetDiskUsage(c.db.Prefix(), 0)
 }
 
+// DiskUsage returns the disk usage from its counter, and computes it from
+// CouchDB when there is no counter yet for this instance.
 func (c *couchdbIndexer) DiskUsage() (int64, error) {
+	if total, ok, err := GetStore().GetDiskUsage(c.db.Prefix()); err == nil && ok {
+		return total, nil
+	}
+	return ReconcileDiskUsage(c.db)
+}
+
+func (c *couchdbIndexer) AcquireBlob(md5sum []byte, size int64) (string, bool, error) {
+	key := BlobKey(md5sum, size)
+	var err error
+	for i := 0; i < maxConflictRetries; i++ {
+		blob := &Blob{}
+		err = couchdb.GetDoc(c.db, consts.FilesBlobs, key, blob)
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			blob = &Blob{BlobID: key, Size: size, Refs: 1}
+			err = couchdb.CreateNamedDocWithDB(c.db, blob)
+			if err == nil {
+				return key, false, nil
+			}
+		} else if err == nil {
+			blob.Refs++
+			err = couchdb.UpdateDoc(c.db, blob)
+			if err == nil {
+				return key, true, nil
+			}
+		}
+		if !couchdb.IsConflictError(err) {
+			return "", false, err
+		}
+	}
+	return "", false, err
+}
+
+func (c *couchdbIndexer) ReleaseBlob(key string) (bool, error) {
+	var err error
+	for i := 0; i < maxConflictRetries; i++ {
+		blob := &Blob{}
+		if err = couchdb.GetDoc(c.db, consts.FilesBlobs, key, blob); err != nil {
+			if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		if blob.Refs <= 1 {
+			err = couchdb.DeleteDoc(c.db, blob)
+		} else {
+			blob.Refs--
+			err = couchdb.UpdateDoc(c.db, blob)
+		}
+		if err == nil {
+			return blob.Refs <= 1, nil
+		}
+		if !couchdb.IsConflictError(err) {
+			return false, err
+		}
+	}
+	return false, err
+}
+
+func (c *couchdbIndexer) DedupSavings() (int64, error) {
 	var doc couchdb.ViewResponse
-	err := couchdb.ExecView(c.db, consts.DiskUsageView, &couchdb.ViewRequest{
+	err := couchdb.ExecView(c.db, consts.FilesBlobsSavingsView, &couchdb.ViewRequest{
 		Reduce: true,
 	}, &doc)
+	if couchdb.IsNoDatabaseError(err) {
+		return 0, nil
+	}
 	if err != nil {
 		return 0, err
 	}
 	if len(doc.Rows) == 0 {
 		return 0, nil
 	}
-	// Reduce of _count should give us a number value
 	f64, ok := doc.Rows[0].Value.(float64)
 	if !ok {
 		return 0, ErrWrongCouchdbState
@@ -75,23 +141,42 @@ func (c *couchdbIndexer) DiskUsage() (int64, error) {
 	return int64(f64), nil
 }
 
+// normalizeDates converts the creation and modification dates of a document
+// to UTC before saving it, as they are compared as strings by CouchDB when
+// the children of a directory are filtered on them.
+func normalizeDates(createdAt, updatedAt *time.Time) {
+	*createdAt = createdAt.UTC()
+	*updatedAt = updatedAt.UTC()
+}
+
 func (c *couchdbIndexer) CreateFileDoc(doc *FileDoc) error {
+	normalizeDates(&doc.CreatedAt, &doc.UpdatedAt)
 	// Ensure that fullpath is filled because it's used in realtime/@events
 	if _, err := doc.Path(c); err != nil {
 		return err
 	}
-	return couchdb.CreateDoc(c.db, doc)
+	if err := couchdb.CreateDoc(c.db, doc); err != nil {
+		return err
+	}
+	AddDiskUsage(c.db, doc.ByteSize)
+	return nil
 }
 
 func (c *couchdbIndexer) CreateNamedFileDoc(doc *FileDoc) error {
+	normalizeDates(&doc.CreatedAt, &doc.UpdatedAt)
 	// Ensure that fullpath is filled because it's used in realtime/@events
 	if _, err := doc.Path(c); err != nil {
 		return err
 	}
-	return couchdb.CreateNamedDoc(c.db, doc)
+	if err := couchdb.CreateNamedDoc(c.db, doc); err != nil {
+		return err
+	}
+	AddDiskUsage(c.db, doc.ByteSize)
+	return nil
 }
 
 func (c *couchdbIndexer) UpdateFileDoc(olddoc, newdoc *FileDoc) error {
+	normalizeDates(&newdoc.CreatedAt, &newdoc.UpdatedAt)
 	// Ensure that fullpath is filled because it's used in realtime/@events
 	if _, err := olddoc.Path(c); err != nil {
 		return err
@@ -101,7 +186,31 @@ func (c *couchdbIndexer) UpdateFileDoc(olddoc, newdoc *FileDoc) error {
 	}
 	newdoc.SetID(olddoc.ID())
 	newdoc.SetRev(olddoc.Rev())
-	return couchdb.UpdateDocWithOld(c.db, newdoc, olddoc)
+	if err := couchdb.UpdateDocWithOld(c.db, newdoc, olddoc); err != nil {
+		return err
+	}
+	AddDiskUsage(c.db, newdoc.ByteSize-olddoc.ByteSize)
+	return nil
+}
+
+func (c *couchdbIndexer) FileConflicts(doc *FileDoc) ([]*FileDoc, error) {
+	revs, err := couchdb.GetConflicts(c.db, consts.Files, doc.ID())
+	if err != nil {
+		return nil, err
+	}
+	conflicts := make([]*FileDoc, 0, len(revs))
+	for _, rev := range revs {
+		conflict := &FileDoc{}
+		if err = couchdb.GetDocRev(c.db, consts.Files, doc.ID(), rev, conflict); err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, nil
+}
+
+func (c *couchdbIndexer) DeleteFileConflicts(doc *FileDoc, revs []string) error {
+	return couchdb.DeleteConflicts(c.db, consts.Files, doc.ID(), revs)
 }
 
 func (c *couchdbIndexer) DeleteFileDoc(doc *FileDoc) error {
@@ -109,18 +218,25 @@ func (c *couchdbIndexer) DeleteFileDoc(doc *FileDoc) error {
 	if _, err := doc.Path(c); err != nil {
 		return err
 	}
-	return couchdb.DeleteDoc(c.db, doc)
+	if err := couchdb.DeleteDoc(c.db, doc); err != nil {
+		return err
+	}
+	AddDiskUsage(c.db, -doc.ByteSize)
+	return nil
 }
 
 func (c *couchdbIndexer) CreateDirDoc(doc *DirDoc) error {
+	normalizeDates(&doc.CreatedAt, &doc.UpdatedAt)
 	return couchdb.CreateDoc(c.db, doc)
 }
 
 func (c *couchdbIndexer) CreateNamedDirDoc(doc *DirDoc) error {
+	normalizeDates(&doc.CreatedAt, &doc.UpdatedAt)
 	return couchdb.CreateNamedDoc(c.db, doc)
 }
 
 func (c *couchdbIndexer) UpdateDirDoc(olddoc, newdoc *DirDoc) error {
+	normalizeDates(&newdoc.CreatedAt, &newdoc.UpdatedAt)
 	newdoc.SetID(olddoc.ID())
 	newdoc.SetRev(olddoc.Rev())
 
@@ -130,28 +246,50 @@ func (c *couchdbIndexer) UpdateDirDoc(olddoc, newdoc *DirDoc) error {
 	isRestored := oldTrashed && !newTrashed
 	isTrashed := !oldTrashed && newTrashed
 
+	// The failures on some files inside the directory don't block the
+	// directory to be put in the trash or restored: they are reported at the
+	// end.
+	var partial *PartialTrashError
 	if isTrashed {
 		if err := c.setTrashedForFilesInsideDir(olddoc, true); err != nil {
-			return err
+			var ok bool
+			if partial, ok = err.(*PartialTrashError); !ok {
+				return err
+			}
 		}
 	}
 
-	if newdoc.Fullpath != olddoc.Fullpath {
+	moved := newdoc.Fullpath != olddoc.Fullpath
+	if moved {
 		if err := c.moveDir(olddoc.Fullpath, newdoc.Fullpath); err != nil {
 			return err
 		}
 	}
 
 	if err := couchdb.UpdateDocWithOld(c.db, newdoc, olddoc); err != nil {
+		// The sub-directories have already been moved: put them back under
+		// the old path to keep the tree consistent.
+		if moved {
+			if errb := c.moveDir(newdoc.Fullpath, olddoc.Fullpath); errb != nil {
+				logger.WithNamespace("vfs").Errorf(
+					"Failed to move back %s to %s: %s", newdoc.Fullpath, olddoc.Fullpath, errb)
+			}
+		}
 		return err
 	}
 
 	if isRestored {
 		if err := c.setTrashedForFilesInsideDir(newdoc, false); err != nil {
-			return err
+			var ok bool
+			if partial, ok = err.(*PartialTrashError); !ok {
+				return err
+			}
 		}
 	}
 
+	if partial != nil {
+		return partial
+	}
 	return nil
 }
 
@@ -187,9 +325,23 @@ func (c *couchdbIndexer) DeleteDirDocAndContent(doc *DirDoc, onlyContent bool) (
 }
 
 func (c *couchdbIndexer) BatchDelete(docs []couchdb.Doc) error {
-	return couchdb.BulkDeleteDocs(c.db, consts.Files, docs)
+	if err := couchdb.BulkDeleteDocs(c.db, consts.Files, docs); err != nil {
+		return err
+	}
+	var size int64
+	for _, doc := range docs {
+		if file, ok := doc.(*FileDoc); ok {
+			size += file.ByteSize
+		}
+	}
+	AddDiskUsage(c.db, -size)
+	return nil
 }
 
+// moveDir updates the path of all the sub-directories of oldpath to make
+// them children of newpath. Only the directories have their path stored in
+// CouchDB: the path of a file is always computed from its parent directory,
+// so the files don't need to be updated.
 func (c *couchdbIndexer) moveDir(oldpath, newpath string) error {
 	limit := 256
 	var children []*DirDoc
@@ -231,6 +383,36 @@ func (c *couchdbIndexer) moveDir(oldpath, newpath string) error {
 	return nil
 }
 
+// SubdirsDepth only fetches the paths of the sub-directories, with the same
+// index as moveDir: the files don't change the depth of a subtree.
+func (c *couchdbIndexer) SubdirsDepth(doc *DirDoc) (int, error) {
+	limit := 256
+	depth := 0
+	base := pathDepth(doc.Fullpath)
+
+	for skip := 0; ; skip += limit {
+		var children []*DirDoc
+		req := &couchdb.FindRequest{
+			UseIndex: "dir-by-path",
+			Selector: mango.StartWith("path", doc.Fullpath+"/"),
+			Fields:   []string{"_id", "path"},
+			Skip:     skip,
+			Limit:    limit,
+		}
+		if err := couchdb.FindDocs(c.db, consts.Files, req, &children); err != nil {
+			return 0, err
+		}
+		for _, child := range children {
+			if d := pathDepth(child.Fullpath) - base; d > depth {
+				depth = d
+			}
+		}
+		if len(children) < limit {
+			return depth, nil
+		}
+	}
+}
+
 func (c *couchdbIndexer) DirByID(fileID string) (*DirDoc, error) {
 	doc := &DirDoc{}
 	err := couchdb.GetDoc(c.db, consts.Files, fileID, doc)
@@ -253,17 +435,18 @@ func (c *couchdbIndexer) DirByID(fileID string) (*DirDoc, error) {
 }
 
 func (c *couchdbIndexer) DirByPath(name string) (*DirDoc, error) {
-	if !path.IsAbs(name) {
-		return nil, ErrNonAbsolutePath
+	name, err := CleanPath(name)
+	if err != nil {
+		return nil, err
 	}
 	var docs []*DirDoc
-	sel := mango.Equal("path", path.Clean(name))
+	sel := mango.Equal("path", normalizeFileName(name))
 	req := &couchdb.FindRequest{
 		UseIndex: "dir-by-path",
 		Selector: sel,
 		Limit:    1,
 	}
-	err := couchdb.FindDocs(c.db, consts.Files, req, &docs)
+	err = couchdb.FindDocs(c.db, consts.Files, req, &docs)
 	if err != nil {
 		return nil, err
 	}
@@ -292,8 +475,9 @@ func (c *couchdbIndexer) FileByID(fileID string) (*FileDoc, error) {
 }
 
 func (c *couchdbIndexer) FileByPath(name string) (*FileDoc, error) {
-	if !path.IsAbs(name) {
-		return nil, ErrNonAbsolutePath
+	name, err := CleanPath(name)
+	if err != nil {
+		return nil, err
 	}
 	parent, err := c.DirByPath(path.Dir(name))
 	if err != nil {
@@ -303,7 +487,7 @@ func (c *couchdbIndexer) FileByPath(name string) (*FileDoc, error) {
 	// consts.FilesByParentView keys are [parentID, type, name]
 	var res couchdb.ViewResponse
 	err = couchdb.ExecView(c.db, consts.FilesByParentView, &couchdb.ViewRequest{
-		Key:         []string{parent.DocID, consts.FileType, path.Base(name)},
+		Key:         []string{parent.DocID, consts.FileType, normalizeFileName(path.Base(name))},
 		IncludeDocs: true,
 	}, &res)
 	if err != nil {
@@ -377,9 +561,156 @@ func (c *couchdbIndexer) DirBatch(doc *DirDoc, cursor couchdb.Cursor) ([]DirOrFi
 		EndKey:      []string{doc.DocID, couchdb.MaxString},
 		IncludeDocs: true,
 	}
+	return c.dirBatch(consts.FilesByParentView, &req, cursor)
+}
+
+func (c *couchdbIndexer) DirBatchTrashed(doc *DirDoc, trashed bool, cursor couchdb.Cursor) ([]DirOrFileDoc, error) {
+	// consts.FilesByParentTrashedView keys are [parentID, trashed, type, name]
+	req := couchdb.ViewRequest{
+		StartKey:    []interface{}{doc.DocID, trashed, ""},
+		EndKey:      []interface{}{doc.DocID, trashed, couchdb.MaxString},
+		IncludeDocs: true,
+	}
+	return c.dirBatch(consts.FilesByParentTrashedView, &req, cursor)
+}
+
+func (c *couchdbIndexer) DirBatchFiltered(doc *DirDoc, filter *DirFilter, cursor *couchdb.SkipCursor) ([]DirOrFileDoc, error) {
+	sel := mango.Equal("dir_id", doc.DocID)
+	if filter.UpdatedSince != nil {
+		sel = mango.And(sel, mango.Gte("updated_at", DateFilterKey(*filter.UpdatedSince)))
+	} else if filter.TrashedAtSort == "" {
+		// Needed for CouchDB to use the index on [dir_id, updated_at]
+		sel = mango.And(sel, mango.Exists("updated_at"))
+	}
+	if filter.CreatedSince != nil {
+		sel = mango.And(sel, mango.Gte("created_at", DateFilterKey(*filter.CreatedSince)))
+	}
+	if doc.DocID == consts.RootDirID {
+		// Hide the trash folder when listing the root directory
+		sel = mango.And(sel, mango.Not(mango.Equal("_id", consts.TrashDirID)))
+	}
+	if filter.Trashed != nil {
+		if *filter.Trashed {
+			sel = mango.And(sel, mango.Equal("trashed", true))
+		} else {
+			// The directories have no trashed field
+			sel = mango.And(sel, mango.Not(mango.Equal("trashed", true)))
+		}
+	}
+	if len(filter.Classes) > 0 {
+		classes := make([]mango.Filter, len(filter.Classes))
+		for i, class := range filter.Classes {
+			classes[i] = mango.Equal("class", class)
+		}
+		sel = mango.And(sel, mango.Or(classes...))
+	}
+	var docs []DirOrFileDoc
+	if filter.TrashedAtSort != "" {
+		var err error
+		docs, err = c.dirBatchByTrashedAt(sel, filter, cursor)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		req := &couchdb.FindRequest{
+			UseIndex: "dir-children-by-updated-at",
+			Selector: sel,
+			Skip:     cursor.Skip,
+			Limit:    cursor.Limit + 1,
+		}
+		if err := couchdb.FindDocs(c.db, consts.Files, req, &docs); err != nil {
+			return nil, err
+		}
+	}
+
+	// Same as cursor.UpdateFrom for a view
+	if len(docs) > cursor.Limit {
+		docs = docs[:cursor.Limit]
+		cursor.Done = false
+	} else {
+		cursor.Done = true
+	}
+	cursor.Skip += cursor.Limit
+	return docs, nil
+}
+
+// dirBatchByTrashedAt returns the children sorted on the date they have been
+// put in the trash, for a skip cursor (with one more item to know if there
+// are more items after this batch). The children trashed before the
+// trashed_at attribute was introduced don't have this date: they are
+// considered as the oldest ones, and sorted on their modification date. So,
+// two queries are made: one for the children with the date, and one for the
+// children without it (first for the ascending sort, last for the descending
+// one).
+func (c *couchdbIndexer) dirBatchByTrashedAt(sel mango.Filter, filter *DirFilter, cursor *couchdb.SkipCursor) ([]DirOrFileDoc, error) {
+	direction := filter.TrashedAtSort
+	dated := &couchdb.FindRequest{
+		UseIndex: "dir-children-by-trashed-at",
+		Selector: mango.And(sel, mango.Exists("trashed_at")),
+		Sort: mango.SortBy{
+			{Field: "dir_id", Direction: direction},
+			{Field: "trashed_at", Direction: direction},
+		},
+	}
+	legacySel := mango.And(sel, mango.Not(mango.Exists("trashed_at")))
+	if filter.UpdatedSince == nil {
+		// Needed for CouchDB to use the index on [dir_id, updated_at]
+		legacySel = mango.And(legacySel, mango.Exists("updated_at"))
+	}
+	legacy := &couchdb.FindRequest{
+		UseIndex: "dir-children-by-updated-at",
+		Selector: legacySel,
+		Sort: mango.SortBy{
+			{Field: "dir_id", Direction: direction},
+			{Field: "updated_at", Direction: direction},
+		},
+	}
+	first, second := legacy, dated
+	if direction == mango.Desc {
+		first, second = dated, legacy
+	}
+
+	limit := cursor.Limit + 1
+	first.Skip = cursor.Skip
+	first.Limit = limit
+	var docs []DirOrFileDoc
+	if err := couchdb.FindDocs(c.db, consts.Files, first, &docs); err != nil {
+		return nil, err
+	}
+	if len(docs) >= limit {
+		return docs, nil
+	}
+
+	// The skip for the second query is the part of the skip of the cursor
+	// that goes beyond the children of the first query. When the first query
+	// has returned nothing, its children are counted (there are at most as
+	// many children as the skip).
+	skip := 0
+	if len(docs) == 0 && cursor.Skip > 0 {
+		var ids []struct {
+			ID string `json:"_id"`
+		}
+		first.Skip = 0
+		first.Limit = cursor.Skip
+		first.Fields = []string{"_id"}
+		if err := couchdb.FindDocs(c.db, consts.Files, first, &ids); err != nil {
+			return nil, err
+		}
+		skip = cursor.Skip - len(ids)
+	}
+	second.Skip = skip
+	second.Limit = limit - len(docs)
+	var more []DirOrFileDoc
+	if err := couchdb.FindDocs(c.db, consts.Files, second, &more); err != nil {
+		return nil, err
+	}
+	return append(docs, more...), nil
+}
+
+func (c *couchdbIndexer) dirBatch(view *couchdb.View, req *couchdb.ViewRequest, cursor couchdb.Cursor) ([]DirOrFileDoc, error) {
 	var res couchdb.ViewResponse
-	cursor.ApplyTo(&req)
-	err := couchdb.ExecView(c.db, consts.FilesByParentView, &req, &res)
+	cursor.ApplyTo(req)
+	err := couchdb.ExecView(c.db, view, req, &res)
 	if err != nil {
 		return nil, err
 	}
@@ -405,8 +736,22 @@ func (c *couchdbIndexer) DirLength(doc *DirDoc) (int, error) {
 		Reduce:     true,
 		GroupLevel: 1,
 	}
+	return c.dirLength(consts.FilesByParentView, &req)
+}
+
+func (c *couchdbIndexer) DirLengthTrashed(doc *DirDoc, trashed bool) (int, error) {
+	req := couchdb.ViewRequest{
+		StartKey:   []interface{}{doc.DocID, trashed, ""},
+		EndKey:     []interface{}{doc.DocID, trashed, couchdb.MaxString},
+		Reduce:     true,
+		GroupLevel: 2,
+	}
+	return c.dirLength(consts.FilesByParentTrashedView, &req)
+}
+
+func (c *couchdbIndexer) dirLength(view *couchdb.View, req *couchdb.ViewRequest) (int, error) {
 	var res couchdb.ViewResponse
-	err := couchdb.ExecView(c.db, consts.FilesByParentView, &req, &res)
+	err := couchdb.ExecView(c.db, view, req, &res)
 	if err != nil {
 		return 0, err
 	}
@@ -425,6 +770,7 @@ func (c *couchdbIndexer) DirLength(doc *DirDoc) (int, error) {
 
 func (c *couchdbIndexer) DirChildExists(dirID, name string) (bool, error) {
 	var res couchdb.ViewResponse
+	name = normalizeFileName(name)
 
 	// consts.FilesByParentView keys are [parentID, type, name]
 	err := couchdb.ExecView(c.db, consts.FilesByParentView, &couchdb.ViewRequest{
@@ -471,6 +817,9 @@ func (c *couchdbIndexer) setTrashedForFilesInsideDir(doc *DirDoc, trashed bool)
 				file.fullpath = fullpath
 			}
 			file.Trashed = trashed
+			if trashed {
+				file.Starred = false
+			}
 			files = append(files, file)
 			olddocs = append(olddocs, cloned)
 		}
@@ -479,7 +828,27 @@ func (c *couchdbIndexer) setTrashedForFilesInsideDir(doc *DirDoc, trashed bool)
 	if err != nil {
 		return err
 	}
-	return couchdb.BulkUpdateDocs(c.db, consts.Files, files, olddocs)
+	res, err := couchdb.BulkUpdateDocsWithResults(c.db, consts.Files, files, olddocs)
+	if err != nil {
+		return err
+	}
+	partial := &PartialTrashError{}
+	for i, r := range res {
+		file := files[i].(*FileDoc)
+		if r.Error != "" {
+			partial.Failures = append(partial.Failures, TrashFailure{
+				ID:     file.ID(),
+				Path:   file.fullpath,
+				Reason: r.Reason,
+			})
+		} else {
+			partial.Trashed = append(partial.Trashed, file.ID())
+		}
+	}
+	if len(partial.Failures) > 0 {
+		return partial
+	}
+	return nil
 }
 
 // TreeFile represent a subset of a file/directory structure that can be used
@@ -504,10 +873,14 @@ type treeError struct {
 }
 
 func (c *couchdbIndexer) CheckIndexIntegrity() (logs []*FsckLog, err error) {
+	var corrupted []string
 	root, orphans, err := checkIndexIntegrity(func(cb func(entry *TreeFile)) error {
 		return couchdb.ForeachDocs(c.db, consts.Files, func(_ string, data json.RawMessage) error {
 			var f TreeFile
 			if err = json.Unmarshal(data, &f); err == nil {
+				if f.Corrupted {
+					corrupted = append(corrupted, f.DocID)
+				}
 				cb(&f)
 			}
 			return err
@@ -537,6 +910,21 @@ func (c *couchdbIndexer) CheckIndexIntegrity() (logs []*FsckLog, err error) {
 		}
 	}
 
+	for _, fileID := range corrupted {
+		var doc *FileDoc
+		doc, err = c.FileByID(fileID)
+		if err != nil {
+			return
+		}
+		fullpath, _ := doc.Path(c)
+		logs = append(logs, &FsckLog{
+			Type:     ContentCorrupted,
+			IsFile:   true,
+			FileDoc:  doc,
+			Filename: fullpath,
+		})
+	}
+
 	return
 }
 
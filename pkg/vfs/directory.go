@@ -6,6 +6,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 )
@@ -31,6 +32,20 @@ type DirDoc struct {
 	UpdatedAt time.Time `json:"updated_at"`
 	Tags      []string  `json:"tags"`
 
+	// Starred is set when the user has pinned the directory in its favorites
+	Starred bool `json:"starred,omitempty"`
+
+	// InheritTags is set when the files created in (or moved to) this
+	// directory must receive its tags
+	InheritTags bool `json:"inherit_tags,omitempty"`
+
+	// TrashedAt is the date when the directory has been put in the trash
+	TrashedAt *time.Time `json:"trashed_at,omitempty"`
+
+	// TrashReason is a short note given when the directory has been put in
+	// the trash, to explain why
+	TrashReason string `json:"trash_reason,omitempty"`
+
 	// Directory path on VFS.
 	// Fullpath should always be present. It is marked "omitempty" because
 	// DirDoc is the base of the DirOrFile struct.
@@ -55,6 +70,10 @@ func (d *DirDoc) Clone() couchdb.Doc {
 	copy(cloned.Tags, d.Tags)
 	cloned.ReferencedBy = make([]couchdb.DocReference, len(d.ReferencedBy))
 	copy(cloned.ReferencedBy, d.ReferencedBy)
+	if d.TrashedAt != nil {
+		trashedAt := *d.TrashedAt
+		cloned.TrashedAt = &trashedAt
+	}
 	return &cloned
 }
 
@@ -148,12 +167,18 @@ func NewDirDoc(index Indexer, name, dirID string, tags []string) (*DirDoc, error
 }
 
 // NewDirDocWithParent returns an instance of DirDoc from a parent document.
-// The given name is validated.
+// The given name is normalized and validated.
 func NewDirDocWithParent(name string, parent *DirDoc, tags []string) (*DirDoc, error) {
+	name = normalizeFileName(name)
 	if err := checkFileName(name); err != nil {
 		return nil, err
 	}
 
+	fullpath := path.Join(parent.Fullpath, name)
+	if err := checkDepth(fullpath); err != nil {
+		return nil, err
+	}
+
 	createDate := time.Now()
 	return &DirDoc{
 		Type:    consts.DirType,
@@ -163,17 +188,23 @@ func NewDirDocWithParent(name string, parent *DirDoc, tags []string) (*DirDoc, e
 		CreatedAt: createDate,
 		UpdatedAt: createDate,
 		Tags:      uniqueTags(tags),
-		Fullpath:  path.Join(parent.Fullpath, name),
+		Fullpath:  fullpath,
 	}, nil
 }
 
 // NewDirDocWithPath returns an instance of DirDoc its directory ID and path.
-// The given name is validated.
+// The given name is normalized and validated.
 func NewDirDocWithPath(name, dirID, dirPath string, tags []string) (*DirDoc, error) {
+	name = normalizeFileName(name)
 	if err := checkFileName(name); err != nil {
 		return nil, err
 	}
 
+	fullpath := path.Join(dirPath, name)
+	if err := checkDepth(fullpath); err != nil {
+		return nil, err
+	}
+
 	createDate := time.Now()
 	return &DirDoc{
 		Type:    consts.DirType,
@@ -183,7 +214,7 @@ func NewDirDocWithPath(name, dirID, dirPath string, tags []string) (*DirDoc, err
 		CreatedAt: createDate,
 		UpdatedAt: createDate,
 		Tags:      uniqueTags(tags),
-		Fullpath:  path.Join(dirPath, name),
+		Fullpath:  fullpath,
 	}, nil
 }
 
@@ -203,14 +234,22 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 		RestorePath: &olddoc.RestorePath,
 		Tags:        &olddoc.Tags,
 		UpdatedAt:   &olddoc.UpdatedAt,
+		Starred:     &olddoc.Starred,
+		InheritTags: &olddoc.InheritTags,
 	}, patch, cdate)
 
 	if err != nil {
 		return nil, err
 	}
+	if *patch.Starred && !olddoc.Starred && strings.HasPrefix(olddoc.Fullpath, TrashDirName) {
+		return nil, ErrFileInTrash
+	}
 
 	var newdoc *DirDoc
 	if *patch.DirID != olddoc.DirID {
+		if err = checkNotDescendant(fs, olddoc, *patch.DirID); err != nil {
+			return nil, err
+		}
 		newdoc, err = NewDirDoc(fs, *patch.Name, *patch.DirID, *patch.Tags)
 	} else {
 		newdoc, err = NewDirDocWithPath(*patch.Name, olddoc.DirID, path.Dir(olddoc.Fullpath), *patch.Tags)
@@ -218,11 +257,20 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 	if err != nil {
 		return nil, err
 	}
+	if err = checkSubtreeDepth(fs, olddoc, newdoc.Fullpath); err != nil {
+		return nil, err
+	}
 
 	newdoc.RestorePath = *patch.RestorePath
 	newdoc.CreatedAt = cdate
 	newdoc.UpdatedAt = *patch.UpdatedAt
 	newdoc.ReferencedBy = olddoc.ReferencedBy
+	newdoc.Starred = *patch.Starred
+	newdoc.InheritTags = *patch.InheritTags
+	if strings.HasPrefix(newdoc.Fullpath, TrashDirName) {
+		newdoc.TrashedAt = olddoc.TrashedAt
+		newdoc.TrashReason = olddoc.TrashReason
+	}
 
 	if err = fs.UpdateDirDoc(olddoc, newdoc); err != nil {
 		return nil, err
@@ -230,8 +278,107 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 	return newdoc, nil
 }
 
-// TrashDir is used to delete a directory given its document
+// ModifyDirMetadataWithRetry is like ModifyDirMetadata, but when the update
+// fails because of a conflict in CouchDB, the last revision of the directory
+// is fetched and the patch is applied again on it.
+func ModifyDirMetadataWithRetry(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error) {
+	for i := 0; ; i++ {
+		p := *patch
+		newdoc, err := ModifyDirMetadata(fs, olddoc, &p)
+		if err == nil || !couchdb.IsConflictError(err) || i >= maxConflictRetries {
+			return newdoc, err
+		}
+		olddoc, err = fs.DirByID(olddoc.ID())
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// checkNotDescendant walks up the tree from the directory with the given id
+// and returns ErrForbiddenDocMove if doc is one of its ancestors (or the
+// directory itself). Moving doc inside this directory would create a cycle.
+func checkNotDescendant(fs VFS, doc *DirDoc, dirID string) error {
+	for dirID != consts.RootDirID && dirID != consts.TrashDirID {
+		if dirID == doc.ID() {
+			return ErrForbiddenDocMove
+		}
+		parent, err := fs.DirByID(dirID)
+		if err != nil {
+			return err
+		}
+		dirID = parent.DirID
+	}
+	return nil
+}
+
+// MaxDepth returns the maximal depth of the directories, from the config, or
+// -1 if there is no limit. The depth of a directory is the number of segments
+// of its path: /foo/bar has a depth of 2.
+func MaxDepth() int {
+	if conf := config.GetConfig(); conf != nil && conf.Fs.MaxDepth > 0 {
+		return conf.Fs.MaxDepth
+	}
+	return -1
+}
+
+func pathDepth(fullpath string) int {
+	fullpath = strings.Trim(path.Clean(fullpath), "/")
+	if fullpath == "" {
+		return 0
+	}
+	return strings.Count(fullpath, "/") + 1
+}
+
+// checkDepth returns ErrMaxDepthExceeded if a directory can't have this path,
+// as it would be too deep. The trash is not limited, so that a directory can
+// always be put in the trash.
+func checkDepth(fullpath string) error {
+	max := MaxDepth()
+	if max < 0 || strings.HasPrefix(fullpath, TrashDirName+"/") {
+		return nil
+	}
+	if pathDepth(fullpath) > max {
+		return ErrMaxDepthExceeded
+	}
+	return nil
+}
+
+// checkSubtreeDepth returns ErrMaxDepthExceeded if the directories inside
+// olddoc would be too deep after olddoc is moved to newpath.
+func checkSubtreeDepth(fs VFS, olddoc *DirDoc, newpath string) error {
+	max := MaxDepth()
+	if max < 0 || strings.HasPrefix(newpath, TrashDirName+"/") {
+		return nil
+	}
+	if pathDepth(newpath) <= pathDepth(olddoc.Fullpath) {
+		return nil
+	}
+	depth, err := fs.SubdirsDepth(olddoc)
+	if err != nil {
+		return err
+	}
+	if pathDepth(newpath)+depth > max {
+		return ErrMaxDepthExceeded
+	}
+	return nil
+}
+
+// TrashDir is used to delete a directory given its document. If some files
+// inside the directory can't be marked as trashed, the directory is still
+// moved to the trash, and a *PartialTrashError is returned with the new
+// document.
 func TrashDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
+	return TrashDirWithReason(fs, olddoc, "")
+}
+
+// TrashDirWithReason is like TrashDir, but it keeps a short note with the
+// reason why the directory has been put in the trash (see CheckTrashReason).
+// The note is only kept on the directory, not on the files inside it.
+func TrashDirWithReason(fs VFS, olddoc *DirDoc, reason string) (*DirDoc, error) {
+	if err := CheckTrashReason(reason); err != nil {
+		return nil, err
+	}
 	oldpath, err := olddoc.Path(fs)
 	if err != nil {
 		return nil, err
@@ -243,6 +390,7 @@ func TrashDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
 
 	trashDirID := consts.TrashDirID
 	restorePath := path.Dir(oldpath)
+	trashedAt := time.Now()
 
 	var newdoc *DirDoc
 	err = tryOrUseSuffix(olddoc.DocName, conflictFormat, func(name string) error {
@@ -251,15 +399,27 @@ func TrashDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
 		newdoc.RestorePath = restorePath
 		newdoc.DocName = name
 		newdoc.Fullpath = path.Join(TrashDirName, name)
+		newdoc.Starred = false
+		newdoc.TrashedAt = &trashedAt
+		newdoc.TrashReason = reason
 		return fs.UpdateDirDoc(olddoc, newdoc)
 	})
+	if _, ok := err.(*PartialTrashError); ok {
+		evictTrashAfter(fs, newdoc.ID())
+		return newdoc, err
+	}
 	if err != nil {
 		return nil, err
 	}
+	evictTrashAfter(fs, newdoc.ID())
 	return newdoc, nil
 }
 
-// RestoreDir is used to restore a trashed directory given its document
+// RestoreDir is used to restore a trashed directory given its document. If
+// the name is already taken in the restore directory, a number is added to it
+// (see UniqueName). Like for TrashDir, a *PartialTrashError is returned with
+// the new document if some files inside the directory can't be marked as no
+// longer trashed.
 func RestoreDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
 	oldpath, err := olddoc.Path(fs)
 	if err != nil {
@@ -274,14 +434,19 @@ func RestoreDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
 	name := stripSuffix(olddoc.DocName, conflictSuffix)
 
 	var newdoc *DirDoc
-	err = tryOrUseSuffix(name, "%s (%s)", func(name string) error {
+	err = tryOrUseUniqueName(fs, restoreDir.DocID, name, func(name string) error {
 		newdoc = olddoc.Clone().(*DirDoc)
 		newdoc.DirID = restoreDir.DocID
 		newdoc.RestorePath = ""
 		newdoc.DocName = name
 		newdoc.Fullpath = path.Join(restoreDir.Fullpath, name)
+		newdoc.TrashedAt = nil
+		newdoc.TrashReason = ""
 		return fs.UpdateDirDoc(olddoc, newdoc)
 	})
+	if _, ok := err.(*PartialTrashError); ok {
+		return newdoc, err
+	}
 	if err != nil {
 		return nil, err
 	}
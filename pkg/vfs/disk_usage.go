@@ -0,0 +1,120 @@
+package vfs
+
+import (
+	"context"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// diskUsageTTL is how long the disk usage counter of an instance is kept
+// without being reconciled. After that, it is computed again from CouchDB on
+// the next read.
+var diskUsageTTL = 24 * time.Hour
+
+// diskUsageMemTTL is the same as diskUsageTTL, but for the counters kept in
+// memory, when redis is not configured. Such a counter is only updated by the
+// files written by the same process: when several stack processes share the
+// same CouchDB, it misses the updates made by the other processes. So, it is
+// computed again from CouchDB more often.
+var diskUsageMemTTL = 5 * time.Minute
+
+// diskUsageReconcileInterval is the time interval between two
+// reconciliations of the disk usage counters.
+var diskUsageReconcileInterval = 6 * time.Hour
+
+// computeDiskUsage computes the disk usage from scratch, with the reduce of
+// the disk-usage view.
+func computeDiskUsage(db couchdb.Database) (int64, error) {
+	var doc couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.DiskUsageView, &couchdb.ViewRequest{
+		Reduce: true,
+	}, &doc)
+	if err != nil {
+		return 0, err
+	}
+	if len(doc.Rows) == 0 {
+		return 0, nil
+	}
+	// Reduce of _sum should give us a number value
+	f64, ok := doc.Rows[0].Value.(float64)
+	if !ok {
+		return 0, ErrWrongCouchdbState
+	}
+	return int64(f64), nil
+}
+
+// AddDiskUsage updates the disk usage counter of an instance after a file
+// has been created, modified or deleted. The counter is incremented
+// atomically, so that concurrent uploads don't lose an update. An error is
+// only logged: the counter will be fixed by the next reconciliation.
+func AddDiskUsage(db couchdb.Database, delta int64) {
+	if delta == 0 {
+		return
+	}
+	if err := GetStore().AddDiskUsage(db.Prefix(), delta); err != nil {
+		logger.WithDomain(db.Prefix()).WithField("nspace", "vfs").
+			Infof("Cannot update the disk usage: %s", err)
+	}
+}
+
+// ReconcileDiskUsage computes the disk usage of an instance from scratch and
+// replaces its counter with it, to correct the drift that can come from the
+// documents modified outside of the VFS. It returns the new disk usage.
+func ReconcileDiskUsage(db couchdb.Database) (int64, error) {
+	total, err := computeDiskUsage(db)
+	if err != nil {
+		return 0, err
+	}
+	if err = GetStore().SetDiskUsage(db.Prefix(), total); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// ReconcileDiskUsages starts a goroutine that reconciles regularly the disk
+// usage counters. The each function must call its callback for every
+// instance: only the instances with a counter are reconciled, the other ones
+// will compute it on their next read.
+func ReconcileDiskUsages(each func(fn func(db couchdb.Database) error) error) utils.Shutdowner {
+	closed := make(chan struct{})
+	go func() {
+		log := logger.WithNamespace("vfs")
+		for {
+			select {
+			case <-time.After(diskUsageReconcileInterval):
+				err := each(func(db couchdb.Database) error {
+					_, ok, err := GetStore().GetDiskUsage(db.Prefix())
+					if err == nil && ok {
+						_, err = ReconcileDiskUsage(db)
+					}
+					if err != nil {
+						log.Errorf("Could not reconcile the disk usage of %s: %s", db.Prefix(), err)
+					}
+					return nil
+				})
+				if err != nil {
+					log.Errorf("Could not reconcile the disk usages: %s", err)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return &diskUsageReconciler{closed}
+}
+
+type diskUsageReconciler struct {
+	closed chan struct{}
+}
+
+func (r *diskUsageReconciler) Shutdown(ctx context.Context) error {
+	select {
+	case r.closed <- struct{}{}:
+	case <-ctx.Done():
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package vfs
 import (
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 
@@ -17,15 +18,35 @@ type DownloadStore interface {
 	AddArchive(domain string, archive *Archive) (string, error)
 	GetFile(domain, key string) (string, error)
 	GetArchive(domain, key string) (*Archive, error)
+	SaveJob(domain string, job *Job) error
+	GetJob(domain, id string) (*Job, error)
+	AcquireLock(domain, fileID string, lock *FileLock) (*FileLock, error)
+	GetLock(domain, fileID string) (*FileLock, error)
+	ReleaseLock(domain, fileID, owner string) (*FileLock, error)
+	ReserveIdempotencyKey(domain, key string) (string, error)
+	SaveIdempotencyKey(domain, key, docID string) error
+	ReleaseIdempotencyKey(domain, key string) error
+	GetDiskUsage(domain string) (int64, bool, error)
+	SetDiskUsage(domain string, total int64) error
+	AddDiskUsage(domain string, delta int64) error
 }
 
 // downloadStoreTTL is the time an Archive stay alive
 var downloadStoreTTL = 1 * time.Hour
 
+// jobStoreTTL is the time a Job record stay alive after its last update
+var jobStoreTTL = 1 * time.Hour
+
 // downloadStoreCleanInterval is the time interval between each download
 // cleanup.
 var downloadStoreCleanInterval = 1 * time.Hour
 
+// SecretTTL returns how long the secrets given by the store for a file or an
+// archive are valid.
+func SecretTTL() time.Duration {
+	return downloadStoreTTL
+}
+
 var globalStoreMu sync.Mutex
 var globalStore DownloadStore
 
@@ -132,6 +153,163 @@ func (s *memStore) GetArchive(domain, key string) (*Archive, error) {
 	return a, nil
 }
 
+func (s *memStore) SaveJob(domain string, job *Job) error {
+	cloned := *job
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vals[jobKey(domain, job.ID)] = &memRef{
+		val: &cloned,
+		exp: time.Now().Add(jobStoreTTL),
+	}
+	return nil
+}
+
+func (s *memStore) GetJob(domain, id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := jobKey(domain, id)
+	ref, ok := s.vals[key]
+	if !ok {
+		return nil, nil
+	}
+	if time.Now().After(ref.exp) {
+		delete(s.vals, key)
+		return nil, nil
+	}
+	j, ok := ref.val.(*Job)
+	if !ok {
+		return nil, nil
+	}
+	cloned := *j
+	return &cloned, nil
+}
+
+func (s *memStore) AcquireLock(domain, fileID string, lock *FileLock) (*FileLock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := lockKey(domain, fileID)
+	if ref, ok := s.vals[key]; ok && time.Now().Before(ref.exp) {
+		if held, ok := ref.val.(*FileLock); ok && held.Owner != lock.Owner {
+			cloned := *held
+			return &cloned, nil
+		}
+	}
+	cloned := *lock
+	s.vals[key] = &memRef{
+		val: &cloned,
+		exp: lock.ExpiresAt,
+	}
+	return lock, nil
+}
+
+func (s *memStore) GetLock(domain, fileID string) (*FileLock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := lockKey(domain, fileID)
+	ref, ok := s.vals[key]
+	if !ok {
+		return nil, nil
+	}
+	if time.Now().After(ref.exp) {
+		delete(s.vals, key)
+		return nil, nil
+	}
+	l, ok := ref.val.(*FileLock)
+	if !ok {
+		return nil, nil
+	}
+	cloned := *l
+	return &cloned, nil
+}
+
+func (s *memStore) ReleaseLock(domain, fileID, owner string) (*FileLock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := lockKey(domain, fileID)
+	ref, ok := s.vals[key]
+	if !ok {
+		return nil, nil
+	}
+	if l, ok := ref.val.(*FileLock); ok && l.Owner != owner && time.Now().Before(ref.exp) {
+		cloned := *l
+		return &cloned, nil
+	}
+	delete(s.vals, key)
+	return nil, nil
+}
+
+func (s *memStore) ReserveIdempotencyKey(domain, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := idempotencyKey(domain, key)
+	if ref, ok := s.vals[k]; ok && time.Now().Before(ref.exp) {
+		if v, ok := ref.val.(string); ok {
+			return v, nil
+		}
+	}
+	s.vals[k] = &memRef{
+		val: idempotencyPending,
+		exp: time.Now().Add(idempotencyPendingTTL),
+	}
+	return "", nil
+}
+
+func (s *memStore) SaveIdempotencyKey(domain, key, docID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vals[idempotencyKey(domain, key)] = &memRef{
+		val: docID,
+		exp: time.Now().Add(idempotencyKeyTTL),
+	}
+	return nil
+}
+
+func (s *memStore) ReleaseIdempotencyKey(domain, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.vals, idempotencyKey(domain, key))
+	return nil
+}
+
+func (s *memStore) GetDiskUsage(domain string) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := diskUsageKey(domain)
+	ref, ok := s.vals[key]
+	if !ok {
+		return 0, false, nil
+	}
+	if time.Now().After(ref.exp) {
+		delete(s.vals, key)
+		return 0, false, nil
+	}
+	total, ok := ref.val.(int64)
+	return total, ok, nil
+}
+
+func (s *memStore) SetDiskUsage(domain string, total int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vals[diskUsageKey(domain)] = &memRef{
+		val: total,
+		exp: time.Now().Add(diskUsageMemTTL),
+	}
+	return nil
+}
+
+func (s *memStore) AddDiskUsage(domain string, delta int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref, ok := s.vals[diskUsageKey(domain)]
+	if !ok || time.Now().After(ref.exp) {
+		return nil
+	}
+	if total, ok := ref.val.(int64); ok {
+		ref.val = total + delta
+	}
+	return nil
+}
+
 type redisStore struct {
 	c redis.UniversalClient
 }
@@ -182,6 +360,179 @@ func (s *redisStore) GetArchive(domain, key string) (*Archive, error) {
 	return arch, nil
 }
 
+func (s *redisStore) SaveJob(domain string, job *Job) error {
+	v, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.c.Set(jobKey(domain, job.ID), v, jobStoreTTL).Err()
+}
+
+func (s *redisStore) GetJob(domain, id string) (*Job, error) {
+	b, err := s.c.Get(jobKey(domain, id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err = json.Unmarshal(b, job); err != nil {
+		return nil, err
+	}
+	job.ID = id
+	return job, nil
+}
+
+// luaAcquireLock sets the lock if there is no lock for this file, or if it is
+// held by the same owner, and returns the lock held after that.
+const luaAcquireLock = `local v = redis.call("GET", KEYS[1])
+if v and cjson.decode(v)["owner"] ~= ARGV[1] then return v end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+return ARGV[2]`
+
+// luaReleaseLock deletes the lock if it is held by the given owner, or
+// returns the lock held by another owner.
+const luaReleaseLock = `local v = redis.call("GET", KEYS[1])
+if not v then return false end
+if cjson.decode(v)["owner"] ~= ARGV[1] then return v end
+redis.call("DEL", KEYS[1])
+return false`
+
+func (s *redisStore) AcquireLock(domain, fileID string, lock *FileLock) (*FileLock, error) {
+	v, err := json.Marshal(lock)
+	if err != nil {
+		return nil, err
+	}
+	ttl := time.Until(lock.ExpiresAt) / time.Millisecond
+	if ttl <= 0 {
+		ttl = 1
+	}
+	res, err := s.c.Eval(luaAcquireLock, []string{lockKey(domain, fileID)},
+		lock.Owner, v, int64(ttl)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeLock(res)
+}
+
+func (s *redisStore) GetLock(domain, fileID string) (*FileLock, error) {
+	b, err := s.c.Get(lockKey(domain, fileID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lock := &FileLock{}
+	if err = json.Unmarshal(b, lock); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+func (s *redisStore) ReleaseLock(domain, fileID, owner string) (*FileLock, error) {
+	res, err := s.c.Eval(luaReleaseLock, []string{lockKey(domain, fileID)}, owner).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeLock(res)
+}
+
+func (s *redisStore) ReserveIdempotencyKey(domain, key string) (string, error) {
+	k := idempotencyKey(domain, key)
+	for i := 0; i < 2; i++ {
+		ok, err := s.c.SetNX(k, idempotencyPending, idempotencyPendingTTL).Result()
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return "", nil
+		}
+		v, err := s.c.Get(k).Result()
+		if err == redis.Nil {
+			// The key has expired between the two commands
+			continue
+		}
+		return v, err
+	}
+	return idempotencyPending, nil
+}
+
+func (s *redisStore) SaveIdempotencyKey(domain, key, docID string) error {
+	return s.c.Set(idempotencyKey(domain, key), docID, idempotencyKeyTTL).Err()
+}
+
+func (s *redisStore) ReleaseIdempotencyKey(domain, key string) error {
+	return s.c.Del(idempotencyKey(domain, key)).Err()
+}
+
+func (s *redisStore) GetDiskUsage(domain string) (int64, bool, error) {
+	total, err := s.c.Get(diskUsageKey(domain)).Int64()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return total, true, nil
+}
+
+func (s *redisStore) SetDiskUsage(domain string, total int64) error {
+	return s.c.Set(diskUsageKey(domain), total, diskUsageTTL).Err()
+}
+
+// luaAddDiskUsage increments the disk usage counter only if it exists, so
+// that a counter is never created from a delta alone.
+const luaAddDiskUsage = `if redis.call("EXISTS", KEYS[1]) == 1 then
+return redis.call("INCRBY", KEYS[1], ARGV[1]) end
+return false`
+
+func (s *redisStore) AddDiskUsage(domain string, delta int64) error {
+	err := s.c.Eval(luaAddDiskUsage, []string{diskUsageKey(domain)}, delta).Err()
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
+
+func decodeLock(res interface{}) (*FileLock, error) {
+	str, ok := res.(string)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected value for a lock: %v", res)
+	}
+	lock := &FileLock{}
+	if err := json.Unmarshal([]byte(str), lock); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// jobKey returns the key for a job record. It uses a different prefix than
+// the files and archives, so that a job ID can't be used as a download key.
+func jobKey(domain, id string) string {
+	return domain + ":jobs:" + id
+}
+
+// lockKey returns the key for the lock of a file.
+func lockKey(domain, fileID string) string {
+	return domain + ":locks:" + fileID
+}
+
+// idempotencyKey returns the key for the ID of a document created with an
+// idempotency key.
+func idempotencyKey(domain, key string) string {
+	return domain + ":idempotency:" + key
+}
+
+// diskUsageKey returns the key for the disk usage counter of an instance.
+func diskUsageKey(domain string) string {
+	return domain + ":disk-usage"
+}
+
 func makeSecret() string {
 	return hex.EncodeToString(crypto.GenerateRandomBytes(8))
 }
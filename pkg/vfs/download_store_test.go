@@ -98,3 +98,102 @@ func TestDownloadStoreInRedis(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Nil(t, a3, "no expiration")
 }
+
+func TestJobStoreInMemory(t *testing.T) {
+	jobStoreTTL = 100 * time.Millisecond
+
+	domainA := "alice.cozycloud.local"
+	domainB := "bob.cozycloud.local"
+	store := newMemStore()
+
+	job := &Job{ID: makeSecret(), Operation: "trash", State: JobRunning}
+	assert.NoError(t, store.SaveJob(domainA, job))
+
+	j1, err := store.GetJob(domainB, job.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, j1, "Inter-instances store leaking")
+
+	path, err := store.GetFile(domainA, job.ID)
+	assert.NoError(t, err)
+	assert.Zero(t, path)
+
+	j2, err := store.GetJob(domainA, job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, job, j2)
+
+	time.Sleep(2 * jobStoreTTL)
+
+	j3, err := store.GetJob(domainA, job.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, j3, "no expiration")
+}
+
+func TestLockStoreInMemory(t *testing.T) {
+	domainA := "alice.cozycloud.local"
+	domainB := "bob.cozycloud.local"
+	store := newMemStore()
+	fileID := makeSecret()
+
+	lock := &FileLock{Owner: "editor", ExpiresAt: time.Now().Add(100 * time.Millisecond)}
+	held, err := store.AcquireLock(domainA, fileID, lock)
+	assert.NoError(t, err)
+	assert.Equal(t, "editor", held.Owner)
+
+	l1, err := store.GetLock(domainB, fileID)
+	assert.NoError(t, err)
+	assert.Nil(t, l1, "Inter-instances store leaking")
+
+	other := &FileLock{Owner: "other", ExpiresAt: time.Now().Add(time.Hour)}
+	held, err = store.AcquireLock(domainA, fileID, other)
+	assert.NoError(t, err)
+	assert.Equal(t, "editor", held.Owner)
+
+	held, err = store.ReleaseLock(domainA, fileID, "other")
+	assert.NoError(t, err)
+	assert.NotNil(t, held)
+
+	time.Sleep(200 * time.Millisecond)
+
+	l2, err := store.GetLock(domainA, fileID)
+	assert.NoError(t, err)
+	assert.Nil(t, l2, "no expiration")
+
+	held, err = store.AcquireLock(domainA, fileID, other)
+	assert.NoError(t, err)
+	assert.Equal(t, "other", held.Owner)
+
+	held, err = store.ReleaseLock(domainA, fileID, "other")
+	assert.NoError(t, err)
+	assert.Nil(t, held)
+	l3, err := store.GetLock(domainA, fileID)
+	assert.NoError(t, err)
+	assert.Nil(t, l3)
+}
+
+func TestIdempotencyStoreInMemory(t *testing.T) {
+	domainA := "alice.cozycloud.local"
+	domainB := "bob.cozycloud.local"
+	store := newMemStore()
+
+	docID, err := store.ReserveIdempotencyKey(domainA, "key1")
+	assert.NoError(t, err)
+	assert.Empty(t, docID)
+
+	docID, err = store.ReserveIdempotencyKey(domainA, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, idempotencyPending, docID)
+
+	docID, err = store.ReserveIdempotencyKey(domainB, "key1")
+	assert.NoError(t, err)
+	assert.Empty(t, docID, "Inter-instances store leaking")
+
+	assert.NoError(t, store.SaveIdempotencyKey(domainA, "key1", "file-id"))
+	docID, err = store.ReserveIdempotencyKey(domainA, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, "file-id", docID)
+
+	assert.NoError(t, store.ReleaseIdempotencyKey(domainB, "key1"))
+	docID, err = store.ReserveIdempotencyKey(domainB, "key1")
+	assert.NoError(t, err)
+	assert.Empty(t, docID)
+}
@@ -0,0 +1,312 @@
+package vfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"golang.org/x/crypto/hkdf"
+)
+
+// EncryptionAlgorithm is the algorithm used to encrypt the content of the
+// files at rest.
+const EncryptionAlgorithm = "AES-256-GCM"
+
+// EncryptionSegmentSize is the size of the plaintext segments that are
+// encrypted separately. Each segment can be decrypted on its own, so that
+// the content can be read from any offset, for the range requests.
+const EncryptionSegmentSize = 64 * 1024
+
+// ErrEncryptionUnavailable is used when the content of a file is encrypted,
+// but the key is not configured, or the parameters are not supported.
+var ErrEncryptionUnavailable = errors.New("vfs: the content of the file is encrypted and cannot be decrypted")
+
+// Encryption has the parameters used to encrypt the content of a file. The
+// content is split in segments of SegmentSize bytes, and each segment is
+// sealed with AES-GCM, with the nonce xored with the index of the segment.
+// The key is derived from the master key of the vault and the domain of the
+// instance, and is never stored.
+type Encryption struct {
+	Algorithm   string `json:"alg"`
+	Nonce       []byte `json:"nonce"`
+	SegmentSize int    `json:"segment_size"`
+}
+
+// Clone returns a copy of the encryption parameters.
+func (e *Encryption) Clone() *Encryption {
+	cloned := *e
+	cloned.Nonce = make([]byte, len(e.Nonce))
+	copy(cloned.Nonce, e.Nonce)
+	return &cloned
+}
+
+// NewEncryption returns the parameters for encrypting a new content, with a
+// random nonce, or nil if the encryption at rest is not enabled.
+func NewEncryption() (*Encryption, error) {
+	if len(filesMasterKey()) == 0 {
+		return nil, nil
+	}
+	return &Encryption{
+		Algorithm:   EncryptionAlgorithm,
+		Nonce:       crypto.GenerateRandomBytes(12),
+		SegmentSize: EncryptionSegmentSize,
+	}, nil
+}
+
+// EncryptionEnabled returns true if the content of the new files is
+// encrypted at rest: the key must be configured, and only the local storage
+// supports it.
+func EncryptionEnabled() bool {
+	return len(filesMasterKey()) > 0 && config.FsURL().Scheme != config.SchemeSwift
+}
+
+func filesMasterKey() []byte {
+	vault := config.GetVault()
+	if vault == nil {
+		return nil
+	}
+	return vault.FilesEncryptionKey()
+}
+
+// instanceCipher returns the AEAD for the instance with the given domain: its
+// key is derived from the master key with HKDF.
+func instanceCipher(domain string, enc *Encryption) (cipher.AEAD, error) {
+	master := filesMasterKey()
+	if len(master) == 0 || enc.Algorithm != EncryptionAlgorithm || enc.SegmentSize <= 0 {
+		return nil, ErrEncryptionUnavailable
+	}
+	key := make([]byte, 32)
+	h := hkdf.New(sha256.New, master, nil, []byte("cozy-files:"+domain))
+	if _, err := io.ReadFull(h, key); err != nil {
+		return nil, err
+	}
+	return newSegmentCipher(key, enc)
+}
+
+func newSegmentCipher(key []byte, enc *Encryption) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(enc.Nonce) != aead.NonceSize() {
+		return nil, ErrEncryptionUnavailable
+	}
+	return aead, nil
+}
+
+// segmentNonce returns the nonce for the segment with the given index.
+func segmentNonce(base []byte, index int64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(uint64(index) >> (8 * uint(i)))
+	}
+	return nonce
+}
+
+// NewEncryptedWriter returns a writer that encrypts the content written to it
+// before writing it to w. The number of bytes returned by Write is the one of
+// the plaintext. Close must be called to write the last segment.
+func NewEncryptedWriter(w io.WriteCloser, domain string, enc *Encryption) (io.WriteCloser, error) {
+	aead, err := instanceCipher(domain, enc)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptedWriter(w, aead, enc), nil
+}
+
+func newEncryptedWriter(w io.WriteCloser, aead cipher.AEAD, enc *Encryption) *encryptedWriter {
+	return &encryptedWriter{
+		w:    w,
+		aead: aead,
+		enc:  enc,
+		buf:  make([]byte, 0, enc.SegmentSize),
+	}
+}
+
+type encryptedWriter struct {
+	w     io.WriteCloser
+	aead  cipher.AEAD
+	enc   *Encryption
+	buf   []byte // plaintext of the current segment
+	out   []byte // ciphertext of the current segment
+	index int64  // index of the current segment
+}
+
+func (e *encryptedWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		k := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+k]
+		p = p[k:]
+		if len(e.buf) == cap(e.buf) {
+			if err := e.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (e *encryptedWriter) flush() error {
+	e.out = e.aead.Seal(e.out[:0], segmentNonce(e.enc.Nonce, e.index), e.buf, nil)
+	if _, err := e.w.Write(e.out); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+func (e *encryptedWriter) Close() error {
+	if len(e.buf) > 0 {
+		if err := e.flush(); err != nil {
+			e.w.Close() // #nosec
+			return err
+		}
+	}
+	return e.w.Close()
+}
+
+// EncryptedReader is the interface of the storage for reading the encrypted
+// content of a file.
+type EncryptedReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// NewDecryptedFile returns a File for reading the content of a file, that is
+// stored encrypted in r. The size is the size of the plaintext.
+func NewDecryptedFile(r EncryptedReader, domain string, enc *Encryption, size int64) (File, error) {
+	aead, err := instanceCipher(domain, enc)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptedFile(r, aead, enc, size), nil
+}
+
+func newDecryptedFile(r EncryptedReader, aead cipher.AEAD, enc *Encryption, size int64) *decryptedFile {
+	return &decryptedFile{
+		r:     r,
+		aead:  aead,
+		enc:   enc,
+		size:  size,
+		index: -1,
+	}
+}
+
+// decryptedFile implements File for reading an encrypted content. The last
+// decrypted segment is kept in memory, for the sequential reads.
+type decryptedFile struct {
+	r    EncryptedReader
+	aead cipher.AEAD
+	enc  *Encryption
+	size int64 // size of the plaintext
+	off  int64 // offset in the plaintext for Read and Seek
+
+	mu    sync.Mutex
+	index int64  // index of the decrypted segment, -1 if none
+	plain []byte // plaintext of the decrypted segment
+	ct    []byte // buffer for the ciphertext
+}
+
+// segment returns the plaintext of the segment with the given index.
+func (f *decryptedFile) segment(index int64) ([]byte, error) {
+	if index == f.index {
+		return f.plain, nil
+	}
+	segSize := int64(f.enc.SegmentSize)
+	plainLen := f.size - index*segSize
+	if plainLen > segSize {
+		plainLen = segSize
+	}
+	overhead := int64(f.aead.Overhead())
+	ctLen := int(plainLen + overhead)
+	if cap(f.ct) < ctLen {
+		f.ct = make([]byte, ctLen)
+	}
+	ct := f.ct[:ctLen]
+	n, err := f.r.ReadAt(ct, index*(segSize+overhead))
+	if n < ctLen {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	plain, err := f.aead.Open(f.plain[:0], segmentNonce(f.enc.Nonce, index), ct, nil)
+	if err != nil {
+		f.index = -1
+		return nil, err
+	}
+	f.index = index
+	f.plain = plain
+	return plain, nil
+}
+
+func (f *decryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	segSize := int64(f.enc.SegmentSize)
+	n := 0
+	for n < len(p) {
+		if off >= f.size {
+			return n, io.EOF
+		}
+		index := off / segSize
+		plain, err := f.segment(index)
+		if err != nil {
+			return n, err
+		}
+		k := copy(p[n:], plain[off-index*segSize:])
+		n += k
+		off += int64(k)
+	}
+	return n, nil
+}
+
+func (f *decryptedFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *decryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *decryptedFile) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *decryptedFile) Close() error {
+	return f.r.Close()
+}
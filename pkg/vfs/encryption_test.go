@@ -0,0 +1,83 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+type memBlob struct {
+	bytes.Buffer
+}
+
+func (b *memBlob) Close() error { return nil }
+
+type memReaderAt struct {
+	*bytes.Reader
+}
+
+func (r memReaderAt) Close() error { return nil }
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	key := crypto.GenerateRandomBytes(32)
+	enc := &Encryption{
+		Algorithm:   EncryptionAlgorithm,
+		Nonce:       crypto.GenerateRandomBytes(12),
+		SegmentSize: 16,
+	}
+	aead, err := newSegmentCipher(key, enc)
+	assert.NoError(t, err)
+
+	plain := crypto.GenerateRandomBytes(100)
+
+	blob := &memBlob{}
+	w := newEncryptedWriter(blob, aead, enc)
+	n, err := w.Write(plain[:10])
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	n, err = w.Write(plain[10:])
+	assert.NoError(t, err)
+	assert.Equal(t, 90, n)
+	assert.NoError(t, w.Close())
+	stored := blob.Bytes()
+	assert.Equal(t, 100+7*aead.Overhead(), len(stored))
+	assert.False(t, bytes.Contains(stored, plain[:16]))
+
+	f := newDecryptedFile(memReaderAt{bytes.NewReader(stored)}, aead, enc, 100)
+	content, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, plain, content)
+
+	buf := make([]byte, 20)
+	n, err = f.ReadAt(buf, 30)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, n)
+	assert.Equal(t, plain[30:50], buf)
+
+	n, err = f.ReadAt(buf, 90)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, plain[90:], buf[:n])
+
+	pos, err := f.Seek(-5, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 95, pos)
+	content, err = ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, plain[95:], content)
+
+	tampered := make([]byte, len(stored))
+	copy(tampered, stored)
+	tampered[40] ^= 0x01
+	f = newDecryptedFile(memReaderAt{bytes.NewReader(tampered)}, aead, enc, 100)
+	_, err = ioutil.ReadAll(f)
+	assert.Error(t, err)
+
+	f = newDecryptedFile(memReaderAt{bytes.NewReader(stored[:50])}, aead, enc, 100)
+	_, err = ioutil.ReadAll(f)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
@@ -1,6 +1,9 @@
 package vfs
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrParentDoesNotExist is used when the parent directory does not
@@ -11,15 +14,30 @@ var (
 	ErrForbiddenDocMove = errors.New("Forbidden document move")
 	// ErrIllegalFilename is used when the given filename is not allowed
 	ErrIllegalFilename = errors.New("Invalid filename: empty or contains an illegal character")
+	// ErrFilenameTooLong is used when the given filename is longer than the
+	// maximal length allowed
+	ErrFilenameTooLong = errors.New("Invalid filename: too long")
+	// ErrMaxDepthExceeded is used when a directory would be deeper in the tree
+	// than the maximal depth allowed
+	ErrMaxDepthExceeded = errors.New("The directory would exceed the maximal depth")
+	// ErrForbiddenMimeType is used when the type of an uploaded file is not
+	// allowed by the upload policy of the instance
+	ErrForbiddenMimeType = errors.New("This type of file is not allowed")
 	// ErrIllegalTime is used when a time given (creation or
 	// modification) is not allowed
 	ErrIllegalTime = errors.New("Invalid time given")
 	// ErrInvalidHash is used when the given hash does not match the
 	// calculated one
 	ErrInvalidHash = errors.New("Invalid hash")
+	// ErrUnknownHashAlgo is used when looking for the files by their hash
+	// with an algorithm that is not supported
+	ErrUnknownHashAlgo = errors.New("Unknown hash algorithm")
 	// ErrContentLengthMismatch is used when the content-length does not
 	// match the calculated one
 	ErrContentLengthMismatch = errors.New("Content length does not match")
+	// ErrTrashReasonTooLong is used when the note given to explain why a
+	// file or directory is put in the trash is too long
+	ErrTrashReasonTooLong = errors.New("The reason for the trash is too long")
 	// ErrConflict is used when the access to a file or directory is in
 	// conflict with another
 	ErrConflict = errors.New("Conflict access to same file or directory")
@@ -33,6 +51,8 @@ var (
 	// ErrNonAbsolutePath is used when the given path is not absolute
 	// while it is required to be
 	ErrNonAbsolutePath = errors.New("Path should be absolute")
+	// ErrPathTraversal is used when the given path has a ".." segment
+	ErrPathTraversal = errors.New("Path should not contain ..")
 	// ErrDirNotEmpty is used to inform that the directory is not
 	// empty
 	ErrDirNotEmpty = errors.New("Directory is not empty")
@@ -40,4 +60,44 @@ var (
 	ErrWrongCouchdbState = errors.New("Wrong couchdb reduce value")
 	// ErrFileTooBig is used when there is no more space left on the filesystem
 	ErrFileTooBig = errors.New("The file is too big and exceeds the disk quota")
+	// ErrUploadTooBig is used when a file is larger than the maximal size of
+	// an upload, set in the config
+	ErrUploadTooBig = errors.New("The file exceeds the maximal size of an upload")
+	// ErrInvalidRange is used when a range of a file can't be written, as it
+	// starts after the end of the file
+	ErrInvalidRange = errors.New("Invalid range for the content of the file")
+	// ErrUnknownRevision is used when a revision is neither the current
+	// revision of a file, nor one of its conflicts
+	ErrUnknownRevision = errors.New("Unknown revision for this file")
+	// ErrConflictContent is used when a conflicting revision of a file can't
+	// be chosen, as its content is not stored anymore
+	ErrConflictContent = errors.New("The content of this revision is not available")
+	// ErrFileLocked is used when a file can't be modified, as it is locked by
+	// another client
+	ErrFileLocked = errors.New("The file is locked by another client")
+	// ErrIdempotencyKeyInUse is used when a request is sent with the same
+	// idempotency key as a request that is still running
+	ErrIdempotencyKeyInUse = errors.New("A request with the same idempotency key is in progress")
+	// ErrOutsideSubtree is used when an operation on a subtree of the VFS
+	// targets a document outside of it
+	ErrOutsideSubtree = errors.New("The document is outside of the allowed directory")
 )
+
+// TrashFailure describes a file inside a trashed directory that has not been
+// marked as trashed.
+type TrashFailure struct {
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// PartialTrashError is used when a directory has been put in the trash, but
+// some files inside it have not been marked as trashed.
+type PartialTrashError struct {
+	Trashed  []string       `json:"trashed"`
+	Failures []TrashFailure `json:"failures"`
+}
+
+func (e *PartialTrashError) Error() string {
+	return fmt.Sprintf("%d files have not been trashed", len(e.Failures))
+}
@@ -1,17 +1,22 @@
 package vfs
 
 import (
+	"bytes"
 	// #nosec
 	"encoding/base64"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/utils"
 )
 
 // FileDoc is a struct containing all the informations about a file.
@@ -45,6 +50,35 @@ type FileDoc struct {
 
 	ReferencedBy []couchdb.DocReference `json:"referenced_by,omitempty"`
 
+	// Key of the shared content of the file, when the deduplication is enabled
+	Blob string `json:"blob,omitempty"`
+
+	// SHA256Sum is the sha256 of the content. It is computed when the content
+	// is written, and missing for the files uploaded before it was added.
+	SHA256Sum []byte `json:"sha256sum,omitempty"`
+
+	// Corrupted is set when a verification has found that the content does
+	// not match the md5sum
+	Corrupted bool `json:"corrupted,omitempty"`
+
+	// Starred is set when the user has pinned the file in its favorites
+	Starred bool `json:"starred,omitempty"`
+
+	// InheritedTags are the tags that have been added to the file from its
+	// parent directory (see DirDoc.InheritTags). They are also in Tags.
+	InheritedTags []string `json:"inherited_tags,omitempty"`
+
+	// TrashedAt is the date when the file has been put in the trash
+	TrashedAt *time.Time `json:"trashed_at,omitempty"`
+
+	// TrashReason is a short note given when the file has been put in the
+	// trash, to explain why
+	TrashReason string `json:"trash_reason,omitempty"`
+
+	// Encryption has the parameters used to encrypt the content of the file,
+	// when the encryption at rest is enabled (the key is not stored here)
+	Encryption *Encryption `json:"encryption,omitempty"`
+
 	// Cache of the fullpath of the file. Should not have to be invalidated
 	// since we use FileDoc as immutable data-structures.
 	fullpath string
@@ -67,14 +101,29 @@ func (f *FileDoc) Clone() couchdb.Doc {
 	cloned := *f
 	cloned.MD5Sum = make([]byte, len(f.MD5Sum))
 	copy(cloned.MD5Sum, f.MD5Sum)
+	if f.SHA256Sum != nil {
+		cloned.SHA256Sum = make([]byte, len(f.SHA256Sum))
+		copy(cloned.SHA256Sum, f.SHA256Sum)
+	}
 	cloned.Tags = make([]string, len(f.Tags))
 	copy(cloned.Tags, f.Tags)
+	if f.InheritedTags != nil {
+		cloned.InheritedTags = make([]string, len(f.InheritedTags))
+		copy(cloned.InheritedTags, f.InheritedTags)
+	}
 	cloned.ReferencedBy = make([]couchdb.DocReference, len(f.ReferencedBy))
 	copy(cloned.ReferencedBy, f.ReferencedBy)
 	cloned.Metadata = make(Metadata, len(f.Metadata))
 	for k, v := range f.Metadata {
 		cloned.Metadata[k] = v
 	}
+	if f.TrashedAt != nil {
+		trashedAt := *f.TrashedAt
+		cloned.TrashedAt = &trashedAt
+	}
+	if f.Encryption != nil {
+		cloned.Encryption = f.Encryption.Clone()
+	}
 	return &cloned
 }
 
@@ -165,8 +214,10 @@ func (f *FileDoc) RemoveReferencedBy(ri ...couchdb.DocReference) {
 	f.ReferencedBy = referenced
 }
 
-// NewFileDoc is the FileDoc constructor. The given name is validated.
+// NewFileDoc is the FileDoc constructor. The given name is normalized and
+// validated.
 func NewFileDoc(name, dirID string, size int64, md5Sum []byte, mime, class string, cdate time.Time, executable, trashed bool, tags []string) (*FileDoc, error) {
+	name = normalizeFileName(name)
 	if err := checkFileName(name); err != nil {
 		return nil, err
 	}
@@ -201,8 +252,10 @@ func NewFileDoc(name, dirID string, size int64, md5Sum []byte, mime, class strin
 //
 // It uses internally http.ServeContent and benefits from it by
 // offering support to Range, If-Modified-Since and If-None-Match
-// requests. It uses the revision of the file as the Etag value for
-// non-ranged requests
+// requests. It uses the md5sum of the content as the Etag value (see
+// ContentETag). The compressible files can be served gzipped, if the client
+// accepts it. HEAD requests are answered with the metadata of the file,
+// without reading its content.
 //
 // The content disposition is inlined.
 func ServeFileContent(fs VFS, doc *FileDoc, disposition string, req *http.Request, w http.ResponseWriter) error {
@@ -212,9 +265,55 @@ func ServeFileContent(fs VFS, doc *FileDoc, disposition string, req *http.Reques
 		header.Set("Content-Disposition", ContentDisposition(disposition, doc.DocName))
 	}
 
-	if header.Get("Range") == "" {
-		eTag := base64.StdEncoding.EncodeToString(doc.MD5Sum)
-		header.Set("Etag", fmt.Sprintf(`"%s"`, eTag))
+	// The disposition can have been set by the caller. Without the header,
+	// the browser displays the file inline.
+	inline := !strings.HasPrefix(header.Get("Content-Disposition"), "attachment")
+	if inline && isUnsafeInline(doc) {
+		csp := "sandbox"
+		if policy := header.Get("Content-Security-Policy"); policy != "" {
+			csp = policy + "; " + csp
+		}
+		header.Set("Content-Security-Policy", csp)
+	}
+
+	header.Set("Etag", ContentETag(doc))
+
+	// The compressible files are served gzipped (or deflated) when the client
+	// accepts it, except for the ranged requests that are always answered on
+	// the identity representation. A HEAD request gets the same headers as
+	// the GET one.
+	compressible := isCompressible(doc)
+	if compressible {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	isGetOrHead := req.Method == http.MethodGet || req.Method == http.MethodHead
+	if compressible && isGetOrHead && req.Header.Get("Range") == "" {
+		if encoding := acceptedEncoding(req); encoding != "" {
+			return serveCompressedContent(fs, doc, encoding, req, w)
+		}
+	}
+
+	// For a HEAD request, the headers can be computed from the metadata,
+	// without opening the content of the file.
+	if req.Method == http.MethodHead {
+		if !doc.UpdatedAt.IsZero() {
+			header.Set("Last-Modified", doc.UpdatedAt.UTC().Format(http.TimeFormat))
+		}
+		// A conditional HEAD is the cheapest freshness check for the caches
+		// and download managers: if they already have the current content,
+		// a 304 is sent without the headers of the representation.
+		if utils.CheckPreconditions(w, req, ContentETag(doc)) {
+			return nil
+		}
+		if notModifiedSince(req, doc) {
+			header.Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+		header.Set("Accept-Ranges", "bytes")
+		header.Set("Content-Length", strconv.FormatInt(doc.ByteSize, 10))
+		w.WriteHeader(http.StatusOK)
+		return nil
 	}
 
 	content, err := fs.OpenFile(doc)
@@ -223,12 +322,90 @@ func ServeFileContent(fs VFS, doc *FileDoc, disposition string, req *http.Reques
 	}
 	defer content.Close()
 
-	http.ServeContent(w, req, doc.DocName, doc.UpdatedAt, content)
+	ServeContent(w, req, doc.DocName, doc.UpdatedAt, "", content)
 	return nil
 }
 
+// notModifiedSince returns true if the If-Modified-Since header of the
+// request is not before the last modification of the file. Like for
+// http.ServeContent, the header is ignored when an If-None-Match is present.
+func notModifiedSince(req *http.Request, doc *FileDoc) bool {
+	if req.Header.Get("If-None-Match") != "" || doc.UpdatedAt.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// The dates in the HTTP headers have only a precision of one second
+	return !doc.UpdatedAt.Truncate(time.Second).After(since)
+}
+
+// isUnsafeInline returns true if the file has a class or mime type listed in
+// the unsafe inline types of the config, ie it can run scripts in a browser.
+func isUnsafeInline(doc *FileDoc) bool {
+	mime := strings.TrimSpace(strings.SplitN(doc.Mime, ";", 2)[0])
+	for _, entry := range config.GetConfig().Fs.UnsafeInlineTypes {
+		if matchPolicyEntry(entry, mime, doc.Class) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasThumbnails returns true if thumbnails are generated for the file: for
+// the images, and for the PDFs (with a preview of their first page).
+func HasThumbnails(doc *FileDoc) bool {
+	return doc.Class == "image" || doc.Class == "pdf"
+}
+
+// ContentETag returns the strong ETag for the content of a file. It is
+// derived only from the md5sum stored in the document, and not from a state
+// of the process, so it stays the same after a restart of the stack, and
+// between the stack instances.
+func ContentETag(doc *FileDoc) string {
+	return fmt.Sprintf(`"%s"`, base64.StdEncoding.EncodeToString(doc.MD5Sum))
+}
+
+// RevETag returns the strong ETag for the metadata of a file or directory. It
+// is the CouchDB revision of the document.
+func RevETag(rev string) string {
+	return fmt.Sprintf(`"%s"`, rev)
+}
+
+// ServeContent replies to a http request with a seekable content, with the
+// support of Range requests. It is used for all the binary contents that are
+// stored (files, thumbnails), so that they have the same behavior. If the
+// etag is not empty, it is used for the Etag header.
+func ServeContent(w http.ResponseWriter, req *http.Request, name string, modtime time.Time, etag string, content io.ReadSeeker) {
+	header := w.Header()
+	if etag != "" {
+		header.Set("Etag", fmt.Sprintf(`"%s"`, etag))
+	}
+	header.Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, req, name, modtime, content)
+}
+
+// InheritTags adds the tags of the directory to the file, if the directory
+// has the InheritTags flag. The tags that were not already on the file are
+// also listed in InheritedTags, so that the clients can know where they come
+// from.
+func InheritTags(doc *FileDoc, dir *DirDoc) {
+	if !dir.InheritTags {
+		return
+	}
+	for _, tag := range dir.Tags {
+		if utils.IsInArray(tag, doc.Tags) {
+			continue
+		}
+		doc.Tags = append(doc.Tags, tag)
+		doc.InheritedTags = append(doc.InheritedTags, tag)
+	}
+}
+
 // ModifyFileMetadata modify the metadata associated to a file. It can
-// be used to rename or move the file in the VFS.
+// be used to rename or move the file in the VFS. When both the name and the
+// parent are changed, they are applied in a single update of the document.
 func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, error) {
 	var err error
 	rename := patch.Name != nil
@@ -245,10 +422,14 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 		Tags:        &olddoc.Tags,
 		UpdatedAt:   &olddoc.UpdatedAt,
 		Executable:  &olddoc.Executable,
+		Starred:     &olddoc.Starred,
 	}, patch, cdate)
 	if err != nil {
 		return nil, err
 	}
+	if *patch.Starred && !olddoc.Starred && trashed {
+		return nil, ErrFileInTrash
+	}
 
 	// in case of a renaming of the file, if the extension of the file has
 	// changed, we consider recalculating the mime and class attributes, using
@@ -282,6 +463,24 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 	newdoc.UpdatedAt = *patch.UpdatedAt
 	newdoc.Metadata = olddoc.Metadata
 	newdoc.ReferencedBy = olddoc.ReferencedBy
+	newdoc.Blob = olddoc.Blob
+	newdoc.SHA256Sum = olddoc.SHA256Sum
+	newdoc.Encryption = olddoc.Encryption
+	newdoc.Corrupted = olddoc.Corrupted
+	newdoc.Starred = *patch.Starred
+	newdoc.InheritedTags = olddoc.InheritedTags
+	if trashed {
+		newdoc.TrashedAt = olddoc.TrashedAt
+		newdoc.TrashReason = olddoc.TrashReason
+	}
+
+	if newdoc.DirID != olddoc.DirID {
+		parent, err := fs.DirByID(newdoc.DirID)
+		if err != nil {
+			return nil, err
+		}
+		InheritTags(newdoc, parent)
+	}
 
 	if patch.MD5Sum != nil {
 		newdoc.MD5Sum = *patch.MD5Sum
@@ -293,8 +492,170 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 	return newdoc, nil
 }
 
+// ModifyFileMetadataWithRetry is like ModifyFileMetadata, but when the update
+// fails because of a conflict in CouchDB, the last revision of the file is
+// fetched and the patch is applied again on it.
+func ModifyFileMetadataWithRetry(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, error) {
+	for i := 0; ; i++ {
+		p := *patch
+		newdoc, err := ModifyFileMetadata(fs, olddoc, &p)
+		if err == nil || !couchdb.IsConflictError(err) || i >= maxConflictRetries {
+			return newdoc, err
+		}
+		olddoc, err = fs.FileByID(olddoc.ID())
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// WriteFileRange writes the given content in an existing file, starting at
+// the start offset. When length is negative, the content is appended: start
+// must be the current size of the file. Else, the region of length bytes is
+// overwritten, and the file can grow if this region goes beyond its end. It
+// returns the new document of the file, with its new size and md5sum.
+//
+// The VFS has no support for partial writes, so the content is rewritten on
+// the storage, but the client only sends the bytes that have changed.
+func WriteFileRange(fs VFS, olddoc *FileDoc, start, length int64, body io.Reader) (newdoc *FileDoc, err error) {
+	size := olddoc.ByteSize
+	if start < 0 || start > size || (length < 0 && start != size) {
+		return nil, ErrInvalidRange
+	}
+
+	newdoc = olddoc.Clone().(*FileDoc)
+	newdoc.MD5Sum = nil
+	newdoc.SHA256Sum = nil
+	newdoc.Metadata = nil
+	newdoc.Corrupted = false
+	newdoc.UpdatedAt = time.Now()
+	newdoc.ByteSize = -1
+	if length >= 0 {
+		newdoc.ByteSize = size
+		if end := start + length; end > size {
+			newdoc.ByteSize = end
+		}
+	}
+
+	content, err := fs.OpenFile(olddoc)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if err != nil {
+			newdoc = nil
+		}
+	}()
+
+	if _, err = io.CopyN(file, content, start); err != nil {
+		return
+	}
+	if length < 0 {
+		_, err = io.Copy(file, body)
+		return
+	}
+	var n int64
+	if n, err = io.CopyN(file, body, length); err != nil {
+		if err == io.EOF || n != length {
+			err = ErrContentLengthMismatch
+		}
+		return
+	}
+	if start+length < size {
+		if _, err = content.Seek(start+length, io.SeekStart); err != nil {
+			return
+		}
+		_, err = io.Copy(file, content)
+	}
+	return
+}
+
+// MaxTouchSkew is how far in the future the modification date of a file can
+// be set with TouchFile, to tolerate the clock skew between the clients and
+// the server.
+const MaxTouchSkew = 5 * time.Minute
+
+// TouchFile changes the modification date of a file, without touching its
+// content or its other attributes. When date is nil, the current time is
+// used.
+func TouchFile(fs VFS, olddoc *FileDoc, date *time.Time) (*FileDoc, error) {
+	now := time.Now()
+	updatedAt := now
+	if date != nil {
+		updatedAt = *date
+	}
+	if updatedAt.Before(olddoc.CreatedAt) || updatedAt.After(now.Add(MaxTouchSkew)) {
+		return nil, ErrIllegalTime
+	}
+	newdoc := olddoc.Clone().(*FileDoc)
+	newdoc.UpdatedAt = updatedAt
+	if err := fs.UpdateFileDoc(olddoc, newdoc); err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+// ResolveFileConflict keeps the given revision of a file, and deletes the
+// other revisions that are in conflict with it. Only the content of the
+// current revision is stored, so a conflicting revision can be chosen only if
+// it has the same content: its other attributes (name, directory, tags, etc.)
+// are then applied to the file.
+func ResolveFileConflict(fs VFS, doc *FileDoc, rev string) (*FileDoc, error) {
+	conflicts, err := fs.FileConflicts(doc)
+	if err != nil {
+		return nil, err
+	}
+	revs := make([]string, len(conflicts))
+	var winner *FileDoc
+	for i, conflict := range conflicts {
+		revs[i] = conflict.Rev()
+		if conflict.Rev() == rev {
+			winner = conflict
+		}
+	}
+
+	newdoc := doc
+	if rev != doc.Rev() {
+		if winner == nil {
+			return nil, ErrUnknownRevision
+		}
+		if !bytes.Equal(winner.MD5Sum, doc.MD5Sum) {
+			return nil, ErrConflictContent
+		}
+		newdoc = winner.Clone().(*FileDoc)
+		newdoc.SetRev(doc.Rev())
+		newdoc.ResetFullpath()
+		if err = fs.UpdateFileDoc(doc, newdoc); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = fs.DeleteFileConflicts(newdoc, revs); err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
 // TrashFile is used to delete a file given its document
 func TrashFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
+	return TrashFileWithReason(fs, olddoc, "")
+}
+
+// TrashFileWithReason is like TrashFile, but it keeps a short note with the
+// reason why the file has been put in the trash (see CheckTrashReason).
+func TrashFileWithReason(fs VFS, olddoc *FileDoc, reason string) (*FileDoc, error) {
+	if err := CheckTrashReason(reason); err != nil {
+		return nil, err
+	}
 	oldpath, err := olddoc.Path(fs)
 	if err != nil {
 		return nil, err
@@ -306,6 +667,7 @@ func TrashFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 
 	trashDirID := consts.TrashDirID
 	restorePath := path.Dir(oldpath)
+	trashedAt := time.Now()
 
 	var newdoc *FileDoc
 	err = tryOrUseSuffix(olddoc.DocName, conflictFormat, func(name string) error {
@@ -314,14 +676,23 @@ func TrashFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 		newdoc.RestorePath = restorePath
 		newdoc.DocName = name
 		newdoc.Trashed = true
+		newdoc.Starred = false
+		newdoc.TrashedAt = &trashedAt
+		newdoc.TrashReason = reason
 		newdoc.fullpath = path.Join(TrashDirName, name)
 		return fs.UpdateFileDoc(olddoc, newdoc)
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return newdoc, err
+	evictTrashAfter(fs, newdoc.ID())
+	return newdoc, nil
 }
 
-// RestoreFile is used to restore a trashed file given its document
+// RestoreFile is used to restore a trashed file given its document. If the
+// name is already taken in the restore directory, a number is added to it
+// (see UniqueName).
 func RestoreFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 	oldpath, err := olddoc.Path(fs)
 	if err != nil {
@@ -336,12 +707,14 @@ func RestoreFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 	name := stripSuffix(olddoc.DocName, conflictSuffix)
 
 	var newdoc *FileDoc
-	err = tryOrUseSuffix(name, "%s (%s)", func(name string) error {
+	err = tryOrUseUniqueName(fs, restoreDir.DocID, name, func(name string) error {
 		newdoc = olddoc.Clone().(*FileDoc)
 		newdoc.DirID = restoreDir.DocID
 		newdoc.RestorePath = ""
 		newdoc.DocName = name
 		newdoc.Trashed = false
+		newdoc.TrashedAt = nil
+		newdoc.TrashReason = ""
 		newdoc.fullpath = path.Join(restoreDir.Fullpath, name)
 		return fs.UpdateFileDoc(olddoc, newdoc)
 	})
@@ -0,0 +1,78 @@
+package vfs
+
+import (
+	"time"
+)
+
+// DefaultLockTTL is the duration of a lock on a file when the client has not
+// asked for a specific one.
+const DefaultLockTTL = 5 * time.Minute
+
+// MaxLockTTL is the maximal duration of a lock on a file. A client that edits
+// a file for a longer time must renew its lock.
+const MaxLockTTL = 1 * time.Hour
+
+// FileLock is an advisory lock on a file, taken by a client that edits it,
+// like a collaborative editor. It is kept in the same store as the downloads,
+// and it expires automatically, so that a client that has crashed can't block
+// the file forever.
+type FileLock struct {
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LockFile takes the lock on the file with the given ID for the given owner,
+// or renews it if the owner already holds it. If the lock is held by another
+// owner, this lock is returned with ErrFileLocked.
+func LockFile(domain, fileID, owner string, ttl time.Duration) (*FileLock, error) {
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	} else if ttl > MaxLockTTL {
+		ttl = MaxLockTTL
+	}
+	lock := &FileLock{
+		Owner:     owner,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	}
+	held, err := GetStore().AcquireLock(domain, fileID, lock)
+	if err != nil {
+		return nil, err
+	}
+	if held.Owner != owner {
+		return held, ErrFileLocked
+	}
+	return held, nil
+}
+
+// UnlockFile releases the lock on the file with the given ID. It is not an
+// error if the file is not locked, but ErrFileLocked is returned if the lock
+// is held by another owner.
+func UnlockFile(domain, fileID, owner string) error {
+	held, err := GetStore().ReleaseLock(domain, fileID, owner)
+	if err != nil {
+		return err
+	}
+	if held != nil {
+		return ErrFileLocked
+	}
+	return nil
+}
+
+// GetFileLock returns the lock on the file with the given ID, or nil if the
+// file is not locked.
+func GetFileLock(domain, fileID string) (*FileLock, error) {
+	return GetStore().GetLock(domain, fileID)
+}
+
+// CheckFileLock returns ErrFileLocked if the file with the given ID is locked
+// by another owner than the given one.
+func CheckFileLock(domain, fileID, owner string) error {
+	lock, err := GetFileLock(domain, fileID)
+	if err != nil {
+		return err
+	}
+	if lock != nil && lock.Owner != owner {
+		return ErrFileLocked
+	}
+	return nil
+}
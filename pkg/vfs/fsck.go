@@ -31,6 +31,9 @@ const (
 	// ContentMismatch is used when a document content checksum does not match
 	// with the one in the underlying fs.
 	ContentMismatch
+	// ContentCorrupted is used when a verification has found that the content
+	// of a file does not match its checksum.
+	ContentCorrupted
 )
 
 // FsckLog is a struct for an inconsistency in the VFS
@@ -73,6 +76,8 @@ func (f *FsckLog) String() string {
 		return "the document is present on the local filesystem but not in the index"
 	case ContentMismatch:
 		return "then document content does not match the store content checksum"
+	case ContentCorrupted:
+		return "the file content has been flagged as corrupted by a verification"
 	}
 	panic("bad FsckLog type")
 }
@@ -190,6 +195,8 @@ func FsckPrune(fs VFS, indexer Indexer, entry *FsckLog, dryrun bool) {
 		if err := indexer.CreateFileDoc(fileDoc); err != nil {
 			entry.PruneError = err
 		}
+	case ContentCorrupted:
+		entry.PruneAction = "no action: requires manual inspection"
 	case ContentMismatch:
 		if !entry.IsFile {
 			return
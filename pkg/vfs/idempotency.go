@@ -0,0 +1,47 @@
+package vfs
+
+import (
+	"time"
+)
+
+// idempotencyKeyTTL is the time an idempotency key is remembered after the
+// creation of the document.
+var idempotencyKeyTTL = 24 * time.Hour
+
+// idempotencyPendingTTL is the time an idempotency key is reserved for a
+// request that has not finished, in case the stack is stopped in the middle
+// of it.
+var idempotencyPendingTTL = 1 * time.Hour
+
+// idempotencyPending is the value stored for an idempotency key while the
+// request is running.
+const idempotencyPending = "-"
+
+// ReserveIdempotencyKey is used at the beginning of a request with an
+// idempotency key. If the key has already been used for a document, its ID is
+// returned and the request should not be done again. If a request with the
+// same key is still running, ErrIdempotencyKeyInUse is returned. Else, the key
+// is reserved for this request, and an empty string is returned: the caller
+// must call SaveIdempotencyKey or ReleaseIdempotencyKey when the request ends.
+func ReserveIdempotencyKey(domain, key string) (string, error) {
+	docID, err := GetStore().ReserveIdempotencyKey(domain, key)
+	if err != nil {
+		return "", err
+	}
+	if docID == idempotencyPending {
+		return "", ErrIdempotencyKeyInUse
+	}
+	return docID, nil
+}
+
+// SaveIdempotencyKey records the ID of the document created by a request with
+// an idempotency key.
+func SaveIdempotencyKey(domain, key, docID string) error {
+	return GetStore().SaveIdempotencyKey(domain, key, docID)
+}
+
+// ReleaseIdempotencyKey removes the reservation of an idempotency key, when
+// the request has failed, so that it can be retried with the same key.
+func ReleaseIdempotencyKey(domain, key string) error {
+	return GetStore().ReleaseIdempotencyKey(domain, key)
+}
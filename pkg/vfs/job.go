@@ -0,0 +1,110 @@
+package vfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/logger"
+)
+
+// JobState is the state of an asynchronous operation on the VFS
+type JobState string
+
+const (
+	// JobPending is the state of a job that has not been started yet
+	JobPending JobState = "pending"
+	// JobRunning is the state of a job currently running
+	JobRunning JobState = "running"
+	// JobDone is the state of a job that has finished with success
+	JobDone JobState = "done"
+	// JobErrored is the state of a job that has failed
+	JobErrored JobState = "error"
+)
+
+// Job is a lightweight record used to track the status of a long operation
+// on the VFS (recursive trash, fsck, archive build, etc.). It is kept in the
+// same store as the downloads, for the instance, and expires after some time.
+// Its owner identifies the permission that has started it: only this
+// permission can read its status.
+type Job struct {
+	ID        string      `json:"-"`
+	Owner     string      `json:"owner,omitempty"`
+	Operation string      `json:"operation"`
+	State     JobState    `json:"state"`
+	Progress  int         `json:"progress"`
+	Error     string      `json:"error,omitempty"`
+	Result    interface{} `json:"result,omitempty"`
+	Related   string      `json:"related,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// JobFunc is the function executed by a job. It can report its progress, in
+// percent, with the given callback, and it returns the result and the link
+// to the related resource to save in the job record when it is done.
+type JobFunc func(progress func(percent int)) (result interface{}, related string, err error)
+
+// StartJob saves a new job record for the given operation and owner, and
+// runs fn in the background. The returned job is the pending record, and its
+// ID can be used to fetch the status of the job from the store later.
+func StartJob(domain, owner, operation string, fn JobFunc) (*Job, error) {
+	store := GetStore()
+	now := time.Now().UTC()
+	job := Job{
+		ID:        makeSecret(),
+		Owner:     owner,
+		Operation: operation,
+		State:     JobPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := store.SaveJob(domain, &job); err != nil {
+		return nil, err
+	}
+	pending := job
+	go runJob(store, domain, job, fn)
+	return &pending, nil
+}
+
+func runJob(store DownloadStore, domain string, job Job, fn JobFunc) {
+	log := logger.WithDomain(domain).WithField("nspace", "vfs")
+	save := func() {
+		job.UpdatedAt = time.Now().UTC()
+		if err := store.SaveJob(domain, &job); err != nil {
+			log.Errorf("Cannot save the job %s: %s", job.ID, err)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			job.State = JobErrored
+			job.Error = fmt.Sprintf("%v", r)
+			save()
+		}
+	}()
+
+	job.State = JobRunning
+	save()
+
+	progress := func(percent int) {
+		if percent < 0 {
+			percent = 0
+		} else if percent > 100 {
+			percent = 100
+		}
+		job.Progress = percent
+		save()
+	}
+
+	result, related, err := fn(progress)
+	if err != nil {
+		job.State = JobErrored
+		job.Error = err.Error()
+	} else {
+		job.State = JobDone
+		job.Progress = 100
+	}
+	job.Result = result
+	job.Related = related
+	save()
+}
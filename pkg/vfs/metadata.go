@@ -2,9 +2,12 @@ package vfs
 
 import (
 	"bytes"
+	"fmt"
 	"image"
 	"io"
 	"io/ioutil"
+	"strconv"
+	"strings"
 	"time"
 
 	// Packages image/... are not used explicitly in the code below,
@@ -304,3 +307,109 @@ func (e *AudioExtractor) Result() Metadata {
 	}
 	return m
 }
+
+// ExifData is the EXIF metadata of an image, as read by ReadExif
+type ExifData struct {
+	DateTime     *time.Time         `json:"datetime,omitempty"`
+	Make         string             `json:"make,omitempty"`
+	Model        string             `json:"model,omitempty"`
+	LensModel    string             `json:"lens_model,omitempty"`
+	Width        int                `json:"width,omitempty"`
+	Height       int                `json:"height,omitempty"`
+	Orientation  int                `json:"orientation,omitempty"`
+	Flash        string             `json:"flash,omitempty"`
+	ExposureTime string             `json:"exposure_time,omitempty"`
+	FNumber      float64            `json:"f_number,omitempty"`
+	ISO          int                `json:"iso,omitempty"`
+	FocalLength  float64            `json:"focal_length,omitempty"`
+	GPS          map[string]float64 `json:"gps,omitempty"`
+}
+
+// ReadExif reads the EXIF metadata of an image. An image without EXIF
+// metadata gives an empty ExifData. The GPS coordinates are only included if
+// withGPS is true, as they can reveal where the user lives.
+func ReadExif(fs VFS, doc *FileDoc, withGPS bool) (*ExifData, error) {
+	f, err := fs.OpenFile(doc)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := &ExifData{}
+	x, err := exif.Decode(f)
+	if err != nil {
+		return data, nil
+	}
+
+	if dt, err := x.DateTime(); err == nil {
+		data.DateTime = &dt
+	}
+	data.Make = exifString(x, exif.Make)
+	data.Model = exifString(x, exif.Model)
+	data.LensModel = exifString(x, exif.LensModel)
+	data.Width = exifInt(x, exif.PixelXDimension)
+	data.Height = exifInt(x, exif.PixelYDimension)
+	data.Orientation = exifInt(x, exif.Orientation)
+	data.ISO = exifInt(x, exif.ISOSpeedRatings)
+	if flash, err := x.Flash(); err == nil {
+		data.Flash = flash
+	}
+	if num, den, ok := exifRat(x, exif.ExposureTime); ok {
+		if num < den && num > 0 && den%num == 0 {
+			data.ExposureTime = fmt.Sprintf("1/%d", den/num)
+		} else {
+			data.ExposureTime = strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+		}
+	}
+	if num, den, ok := exifRat(x, exif.FNumber); ok {
+		data.FNumber = float64(num) / float64(den)
+	}
+	if num, den, ok := exifRat(x, exif.FocalLength); ok {
+		data.FocalLength = float64(num) / float64(den)
+	}
+	if withGPS {
+		if lat, long, err := x.LatLong(); err == nil {
+			data.GPS = map[string]float64{
+				"lat":  lat,
+				"long": long,
+			}
+		}
+	}
+	return data, nil
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func exifInt(x *exif.Exif, name exif.FieldName) int {
+	tag, err := x.Get(name)
+	if err != nil || tag.Count == 0 {
+		return 0
+	}
+	i, err := tag.Int(0)
+	if err != nil {
+		return 0
+	}
+	return i
+}
+
+func exifRat(x *exif.Exif, name exif.FieldName) (num, den int64, ok bool) {
+	tag, err := x.Get(name)
+	if err != nil || tag.Count == 0 {
+		return 0, 0, false
+	}
+	num, den, err = tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0, 0, false
+	}
+	return num, den, true
+}
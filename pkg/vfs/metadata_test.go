@@ -1,6 +1,8 @@
 package vfs
 
 import (
+	"image"
+	"image/color"
 	"io"
 	"os"
 	"testing"
@@ -31,6 +33,39 @@ func TestImageMetadataExtractor(t *testing.T) {
 	assert.Equal(t, 140, h)
 }
 
+func TestPHash(t *testing.T) {
+	gradient := func(w, h int, inverted bool) image.Image {
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				v := uint8((x*255/w + y*255/h) / 2)
+				if (x*4/w+y*4/h)%2 == 0 {
+					v /= 2
+				}
+				if inverted {
+					v = 255 - v
+				}
+				img.SetGray(x, y, color.Gray{Y: v})
+			}
+		}
+		return img
+	}
+
+	small := FormatPHash(PHash(gradient(120, 80, false)))
+	large := FormatPHash(PHash(gradient(600, 400, false)))
+	other := FormatPHash(PHash(gradient(600, 400, true)))
+
+	d, err := PHashDistance(small, large)
+	assert.NoError(t, err)
+	assert.True(t, d <= 10, "images that look alike have close hashes")
+	d, err = PHashDistance(large, other)
+	assert.NoError(t, err)
+	assert.True(t, d > 20, "different images have distant hashes")
+
+	_, err = PHashDistance(small, "not-a-hash")
+	assert.Equal(t, ErrInvalidPHash, err)
+}
+
 func TestExifMetadataExtractor(t *testing.T) {
 	doc := &FileDoc{Mime: "image/jpeg"}
 	extractor := NewMetaExtractor(doc)
@@ -0,0 +1,151 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+// phashSize is the size of the grayscale square on which the DCT is applied
+const phashSize = 32
+
+// phashLowFreq is the size of the square of low frequencies kept in the hash
+const phashLowFreq = 8
+
+// phashSamples is the maximal number of samples per axis used to compute the
+// mean of a cell when the image is reduced to phashSize x phashSize
+const phashSamples = 8
+
+// ErrInvalidPHash is used when a perceptual hash can't be parsed
+var ErrInvalidPHash = errors.New("Invalid perceptual hash")
+
+// PHash computes the perceptual hash of an image: the image is reduced to a
+// small grayscale square, a DCT is applied on it, and the bits of the hash
+// tell if the low frequencies are above or below their median. Two images
+// that look alike have hashes with a small Hamming distance.
+func PHash(img image.Image) uint64 {
+	pixels := grayscaleSquare(img, phashSize)
+	freqs := dct2D(pixels, phashSize)
+
+	coeffs := make([]float64, 0, phashLowFreq*phashLowFreq)
+	for y := 0; y < phashLowFreq; y++ {
+		for x := 0; x < phashLowFreq; x++ {
+			coeffs = append(coeffs, freqs[y*phashSize+x])
+		}
+	}
+
+	// The first coefficient is the mean of the image and is ignored for the
+	// median, as it can be very different from the other coefficients
+	sorted := make([]float64, len(coeffs)-1)
+	copy(sorted, coeffs[1:])
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// FormatPHash returns the representation of a perceptual hash that is saved
+// in the metadata of a file.
+func FormatPHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// PHashDistance returns the Hamming distance between two perceptual hashes,
+// as formatted by FormatPHash.
+func PHashDistance(a, b string) (int, error) {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, ErrInvalidPHash
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return 0, ErrInvalidPHash
+	}
+	return bits.OnesCount64(x ^ y), nil
+}
+
+// grayscaleSquare reduces the image to a square of size x size gray levels.
+// Each cell is the mean of some pixels sampled inside it.
+func grayscaleSquare(img image.Image, size int) []float64 {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	pixels := make([]float64, size*size)
+	if w == 0 || h == 0 {
+		return pixels
+	}
+	for cy := 0; cy < size; cy++ {
+		y0, y1 := cy*h/size, (cy+1)*h/size
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for cx := 0; cx < size; cx++ {
+			x0, x1 := cx*w/size, (cx+1)*w/size
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum float64
+			var n int
+			for y := y0; y < y1; y += stepFor(y1 - y0) {
+				for x := x0; x < x1; x += stepFor(x1 - x0) {
+					g := color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray)
+					sum += float64(g.Y)
+					n++
+				}
+			}
+			pixels[cy*size+cx] = sum / float64(n)
+		}
+	}
+	return pixels
+}
+
+func stepFor(length int) int {
+	step := length / phashSamples
+	if step < 1 {
+		step = 1
+	}
+	return step
+}
+
+// dct2D applies a type-II discrete cosine transform on a square matrix
+func dct2D(pixels []float64, size int) []float64 {
+	cosines := make([]float64, size*size)
+	for k := 0; k < size; k++ {
+		for n := 0; n < size; n++ {
+			cosines[k*size+n] = math.Cos(math.Pi / float64(size) * (float64(n) + 0.5) * float64(k))
+		}
+	}
+
+	rows := make([]float64, size*size)
+	for y := 0; y < size; y++ {
+		for k := 0; k < size; k++ {
+			var sum float64
+			for n := 0; n < size; n++ {
+				sum += pixels[y*size+n] * cosines[k*size+n]
+			}
+			rows[y*size+k] = sum
+		}
+	}
+
+	freqs := make([]float64, size*size)
+	for x := 0; x < size; x++ {
+		for k := 0; k < size; k++ {
+			var sum float64
+			for n := 0; n < size; n++ {
+				sum += rows[n*size+x] * cosines[k*size+n]
+			}
+			freqs[k*size+x] = sum
+		}
+	}
+	return freqs
+}
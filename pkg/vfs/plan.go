@@ -0,0 +1,141 @@
+package vfs
+
+import (
+	"os"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
+// Plan is the list of the files and directories that would be affected by a
+// destructive operation. It is computed by a dry run, without modifying
+// anything, and with the same traversal as the real operation.
+type Plan struct {
+	Files            []string `json:"files"`
+	Directories      []string `json:"directories"`
+	FilesCount       int      `json:"files_count"`
+	DirectoriesCount int      `json:"directories_count"`
+	Size             int64    `json:"size"`
+}
+
+func newPlan() *Plan {
+	return &Plan{Files: []string{}, Directories: []string{}}
+}
+
+func (p *Plan) addDir(dir *DirDoc) {
+	p.Directories = append(p.Directories, dir.ID())
+	p.DirectoriesCount++
+}
+
+func (p *Plan) addFile(file *FileDoc) {
+	p.Files = append(p.Files, file.ID())
+	p.FilesCount++
+	p.Size += file.ByteSize
+}
+
+// PlanTrash returns the plan for putting a file or a directory in the trash
+// (see TrashFile and TrashDir). For a directory, the files inside it that
+// would be marked as trashed are listed.
+func PlanTrash(fs VFS, dir *DirDoc, file *FileDoc) (*Plan, error) {
+	var oldpath string
+	var err error
+	if file != nil {
+		oldpath, err = file.Path(fs)
+	} else {
+		oldpath, err = dir.Path(fs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(oldpath, TrashDirName) {
+		return nil, ErrFileInTrash
+	}
+
+	plan := newPlan()
+	if file != nil {
+		plan.addFile(file)
+		return plan, nil
+	}
+	plan.addDir(dir)
+	// Same walk as setTrashedForFilesInsideDir
+	err = walk(fs, dir.Name(), dir, nil, func(name string, d *DirDoc, f *FileDoc, err error) error {
+		if f != nil && !f.Trashed {
+			plan.addFile(f)
+		}
+		return err
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// PlanDestroy returns the plan for destroying a file or a directory and its
+// content (see DestroyFile and DestroyDirAndContent). With onlyContent, the
+// directory itself is kept, like for DestroyDirContent.
+func PlanDestroy(fs VFS, dir *DirDoc, file *FileDoc, onlyContent bool) (*Plan, error) {
+	plan := newPlan()
+	if file != nil {
+		plan.addFile(file)
+		return plan, nil
+	}
+
+	// Same walk as DeleteDirDocAndContent
+	err := walk(fs, dir.Name(), dir, nil, func(name string, d *DirDoc, f *FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if d != nil {
+			if d.ID() != dir.ID() || !onlyContent {
+				plan.addDir(d)
+			}
+		} else {
+			plan.addFile(f)
+		}
+		return nil
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// PlanMove returns the plan for moving a file or a directory to the
+// directory with the given id (see ModifyFileMetadata and ModifyDirMetadata).
+// For a directory, all its descendants are moved with it.
+func PlanMove(fs VFS, dir *DirDoc, file *FileDoc, dirID string) (*Plan, error) {
+	if _, err := fs.DirByID(dirID); err != nil {
+		return nil, err
+	}
+
+	plan := newPlan()
+	if file != nil {
+		plan.addFile(file)
+		return plan, nil
+	}
+
+	id := dir.ID()
+	if id == consts.RootDirID || id == consts.TrashDirID {
+		return nil, os.ErrInvalid
+	}
+	if dirID != dir.DirID {
+		if err := checkNotDescendant(fs, dir, dirID); err != nil {
+			return nil, err
+		}
+	}
+	err := walk(fs, dir.Name(), dir, nil, func(name string, d *DirDoc, f *FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if d != nil {
+			plan.addDir(d)
+		} else {
+			plan.addFile(f)
+		}
+		return nil
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
@@ -0,0 +1,191 @@
+package vfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+)
+
+// PublicLink is a link that gives access to the content of a file to anyone
+// who knows it. Unlike the links of the download store, it does not expire:
+// it is valid until it is revoked. There is at most one public link for a
+// file, and its identifier is the identifier of the file.
+type PublicLink struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ID returns the public link qualified identifier
+func (p *PublicLink) ID() string { return p.DocID }
+
+// Rev returns the public link revision
+func (p *PublicLink) Rev() string { return p.DocRev }
+
+// DocType returns the public link document type
+func (p *PublicLink) DocType() string { return consts.FilesPublicLinks }
+
+// Clone implements couchdb.Doc
+func (p *PublicLink) Clone() couchdb.Doc {
+	cloned := *p
+	return &cloned
+}
+
+// SetID changes the public link qualified identifier
+func (p *PublicLink) SetID(id string) { p.DocID = id }
+
+// SetRev changes the public link revision
+func (p *PublicLink) SetRev(rev string) { p.DocRev = rev }
+
+// FileID returns the identifier of the file shared by this link.
+func (p *PublicLink) FileID() string { return p.DocID }
+
+// PublicAccess is a record of an access to a file via its public link. The
+// IP address is not kept, only a keyed hash of it, that can be used to count
+// the distinct visitors.
+type PublicAccess struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	FileID    string    `json:"file_id"`
+	IPHash    string    `json:"ip_hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ID returns the public access qualified identifier
+func (a *PublicAccess) ID() string { return a.DocID }
+
+// Rev returns the public access revision
+func (a *PublicAccess) Rev() string { return a.DocRev }
+
+// DocType returns the public access document type
+func (a *PublicAccess) DocType() string { return consts.FilesPublicAccesses }
+
+// Clone implements couchdb.Doc
+func (a *PublicAccess) Clone() couchdb.Doc {
+	cloned := *a
+	return &cloned
+}
+
+// SetID changes the public access qualified identifier
+func (a *PublicAccess) SetID(id string) { a.DocID = id }
+
+// SetRev changes the public access revision
+func (a *PublicAccess) SetRev(rev string) { a.DocRev = rev }
+
+// GetPublicLink returns the public link of the given file, or os.ErrNotExist
+// if the file has no public link.
+func GetPublicLink(db couchdb.Database, fileID string) (*PublicLink, error) {
+	link := &PublicLink{}
+	err := couchdb.GetDoc(db, consts.FilesPublicLinks, fileID, link)
+	if couchdb.IsNotFoundError(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// CreatePublicLink returns the public link of the given file, and creates it
+// if the file has no public link. The boolean is true if the link has been
+// created.
+func CreatePublicLink(db couchdb.Database, fileID string) (*PublicLink, bool, error) {
+	link, err := GetPublicLink(db, fileID)
+	if err == nil {
+		return link, false, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	link = &PublicLink{
+		DocID:     fileID,
+		Token:     hex.EncodeToString(crypto.GenerateRandomBytes(16)),
+		CreatedAt: time.Now(),
+	}
+	err = couchdb.CreateNamedDocWithDB(db, link)
+	if couchdb.IsConflictError(err) {
+		// Another request has created the link at the same time
+		link, err = GetPublicLink(db, fileID)
+		return link, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return link, true, nil
+}
+
+// PublicLinkByToken returns the public link with the given token, or
+// os.ErrNotExist if there is no such link (or if it has been revoked).
+func PublicLinkByToken(db couchdb.Database, token string) (*PublicLink, error) {
+	var links []*PublicLink
+	req := &couchdb.FindRequest{
+		UseIndex: "by-token",
+		Selector: mango.Equal("token", token),
+		Limit:    1,
+	}
+	err := couchdb.FindDocs(db, consts.FilesPublicLinks, req, &links)
+	if couchdb.IsNoDatabaseError(err) || (err == nil && len(links) == 0) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return links[0], nil
+}
+
+// RevokePublicLink deletes the public link: its token can no longer be used
+// to access the file. The records of the accesses are kept.
+func RevokePublicLink(db couchdb.Database, link *PublicLink) error {
+	return couchdb.DeleteDoc(db, link)
+}
+
+// WritePublicAccess saves a record for an access to a file via its public
+// link, from the given IP address. The address is hashed with an HMAC keyed
+// by the secret of the instance, as the IPv4 space is small enough to reverse
+// a simple hash.
+func WritePublicAccess(db couchdb.Database, secret []byte, fileID, ip string) error {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(fileID + "\n" + ip)) // #nosec
+	access := &PublicAccess{
+		FileID:    fileID,
+		IPHash:    hex.EncodeToString(h.Sum(nil)),
+		CreatedAt: time.Now(),
+	}
+	return couchdb.CreateDoc(db, access)
+}
+
+// PublicAccesses returns the most recent records of the accesses to the
+// given file via its public link, the newest first.
+func PublicAccesses(db couchdb.Database, fileID string, limit int) ([]*PublicAccess, error) {
+	var accesses []*PublicAccess
+	req := &couchdb.FindRequest{
+		UseIndex: "by-file-id",
+		Selector: mango.Equal("file_id", fileID),
+		Sort: mango.SortBy{
+			{Field: "file_id", Direction: mango.Desc},
+			{Field: "created_at", Direction: mango.Desc},
+		},
+		Limit: limit,
+	}
+	err := couchdb.FindDocs(db, consts.FilesPublicAccesses, req, &accesses)
+	if couchdb.IsNoDatabaseError(err) {
+		return accesses, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return accesses, nil
+}
+
+var (
+	_ couchdb.Doc = &PublicLink{}
+	_ couchdb.Doc = &PublicAccess{}
+)
@@ -0,0 +1,35 @@
+package vfs
+
+import (
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// RecentFiles returns the most recently updated files that are not in the
+// trash, the newest first. If class is not empty, only the files of this
+// class are returned.
+func RecentFiles(db couchdb.Database, class string, limit int) ([]*FileDoc, error) {
+	selector := mango.And(
+		mango.Equal("type", consts.FileType),
+		mango.Equal("trashed", false),
+	)
+	if class != "" {
+		selector = mango.And(selector, mango.Equal("class", class))
+	}
+	var files []*FileDoc
+	req := &couchdb.FindRequest{
+		UseIndex: "by-type-trashed-and-updated-at",
+		Selector: selector,
+		Sort: mango.SortBy{
+			{Field: "type", Direction: mango.Desc},
+			{Field: "trashed", Direction: mango.Desc},
+			{Field: "updated_at", Direction: mango.Desc},
+		},
+		Limit: limit,
+	}
+	if err := couchdb.FindDocs(db, consts.Files, req, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
@@ -0,0 +1,64 @@
+package vfs
+
+// ReclassifyReport is the result of the computation of the classes of the
+// files with the current rules.
+type ReclassifyReport struct {
+	Checked  int      `json:"checked"`
+	Updated  int      `json:"updated"`
+	Failures []string `json:"failures,omitempty"`
+}
+
+// Reclassify computes the class of the file from its mime type, with the
+// current rules of the taxonomy and the given custom rules, and updates the
+// document if the class has changed. It returns true if the document has been
+// updated.
+func Reclassify(fs VFS, doc *FileDoc, rules map[string]string) (bool, error) {
+	_, class := ExtractMimeAndClassWithRules(doc.Mime, rules)
+	if class == doc.Class {
+		return false, nil
+	}
+	newdoc := doc.Clone().(*FileDoc)
+	newdoc.Class = class
+	if err := fs.UpdateFileDoc(doc, newdoc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReclassifyFiles calls Reclassify on all the files of the tree rooted at the
+// directory with the given identifier. The progress is computed from the
+// number of bytes of the files that have been checked, like for
+// VerifyAllFiles.
+func ReclassifyFiles(fs VFS, rootID string, rules map[string]string, progress func(percent int)) (*ReclassifyReport, error) {
+	total, err := fs.DiskUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReclassifyReport{}
+	var checked int64
+	err = WalkByID(fs, rootID, func(name string, dir *DirDoc, file *FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return nil
+		}
+		updated, erru := Reclassify(fs, file, rules)
+		if erru != nil {
+			report.Failures = append(report.Failures, file.ID())
+		} else if updated {
+			report.Updated++
+		}
+		report.Checked++
+		checked += file.ByteSize
+		if total > 0 && progress != nil {
+			progress(int(checked * 100 / total))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
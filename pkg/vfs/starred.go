@@ -0,0 +1,38 @@
+package vfs
+
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// StarredDocs returns the starred files and directories, the most recently
+// updated first. The files and directories in the trash are not starred, but
+// a directory inside a trashed directory can still have the flag, so they
+// are filtered out.
+func StarredDocs(db couchdb.Database, limit int) ([]DirOrFileDoc, error) {
+	var results []DirOrFileDoc
+	req := &couchdb.FindRequest{
+		UseIndex: "by-starred",
+		Selector: mango.Equal("starred", true),
+		Sort: mango.SortBy{
+			{Field: "starred", Direction: mango.Desc},
+			{Field: "updated_at", Direction: mango.Desc},
+		},
+		Limit: limit,
+	}
+	if err := couchdb.FindDocs(db, consts.Files, req, &results); err != nil {
+		return nil, err
+	}
+
+	docs := results[:0]
+	for _, doc := range results {
+		if doc.Trashed || strings.HasPrefix(doc.Fullpath, TrashDirName) {
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
@@ -0,0 +1,198 @@
+package vfs
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// Subtree is a view of the VFS restricted to a directory and its descendants,
+// for example the folder of an application or a shared folder. The paths are
+// resolved relatively to the root of the subtree, and can't escape it: "/" is
+// the root, and ".." on the root is the root itself. The documents outside of
+// the subtree are hidden, as if they don't exist.
+//
+// The documents returned by a Subtree are the documents of the VFS, with their
+// full paths (and not the paths relative to the root): Rel can be used to
+// compute these relative paths.
+type Subtree struct {
+	fs   VFS
+	root *DirDoc
+}
+
+// NewSubtree returns a view of the VFS restricted to the given directory.
+func NewSubtree(fs VFS, root *DirDoc) *Subtree {
+	return &Subtree{fs: fs, root: root}
+}
+
+// FS returns the underlying VFS, that can be used with the documents of the
+// subtree (DirIterator, CreateFile, etc.).
+func (s *Subtree) FS() VFS { return s.fs }
+
+// Root returns the directory at the root of the subtree.
+func (s *Subtree) Root() *DirDoc { return s.root }
+
+// Abs returns the full path in the VFS for a path relative to the root of the
+// subtree.
+func (s *Subtree) Abs(name string) string {
+	return path.Join(s.root.Fullpath, path.Clean("/"+name))
+}
+
+// Rel returns the path relative to the root of the subtree for a full path
+// of the VFS. ErrOutsideSubtree is returned if it is not in the subtree.
+func (s *Subtree) Rel(fullpath string) (string, error) {
+	if !s.containsPath(fullpath) {
+		return "", ErrOutsideSubtree
+	}
+	rel := strings.TrimPrefix(path.Clean(fullpath), s.root.Fullpath)
+	if rel == "" || s.root.Fullpath == "/" {
+		return path.Clean("/" + rel), nil
+	}
+	return rel, nil
+}
+
+func (s *Subtree) containsPath(fullpath string) bool {
+	fullpath = path.Clean(fullpath)
+	root := s.root.Fullpath
+	if root == "/" || fullpath == root {
+		return true
+	}
+	return strings.HasPrefix(fullpath, root+"/")
+}
+
+// ContainsDir returns true if the directory is the root of the subtree or
+// one of its descendants.
+func (s *Subtree) ContainsDir(doc *DirDoc) bool {
+	return s.containsPath(doc.Fullpath)
+}
+
+// ContainsFile returns true if the file is in the subtree.
+func (s *Subtree) ContainsFile(doc *FileDoc) bool {
+	fullpath, err := doc.Path(s.fs)
+	if err != nil {
+		return false
+	}
+	return s.containsPath(fullpath)
+}
+
+// DirByPath returns the directory with the given path, relative to the root
+// of the subtree.
+func (s *Subtree) DirByPath(name string) (*DirDoc, error) {
+	return s.fs.DirByPath(s.Abs(name))
+}
+
+// FileByPath returns the file with the given path, relative to the root of
+// the subtree.
+func (s *Subtree) FileByPath(name string) (*FileDoc, error) {
+	return s.fs.FileByPath(s.Abs(name))
+}
+
+// DirOrFileByPath returns the document with the given path, relative to the
+// root of the subtree.
+func (s *Subtree) DirOrFileByPath(name string) (*DirDoc, *FileDoc, error) {
+	return s.fs.DirOrFileByPath(s.Abs(name))
+}
+
+// DirByID returns the directory with the given identifier, if it is in the
+// subtree.
+func (s *Subtree) DirByID(id string) (*DirDoc, error) {
+	doc, err := s.fs.DirByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ContainsDir(doc) {
+		return nil, os.ErrNotExist
+	}
+	return doc, nil
+}
+
+// FileByID returns the file with the given identifier, if it is in the
+// subtree.
+func (s *Subtree) FileByID(id string) (*FileDoc, error) {
+	doc, err := s.fs.FileByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ContainsFile(doc) {
+		return nil, os.ErrNotExist
+	}
+	return doc, nil
+}
+
+// DirOrFileByID returns the document with the given identifier, if it is in
+// the subtree.
+func (s *Subtree) DirOrFileByID(id string) (*DirDoc, *FileDoc, error) {
+	dir, file, err := s.fs.DirOrFileByID(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if (dir != nil && !s.ContainsDir(dir)) || (file != nil && !s.ContainsFile(file)) {
+		return nil, nil, os.ErrNotExist
+	}
+	return dir, file, nil
+}
+
+// Mkdir creates a directory with the given path, relative to the root of the
+// subtree.
+func (s *Subtree) Mkdir(name string, tags []string) (*DirDoc, error) {
+	if s.Abs(name) == s.root.Fullpath {
+		return nil, os.ErrExist
+	}
+	return Mkdir(s.fs, s.Abs(name), tags)
+}
+
+// MkdirAll creates a directory with the given path, relative to the root of
+// the subtree, and its missing parents.
+func (s *Subtree) MkdirAll(name string, tags []string) (*DirDoc, error) {
+	return MkdirAll(s.fs, s.Abs(name), tags)
+}
+
+// NewDirDoc returns a new directory document (not saved) in the given
+// parent, that must be in the subtree.
+func (s *Subtree) NewDirDoc(name, parentID string, tags []string) (*DirDoc, error) {
+	parent, err := s.parent(parentID)
+	if err != nil {
+		return nil, err
+	}
+	return NewDirDocWithParent(name, parent, tags)
+}
+
+// CreateFile creates a file, or modifies its content, like the CreateFile
+// method of the VFS, but only if the parent directory is in the subtree.
+func (s *Subtree) CreateFile(newdoc, olddoc *FileDoc) (File, error) {
+	if _, err := s.parent(newdoc.DirID); err != nil {
+		return nil, err
+	}
+	if olddoc != nil && !s.ContainsFile(olddoc) {
+		return nil, ErrOutsideSubtree
+	}
+	return s.fs.CreateFile(newdoc, olddoc)
+}
+
+// CreateDir creates a directory, like the CreateDir method of the VFS, but
+// only if the parent directory is in the subtree.
+func (s *Subtree) CreateDir(doc *DirDoc) error {
+	if _, err := s.parent(doc.DirID); err != nil {
+		return err
+	}
+	return s.fs.CreateDir(doc)
+}
+
+// parent returns the directory with the given id, to add a child to it. The
+// root of the subtree is used for an empty id.
+func (s *Subtree) parent(id string) (*DirDoc, error) {
+	if id == "" || id == s.root.ID() {
+		return s.root, nil
+	}
+	parent, err := s.fs.DirByID(id)
+	if os.IsNotExist(err) {
+		return nil, ErrParentDoesNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !s.ContainsDir(parent) {
+		return nil, ErrOutsideSubtree
+	}
+	return parent, nil
+}
@@ -0,0 +1,161 @@
+package vfs
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// renameTagBatchSize is the number of documents loaded at once when renaming
+// a tag.
+const renameTagBatchSize = 100
+
+// TagCount is a tag with the number of files that have it.
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// TagsCounts returns the tags of the files starting with the given prefix,
+// sorted by name, with the number of files for each tag. The trashed files
+// are counted only if withTrashed is true.
+func TagsCounts(db couchdb.Database, prefix string, withTrashed bool) ([]TagCount, error) {
+	counts := make(map[string]int)
+	states := []bool{false}
+	if withTrashed {
+		states = append(states, true)
+	}
+	for _, trashed := range states {
+		// consts.FilesTagsView keys are [trashed, tag]
+		var res couchdb.ViewResponse
+		err := couchdb.ExecView(db, consts.FilesTagsView, &couchdb.ViewRequest{
+			StartKey:   []interface{}{trashed, prefix},
+			EndKey:     []interface{}{trashed, prefix + "\ufff0"},
+			Reduce:     true,
+			GroupLevel: 2,
+		}, &res)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range res.Rows {
+			key, ok := row.Key.([]interface{})
+			if !ok || len(key) != 2 {
+				continue
+			}
+			tag, _ := key[1].(string)
+			n, _ := row.Value.(float64)
+			counts[tag] += int(n)
+		}
+	}
+
+	tags := make([]TagCount, 0, len(counts))
+	for name, count := range counts {
+		tags = append(tags, TagCount{Name: name, Count: count})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+// RenameTag replaces the tag from by the tag to on all the files and
+// directories that have it. When a document already has the tag to, the tag
+// from is just removed. It returns the number of documents that have been
+// updated. The update date of the documents is kept, as the content has not
+// changed.
+func RenameTag(fs VFS, db couchdb.Database, from, to string, progress func(percent int)) (int, error) {
+	var total int
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.FilesByTagView, &couchdb.ViewRequest{
+		Key:    from,
+		Reduce: true,
+	}, &res)
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Rows) > 0 {
+		if n, ok := res.Rows[0].Value.(float64); ok {
+			total = int(n)
+		}
+	}
+	if total == 0 || from == to {
+		return 0, nil
+	}
+
+	// The updated documents are no longer in the view, so the next batch is
+	// always fetched from the start, except for the documents that have
+	// failed.
+	var errm *multierror.Error
+	count, skip := 0, 0
+	for {
+		var res couchdb.ViewResponse
+		err := couchdb.ExecView(db, consts.FilesByTagView, &couchdb.ViewRequest{
+			Key:         from,
+			IncludeDocs: true,
+			Limit:       renameTagBatchSize,
+			Skip:        skip,
+		}, &res)
+		if err != nil {
+			return count, err
+		}
+		if len(res.Rows) == 0 {
+			break
+		}
+
+		// A document with the tag twice has two rows: they both stay in the
+		// view only if the update has failed.
+		failed := make(map[string]bool)
+		for _, row := range res.Rows {
+			if ko, ok := failed[row.ID]; ok {
+				if ko {
+					skip++
+				}
+				continue
+			}
+			var doc DirOrFileDoc
+			if err = json.Unmarshal(row.Doc, &doc); err == nil {
+				err = renameTagInDoc(fs, &doc, from, to)
+			}
+			failed[row.ID] = err != nil
+			if err != nil {
+				errm = multierror.Append(errm, err)
+				skip++
+				continue
+			}
+			count++
+		}
+		if progress != nil {
+			progress((count + skip) * 100 / total)
+		}
+	}
+	return count, errm.ErrorOrNil()
+}
+
+func renameTagInDoc(fs VFS, doc *DirOrFileDoc, from, to string) error {
+	dir, file := doc.Refine()
+	if dir != nil {
+		newdoc := dir.Clone().(*DirDoc)
+		newdoc.Tags = replaceTag(dir.Tags, from, to)
+		return fs.UpdateDirDoc(dir, newdoc)
+	}
+	newdoc := file.Clone().(*FileDoc)
+	newdoc.Tags = replaceTag(file.Tags, from, to)
+	if len(file.InheritedTags) > 0 {
+		newdoc.InheritedTags = replaceTag(file.InheritedTags, from, to)
+	}
+	return fs.UpdateFileDoc(file, newdoc)
+}
+
+// replaceTag returns a copy of tags where from is replaced by to, without
+// duplicates.
+func replaceTag(tags []string, from, to string) []string {
+	replaced := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag == from {
+			tag = to
+		}
+		replaced = append(replaced, tag)
+	}
+	return uniqueTags(replaced)
+}
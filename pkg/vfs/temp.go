@@ -0,0 +1,203 @@
+package vfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tempSweepInterval is the time interval between two sweeps of the temporary
+// directory.
+var tempSweepInterval = 1 * time.Hour
+
+// TempDir returns the directory used as scratch space for the uploads and
+// the archives being built.
+func TempDir() string {
+	if dir := config.GetConfig().Fs.TempDir; dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "cozy-stack")
+}
+
+// TempTTL returns the age from which the files left in the temporary
+// directory are removed by the sweeper.
+func TempTTL() time.Duration {
+	return config.GetConfig().Fs.TempTTL
+}
+
+// CreateTempFile creates a new file in the temporary directory, in a
+// sub-directory for the instance. The caller must remove it when it is no
+// longer used, but if it is not the case (an interrupted upload for example),
+// it will be removed by the sweeper after the TTL.
+func CreateTempFile(domain, prefix string) (*os.File, error) {
+	dir := filepath.Join(TempDir(), tempDomainDir(domain))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, prefix)
+}
+
+// TempPath returns the path of a file or a directory with the given name in
+// the sub-directory of the instance in the temporary directory.
+func TempPath(domain, name string) string {
+	return filepath.Join(TempDir(), tempDomainDir(domain), name)
+}
+
+func tempDomainDir(domain string) string {
+	domain = strings.Replace(domain, string(filepath.Separator), "_", -1)
+	if domain == "" || domain == "." || domain == ".." {
+		return "_"
+	}
+	return domain
+}
+
+// TempUsage returns the number of files and their total size in the temporary
+// directory. The cache of the thumbnails is not counted, as it has its own
+// metrics.
+func TempUsage() (count int, size int64, err error) {
+	err = filepath.Walk(TempDir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() && info.Name() == thumbsCacheDirName {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() {
+			count++
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// SweepTempFiles removes the files of the temporary directory that have not
+// been modified for more than the TTL, and the directories of the instances
+// that are empty. The cache of the thumbnails is left untouched: it has its
+// own eviction. It returns the number of files removed.
+func SweepTempFiles(ttl time.Duration) (int, error) {
+	root := TempDir()
+	instances, err := ioutil.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	limit := time.Now().Add(-ttl)
+	removed := 0
+	for _, info := range instances {
+		if info.Name() == thumbsCacheDirName {
+			continue
+		}
+		path := filepath.Join(root, info.Name())
+		if !info.IsDir() {
+			if info.ModTime().Before(limit) && os.Remove(path) == nil {
+				removed++
+			}
+			continue
+		}
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			continue
+		}
+		left := len(files)
+		for _, file := range files {
+			if !file.ModTime().Before(limit) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(path, file.Name())); err == nil {
+				removed++
+				left--
+			}
+		}
+		if left == 0 {
+			os.Remove(path) // #nosec
+		}
+	}
+	return removed, nil
+}
+
+// SweepTempDir starts a goroutine that removes regularly the files left in
+// the temporary directory, like the ones of the interrupted uploads.
+func SweepTempDir() utils.Shutdowner {
+	closed := make(chan struct{})
+	go func() {
+		log := logger.WithNamespace("vfs")
+		for {
+			select {
+			case <-time.After(tempSweepInterval):
+				removed, err := SweepTempFiles(TempTTL())
+				if err != nil {
+					log.Errorf("Could not sweep the temporary directory: %s", err)
+				} else if removed > 0 {
+					log.Infof("%d files removed from the temporary directory", removed)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return &tempSweeper{closed}
+}
+
+type tempSweeper struct {
+	closed chan struct{}
+}
+
+func (s *tempSweeper) Shutdown(ctx context.Context) error {
+	select {
+	case s.closed <- struct{}{}:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+// tempUsageCollector exposes the usage of the temporary directory in the
+// metrics.
+type tempUsageCollector struct {
+	filesDesc *prometheus.Desc
+	bytesDesc *prometheus.Desc
+}
+
+func (t *tempUsageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.filesDesc
+	ch <- t.bytesDesc
+}
+
+func (t *tempUsageCollector) Collect(ch chan<- prometheus.Metric) {
+	count, size, err := TempUsage()
+	if err != nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(t.filesDesc, prometheus.GaugeValue, float64(count))
+	ch <- prometheus.MustNewConstMetric(t.bytesDesc, prometheus.GaugeValue, float64(size))
+}
+
+func init() {
+	prometheus.MustRegister(&tempUsageCollector{
+		filesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName("fs", "temp", "files"),
+			"Number of files in the temporary directory.",
+			[]string{},
+			prometheus.Labels{},
+		),
+		bytesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName("fs", "temp", "bytes"),
+			"Total size of the files in the temporary directory.",
+			[]string{},
+			prometheus.Labels{},
+		),
+	})
+}
@@ -0,0 +1,65 @@
+package vfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSweepTempFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-temp-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	previous := config.GetConfig().Fs.TempDir
+	config.GetConfig().Fs.TempDir = dir
+	defer func() { config.GetConfig().Fs.TempDir = previous }()
+
+	old, err := vfs.CreateTempFile("alice.cozy.tools", "upload-")
+	assert.NoError(t, err)
+	_, err = old.Write([]byte("partial upload"))
+	assert.NoError(t, err)
+	assert.NoError(t, old.Close())
+	past := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(old.Name(), past, past))
+
+	recent, err := vfs.CreateTempFile("bob.cozy.tools", "upload-")
+	assert.NoError(t, err)
+	assert.NoError(t, recent.Close())
+
+	// The cache of the thumbnails is not swept
+	cached := filepath.Join(dir, ".thumbs-cache", "thumb")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(cached), 0700))
+	assert.NoError(t, ioutil.WriteFile(cached, []byte("thumb"), 0600))
+	assert.NoError(t, os.Chtimes(cached, past, past))
+	assert.NoError(t, os.Chtimes(filepath.Dir(cached), past, past))
+
+	count, size, err := vfs.TempUsage()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.EqualValues(t, 14, size)
+
+	removed, err := vfs.SweepTempFiles(1 * time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	_, err = os.Stat(old.Name())
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Dir(old.Name()))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(recent.Name())
+	assert.NoError(t, err)
+	_, err = os.Stat(cached)
+	assert.NoError(t, err)
+
+	count, _, err = vfs.TempUsage()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
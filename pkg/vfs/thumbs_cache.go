@@ -0,0 +1,441 @@
+package vfs
+
+import (
+	"container/list"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// thumbsCacheDirName is the name of the directory, inside the temporary
+// directory, where the thumbnails of the cache are stored. It is skipped by
+// the sweeper of the temporary directory, and emptied when the cache is
+// created, as the thumbnails of a previous process are not known by the cache.
+const thumbsCacheDirName = ".thumbs-cache"
+
+// ThumbsCache is a local cache for the thumbnails and the previews of the
+// PDFs, to avoid fetching them from the storage (like Swift) for each
+// request of a gallery view. It is bounded in size and in number of
+// thumbnails, and the least recently used thumbnails are evicted first.
+//
+// The thumbnails are stored as files in a directory: a thumbnail evicted
+// while it is served is removed only when the last reader has finished.
+type ThumbsCache struct {
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	maxCount int
+	size     int64
+	lru      *list.List // of *thumbsCacheEntry, the most recent first
+	entries  map[string]*list.Element
+
+	// generation is incremented each time that some thumbnails are
+	// invalidated: a thumbnail fetched during an invalidation is not added
+	// to the cache, as it can be stale.
+	generation uint64
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type thumbsCacheEntry struct {
+	key         string
+	path        string
+	size        int64
+	contentType string
+	etag        string
+	modtime     time.Time
+	readers     int
+	evicted     bool
+}
+
+// ThumbsCacheStats are the statistics of the cache, for the metrics.
+type ThumbsCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Count     int
+	Size      int64
+}
+
+// NewThumbsCache returns a cache that stores the thumbnails in the given
+// directory. maxSize is the maximal total size in bytes of the thumbnails,
+// and maxCount their maximal number (0 for no limit).
+func NewThumbsCache(dir string, maxSize int64, maxCount int) *ThumbsCache {
+	return &ThumbsCache{
+		dir:      dir,
+		maxSize:  maxSize,
+		maxCount: maxCount,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+var (
+	thumbsCache     *ThumbsCache
+	thumbsCacheOnce sync.Once
+)
+
+// GetThumbsCache returns the cache for the thumbnails configured with the
+// fs.thumbs_cache_max_size and fs.thumbs_cache_max_count parameters, or nil
+// if the cache is disabled.
+func GetThumbsCache() *ThumbsCache {
+	thumbsCacheOnce.Do(func() {
+		conf := config.GetConfig().Fs
+		if conf.ThumbsCacheMaxSize <= 0 && conf.ThumbsCacheMaxCount <= 0 {
+			return
+		}
+		dir := filepath.Join(TempDir(), thumbsCacheDirName)
+		os.RemoveAll(dir) // #nosec
+		thumbsCache = NewThumbsCache(dir, conf.ThumbsCacheMaxSize, conf.ThumbsCacheMaxCount)
+	})
+	return thumbsCache
+}
+
+// thumbsCacheSettleDelay is the time after a modification of a file during
+// which its thumbnails are not cached, as they can be regenerated by a worker
+// of another stack process (that can't invalidate the cache of this one).
+var thumbsCacheSettleDelay = 1 * time.Minute
+
+// thumbsCacheKey returns the key of a thumbnail in the cache. The md5sum of
+// the file is part of the key, so that a thumbnail of an old version of the
+// file is not served.
+func thumbsCacheKey(domain string, img *FileDoc, format string) string {
+	return thumbsCachePrefix(domain, img.ID()) + hex.EncodeToString(img.MD5Sum) + "/" + format
+}
+
+func thumbsCachePrefix(domain, id string) string {
+	return domain + "/" + id + "/"
+}
+
+// acquire returns the entry for the key, or nil if it is not in the cache.
+// The entry can't be removed before it is released.
+func (c *ThumbsCache) acquire(key string) *thumbsCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+	e := el.Value.(*thumbsCacheEntry)
+	e.readers++
+	return e
+}
+
+// release must be called when an acquired entry is no longer used.
+func (c *ThumbsCache) release(e *thumbsCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.readers--
+	if e.evicted && e.readers == 0 {
+		os.Remove(e.path) // #nosec
+	}
+}
+
+// currentGeneration returns the generation to give to add for a thumbnail
+// that is going to be fetched.
+func (c *ThumbsCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// add puts the thumbnail, already written in the cache directory, in the
+// cache. It returns the acquired entry, or nil if the thumbnail can't be
+// cached: in this case, the caller must remove the file after using it.
+func (c *ThumbsCache) add(e *thumbsCacheEntry, generation uint64) *thumbsCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation || (c.maxSize > 0 && e.size > c.maxSize) {
+		return nil
+	}
+	if el, ok := c.entries[e.key]; ok {
+		// Another request has fetched the same thumbnail in the meantime
+		os.Remove(e.path) // #nosec
+		c.lru.MoveToFront(el)
+		existing := el.Value.(*thumbsCacheEntry)
+		existing.readers++
+		return existing
+	}
+	for c.lru.Len() > 0 &&
+		((c.maxSize > 0 && c.size+e.size > c.maxSize) ||
+			(c.maxCount > 0 && c.lru.Len()+1 > c.maxCount)) {
+		c.evict(c.lru.Back())
+	}
+	e.readers = 1
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size
+	return e
+}
+
+// evict removes an element from the cache. The file is removed now, or when
+// its last reader has finished. The lock must be held.
+func (c *ThumbsCache) evict(el *list.Element) {
+	e := el.Value.(*thumbsCacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.size -= e.size
+	c.evictions++
+	e.evicted = true
+	if e.readers == 0 {
+		os.Remove(e.path) // #nosec
+	}
+}
+
+// drop removes an entry whose file has disappeared (removed by the sweeper
+// of the temporary directory for example).
+func (c *ThumbsCache) drop(e *thumbsCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok && el.Value == e {
+		c.evict(el)
+	}
+}
+
+// invalidate removes the thumbnails of a file from the cache, after they
+// have been removed or regenerated.
+func (c *ThumbsCache) invalidate(domain, id string) {
+	prefix := thumbsCachePrefix(domain, id)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key, el := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.evict(el)
+		}
+	}
+}
+
+// Stats returns the statistics of the cache.
+func (c *ThumbsCache) Stats() ThumbsCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ThumbsCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Count:     c.lru.Len(),
+		Size:      c.size,
+	}
+}
+
+// CachedThumbs returns a Thumbser that serves the thumbnails of the given
+// one through the cache, or the given Thumbser if the cache is disabled.
+func CachedThumbs(thumbs Thumbser, domain string) Thumbser {
+	cache := GetThumbsCache()
+	if cache == nil {
+		return thumbs
+	}
+	return &cachedThumbs{Thumbser: thumbs, cache: cache, domain: domain}
+}
+
+type cachedThumbs struct {
+	Thumbser
+	cache  *ThumbsCache
+	domain string
+}
+
+type cachedThumbFiler struct {
+	ThumbFiler
+	thumbs *cachedThumbs
+	img    *FileDoc
+}
+
+func (t *cachedThumbFiler) Commit() error {
+	err := t.ThumbFiler.Commit()
+	t.thumbs.cache.invalidate(t.thumbs.domain, t.img.ID())
+	return err
+}
+
+func (t *cachedThumbs) CreateThumb(img *FileDoc, format string) (ThumbFiler, error) {
+	th, err := t.Thumbser.CreateThumb(img, format)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedThumbFiler{ThumbFiler: th, thumbs: t, img: img}, nil
+}
+
+func (t *cachedThumbs) RemoveThumbs(img *FileDoc, formats []string) error {
+	err := t.Thumbser.RemoveThumbs(img, formats)
+	t.cache.invalidate(t.domain, img.ID())
+	return err
+}
+
+// ServeThumbContent serves the thumbnail from the cache. On a miss, the
+// whole thumbnail is fetched first, so that the ranged and conditional
+// requests are answered from the cache like the other ones.
+func (t *cachedThumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request, img *FileDoc, format string) error {
+	if time.Since(img.UpdatedAt) < thumbsCacheSettleDelay {
+		return t.Thumbser.ServeThumbContent(w, req, img, format)
+	}
+	key := thumbsCacheKey(t.domain, img, format)
+	if e := t.cache.acquire(key); e != nil {
+		f, err := os.Open(e.path)
+		if err == nil {
+			defer t.cache.release(e)
+			defer f.Close()
+			serveCachedThumb(w, req, e, f)
+			return nil
+		}
+		t.cache.release(e)
+		t.cache.drop(e)
+	}
+
+	generation := t.cache.currentGeneration()
+	fetched, err := t.fetch(key, img, format)
+	if err != nil {
+		return err
+	}
+	e := t.cache.add(fetched, generation)
+	if e != nil {
+		defer t.cache.release(e)
+	} else {
+		e = fetched
+		defer os.Remove(e.path) // #nosec
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	serveCachedThumb(w, req, e, f)
+	return nil
+}
+
+// fetch writes the thumbnail in a new file of the cache directory.
+func (t *cachedThumbs) fetch(key string, img *FileDoc, format string) (*thumbsCacheEntry, error) {
+	if err := os.MkdirAll(t.cache.dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(t.cache.dir, "thumb-")
+	if err != nil {
+		return nil, err
+	}
+	rec := &thumbRecorder{header: make(http.Header), w: f}
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	if err == nil {
+		err = t.Thumbser.ServeThumbContent(rec, req, img, format)
+	}
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	if err == nil && rec.status != http.StatusOK {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		os.Remove(f.Name()) // #nosec
+		return nil, err
+	}
+	modtime, _ := http.ParseTime(rec.header.Get("Last-Modified")) // #nosec
+	return &thumbsCacheEntry{
+		key:         key,
+		path:        f.Name(),
+		size:        rec.size,
+		contentType: rec.header.Get("Content-Type"),
+		etag:        strings.Trim(rec.header.Get("Etag"), `"`),
+		modtime:     modtime,
+	}, nil
+}
+
+func serveCachedThumb(w http.ResponseWriter, req *http.Request, e *thumbsCacheEntry, content io.ReadSeeker) {
+	if e.contentType != "" {
+		w.Header().Set("Content-Type", e.contentType)
+	}
+	ServeContent(w, req, e.key, e.modtime, e.etag, content)
+}
+
+// thumbRecorder is an http.ResponseWriter that writes the body of the
+// response in a file, to fetch a thumbnail for the cache.
+type thumbRecorder struct {
+	header http.Header
+	status int
+	w      io.Writer
+	size   int64
+}
+
+func (r *thumbRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *thumbRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *thumbRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	n, err := r.w.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// thumbsCacheCollector exposes the statistics of the cache for the
+// thumbnails in the metrics.
+type thumbsCacheCollector struct {
+	hitsDesc      *prometheus.Desc
+	missesDesc    *prometheus.Desc
+	evictionsDesc *prometheus.Desc
+	ratioDesc     *prometheus.Desc
+	entriesDesc   *prometheus.Desc
+	bytesDesc     *prometheus.Desc
+}
+
+func (t *thumbsCacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.hitsDesc
+	ch <- t.missesDesc
+	ch <- t.evictionsDesc
+	ch <- t.ratioDesc
+	ch <- t.entriesDesc
+	ch <- t.bytesDesc
+}
+
+func (t *thumbsCacheCollector) Collect(ch chan<- prometheus.Metric) {
+	cache := GetThumbsCache()
+	if cache == nil {
+		return
+	}
+	stats := cache.Stats()
+	ratio := 0.0
+	if total := stats.Hits + stats.Misses; total > 0 {
+		ratio = float64(stats.Hits) / float64(total)
+	}
+	ch <- prometheus.MustNewConstMetric(t.hitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(t.missesDesc, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(t.evictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(t.ratioDesc, prometheus.GaugeValue, ratio)
+	ch <- prometheus.MustNewConstMetric(t.entriesDesc, prometheus.GaugeValue, float64(stats.Count))
+	ch <- prometheus.MustNewConstMetric(t.bytesDesc, prometheus.GaugeValue, float64(stats.Size))
+}
+
+func init() {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName("fs", "thumbs_cache", name),
+			help,
+			[]string{},
+			prometheus.Labels{},
+		)
+	}
+	prometheus.MustRegister(&thumbsCacheCollector{
+		hitsDesc:      desc("hits", "Number of thumbnails served from the cache."),
+		missesDesc:    desc("misses", "Number of thumbnails not found in the cache."),
+		evictionsDesc: desc("evictions", "Number of thumbnails evicted from the cache."),
+		ratioDesc:     desc("hit_ratio", "Ratio of the thumbnails served from the cache."),
+		entriesDesc:   desc("entries", "Number of thumbnails in the cache."),
+		bytesDesc:     desc("bytes", "Total size of the thumbnails in the cache."),
+	})
+}
@@ -0,0 +1,185 @@
+package vfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memThumbs is a Thumbser that keeps the thumbnails in memory, and counts
+// how many times they have been served.
+type memThumbs struct {
+	contents map[string][]byte
+	served   int
+}
+
+type memThumb struct {
+	bytes.Buffer
+	thumbs *memThumbs
+	key    string
+}
+
+func (t *memThumb) Abort() error { return nil }
+
+func (t *memThumb) Commit() error {
+	t.thumbs.contents[t.key] = t.Bytes()
+	return nil
+}
+
+func (m *memThumbs) ThumbExists(img *FileDoc, format string) (bool, error) {
+	_, ok := m.contents[img.ID()+"-"+format]
+	return ok, nil
+}
+
+func (m *memThumbs) CreateThumb(img *FileDoc, format string) (ThumbFiler, error) {
+	return &memThumb{thumbs: m, key: img.ID() + "-" + format}, nil
+}
+
+func (m *memThumbs) RemoveThumbs(img *FileDoc, formats []string) error {
+	for _, format := range formats {
+		delete(m.contents, img.ID()+"-"+format)
+	}
+	return nil
+}
+
+func (m *memThumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request, img *FileDoc, format string) error {
+	data, ok := m.contents[img.ID()+"-"+format]
+	if !ok {
+		return os.ErrNotExist
+	}
+	m.served++
+	w.Header().Set("Content-Type", "image/jpeg")
+	ServeContent(w, req, format, time.Time{}, "etag-"+format, bytes.NewReader(data))
+	return nil
+}
+
+func serveThumb(t *testing.T, thumbs Thumbser, img *FileDoc, format, rng string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/thumb", nil)
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	w := httptest.NewRecorder()
+	assert.NoError(t, thumbs.ServeThumbContent(w, req, img, format))
+	return w
+}
+
+func TestThumbsCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-thumbs-cache")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	mem := &memThumbs{contents: map[string][]byte{
+		"one-small":   []byte("first thumbnail"),
+		"two-small":   []byte("second thumbnail"),
+		"three-small": []byte("third thumbnail"),
+	}}
+	cache := NewThumbsCache(dir, 0, 2)
+	thumbs := &cachedThumbs{Thumbser: mem, cache: cache, domain: "alice.cozy.tools"}
+	old := time.Now().Add(-1 * time.Hour)
+	one := &FileDoc{DocID: "one", MD5Sum: []byte{1}, UpdatedAt: old}
+	two := &FileDoc{DocID: "two", MD5Sum: []byte{2}, UpdatedAt: old}
+	three := &FileDoc{DocID: "three", MD5Sum: []byte{3}, UpdatedAt: old}
+
+	// A miss, then a hit
+	w := serveThumb(t, thumbs, one, "small", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "first thumbnail", w.Body.String())
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.Equal(t, `"etag-small"`, w.Header().Get("Etag"))
+	w = serveThumb(t, thumbs, one, "small", "bytes=6-14")
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, "thumbnail", w.Body.String())
+	assert.Equal(t, 1, mem.served)
+	stats := cache.Stats()
+	assert.EqualValues(t, 1, stats.Hits)
+	assert.EqualValues(t, 1, stats.Misses)
+	assert.Equal(t, 1, stats.Count)
+	assert.EqualValues(t, 15, stats.Size)
+
+	// The least recently used thumbnail is evicted
+	serveThumb(t, thumbs, two, "small", "")
+	serveThumb(t, thumbs, one, "small", "")
+	serveThumb(t, thumbs, three, "small", "")
+	stats = cache.Stats()
+	assert.Equal(t, 2, stats.Count)
+	assert.EqualValues(t, 1, stats.Evictions)
+	assert.Equal(t, 3, mem.served)
+	serveThumb(t, thumbs, one, "small", "")
+	assert.Equal(t, 3, mem.served)
+	serveThumb(t, thumbs, two, "small", "")
+	assert.Equal(t, 4, mem.served)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 2)
+
+	// A thumbnail being read is removed only after its last reader
+	e := cache.acquire(thumbsCacheKey("alice.cozy.tools", two, "small"))
+	if assert.NotNil(t, e) {
+		cache.invalidate("alice.cozy.tools", "two")
+		_, err = os.Stat(e.path)
+		assert.NoError(t, err)
+		cache.release(e)
+		_, err = os.Stat(e.path)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// The thumbnails are invalidated when they are regenerated
+	th, err := thumbs.CreateThumb(one, "small")
+	if assert.NoError(t, err) {
+		_, err = th.Write([]byte("new thumbnail"))
+		assert.NoError(t, err)
+		assert.NoError(t, th.Commit())
+	}
+	w = serveThumb(t, thumbs, one, "small", "")
+	assert.Equal(t, "new thumbnail", w.Body.String())
+
+	// A missing thumbnail is not cached
+	req := httptest.NewRequest(http.MethodGet, "/thumb", nil)
+	err = thumbs.ServeThumbContent(httptest.NewRecorder(), req, one, "large")
+	assert.True(t, os.IsNotExist(err))
+	files, _ = ioutil.ReadDir(dir)
+	assert.Len(t, files, cache.Stats().Count)
+}
+
+func TestThumbsCacheMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-thumbs-cache")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	mem := &memThumbs{contents: map[string][]byte{
+		"img-small":  bytes.Repeat([]byte("s"), 40),
+		"img-medium": bytes.Repeat([]byte("m"), 60),
+		"img-large":  bytes.Repeat([]byte("l"), 200),
+	}}
+	cache := NewThumbsCache(dir, 100, 0)
+	thumbs := &cachedThumbs{Thumbser: mem, cache: cache, domain: "bob.cozy.tools"}
+	img := &FileDoc{DocID: "img", MD5Sum: []byte{1}, UpdatedAt: time.Now().Add(-1 * time.Hour)}
+
+	serveThumb(t, thumbs, img, "small", "")
+	serveThumb(t, thumbs, img, "medium", "")
+	assert.EqualValues(t, 100, cache.Stats().Size)
+
+	// Too large to be cached, but still served
+	w := serveThumb(t, thumbs, img, "large", "")
+	assert.Equal(t, 200, w.Body.Len())
+	assert.EqualValues(t, 100, cache.Stats().Size)
+	assert.Equal(t, 2, cache.Stats().Count)
+
+	// A recently modified file is not cached
+	img.UpdatedAt = time.Now()
+	img.MD5Sum = []byte{2}
+	serveThumb(t, thumbs, img, "small", "")
+	assert.Equal(t, 2, cache.Stats().Count)
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 2)
+}
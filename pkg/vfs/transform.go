@@ -0,0 +1,294 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// ErrTransformFailed is used when the content of an uploaded file can't be
+// transformed, for example when it is not a valid image. The upload is then
+// rejected, to avoid storing a half-processed content.
+var ErrTransformFailed = errors.New("The content of the file can't be transformed")
+
+// A Transform rewrites the content of the files on upload. Wrap returns a
+// writer that transforms the bytes written to it and writes the result to w.
+// Its Close method must flush the remaining bytes to w (without closing w),
+// and return an error if the content was not valid.
+type Transform interface {
+	Wrap(doc *FileDoc, w io.Writer) io.WriteCloser
+}
+
+// transforms is the list of the transforms that can be used in the config,
+// by name.
+var transforms = map[string]Transform{
+	"strip_exif": stripExif{},
+}
+
+// transformsFor returns the transforms to apply to the content of a file,
+// from the classes and mime types listed in the transforms of the config.
+func transformsFor(doc *FileDoc) ([]Transform, error) {
+	conf := config.GetConfig().Fs.Transforms
+	if len(conf) == 0 {
+		return nil, nil
+	}
+	entries := make([]string, 0, len(conf))
+	for entry := range conf {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+
+	var list []Transform
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if !matchPolicyEntry(entry, doc.Mime, doc.Class) {
+			continue
+		}
+		for _, name := range conf[entry] {
+			if seen[name] {
+				continue
+			}
+			t, ok := transforms[name]
+			if !ok {
+				return nil, fmt.Errorf("Unknown transform %q", name)
+			}
+			seen[name] = true
+			list = append(list, t)
+		}
+	}
+	return list, nil
+}
+
+// Transformer applies the transforms of the config to the content of a file
+// being created.
+type Transformer struct {
+	doc        *FileDoc
+	transforms []Transform
+	size       int64
+	md5sum     []byte
+}
+
+// NewTransformer returns a Transformer for a file that will be created or
+// overwritten, or nil if there is no transform for this file. The size and
+// md5sum given by the client are kept to check the original content, and
+// they are removed from the document: the ones of the transformed content
+// are computed by the VFS when the file is closed. It must be called by the
+// VFS before the document is added to the index.
+func NewTransformer(doc *FileDoc) (*Transformer, error) {
+	list, err := transformsFor(doc)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	t := &Transformer{
+		doc:        doc,
+		transforms: list,
+		size:       doc.ByteSize,
+		md5sum:     doc.MD5Sum,
+	}
+	doc.ByteSize = -1
+	doc.MD5Sum = nil
+	return t, nil
+}
+
+// Wrap returns a File that transforms the content written to it before
+// writing it to the given file.
+func (t *Transformer) Wrap(file File) File {
+	tf := &transformFile{
+		File:   file,
+		size:   t.size,
+		md5sum: t.md5sum,
+		hash:   md5.New(), // #nosec
+	}
+	var w io.Writer = file
+	tf.closers = make([]io.WriteCloser, len(t.transforms))
+	for i := len(t.transforms) - 1; i >= 0; i-- {
+		wc := t.transforms[i].Wrap(t.doc, w)
+		tf.closers[i] = wc
+		w = wc
+	}
+	tf.w = w
+	return tf
+}
+
+// transformFile is the File returned by Transformer.Wrap. The original
+// content is checked against the size and md5sum given by the client, and if
+// anything fails, the creation of the file is aborted.
+type transformFile struct {
+	File
+	w       io.Writer
+	closers []io.WriteCloser
+	size    int64
+	md5sum  []byte
+	hash    hash.Hash
+	written int64
+	err     error
+}
+
+func (f *transformFile) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	f.hash.Write(p) // #nosec
+	f.written += int64(len(p))
+	n, err := f.w.Write(p)
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// Abort implements FileAborter
+func (f *transformFile) Abort(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *transformFile) Close() error {
+	err := f.err
+	for _, c := range f.closers {
+		if err != nil {
+			break
+		}
+		err = c.Close()
+	}
+	if err == nil && f.size >= 0 && f.written != f.size {
+		err = ErrContentLengthMismatch
+	}
+	if err == nil && f.md5sum != nil && !bytes.Equal(f.md5sum, f.hash.Sum(nil)) {
+		err = ErrInvalidHash
+	}
+	if err != nil {
+		if aborter, ok := f.File.(FileAborter); ok {
+			aborter.Abort(err)
+		}
+		f.File.Close() // #nosec
+		return err
+	}
+	return f.File.Close()
+}
+
+// stripExif is the transform that removes the EXIF and XMP metadata (the
+// APP1 segments) of the JPEG images, like the GPS coordinates of the photos.
+// The other files are kept as is.
+type stripExif struct{}
+
+func (stripExif) Wrap(doc *FileDoc, w io.Writer) io.WriteCloser {
+	if doc.Mime != "image/jpeg" {
+		return nopWriteCloser{w}
+	}
+	return &jpegStripper{w: w}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// JPEG markers
+const (
+	jpegSOI  = 0xd8 // Start of image
+	jpegAPP1 = 0xe1 // EXIF and XMP
+	jpegSOS  = 0xda // Start of scan, followed by the compressed data
+)
+
+// jpegStripper removes the APP1 segments of a JPEG stream. The segments
+// before the start of scan are parsed, and the rest of the stream is copied
+// as is. Only the header of a segment is kept in memory.
+type jpegStripper struct {
+	w       io.Writer
+	buf     []byte
+	started bool  // the SOI marker has been read
+	scan    bool  // the SOS marker has been reached
+	copy    int64 // number of bytes of the current segment to copy
+	skip    int64 // number of bytes of the current segment to skip
+}
+
+func (s *jpegStripper) Write(p []byte) (int, error) {
+	if s.scan {
+		return s.w.Write(p)
+	}
+	s.buf = append(s.buf, p...)
+	if err := s.process(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *jpegStripper) process() error {
+	for {
+		switch {
+		case s.copy > 0:
+			n := min64(s.copy, int64(len(s.buf)))
+			if _, err := s.w.Write(s.buf[:n]); err != nil {
+				return err
+			}
+			s.buf, s.copy = s.buf[n:], s.copy-n
+		case s.skip > 0:
+			n := min64(s.skip, int64(len(s.buf)))
+			s.buf, s.skip = s.buf[n:], s.skip-n
+		case !s.started:
+			if len(s.buf) < 2 {
+				return nil
+			}
+			if s.buf[0] != 0xff || s.buf[1] != jpegSOI {
+				return ErrTransformFailed
+			}
+			s.started = true
+			s.copy = 2
+		default:
+			if len(s.buf) < 4 {
+				return nil
+			}
+			if s.buf[0] != 0xff {
+				return ErrTransformFailed
+			}
+			if s.buf[1] == 0xff {
+				// A fill byte before the marker
+				s.buf = s.buf[1:]
+				continue
+			}
+			if s.buf[1] == jpegSOS {
+				s.scan = true
+				_, err := s.w.Write(s.buf)
+				s.buf = nil
+				return err
+			}
+			length := int64(s.buf[2])<<8 + int64(s.buf[3])
+			if length < 2 {
+				return ErrTransformFailed
+			}
+			// The length of a segment doesn't include its marker
+			length += 2
+			if s.buf[1] == jpegAPP1 {
+				s.skip = length
+			} else {
+				s.copy = length
+			}
+		}
+		if len(s.buf) == 0 {
+			return nil
+		}
+	}
+}
+
+func (s *jpegStripper) Close() error {
+	if !s.scan {
+		return ErrTransformFailed
+	}
+	return nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
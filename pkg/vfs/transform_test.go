@@ -0,0 +1,70 @@
+package vfs
+
+import (
+	"bytes"
+	"image/jpeg"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripExif(t *testing.T) {
+	original, err := ioutil.ReadFile("../../tests/fixtures/wet-cozy_20160910__©M4Dz.jpg")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, bytes.Contains(original, []byte("Exif\x00\x00")))
+
+	var buf bytes.Buffer
+	w := stripExif{}.Wrap(&FileDoc{Mime: "image/jpeg"}, &buf)
+	// Small chunks, to cut the segments headers
+	for i := 0; i < len(original); i += 7 {
+		end := i + 7
+		if end > len(original) {
+			end = len(original)
+		}
+		_, err = w.Write(original[i:end])
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+	assert.NoError(t, w.Close())
+
+	stripped := buf.Bytes()
+	assert.True(t, len(stripped) < len(original))
+	assert.False(t, bytes.Contains(stripped, []byte("Exif\x00\x00")))
+	img, err := jpeg.Decode(bytes.NewReader(stripped))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 440, img.Bounds().Dx())
+		assert.Equal(t, 294, img.Bounds().Dy())
+	}
+
+	extractor := NewExifExtractor(time.Now(), false)
+	extractor.Write(stripped) // #nosec
+	extractor.Close()
+	_, ok := extractor.Result()["datetime"]
+	assert.False(t, ok)
+
+	// The files that are not JPEG are kept as is
+	buf.Reset()
+	w = stripExif{}.Wrap(&FileDoc{Mime: "text/plain"}, &buf)
+	_, err = w.Write([]byte("not an image"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, "not an image", buf.String())
+
+	// A file that pretends to be a JPEG is rejected
+	buf.Reset()
+	w = stripExif{}.Wrap(&FileDoc{Mime: "image/jpeg"}, &buf)
+	_, err = w.Write([]byte("not an image"))
+	assert.Equal(t, ErrTransformFailed, err)
+
+	// And a truncated JPEG too
+	buf.Reset()
+	w = stripExif{}.Wrap(&FileDoc{Mime: "image/jpeg"}, &buf)
+	_, err = w.Write(original[:100])
+	assert.NoError(t, err)
+	assert.Equal(t, ErrTransformFailed, w.Close())
+}
@@ -0,0 +1,154 @@
+package vfs
+
+import (
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/logger"
+)
+
+// trashEvictionBatch is the number of candidates for the eviction fetched at
+// once from CouchDB.
+const trashEvictionBatch = 20
+
+// trashLimits returns the maximal size in bytes and the maximal number of
+// items of the trash, as configured with the fs.trash_max_size and
+// fs.trash_max_count parameters. 0 means no limit.
+func trashLimits() (int64, int) {
+	conf := config.GetConfig()
+	if conf == nil {
+		return 0, 0
+	}
+	return conf.Fs.TrashMaxSize, conf.Fs.TrashMaxCount
+}
+
+// overTrashLimits returns true if the trash exceeds one of the limits.
+func overTrashLimits(summary *TrashSummary, maxSize int64, maxCount int) bool {
+	if maxSize > 0 && summary.Size > maxSize {
+		return true
+	}
+	return maxCount > 0 && summary.Files+summary.Dirs > maxCount
+}
+
+// EvictTrash permanently destroys the oldest items of the trash, until it is
+// under the limits of the config (the total size of the files, and the
+// number of files and directories, counted recursively like in the trash
+// summary). The item with the keep id, the one that has just been put in the
+// trash, is never evicted, even if it exceeds the limits on its own. The
+// items trashed before the trashed_at attribute was introduced are the oldest
+// ones, like in the listing of the trash: they are evicted first, from the
+// least recently modified. It returns the ids of the evicted items.
+func EvictTrash(fs VFS, db couchdb.Database, keep string) ([]string, error) {
+	maxSize, maxCount := trashLimits()
+	if maxSize <= 0 && maxCount <= 0 {
+		return nil, nil
+	}
+
+	var evicted []string
+	for {
+		summary, err := GetTrashSummary(db)
+		if err != nil {
+			return evicted, err
+		}
+		if !overTrashLimits(summary, maxSize, maxCount) {
+			return evicted, nil
+		}
+
+		docs, err := trashEvictionCandidates(db)
+		if err != nil {
+			return evicted, err
+		}
+
+		destroyed := false
+		for _, doc := range docs {
+			if doc.ID() == keep {
+				continue
+			}
+			dir, file := doc.Refine()
+			if dir != nil {
+				err = fs.DestroyDirAndContent(dir)
+			} else if file != nil {
+				err = fs.DestroyFile(file)
+			} else {
+				continue
+			}
+			if err != nil {
+				return evicted, err
+			}
+			evicted = append(evicted, doc.ID())
+			destroyed = true
+			summary, err = GetTrashSummary(db)
+			if err != nil {
+				return evicted, err
+			}
+			if !overTrashLimits(summary, maxSize, maxCount) {
+				return evicted, nil
+			}
+		}
+		if !destroyed {
+			// Only the kept item is left
+			return evicted, nil
+		}
+	}
+}
+
+// trashEvictionCandidates returns the oldest direct children of the trash:
+// the ones without trashed_at sorted on their modification date if there are
+// some left, or else the ones with trashed_at sorted on this date.
+func trashEvictionCandidates(db couchdb.Database) ([]DirOrFileDoc, error) {
+	var docs []DirOrFileDoc
+	legacy := &couchdb.FindRequest{
+		UseIndex: "dir-children-by-updated-at",
+		Selector: mango.And(
+			mango.Equal("dir_id", consts.TrashDirID),
+			mango.Not(mango.Exists("trashed_at")),
+			mango.Exists("updated_at"),
+		),
+		Sort: mango.SortBy{
+			{Field: "dir_id", Direction: mango.Asc},
+			{Field: "updated_at", Direction: mango.Asc},
+		},
+		Limit: trashEvictionBatch,
+	}
+	if err := couchdb.FindDocs(db, consts.Files, legacy, &docs); err != nil {
+		return nil, err
+	}
+	if len(docs) > 0 {
+		return docs, nil
+	}
+
+	dated := &couchdb.FindRequest{
+		UseIndex: "dir-children-by-trashed-at",
+		Selector: mango.And(
+			mango.Equal("dir_id", consts.TrashDirID),
+			mango.Exists("trashed_at"),
+		),
+		Sort: mango.SortBy{
+			{Field: "dir_id", Direction: mango.Asc},
+			{Field: "trashed_at", Direction: mango.Asc},
+		},
+		Limit: trashEvictionBatch,
+	}
+	if err := couchdb.FindDocs(db, consts.Files, dated, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// evictTrashAfter destroys the oldest items of the trash when it exceeds the
+// limits of the config, after the item with the keep id has been put in the
+// trash. It is called for all the ways to put an item in the trash (by a
+// client, or by a sharing). An error is only logged, as this item is in the
+// trash anyway.
+func evictTrashAfter(fs VFS, keep string) {
+	db := couchdb.SimpleDatabasePrefix(fs.Domain())
+	evicted, err := EvictTrash(fs, db, keep)
+	log := logger.WithDomain(fs.Domain()).WithField("nspace", "vfs")
+	if len(evicted) > 0 {
+		log.Infof("Evicted %d items from the trash: %v", len(evicted), evicted)
+	}
+	if err != nil {
+		log.Warnf("Cannot evict the oldest items of the trash: %s", err)
+	}
+}
@@ -0,0 +1,102 @@
+package vfs
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// TrashSummary gives the counts for the content of the trash, without
+// listing it.
+type TrashSummary struct {
+	Files  int        `json:"files"`
+	Dirs   int        `json:"directories"`
+	Size   int64      `json:"size,string"` // Serialized in JSON as a string, like the size of a file
+	Oldest *time.Time `json:"oldest,omitempty"`
+}
+
+// GetTrashSummary returns the number of files and directories in the trash
+// (recursively), the total size of these files, and the date of the oldest
+// deletion of an item that is still in the trash (or the modification date of
+// the oldest item trashed without a date).
+func GetTrashSummary(db couchdb.Database) (*TrashSummary, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.FilesTrashSummaryView, &couchdb.ViewRequest{
+		Reduce: true,
+		Group:  true,
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	summary := &TrashSummary{}
+	for _, row := range res.Rows {
+		stats, ok := row.Value.(map[string]interface{})
+		if !ok {
+			return nil, ErrWrongCouchdbState
+		}
+		count, _ := stats["count"].(float64)
+		sum, _ := stats["sum"].(float64)
+		switch row.Key {
+		case consts.FileType:
+			summary.Files = int(count)
+			summary.Size = int64(sum)
+		case consts.DirType:
+			summary.Dirs = int(count)
+		}
+	}
+
+	// The items inside a trashed directory have no trashed_at, so the oldest
+	// item is one of the direct children of the trash. The children trashed
+	// before the trashed_at attribute was introduced are the oldest ones, like
+	// in the listing of the trash, and their modification date is used.
+	var legacy []struct {
+		UpdatedAt *time.Time `json:"updated_at"`
+	}
+	req := &couchdb.FindRequest{
+		UseIndex: "dir-children-by-updated-at",
+		Selector: mango.And(
+			mango.Equal("dir_id", consts.TrashDirID),
+			mango.Not(mango.Exists("trashed_at")),
+			mango.Exists("updated_at"),
+		),
+		Sort: mango.SortBy{
+			{Field: "dir_id", Direction: mango.Asc},
+			{Field: "updated_at", Direction: mango.Asc},
+		},
+		Fields: []string{"updated_at"},
+		Limit:  1,
+	}
+	if err := couchdb.FindDocs(db, consts.Files, req, &legacy); err != nil {
+		return nil, err
+	}
+	if len(legacy) > 0 {
+		summary.Oldest = legacy[0].UpdatedAt
+		return summary, nil
+	}
+
+	var docs []struct {
+		TrashedAt *time.Time `json:"trashed_at"`
+	}
+	req = &couchdb.FindRequest{
+		UseIndex: "dir-children-by-trashed-at",
+		Selector: mango.And(
+			mango.Equal("dir_id", consts.TrashDirID),
+			mango.Exists("trashed_at"),
+		),
+		Sort: mango.SortBy{
+			{Field: "dir_id", Direction: mango.Asc},
+			{Field: "trashed_at", Direction: mango.Asc},
+		},
+		Fields: []string{"trashed_at"},
+		Limit:  1,
+	}
+	if err := couchdb.FindDocs(db, consts.Files, req, &docs); err != nil {
+		return nil, err
+	}
+	if len(docs) > 0 {
+		summary.Oldest = docs[0].TrashedAt
+	}
+	return summary, nil
+}
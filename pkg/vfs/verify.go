@@ -0,0 +1,99 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+)
+
+// Statuses of a verification of the content of a file
+const (
+	VerifyOK       = "ok"
+	VerifyMismatch = "mismatch"
+)
+
+// Verification is the result of the verification of the content of a file
+// against its md5sum.
+type Verification struct {
+	Status   string `json:"status"`
+	Expected []byte `json:"expected_md5sum"`
+	Computed []byte `json:"computed_md5sum"`
+}
+
+// VerifyReport is the result of the verification of all the files of an
+// instance.
+type VerifyReport struct {
+	Checked   int      `json:"checked"`
+	Corrupted []string `json:"corrupted"`
+	Failures  []string `json:"failures,omitempty"`
+}
+
+// VerifyFile reads the content of a file, computes its md5sum, and compares
+// it with the md5sum of the document. The corrupted flag of the document is
+// updated if needed.
+func VerifyFile(fs VFS, doc *FileDoc) (*Verification, error) {
+	content, err := fs.OpenFile(doc)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	h := md5.New()
+	if _, err = io.Copy(h, content); err != nil {
+		return nil, err
+	}
+
+	v := &Verification{
+		Status:   VerifyOK,
+		Expected: doc.MD5Sum,
+		Computed: h.Sum(nil),
+	}
+	if !bytes.Equal(v.Expected, v.Computed) {
+		v.Status = VerifyMismatch
+	}
+
+	if corrupted := v.Status == VerifyMismatch; corrupted != doc.Corrupted {
+		newdoc := doc.Clone().(*FileDoc)
+		newdoc.Corrupted = corrupted
+		if err = fs.UpdateFileDoc(doc, newdoc); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// VerifyAllFiles verifies the content of all the files of the VFS. The
+// progress is computed from the number of bytes that have been read.
+func VerifyAllFiles(fs VFS, progress func(percent int)) (*VerifyReport, error) {
+	total, err := fs.DiskUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{Corrupted: []string{}}
+	var read int64
+	err = Walk(fs, "/", func(name string, dir *DirDoc, file *FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return nil
+		}
+		v, errv := VerifyFile(fs, file)
+		if errv != nil {
+			report.Failures = append(report.Failures, file.ID())
+		} else if v.Status == VerifyMismatch {
+			report.Corrupted = append(report.Corrupted, file.ID())
+		}
+		report.Checked++
+		read += file.ByteSize
+		if total > 0 && progress != nil {
+			progress(int(read * 100 / total))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
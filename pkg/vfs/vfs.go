@@ -6,6 +6,7 @@
 package vfs
 
 import (
+	"context"
 	"errors"
 	"io"
 	mimetype "mime"
@@ -14,9 +15,14 @@ import (
 	"path"
 	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	multierror "github.com/hashicorp/go-multierror"
+	"golang.org/x/text/unicode/norm"
 )
 
 // DefaultContentType is used for files uploaded with no content-type
@@ -49,6 +55,10 @@ const (
 // recursive walk process.
 const maxWalkRecursive = 512
 
+// maxConflictRetries is the maximum number of times a patch is applied again
+// on the last revision of a document after a conflict in CouchDB.
+const maxConflictRetries = 3
+
 // ErrSkipDir is used in WalkFn as an error to skip the current
 // directory. It is not returned by any function of the package.
 var ErrSkipDir = errors.New("skip directories")
@@ -105,6 +115,14 @@ type File interface {
 	io.Closer
 }
 
+// FileAborter is implemented by the files open for writing whose creation can
+// be cancelled, for example when the upload is interrupted. After Abort, Close
+// removes the content that has been written, does not commit the document,
+// and returns the given error.
+type FileAborter interface {
+	Abort(err error)
+}
+
 // FilePather is an interface for computing the fullpath of a filedoc
 type FilePather interface {
 	FilePath(doc *FileDoc) (string, error)
@@ -123,6 +141,17 @@ type Indexer interface {
 	// DiskUsage computes the total size of the files contained in the VFS.
 	DiskUsage() (int64, error)
 
+	// AcquireBlob adds a reference to the shared content with the given md5sum
+	// and size, and creates it if needed. It returns the key of the blob, and
+	// if the content was already stored.
+	AcquireBlob(md5sum []byte, size int64) (key string, existed bool, err error)
+	// ReleaseBlob removes a reference to a shared content. It returns true if
+	// it was the last reference, and the content can be deleted.
+	ReleaseBlob(key string) (last bool, err error)
+	// DedupSavings returns the number of bytes saved by the deduplication of
+	// the contents.
+	DedupSavings() (int64, error)
+
 	// CreateFileDoc creates and add in the index a new file document.
 	CreateFileDoc(doc *FileDoc) error
 	// CreateNamedFileDoc creates and add in the index a new file document with
@@ -134,6 +163,12 @@ type Indexer interface {
 	UpdateFileDoc(olddoc, newdoc *FileDoc) error
 	// DeleteFileDoc removes from the index the specified file document.
 	DeleteFileDoc(doc *FileDoc) error
+	// FileConflicts returns the revisions of a file document that are in
+	// conflict with its current revision.
+	FileConflicts(doc *FileDoc) ([]*FileDoc, error)
+	// DeleteFileConflicts deletes the given conflicting revisions of a file
+	// document.
+	DeleteFileConflicts(doc *FileDoc, revs []string) error
 
 	// CreateDirDoc creates and add in the index a new directory document.
 	CreateDirDoc(doc *DirDoc) error
@@ -157,6 +192,9 @@ type Indexer interface {
 	// DirByPath returns the directory document information associated with the
 	// specified path.
 	DirByPath(name string) (*DirDoc, error)
+	// SubdirsDepth returns the depth of the deepest directory inside the
+	// specified directory, relatively to it (0 if it has no sub-directory).
+	SubdirsDepth(doc *DirDoc) (int, error)
 
 	// FileByID returns the file document information associated with the
 	// specified identifier.
@@ -179,6 +217,13 @@ type Indexer interface {
 	// DirBatch returns a batch of documents
 	DirBatch(*DirDoc, couchdb.Cursor) ([]DirOrFileDoc, error)
 	DirLength(*DirDoc) (int, error)
+	// DirBatchTrashed returns a batch of documents, filtered on their trashed
+	// attribute
+	DirBatchTrashed(doc *DirDoc, trashed bool, cursor couchdb.Cursor) ([]DirOrFileDoc, error)
+	DirLengthTrashed(doc *DirDoc, trashed bool) (int, error)
+	// DirBatchFiltered returns a batch of documents that match the filter,
+	// sorted by their update date
+	DirBatchFiltered(doc *DirDoc, filter *DirFilter, cursor *couchdb.SkipCursor) ([]DirOrFileDoc, error)
 	DirChildExists(dirID, filename string) (bool, error)
 	BatchDelete([]couchdb.Doc) error
 
@@ -186,6 +231,30 @@ type Indexer interface {
 	CheckIndexIntegrity() ([]*FsckLog, error)
 }
 
+// DirFilter is used to select only some children of a directory. A nil field
+// means that no filter is applied on it.
+type DirFilter struct {
+	Trashed      *bool
+	UpdatedSince *time.Time
+	CreatedSince *time.Time
+	// Classes keeps only the files with one of those classes
+	Classes []string
+	// TrashedAtSort can be mango.Asc or mango.Desc to sort the children on
+	// the date they have been put in the trash. The children without this
+	// date, trashed before it was recorded, are considered as the oldest.
+	TrashedAtSort mango.SortDirection
+}
+
+// DateFilterKey returns the value to compare with the created_at or
+// updated_at field in a mango selector, to keep the documents created or
+// updated since the given date. The dates are saved in UTC, but the fraction
+// of seconds is omitted in JSON when it is zero, and CouchDB compares them as
+// strings: the comparison is made on the date without the fraction and the
+// time zone, with a precision of one second.
+func DateFilterKey(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05")
+}
+
 // DiskThresholder it an interface that can be implemeted to known how many space
 // is available on the disk.
 type DiskThresholder interface {
@@ -252,6 +321,13 @@ type DocPatch struct {
 	Executable  *bool      `json:"executable,omitempty"`
 	MD5Sum      *[]byte    `json:"md5sum,omitempty"`
 	Class       *string    `json:"class,omitempty"`
+	Starred     *bool      `json:"starred,omitempty"`
+	InheritTags *bool      `json:"inherit_tags,omitempty"`
+
+	// ParentPath is the path of the new parent directory, for clients that
+	// know the destination of a move by its path, and not by its ID. It is
+	// resolved in DirID by ResolveParentPath.
+	ParentPath *string `json:"parent_path,omitempty"`
 }
 
 // DirOrFileDoc is a union struct of FileDoc and DirDoc. It is useful to
@@ -262,11 +338,17 @@ type DirOrFileDoc struct {
 	// fields from FileDoc not contained in DirDoc
 	ByteSize   int64    `json:"size,string"`
 	MD5Sum     []byte   `json:"md5sum,omitempty"`
+	SHA256Sum  []byte   `json:"sha256sum,omitempty"`
 	Mime       string   `json:"mime,omitempty"`
 	Class      string   `json:"class,omitempty"`
 	Executable bool     `json:"executable,omitempty"`
 	Trashed    bool     `json:"trashed,omitempty"`
 	Metadata   Metadata `json:"metadata,omitempty"`
+	Blob       string   `json:"blob,omitempty"`
+	Corrupted  bool     `json:"corrupted,omitempty"`
+
+	InheritedTags []string    `json:"inherited_tags,omitempty"`
+	Encryption    *Encryption `json:"encryption,omitempty"`
 }
 
 // Refine returns either a DirDoc or FileDoc pointer depending on the type of
@@ -287,6 +369,7 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			UpdatedAt:    fd.UpdatedAt,
 			ByteSize:     fd.ByteSize,
 			MD5Sum:       fd.MD5Sum,
+			SHA256Sum:    fd.SHA256Sum,
 			Mime:         fd.Mime,
 			Class:        fd.Class,
 			Executable:   fd.Executable,
@@ -294,6 +377,14 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			Tags:         fd.Tags,
 			Metadata:     fd.Metadata,
 			ReferencedBy: fd.ReferencedBy,
+			Blob:         fd.Blob,
+			Corrupted:    fd.Corrupted,
+			Starred:      fd.Starred,
+
+			InheritedTags: fd.InheritedTags,
+			TrashedAt:     fd.TrashedAt,
+			TrashReason:   fd.TrashReason,
+			Encryption:    fd.Encryption,
 		}
 	}
 	return nil, nil
@@ -398,7 +489,8 @@ func Mkdir(fs VFS, name string, tags []string) (*DirDoc, error) {
 }
 
 // MkdirAll creates a directory named path, along with any necessary
-// parents, and returns nil, or else returns an error.
+// parents, and returns nil, or else returns an error. The tags are added to
+// the directory if it is created, but not to its parents.
 func MkdirAll(fs VFS, name string, tags []string) (*DirDoc, error) {
 	var err error
 	var dirs []string
@@ -420,12 +512,16 @@ func MkdirAll(fs VFS, name string, tags []string) (*DirDoc, error) {
 	}
 
 	for i := len(dirs) - 1; i >= 0; i-- {
-		parent, err = NewDirDocWithParent(dirs[i], parent, nil)
+		var dirTags []string
+		if i == 0 {
+			dirTags = tags
+		}
+		parent, err = NewDirDocWithParent(dirs[i], parent, dirTags)
 		if err == nil {
 			err = fs.CreateDir(parent)
 			// XXX MkdirAll has no lock, so we have to consider the risk of a race condition
 			if os.IsExist(err) {
-				parent, err = fs.DirByPath(path.Join(parent.Fullpath, dirs[i]))
+				parent, err = fs.DirByPath(parent.Fullpath)
 			}
 		}
 		if err != nil {
@@ -436,6 +532,34 @@ func MkdirAll(fs VFS, name string, tags []string) (*DirDoc, error) {
 	return parent, nil
 }
 
+// ResolveParentPath sets the DirID of the patch to the ID of the directory
+// with its ParentPath, if any. With create, the missing directories are
+// created, like for MkdirAll. Else, ErrParentDoesNotExist is returned if there
+// is no directory with this path.
+func ResolveParentPath(fs VFS, patch *DocPatch, create bool) error {
+	if patch.ParentPath == nil {
+		return nil
+	}
+	name, err := CleanPath(*patch.ParentPath)
+	if err != nil {
+		return err
+	}
+	parent, err := fs.DirByPath(name)
+	if os.IsNotExist(err) {
+		if !create {
+			return ErrParentDoesNotExist
+		}
+		parent, err = MkdirAll(fs, name, nil)
+	}
+	if err != nil {
+		return err
+	}
+	dirID := parent.ID()
+	patch.DirID = &dirID
+	patch.ParentPath = nil
+	return nil
+}
+
 // Rename will rename a file or directory from a specified path to
 // another.
 func Rename(fs VFS, oldpath, newpath string) error {
@@ -561,28 +685,77 @@ func WalkByID(fs Indexer, fileID string, walkFn WalkFn) error {
 	return walk(fs, root, dir, file, walkFn, 0)
 }
 
+// WalkOptions can be used to tune the walk of a tree with WalkContext.
+type WalkOptions struct {
+	// ByFetch is the number of children of a directory that are loaded at
+	// once (by default, the maximal size of a page of the iterator).
+	ByFetch int
+	// SkipErrors can be set to true to continue the walk when the walkFn
+	// returns an error. The errors are collected and returned at the end.
+	SkipErrors bool
+}
+
+// WalkContext walks the file tree document rooted at root, depth-first, like
+// Walk. The walk is stopped if the context is canceled. The walkFn can return
+// ErrSkipDir to prune the current directory.
+func WalkContext(ctx context.Context, fs Indexer, root string, opts *WalkOptions, walkFn WalkFn) error {
+	dir, file, err := fs.DirOrFileByPath(root)
+	if err != nil {
+		return walkFn(root, dir, file, err)
+	}
+	if opts == nil {
+		opts = &WalkOptions{}
+	}
+	w := &walker{ctx: ctx, fs: fs, opts: opts, walkFn: walkFn}
+	if err = w.walk(root, dir, file, 0); err != nil {
+		return err
+	}
+	return w.errs.ErrorOrNil()
+}
+
 func walk(fs Indexer, name string, dir *DirDoc, file *FileDoc, walkFn WalkFn, count int) error {
+	w := &walker{
+		ctx:    context.Background(),
+		fs:     fs,
+		opts:   &WalkOptions{},
+		walkFn: walkFn,
+	}
+	return w.walk(name, dir, file, count)
+}
+
+type walker struct {
+	ctx    context.Context
+	fs     Indexer
+	opts   *WalkOptions
+	walkFn WalkFn
+	errs   *multierror.Error
+}
+
+func (w *walker) walk(name string, dir *DirDoc, file *FileDoc, count int) error {
 	if count >= maxWalkRecursive {
 		return ErrWalkOverflow
 	}
-	err := walkFn(name, dir, file, nil)
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	err := w.walkFn(name, dir, file, nil)
 	if err != nil {
 		if dir != nil && err == ErrSkipDir {
 			return nil
 		}
-		return err
+		return w.skip(err)
 	}
 	if file != nil {
 		return nil
 	}
-	iter := fs.DirIterator(dir, nil)
+	iter := w.fs.DirIterator(dir, &IteratorOptions{ByFetch: w.opts.ByFetch})
 	for {
 		d, f, err := iter.Next()
 		if err == ErrIteratorDone {
 			break
 		}
 		if err != nil {
-			return walkFn(name, nil, nil, err)
+			return w.skip(w.walkFn(name, nil, nil, err))
 		}
 		var fullpath string
 		if f != nil {
@@ -590,17 +763,34 @@ func walk(fs Indexer, name string, dir *DirDoc, file *FileDoc, walkFn WalkFn, co
 		} else {
 			fullpath = path.Join(name, d.DocName)
 		}
-		if err = walk(fs, fullpath, d, f, walkFn, count+1); err != nil {
+		if err = w.walk(fullpath, d, f, count+1); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// skip returns nil and keeps the error for later if the errors should be
+// skipped.
+func (w *walker) skip(err error) error {
+	if err == nil || !w.opts.SkipErrors || err == ErrWalkOverflow || err == w.ctx.Err() {
+		return err
+	}
+	w.errs = multierror.Append(w.errs, err)
+	return nil
+}
+
 // ExtractMimeAndClass returns a mime and class value from the
 // specified content-type. For now it only takes the first segment of
 // the type as the class and the whole type as mime.
 func ExtractMimeAndClass(contentType string) (mime, class string) {
+	return ExtractMimeAndClassWithRules(contentType, nil)
+}
+
+// ExtractMimeAndClassWithRules works like ExtractMimeAndClass, but the given
+// rules, a map of mime types to classes, take precedence over the built-in
+// rules of the class taxonomy.
+func ExtractMimeAndClassWithRules(contentType string, rules map[string]string) (mime, class string) {
 	if contentType == "" {
 		contentType = DefaultContentType
 	}
@@ -613,40 +803,19 @@ func ExtractMimeAndClass(contentType string) (mime, class string) {
 	}
 
 	mime = strings.TrimSpace(mime)
-	switch mime {
-	case DefaultContentType:
-		class = "files"
-	case "application/x-apple-diskimage", "application/x-msdownload":
-		class = "binary"
-	case "text/html", "text/css", "text/xml", "application/js", "text/x-c",
-		"text/x-go", "text/x-python", "application/x-ruby":
-		class = "code"
-	case "application/pdf":
-		class = "pdf"
-	case "application/vnd.ms-powerpoint", "application/x-iwork-keynote-sffkey",
-		"application/vnd.oasis.opendocument.graphics",
-		"application/vnd.openxmlformats-officedocument.presentationml.presentation":
-		class = "slide"
-	case "application/vnd.ms-excel", "application/x-iwork-numbers-sffnumbers",
-		"application/vnd.oasis.opendocument.spreadsheet",
-		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":
-		class = "spreadsheet"
-	case "application/msword", "application/x-iwork-pages-sffpages",
-		"application/vnd.oasis.opendocument.text",
-		"application/vnd.openxmlformats-officedocument.wordprocessingml.document":
-		class = "text"
-	case "application/x-7z-compressed", "application/x-rar-compressed",
-		"application/zip", "application/gzip", "application/x-tar":
-		class = "zip"
-	default:
-		slashIndex := strings.Index(mime, "/")
-		if slashIndex >= 0 {
-			class = mime[:slashIndex]
-		} else {
-			class = mime
-		}
+	if c, ok := rules[mime]; ok && c != "" {
+		return mime, c
+	}
+	if c, ok := mimeClasses[mime]; ok {
+		return mime, c
 	}
 
+	slashIndex := strings.Index(mime, "/")
+	if slashIndex >= 0 {
+		class = mime[:slashIndex]
+	} else {
+		class = mime
+	}
 	return mime, class
 }
 
@@ -724,18 +893,40 @@ func getRestoreDir(fs VFS, name, restorePath string) (*DirDoc, error) {
 	// This should not happened but is here in case we could not resolve the
 	// restore path
 	if restorePath == "" {
-		restorePath = "/"
+		restorePath = restoreFallbackDir()
+		if restorePath == "" {
+			restorePath = "/"
+		}
 	}
 
-	// If the restore directory does not exist anymore, we re-create the
-	// directory hierarchy to restore the file in.
+	// If the restore directory does not exist anymore, we use the fallback
+	// directory of the config if any, or else we re-create the directory
+	// hierarchy to restore the file in.
 	restoreDir, err := fs.DirByPath(restorePath)
 	if os.IsNotExist(err) {
+		if fallback := restoreFallbackDir(); fallback != "" {
+			restorePath = fallback
+		}
 		return MkdirAll(fs, restorePath, nil)
 	}
 	return restoreDir, err
 }
 
+// restoreFallbackDir returns the path of the directory where the files are
+// restored when their original directory no longer exists, as configured by
+// the fs.restore_fallback_dir parameter, or "" if it is not set (or invalid).
+func restoreFallbackDir() string {
+	conf := config.GetConfig()
+	if conf == nil || conf.Fs.RestoreFallbackDir == "" {
+		return ""
+	}
+	dir := path.Clean(conf.Fs.RestoreFallbackDir)
+	if !path.IsAbs(dir) || strings.HasPrefix(dir, TrashDirName) {
+		return ""
+	}
+	return dir
+}
+
 func normalizeDocPatch(data, patch *DocPatch, cdate time.Time) (*DocPatch, error) {
 	if patch.DirID == nil {
 		patch.DirID = data.DirID
@@ -765,16 +956,83 @@ func normalizeDocPatch(data, patch *DocPatch, cdate time.Time) (*DocPatch, error
 		patch.Executable = data.Executable
 	}
 
+	if patch.Starred == nil {
+		patch.Starred = data.Starred
+	}
+
+	if patch.InheritTags == nil {
+		patch.InheritTags = data.InheritTags
+	}
+
 	return patch, nil
 }
 
+// normalizeFileName returns the name in the unicode NFC form, to avoid having
+// two files with visually identical names in the same directory (macOS uses
+// NFD for example). It can be disabled with fs.preserve_unicode_names.
+func normalizeFileName(name string) string {
+	if conf := config.GetConfig(); conf != nil && conf.Fs.PreserveUnicodeNames {
+		return name
+	}
+	return norm.NFC.String(name)
+}
+
+// CleanPath returns the canonical form of the given path, to be used for a
+// lookup in the VFS. The path must be absolute, and it can't have a ".."
+// segment: it is rejected instead of being resolved, to avoid a path like
+// /Documents/../../etc being silently mapped to another directory.
+func CleanPath(name string) (string, error) {
+	if !path.IsAbs(name) {
+		return "", ErrNonAbsolutePath
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", ErrPathTraversal
+		}
+	}
+	return path.Clean(name), nil
+}
+
+// checkFileName checks that the given name can be used for a file or a
+// directory. The maximal length and the illegal characters can be configured
+// with the fs.max_name_length and fs.illegal_chars parameters.
 func checkFileName(str string) error {
 	if str == "" || strings.ContainsAny(str, ForbiddenFilenameChars) {
 		return ErrIllegalFilename
 	}
+	if conf := config.GetConfig(); conf != nil {
+		if conf.Fs.MaxNameLength > 0 && len(str) > conf.Fs.MaxNameLength {
+			return ErrFilenameTooLong
+		}
+		if conf.Fs.IllegalChars != "" && strings.ContainsAny(str, conf.Fs.IllegalChars) {
+			return ErrIllegalFilename
+		}
+	}
+	return nil
+}
+
+// MaxTrashReasonLength is the maximal number of characters of the note that
+// explains why a file or directory has been put in the trash.
+const MaxTrashReasonLength = 256
+
+// CheckTrashReason checks that the given note can be kept with a file or a
+// directory put in the trash.
+func CheckTrashReason(reason string) error {
+	if utf8.RuneCountInString(reason) > MaxTrashReasonLength {
+		return ErrTrashReasonTooLong
+	}
 	return nil
 }
 
+// MaxUploadSize returns the maximal size in bytes of a file, as configured
+// with the fs.max_upload_size parameter, or -1 if there is no limit.
+func MaxUploadSize() int64 {
+	if conf := config.GetConfig(); conf != nil && conf.Fs.MaxUploadSize > 0 {
+		return conf.Fs.MaxUploadSize
+	}
+	return -1
+}
+
 func uniqueTags(tags []string) []string {
 	m := make(map[string]struct{})
 	clone := make([]string, 0)
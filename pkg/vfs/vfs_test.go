@@ -3,6 +3,8 @@ package vfs_test
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/md5"
 	"errors"
 	"fmt"
 	"io"
@@ -12,6 +14,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -242,6 +245,29 @@ func TestGetFileDocFromPath(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestPathTraversal(t *testing.T) {
+	for _, name := range []string{"/..", "/a/../../etc", "/container/../container/toto", "/container/.."} {
+		_, err := fs.DirByPath(name)
+		assert.Equal(t, vfs.ErrPathTraversal, err, name)
+		_, err = fs.FileByPath(name)
+		assert.Equal(t, vfs.ErrPathTraversal, err, name)
+		_, _, err = fs.DirOrFileByPath(name)
+		assert.Equal(t, vfs.ErrPathTraversal, err, name)
+	}
+
+	_, err := fs.FileByPath("container/toto")
+	assert.Equal(t, vfs.ErrNonAbsolutePath, err)
+
+	doc, err := fs.FileByPath("/container/./toto")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "toto", doc.DocName)
+	}
+	dir, err := fs.DirByPath("/container/")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/container", dir.Fullpath)
+	}
+}
+
 func TestCreateGetAndModifyFile(t *testing.T) {
 	origtree := H{
 		"createandget1/": H{
@@ -300,6 +326,101 @@ func TestCreateGetAndModifyFile(t *testing.T) {
 	assert.Equal(t, "image/jpeg", fileAfter.Mime)
 }
 
+func TestModifyFileMetadataWithRetry(t *testing.T) {
+	_, err := createTree(H{"retryonconflict/": H{"file": nil}}, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	stale, err := fs.FileByPath("/retryonconflict/file")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tags1 := []string{"foo"}
+	_, err = vfs.ModifyFileMetadata(fs, stale, &vfs.DocPatch{Tags: &tags1})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tags2 := []string{"bar"}
+	_, err = vfs.ModifyFileMetadata(fs, stale, &vfs.DocPatch{Tags: &tags2})
+	assert.True(t, couchdb.IsConflictError(err))
+
+	newdoc, err := vfs.ModifyFileMetadataWithRetry(fs, stale, &vfs.DocPatch{Tags: &tags2})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, tags2, newdoc.Tags)
+	assert.True(t, strings.HasPrefix(newdoc.Rev(), "3-"))
+}
+
+func TestConfigurableFileNames(t *testing.T) {
+	conf := config.GetConfig()
+	conf.Fs.MaxNameLength = 10
+	conf.Fs.IllegalChars = ":*"
+	defer func() {
+		conf.Fs.MaxNameLength = 0
+		conf.Fs.IllegalChars = ""
+	}()
+
+	_, err := vfs.NewFileDoc("0123456789", consts.RootDirID, -1, nil, "", "", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	_, err = vfs.NewFileDoc("0123456789a", consts.RootDirID, -1, nil, "", "", time.Now(), false, false, nil)
+	assert.Equal(t, vfs.ErrFilenameTooLong, err)
+	// The length is counted in bytes: é is 2 bytes long
+	_, err = vfs.NewFileDoc("012345678é", consts.RootDirID, -1, nil, "", "", time.Now(), false, false, nil)
+	assert.Equal(t, vfs.ErrFilenameTooLong, err)
+	_, err = vfs.NewDirDoc(fs, "0123456789a", consts.RootDirID, nil)
+	assert.Equal(t, vfs.ErrFilenameTooLong, err)
+
+	_, err = vfs.NewFileDoc("foo:bar", consts.RootDirID, -1, nil, "", "", time.Now(), false, false, nil)
+	assert.Equal(t, vfs.ErrIllegalFilename, err)
+	_, err = vfs.NewDirDoc(fs, "foo*", consts.RootDirID, nil)
+	assert.Equal(t, vfs.ErrIllegalFilename, err)
+	_, err = vfs.NewFileDoc("foo/bar", consts.RootDirID, -1, nil, "", "", time.Now(), false, false, nil)
+	assert.Equal(t, vfs.ErrIllegalFilename, err)
+}
+
+func TestNormalizedFileNames(t *testing.T) {
+	composed := "caf\u00e9"
+	decomposed := "cafe\u0301"
+	assert.NotEqual(t, composed, decomposed)
+
+	doc, err := vfs.NewFileDoc(composed, consts.RootDirID, -1, nil, "", "", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, f.Close())
+
+	other, err := vfs.NewFileDoc(decomposed, consts.RootDirID, -1, nil, "", "", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, composed, other.DocName)
+	_, err = fs.CreateFile(other, nil)
+	assert.True(t, os.IsExist(err))
+
+	found, err := fs.FileByPath("/" + decomposed)
+	if assert.NoError(t, err) {
+		assert.Equal(t, doc.ID(), found.ID())
+	}
+
+	dir, err := vfs.NewDirDoc(fs, "r\u00e9sum\u00e9", consts.RootDirID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, fs.CreateDir(dir))
+	found2, err := fs.DirByPath("/re\u0301sume\u0301")
+	if assert.NoError(t, err) {
+		assert.Equal(t, dir.ID(), found2.ID())
+	}
+}
+
 func TestUpdateDir(t *testing.T) {
 	origtree := H{
 		"update1/": H{
@@ -431,6 +552,78 @@ func TestWalk(t *testing.T) {
 	assert.Equal(t, expectedWalk, walked)
 }
 
+func TestWalkContext(t *testing.T) {
+	walktree := H{
+		"walkctx/": H{
+			"dirchild1/": H{
+				"food/": H{},
+				"bard/": H{},
+			},
+			"dirchild2/": H{
+				"foof": nil,
+				"barf": nil,
+				"bazf": nil,
+			},
+			"filechild1": nil,
+		},
+	}
+
+	_, err := createTree(walktree, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Pruning a sub-tree, and reading the children one by one
+	walked := H{}
+	opts := &vfs.WalkOptions{ByFetch: 1}
+	err = vfs.WalkContext(context.Background(), fs, "/walkctx", opts, func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if !assert.NoError(t, err) {
+			return err
+		}
+		walked[name] = nil
+		if name == "/walkctx/dirchild1" {
+			return vfs.ErrSkipDir
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, H{
+		"/walkctx":                nil,
+		"/walkctx/dirchild1":      nil,
+		"/walkctx/dirchild2":      nil,
+		"/walkctx/dirchild2/foof": nil,
+		"/walkctx/dirchild2/barf": nil,
+		"/walkctx/dirchild2/bazf": nil,
+		"/walkctx/filechild1":     nil,
+	}, walked)
+
+	// Skipping the errors
+	count := 0
+	opts = &vfs.WalkOptions{SkipErrors: true}
+	err = vfs.WalkContext(context.Background(), fs, "/walkctx", opts, func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		count++
+		if file != nil && strings.HasPrefix(file.DocName, "ba") {
+			return errors.New("failure on " + name)
+		}
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 9, count)
+	assert.Contains(t, err.Error(), "failure on /walkctx/dirchild2/barf")
+	assert.Contains(t, err.Error(), "failure on /walkctx/dirchild2/bazf")
+
+	// Canceling the walk
+	ctx, cancel := context.WithCancel(context.Background())
+	count = 0
+	err = vfs.WalkContext(ctx, fs, "/walkctx", nil, func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		count++
+		cancel()
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, count)
+}
+
 func TestIterator(t *testing.T) {
 	iterTree := H{
 		"iter/": H{
@@ -590,6 +783,52 @@ func TestContentDisposition(t *testing.T) {
 	assert.Equal(t, `inline; filename="tab"; filename*=UTF-8''tab%09`, tab)
 	emoji := vfs.ContentDisposition("inline", "🐧")
 	assert.Equal(t, `inline; filename="download"; filename*=UTF-8''%F0%9F%90%A7`, emoji)
+	cyrillic := vfs.ContentDisposition("attachment", "Привет.txt")
+	assert.Equal(t, `attachment; filename=".txt"; filename*=UTF-8''%D0%9F%D1%80%D0%B8%D0%B2%D0%B5%D1%82.txt`, cyrillic)
+	mixed := vfs.ContentDisposition("attachment", "photo 🐧.jpg")
+	assert.Equal(t, `attachment; filename="photo.jpg"; filename*=UTF-8''photo%20%F0%9F%90%A7.jpg`, mixed)
+}
+
+func TestExtractMimeAndClassWithRules(t *testing.T) {
+	mime, class := vfs.ExtractMimeAndClass("application/pdf; charset=binary")
+	assert.Equal(t, "application/pdf", mime)
+	assert.Equal(t, "pdf", class)
+
+	mime, class = vfs.ExtractMimeAndClass("image/png")
+	assert.Equal(t, "image/png", mime)
+	assert.Equal(t, "image", class)
+
+	rules := map[string]string{
+		"application/x-autocad": "cad",
+		"application/pdf":       "document",
+	}
+	mime, class = vfs.ExtractMimeAndClassWithRules("application/x-autocad", rules)
+	assert.Equal(t, "application/x-autocad", mime)
+	assert.Equal(t, "cad", class)
+	_, class = vfs.ExtractMimeAndClassWithRules("application/pdf", rules)
+	assert.Equal(t, "document", class)
+	_, class = vfs.ExtractMimeAndClassWithRules("", rules)
+	assert.Equal(t, "files", class)
+
+	classes := vfs.Classes(rules)
+	assert.Contains(t, classes, "cad")
+	assert.Contains(t, classes, "image")
+	assert.Contains(t, classes, "spreadsheet")
+}
+
+func TestUploadPolicy(t *testing.T) {
+	var nilPolicy *vfs.UploadPolicy
+	assert.NoError(t, nilPolicy.Check("application/x-msdownload", "binary"))
+
+	deny := &vfs.UploadPolicy{Deny: []string{"binary", "video/*"}}
+	assert.Equal(t, vfs.ErrForbiddenMimeType, deny.Check("application/x-msdownload", "binary"))
+	assert.Equal(t, vfs.ErrForbiddenMimeType, deny.Check("video/mp4", "video"))
+	assert.NoError(t, deny.Check("image/png", "image"))
+
+	allow := &vfs.UploadPolicy{Allow: []string{"image", "application/pdf"}}
+	assert.NoError(t, allow.Check("image/png", "image"))
+	assert.NoError(t, allow.Check("application/pdf", "pdf"))
+	assert.Equal(t, vfs.ErrForbiddenMimeType, allow.Check("text/plain", "text"))
 }
 
 func TestArchive(t *testing.T) {
@@ -628,7 +867,8 @@ func TestArchive(t *testing.T) {
 		},
 	}
 	w := httptest.NewRecorder()
-	err = a.Serve(fs, w)
+	req := httptest.NewRequest("GET", "/files/archive/test.zip", nil)
+	err = a.Serve(fs, w, req)
 	assert.NoError(t, err)
 
 	res := w.Result()
@@ -652,6 +892,12 @@ func TestArchive(t *testing.T) {
 		"test/bar/baz/two.png": nil,
 		"test/bar/z.gif":       nil,
 	}, zipfiles)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = httptest.NewRecorder()
+	err = a.Serve(fs, w, req.WithContext(ctx))
+	assert.Equal(t, context.Canceled, err)
 }
 
 func TestCreateFileTooBig(t *testing.T) {
@@ -763,6 +1009,620 @@ func TestCreateFileTooBig(t *testing.T) {
 	assert.NoError(t, fs.DestroyDirContent(root))
 }
 
+func TestDedup(t *testing.T) {
+	config.GetConfig().Fs.Dedup = true
+	defer func() { config.GetConfig().Fs.Dedup = false }()
+
+	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
+	assert.NoError(t, couchdb.ResetDB(db, consts.FilesBlobs))
+	defer couchdb.DeleteDB(db, consts.FilesBlobs)
+	assert.NoError(t, couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesBlobs)))
+
+	content := []byte("the same content, twice")
+	upload := func(name string) *vfs.FileDoc {
+		doc, err := vfs.NewFileDoc(name, consts.RootDirID, -1, nil, "", "",
+			time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		f, err := fs.CreateFile(doc, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		_, err = f.Write(content)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+		doc, err = fs.FileByPath("/" + name)
+		assert.NoError(t, err)
+		return doc
+	}
+
+	doc1 := upload("dedup1")
+	doc2 := upload("dedup2")
+	if doc1 == nil || doc2 == nil {
+		return
+	}
+	defer func() {
+		root, err := fs.DirByPath("/")
+		if assert.NoError(t, err) {
+			assert.NoError(t, fs.DestroyDirContent(root))
+		}
+	}()
+	if doc1.Blob == "" {
+		t.Skip("the deduplication is not supported by this VFS")
+	}
+	assert.Equal(t, doc1.Blob, doc2.Blob)
+
+	savings, err := fs.DedupSavings()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), savings)
+
+	assert.NoError(t, fs.DestroyFile(doc1))
+	savings, err = fs.DedupSavings()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), savings)
+
+	f, err := fs.OpenFile(doc2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, content, buf)
+
+	assert.NoError(t, fs.DestroyFile(doc2))
+	last, err := fs.ReleaseBlob(doc2.Blob)
+	assert.NoError(t, err)
+	assert.False(t, last)
+}
+
+func TestBlobRefs(t *testing.T) {
+	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
+	assert.NoError(t, couchdb.ResetDB(db, consts.FilesBlobs))
+	defer couchdb.DeleteDB(db, consts.FilesBlobs)
+	assert.NoError(t, couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesBlobs)))
+	index := vfs.NewCouchdbIndexer(db)
+
+	md5sum := []byte("0123456789abcdef")
+	key, shared, err := index.AcquireBlob(md5sum, 42)
+	assert.NoError(t, err)
+	assert.False(t, shared)
+	assert.Equal(t, vfs.BlobKey(md5sum, 42), key)
+
+	// Another size for the same md5sum is another content
+	other, shared, err := index.AcquireBlob(md5sum, 43)
+	assert.NoError(t, err)
+	assert.False(t, shared)
+	assert.NotEqual(t, key, other)
+
+	for i := 0; i < 2; i++ {
+		k, shared, err := index.AcquireBlob(md5sum, 42)
+		assert.NoError(t, err)
+		assert.True(t, shared)
+		assert.Equal(t, key, k)
+	}
+	savings, err := index.DedupSavings()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*42), savings)
+
+	for i := 0; i < 2; i++ {
+		last, err := index.ReleaseBlob(key)
+		assert.NoError(t, err)
+		assert.False(t, last)
+	}
+	savings, err = index.DedupSavings()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), savings)
+
+	last, err := index.ReleaseBlob(key)
+	assert.NoError(t, err)
+	assert.True(t, last)
+
+	// The blob has been deleted with its last reference
+	last, err = index.ReleaseBlob(key)
+	assert.NoError(t, err)
+	assert.False(t, last)
+
+	last, err = index.ReleaseBlob(other)
+	assert.NoError(t, err)
+	assert.True(t, last)
+}
+
+func TestVerifyFile(t *testing.T) {
+	doc, err := vfs.NewFileDoc("verified", consts.RootDirID, -1, nil, "", "",
+		time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("content to verify"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	doc, err = fs.FileByPath("/verified")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		if doc, err := fs.FileByPath("/verified"); err == nil {
+			assert.NoError(t, fs.DestroyFile(doc))
+		}
+	}()
+
+	v, err := vfs.VerifyFile(fs, doc)
+	assert.NoError(t, err)
+	assert.Equal(t, vfs.VerifyOK, v.Status)
+	assert.Equal(t, doc.MD5Sum, v.Computed)
+
+	// Simulate a bit rot by changing the expected checksum
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	newdoc.MD5Sum = []byte("0123456789abcdef")
+	assert.NoError(t, fs.UpdateFileDoc(doc, newdoc))
+	v, err = vfs.VerifyFile(fs, newdoc)
+	assert.NoError(t, err)
+	assert.Equal(t, vfs.VerifyMismatch, v.Status)
+	assert.Equal(t, doc.MD5Sum, v.Computed)
+
+	flagged, err := fs.FileByID(doc.ID())
+	assert.NoError(t, err)
+	assert.True(t, flagged.Corrupted)
+
+	logbook, err := fs.Fsck(vfs.FsckOptions{})
+	assert.NoError(t, err)
+	found := false
+	for _, entry := range logbook {
+		if entry.Type == vfs.ContentCorrupted && entry.FileDoc.ID() == doc.ID() {
+			found = true
+		}
+	}
+	assert.True(t, found)
+
+	fixed := flagged.Clone().(*vfs.FileDoc)
+	fixed.MD5Sum = doc.MD5Sum
+	assert.NoError(t, fs.UpdateFileDoc(flagged, fixed))
+	v, err = vfs.VerifyFile(fs, fixed)
+	assert.NoError(t, err)
+	assert.Equal(t, vfs.VerifyOK, v.Status)
+	fixed, err = fs.FileByID(doc.ID())
+	assert.NoError(t, err)
+	assert.False(t, fixed.Corrupted)
+}
+
+func TestSubtree(t *testing.T) {
+	origtree := H{
+		"subtree/": H{
+			"app/": H{
+				"foo/": H{
+					"bar": nil,
+				},
+			},
+			"other/": H{
+				"secret": nil,
+			},
+		},
+	}
+	_, err := createTree(origtree, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		_ = vfs.RemoveAll(fs, "/subtree")
+	}()
+
+	root, err := fs.DirByPath("/subtree/app")
+	if !assert.NoError(t, err) {
+		return
+	}
+	sub := vfs.NewSubtree(fs, root)
+	assert.Equal(t, "/subtree/app/foo", sub.Abs("foo"))
+	assert.Equal(t, "/subtree/app/foo", sub.Abs("/foo"))
+	assert.Equal(t, "/subtree/app", sub.Abs("/"))
+	assert.Equal(t, "/subtree/app/other", sub.Abs("../../other"))
+
+	rel, err := sub.Rel("/subtree/app/foo/bar")
+	assert.NoError(t, err)
+	assert.Equal(t, "/foo/bar", rel)
+	rel, err = sub.Rel("/subtree/app")
+	assert.NoError(t, err)
+	assert.Equal(t, "/", rel)
+	_, err = sub.Rel("/subtree/application")
+	assert.Equal(t, vfs.ErrOutsideSubtree, err)
+
+	foo, err := sub.DirByPath("/foo")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "/subtree/app/foo", foo.Fullpath)
+	bar, err := sub.FileByPath("foo/bar")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = sub.DirByPath("../other")
+	assert.True(t, os.IsNotExist(err))
+
+	other, err := fs.DirByPath("/subtree/other")
+	if !assert.NoError(t, err) {
+		return
+	}
+	secret, err := fs.FileByPath("/subtree/other/secret")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = sub.DirByID(foo.ID())
+	assert.NoError(t, err)
+	_, err = sub.FileByID(bar.ID())
+	assert.NoError(t, err)
+	_, err = sub.DirByID(other.ID())
+	assert.True(t, os.IsNotExist(err))
+	_, err = sub.FileByID(secret.ID())
+	assert.True(t, os.IsNotExist(err))
+	_, _, err = sub.DirOrFileByID(secret.ID())
+	assert.True(t, os.IsNotExist(err))
+
+	dir, err := sub.MkdirAll("/baz/qux", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "/subtree/app/baz/qux", dir.Fullpath)
+
+	doc, err := vfs.NewFileDoc("leak", other.ID(), -1, nil, "", "", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	_, err = sub.CreateFile(doc, nil)
+	assert.Equal(t, vfs.ErrOutsideSubtree, err)
+	_, err = sub.NewDirDoc("leak", other.ID(), nil)
+	assert.Equal(t, vfs.ErrOutsideSubtree, err)
+
+	doc, err = vfs.NewFileDoc("inside", root.ID(), -1, nil, "", "", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	f, err := sub.CreateFile(doc, nil)
+	if assert.NoError(t, err) {
+		assert.NoError(t, f.Close())
+	}
+	_, err = sub.FileByPath("/inside")
+	assert.NoError(t, err)
+}
+
+func TestMaxDepth(t *testing.T) {
+	conf := config.GetConfig()
+	maxDepth := conf.Fs.MaxDepth
+	defer func() { conf.Fs.MaxDepth = maxDepth }()
+	conf.Fs.MaxDepth = 3
+
+	parent, err := vfs.MkdirAll(fs, "/maxdepth/a/b", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = vfs.Mkdir(fs, "/maxdepth/a/b/c", nil)
+	assert.Equal(t, vfs.ErrMaxDepthExceeded, err)
+	_, err = vfs.MkdirAll(fs, "/maxdepth/x/y/z", nil)
+	assert.Equal(t, vfs.ErrMaxDepthExceeded, err)
+	_, err = vfs.NewDirDocWithParent("c", parent, nil)
+	assert.Equal(t, vfs.ErrMaxDepthExceeded, err)
+
+	moved, err := vfs.MkdirAll(fs, "/maxdepth-moved/child", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	moved, err = fs.DirByID(moved.DirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	a, err := fs.DirByPath("/maxdepth/a")
+	if !assert.NoError(t, err) {
+		return
+	}
+	aID := a.ID()
+	_, err = vfs.ModifyDirMetadata(fs, moved, &vfs.DocPatch{DirID: &aID})
+	assert.Equal(t, vfs.ErrMaxDepthExceeded, err)
+
+	root, err := fs.DirByPath("/maxdepth")
+	if !assert.NoError(t, err) {
+		return
+	}
+	rootID := root.ID()
+	moved, err = vfs.ModifyDirMetadata(fs, moved, &vfs.DocPatch{DirID: &rootID})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/maxdepth/maxdepth-moved", moved.Fullpath)
+	}
+
+	// A directory with a name that starts like the trash is limited
+	_, err = vfs.MkdirAll(fs, vfs.TrashDirName+"-like/a/b/c", nil)
+	assert.Equal(t, vfs.ErrMaxDepthExceeded, err)
+
+	// The trash is not limited
+	trashed, err := vfs.TrashDir(fs, parent)
+	if assert.NoError(t, err) {
+		assert.Equal(t, vfs.TrashDirName+"/b", trashed.Fullpath)
+	}
+}
+
+func TestCreateFileContentLengthMismatch(t *testing.T) {
+	create := func(name string, size int64, content string) error {
+		doc, err := vfs.NewFileDoc(name, consts.RootDirID, size, nil,
+			"text/plain", "text", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		f, err := fs.CreateFile(doc, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		_, errw := io.Copy(f, strings.NewReader(content))
+		errc := f.Close()
+		if errw != nil {
+			return errw
+		}
+		return errc
+	}
+
+	err := create("length-shorter", 10, "foo")
+	assert.Equal(t, vfs.ErrContentLengthMismatch, err)
+	_, err = fs.FileByPath("/length-shorter")
+	assert.True(t, os.IsNotExist(err))
+
+	err = create("length-longer", 3, "foobarbaz")
+	assert.Equal(t, vfs.ErrContentLengthMismatch, err)
+	_, err = fs.FileByPath("/length-longer")
+	assert.True(t, os.IsNotExist(err))
+
+	err = create("length-exact", 3, "foo")
+	assert.NoError(t, err)
+	doc, err := fs.FileByPath("/length-exact")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(3), doc.ByteSize)
+	}
+}
+
+func TestCreateFileUnknownLength(t *testing.T) {
+	doc, err := vfs.NewFileDoc("unknown-length", consts.RootDirID, -1, nil,
+		"text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	content := crypto.GenerateRandomBytes(12345)
+	_, err = io.Copy(f, bytes.NewReader(content))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, int64(len(content)), doc.ByteSize)
+
+	stored, err := fs.FileByPath("/unknown-length")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(len(content)), stored.ByteSize)
+	}
+}
+
+func TestCreateFileAborted(t *testing.T) {
+	newDoc := func() *vfs.FileDoc {
+		doc, err := vfs.NewFileDoc("aborted", consts.RootDirID, -1, nil,
+			"text/plain", "text", time.Now(), false, false, nil)
+		assert.NoError(t, err)
+		return doc
+	}
+
+	f, err := fs.CreateFile(newDoc(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("partial content"))
+	assert.NoError(t, err)
+	aborter, ok := f.(vfs.FileAborter)
+	if !assert.True(t, ok) {
+		return
+	}
+	errRead := errors.New("connection reset")
+	aborter.Abort(errRead)
+	assert.Equal(t, errRead, f.Close())
+
+	_, err = fs.FileByPath("/aborted")
+	assert.True(t, os.IsNotExist(err))
+
+	// No blob has been left behind: the file can be created again
+	f, err = fs.CreateFile(newDoc(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("full content"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	doc, err := fs.FileByPath("/aborted")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(12), doc.ByteSize)
+	}
+
+	// An aborted overwrite keeps the previous content
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	newdoc.ByteSize = -1
+	newdoc.MD5Sum = nil
+	f, err = fs.CreateFile(newdoc, doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("new"))
+	assert.NoError(t, err)
+	f.(vfs.FileAborter).Abort(errRead)
+	assert.Equal(t, errRead, f.Close())
+	doc, err = fs.FileByPath("/aborted")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(12), doc.ByteSize)
+		content, err := fs.OpenFile(doc)
+		if assert.NoError(t, err) {
+			buf, _ := ioutil.ReadAll(content)
+			content.Close()
+			assert.Equal(t, "full content", string(buf))
+		}
+	}
+}
+
+func TestDiskUsageCounter(t *testing.T) {
+	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
+	dir, _ := vfs.NewDirDoc(fs, "usagecounter", "", nil)
+	if !assert.NoError(t, fs.CreateDir(dir)) {
+		return
+	}
+	before, err := fs.DiskUsage()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	n := 10
+	docs := make([]*vfs.FileDoc, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			doc, err := vfs.NewFileDoc(fmt.Sprintf("file%d", i), dir.ID(), -1, nil,
+				"text/plain", "text", time.Now(), false, false, nil)
+			if !assert.NoError(t, err) {
+				return
+			}
+			file, err := fs.CreateFile(doc, nil)
+			if !assert.NoError(t, err) {
+				return
+			}
+			_, err = file.Write([]byte("12345"))
+			assert.NoError(t, err)
+			assert.NoError(t, file.Close())
+			docs[i] = doc
+		}(i)
+	}
+	wg.Wait()
+
+	used, err := fs.DiskUsage()
+	assert.NoError(t, err)
+	assert.Equal(t, before+int64(5*n), used)
+
+	// Overwriting a file adds the difference of size
+	doc, err := fs.FileByID(docs[0].ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	newdoc.ByteSize = -1
+	newdoc.MD5Sum = nil
+	file, err := fs.CreateFile(newdoc, doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = file.Write([]byte("123"))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	// The trashed files still count, until they are destroyed
+	trashed, err := vfs.TrashFile(fs, docs[1])
+	assert.NoError(t, err)
+	used, err = fs.DiskUsage()
+	assert.NoError(t, err)
+	assert.Equal(t, before+int64(5*n-2), used)
+	assert.NoError(t, fs.DestroyFile(trashed))
+
+	used, err = fs.DiskUsage()
+	assert.NoError(t, err)
+	assert.Equal(t, before+int64(5*n-7), used)
+	reconciled, err := vfs.ReconcileDiskUsage(db)
+	assert.NoError(t, err)
+	assert.Equal(t, used, reconciled)
+
+	assert.NoError(t, fs.DestroyDirAndContent(dir))
+	used, err = fs.DiskUsage()
+	assert.NoError(t, err)
+	assert.Equal(t, before, used)
+}
+
+func TestTransformsOnUpload(t *testing.T) {
+	config.GetConfig().Fs.Transforms = map[string][]string{"image/jpeg": {"strip_exif"}}
+	defer func() { config.GetConfig().Fs.Transforms = nil }()
+
+	original, err := ioutil.ReadFile("../../tests/fixtures/wet-cozy_20160910__©M4Dz.jpg")
+	if !assert.NoError(t, err) {
+		return
+	}
+	sum := md5.Sum(original)
+
+	newDoc := func(name string, md5sum []byte) *vfs.FileDoc {
+		doc, err := vfs.NewFileDoc(name, consts.RootDirID, int64(len(original)), md5sum,
+			"image/jpeg", "image", time.Now(), false, false, nil)
+		assert.NoError(t, err)
+		return doc
+	}
+
+	// The md5sum given by the client is checked on the original content
+	f, err := fs.CreateFile(newDoc("transformed-bad.jpg", []byte("0123456789abcdef")), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write(original)
+	assert.NoError(t, err)
+	assert.Equal(t, vfs.ErrInvalidHash, f.Close())
+	_, err = fs.FileByPath("/transformed-bad.jpg")
+	assert.True(t, os.IsNotExist(err))
+
+	f, err = fs.CreateFile(newDoc("transformed.jpg", sum[:]), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write(original)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	doc, err := fs.FileByPath("/transformed.jpg")
+	if !assert.NoError(t, err) {
+		return
+	}
+	content, err := fs.OpenFile(doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	stored, err := ioutil.ReadAll(content)
+	content.Close()
+	assert.NoError(t, err)
+	assert.True(t, len(stored) < len(original))
+	assert.False(t, bytes.Contains(stored, []byte("Exif\x00\x00")))
+	assert.Equal(t, int64(len(stored)), doc.ByteSize)
+	storedSum := md5.Sum(stored)
+	assert.Equal(t, storedSum[:], doc.MD5Sum)
+}
+
+func TestUniqueName(t *testing.T) {
+	dir, err := createTree(H{
+		"uniquename/": H{
+			"photo.jpg":     nil,
+			"photo (2).jpg": nil,
+			"photo (3).jpg": nil,
+			".bashrc":       nil,
+			"notes":         nil,
+			"notes (2)/":    H{},
+		},
+	}, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	name, err := vfs.UniqueName(fs, dir.ID(), "free.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "free.txt", name)
+	name, err = vfs.UniqueName(fs, dir.ID(), "photo.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "photo (4).jpg", name)
+	name, err = vfs.UniqueName(fs, dir.ID(), ".bashrc")
+	assert.NoError(t, err)
+	assert.Equal(t, ".bashrc (2)", name)
+	name, err = vfs.UniqueName(fs, dir.ID(), "notes")
+	assert.NoError(t, err)
+	assert.Equal(t, "notes (3)", name)
+
+	config.GetConfig().Fs.ConflictPattern = "%s_%d"
+	defer func() { config.GetConfig().Fs.ConflictPattern = "" }()
+	name, err = vfs.UniqueName(fs, dir.ID(), "photo.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "photo_2.jpg", name)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -0,0 +1,45 @@
+package vfsafero
+
+import (
+	"io"
+	"os"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// NewBlobStore returns a vfs.BlobStore where the blobs are the files of the
+// given afero.Fs, named by their path.
+func NewBlobStore(fs afero.Fs) vfs.BlobStore {
+	return &blobStore{fs}
+}
+
+type blobStore struct {
+	fs afero.Fs
+}
+
+func (s *blobStore) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	return safeCreateFile(name, mode, s.fs)
+}
+
+func (s *blobStore) Open(name string) (vfs.BlobReader, error) {
+	return s.fs.Open(name)
+}
+
+func (s *blobStore) Remove(name string) error {
+	return s.fs.Remove(name)
+}
+
+func (s *blobStore) Stat(name string) (*vfs.BlobInfo, error) {
+	infos, err := s.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &vfs.BlobInfo{
+		Name:    name,
+		Size:    infos.Size(),
+		ModTime: infos.ModTime(),
+	}, nil
+}
+
+var _ vfs.BlobStore = &blobStore{}
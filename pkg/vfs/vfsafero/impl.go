@@ -4,6 +4,7 @@ package vfsafero
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"hash"
 	"io"
@@ -30,12 +31,16 @@ type aferoVFS struct {
 
 	domain string
 	fs     afero.Fs
+	blobs  vfs.BlobStore // the content of the files, in the same afero.Fs
 	mu     lock.ErrorRWLocker
 	pth    string
 
 	// whether or not the localfilesystem requires an initialisation of its root
 	// directory
 	osFS bool
+
+	// true for the VFS used by the sharing replication (see UseSharingIndexer)
+	replication bool
 }
 
 // New returns a vfs.VFS instance associated with the specified indexer and
@@ -67,6 +72,7 @@ func New(domain string, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.Err
 
 		domain: domain,
 		fs:     fs,
+		blobs:  NewBlobStore(fs),
 		mu:     mu,
 		pth:    pth,
 		// for now, only the file:// scheme needs a specific initialisation of its
@@ -85,9 +91,11 @@ func (afs *aferoVFS) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
 		DiskThresholder: afs.DiskThresholder,
 		domain:          afs.domain,
 		fs:              afs.fs,
+		blobs:           afs.blobs,
 		mu:              afs.mu,
 		pth:             afs.pth,
 		osFS:            afs.osFS,
+		replication:     true,
 	}
 }
 
@@ -177,6 +185,26 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		maxsize = -1 // no limit
 	}
 
+	uploadsize := vfs.MaxUploadSize()
+	if uploadsize >= 0 && newsize > uploadsize {
+		return nil, vfs.ErrUploadTooBig
+	}
+
+	// The transformed content has a size and a hash that are known only at
+	// the end of the upload. The content replicated by a sharing is not
+	// transformed again: it was when it was uploaded on the other instance.
+	var transformer *vfs.Transformer
+	var err error
+	if !afs.replication {
+		transformer, err = vfs.NewTransformer(newdoc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if transformer != nil {
+		newsize = -1
+	}
+
 	newpath, err := afs.Indexer.FilePath(newdoc)
 	if err != nil {
 		return nil, err
@@ -201,6 +229,13 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		newdoc.ByteSize = 0
 	}
 
+	// The new content is encrypted with a new nonce, even if the old one was
+	// not encrypted.
+	newdoc.Encryption, err = vfs.NewEncryption()
+	if err != nil {
+		return nil, err
+	}
+
 	if olddoc == nil {
 		var exists bool
 		exists, err = afs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
@@ -226,30 +261,46 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		}
 	}
 
-	f, err := safeCreateFile(tmppath, newdoc.Mode(), afs.fs)
+	f, err := afs.blobs.Create(tmppath, newdoc.Mode())
 	if err != nil {
 		return nil, err
 	}
 
+	var out io.WriteCloser = f
+	if newdoc.Encryption != nil {
+		out, err = vfs.NewEncryptedWriter(f, afs.domain, newdoc.Encryption)
+		if err != nil {
+			f.Close() // #nosec
+			return nil, err
+		}
+	}
+
 	hash := md5.New() // #nosec
 	extractor := vfs.NewMetaExtractor(newdoc)
 
-	return &aferoFileCreation{
+	var file vfs.File = &aferoFileCreation{
 		w:    0,
 		f:    f,
+		out:  out,
 		size: newsize,
 
-		afs:     afs,
-		newdoc:  newdoc,
-		olddoc:  olddoc,
-		tmppath: tmppath,
-		newpath: newpath,
-		maxsize: maxsize,
-		capsize: capsize,
+		afs:        afs,
+		newdoc:     newdoc,
+		olddoc:     olddoc,
+		tmppath:    tmppath,
+		newpath:    newpath,
+		maxsize:    maxsize,
+		uploadsize: uploadsize,
+		capsize:    capsize,
 
-		hash: hash,
-		meta: extractor,
-	}, nil
+		hash:   hash,
+		sha256: sha256.New(),
+		meta:   extractor,
+	}
+	if transformer != nil {
+		file = transformer.Wrap(file)
+	}
+	return file, nil
 }
 
 func (afs *aferoVFS) DestroyDirContent(doc *vfs.DirDoc) error {
@@ -306,7 +357,7 @@ func (afs *aferoVFS) DestroyFile(doc *vfs.FileDoc) error {
 		return err
 	}
 	vfs.DiskQuotaAfterDestroy(afs, diskUsage, doc.ByteSize)
-	err = afs.fs.Remove(name)
+	err = afs.blobs.Remove(name)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
@@ -322,10 +373,18 @@ func (afs *aferoVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	f, err := afs.fs.Open(name)
+	f, err := afs.blobs.Open(name)
 	if err != nil {
 		return nil, err
 	}
+	if doc.Encryption != nil {
+		dec, err := vfs.NewDecryptedFile(f, afs.domain, doc.Encryption, doc.ByteSize)
+		if err != nil {
+			f.Close() // #nosec
+			return nil, err
+		}
+		return dec, nil
+	}
 	return &aferoFileOpen{f}, nil
 }
 
@@ -490,7 +549,8 @@ func fileInfosToFileDoc(dir *vfs.DirDoc, fullpath string, fileinfo os.FileInfo)
 func (afs *aferoVFS) fsckPrune(logbook []*vfs.FsckLog, dryrun bool) {
 	for _, entry := range logbook {
 		switch entry.Type {
-		case vfs.IndexOrphanTree, vfs.IndexBadFullpath, vfs.FileMissing, vfs.IndexMissing:
+		case vfs.IndexOrphanTree, vfs.IndexBadFullpath, vfs.FileMissing, vfs.IndexMissing,
+			vfs.ContentCorrupted:
 			vfs.FsckPrune(afs, afs.Indexer, entry, dryrun)
 		case vfs.TypeMismatch:
 			if entry.IsFile {
@@ -548,12 +608,15 @@ func (afs *aferoVFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
 		return lockerr
 	}
 	defer afs.mu.Unlock()
-	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
-		oldpath, err := afs.Indexer.FilePath(olddoc)
+	var oldpath, newpath string
+	moved := newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName
+	if moved {
+		var err error
+		oldpath, err = afs.Indexer.FilePath(olddoc)
 		if err != nil {
 			return err
 		}
-		newpath, err := afs.Indexer.FilePath(newdoc)
+		newpath, err = afs.Indexer.FilePath(newdoc)
 		if err != nil {
 			return err
 		}
@@ -572,7 +635,15 @@ func (afs *aferoVFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
 			return err
 		}
 	}
-	return afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	// The rename and the move are applied in a single update of the index. If
+	// this update fails, the file is put back at its old place.
+	if err := afs.Indexer.UpdateFileDoc(olddoc, newdoc); err != nil {
+		if moved {
+			afs.fs.Rename(newpath, oldpath) // #nosec
+		}
+		return err
+	}
+	return nil
 }
 
 // UpdateDirDoc overrides the indexer's one since the afero.Fs is by essence
@@ -585,12 +656,19 @@ func (afs *aferoVFS) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
 		return lockerr
 	}
 	defer afs.mu.Unlock()
-	if newdoc.Fullpath != olddoc.Fullpath {
+	moved := newdoc.Fullpath != olddoc.Fullpath
+	if moved {
 		if err := safeRenameDir(afs, olddoc.Fullpath, newdoc.Fullpath); err != nil {
 			return err
 		}
 	}
-	return afs.Indexer.UpdateDirDoc(olddoc, newdoc)
+	if err := afs.Indexer.UpdateDirDoc(olddoc, newdoc); err != nil {
+		if _, partial := err.(*vfs.PartialTrashError); moved && !partial {
+			afs.fs.Rename(newdoc.Fullpath, olddoc.Fullpath) // #nosec
+		}
+		return err
+	}
+	return nil
 }
 
 func (afs *aferoVFS) DirByID(fileID string) (*vfs.DirDoc, error) {
@@ -651,7 +729,7 @@ func (afs *aferoVFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, er
 
 // aferoFileOpen represents a file handle opened for reading.
 type aferoFileOpen struct {
-	f afero.File
+	f vfs.BlobReader
 }
 
 func (f *aferoFileOpen) Read(p []byte) (int, error) {
@@ -679,19 +757,22 @@ func (f *aferoFileOpen) Close() error {
 //
 // aferoFileCreation implements io.WriteCloser.
 type aferoFileCreation struct {
-	f       afero.File         // file handle
-	w       int64              // total size written
-	size    int64              // total file size, -1 if unknown
-	afs     *aferoVFS          // parent vfs
-	newdoc  *vfs.FileDoc       // new document
-	olddoc  *vfs.FileDoc       // old document
-	newpath string             // file new path
-	tmppath string             // temporary file path for uploading a new version of this file
-	maxsize int64              // maximum size allowed for the file
-	capsize int64              // size cap from which we send a notification to the user
-	hash    hash.Hash          // hash we build up along the file
-	meta    *vfs.MetaExtractor // extracts metadata from the content
-	err     error              // write error
+	f          io.WriteCloser     // blob handle
+	out        io.WriteCloser     // writer for the content, encrypted or not
+	w          int64              // total size written
+	size       int64              // total file size, -1 if unknown
+	afs        *aferoVFS          // parent vfs
+	newdoc     *vfs.FileDoc       // new document
+	olddoc     *vfs.FileDoc       // old document
+	newpath    string             // file new path
+	tmppath    string             // temporary file path for uploading a new version of this file
+	maxsize    int64              // maximum size allowed for the file
+	uploadsize int64              // maximum size of a file from the config
+	capsize    int64              // size cap from which we send a notification to the user
+	hash       hash.Hash          // hash we build up along the file
+	sha256     hash.Hash          // sha256 of the content, for the lookups by hash
+	meta       *vfs.MetaExtractor // extracts metadata from the content
+	err        error              // write error
 }
 
 func (f *aferoFileCreation) Read(p []byte) (int, error) {
@@ -707,7 +788,7 @@ func (f *aferoFileCreation) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *aferoFileCreation) Write(p []byte) (int, error) {
-	n, err := f.f.Write(p)
+	n, err := f.out.Write(p)
 	if err != nil {
 		f.err = err
 		return n, err
@@ -719,6 +800,11 @@ func (f *aferoFileCreation) Write(p []byte) (int, error) {
 		return n, f.err
 	}
 
+	if f.uploadsize >= 0 && f.w > f.uploadsize {
+		f.err = vfs.ErrUploadTooBig
+		return n, f.err
+	}
+
 	if f.size >= 0 && f.w > f.size {
 		f.err = vfs.ErrContentLengthMismatch
 		return n, f.err
@@ -731,10 +817,18 @@ func (f *aferoFileCreation) Write(p []byte) (int, error) {
 		}
 	}
 
+	f.sha256.Write(p) // #nosec
 	_, err = f.hash.Write(p)
 	return n, err
 }
 
+// Abort implements vfs.FileAborter
+func (f *aferoFileCreation) Abort(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
 func (f *aferoFileCreation) Close() (err error) {
 	defer func() {
 		if err == nil {
@@ -747,7 +841,7 @@ func (f *aferoFileCreation) Close() (err error) {
 			}
 		} else if err != nil {
 			// remove the temporary file if an error occured
-			f.afs.fs.Remove(f.tmppath) // #nosec
+			f.afs.blobs.Remove(f.tmppath) // #nosec
 			// If an error has occured that is not due to the index update, we should
 			// delete the file from the index.
 			if f.olddoc == nil {
@@ -758,7 +852,7 @@ func (f *aferoFileCreation) Close() (err error) {
 		}
 	}()
 
-	if err = f.f.Close(); err != nil {
+	if err = f.out.Close(); err != nil {
 		if f.meta != nil {
 			(*f.meta).Abort(err)
 		}
@@ -787,8 +881,10 @@ func (f *aferoFileCreation) Close() (err error) {
 	if !bytes.Equal(newdoc.MD5Sum, md5sum) {
 		return vfs.ErrInvalidHash
 	}
+	newdoc.SHA256Sum = f.sha256.Sum(nil)
 
-	if newdoc.ByteSize <= 0 {
+	// When the length was unknown, the size is the number of bytes written
+	if f.size < 0 {
 		newdoc.ByteSize = written
 	}
 
@@ -804,6 +900,12 @@ func (f *aferoFileCreation) Close() (err error) {
 	}
 	if olddoc == nil {
 		olddoc = newdoc.Clone().(*vfs.FileDoc)
+		// The document was indexed with the size announced at its creation,
+		// or 0 if it was unknown.
+		olddoc.ByteSize = f.size
+		if olddoc.ByteSize < 0 {
+			olddoc.ByteSize = 0
+		}
 	}
 	lockerr := f.afs.mu.Lock()
 	if lockerr != nil {
@@ -879,7 +981,8 @@ func extractContentTypeAndMD5(filename string) (contentType string, md5sum []byt
 }
 
 var (
-	_ vfs.VFS  = &aferoVFS{}
-	_ vfs.File = &aferoFileOpen{}
-	_ vfs.File = &aferoFileCreation{}
+	_ vfs.VFS         = &aferoVFS{}
+	_ vfs.File        = &aferoFileOpen{}
+	_ vfs.File        = &aferoFileCreation{}
+	_ vfs.FileAborter = &aferoFileCreation{}
 )
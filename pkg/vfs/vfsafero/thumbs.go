@@ -91,7 +91,7 @@ func (t *thumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request,
 		return err
 	}
 	defer f.Close()
-	http.ServeContent(w, req, name, s.ModTime(), f)
+	vfs.ServeContent(w, req, name, s.ModTime(), "", f)
 	return nil
 }
 
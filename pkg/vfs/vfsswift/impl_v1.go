@@ -2,8 +2,10 @@ package vfsswift
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -36,6 +38,9 @@ type swiftVFS struct {
 	version   string
 	mu        lock.ErrorRWLocker
 	log       *logrus.Entry
+
+	// true for the VFS used by the sharing replication (see UseSharingIndexer)
+	replication bool
 }
 
 // New returns a vfs.VFS instance associated with the specified indexer and the
@@ -71,6 +76,7 @@ func (sfs *swiftVFS) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
 		version:         sfs.version,
 		mu:              sfs.mu,
 		log:             sfs.log,
+		replication:     true,
 	}
 }
 
@@ -199,6 +205,25 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 	if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
 		return nil, vfs.ErrFileTooBig
 	}
+	uploadsize := vfs.MaxUploadSize()
+	if uploadsize >= 0 && newsize > uploadsize {
+		return nil, vfs.ErrUploadTooBig
+	}
+
+	// The transformed content has a size and a hash that are known only at
+	// the end of the upload. The content replicated by a sharing is not
+	// transformed again: it was when it was uploaded on the other instance.
+	var transformer *vfs.Transformer
+	var err error
+	if !sfs.replication {
+		transformer, err = vfs.NewTransformer(newdoc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if transformer != nil {
+		newsize = -1
+	}
 
 	if olddoc != nil {
 		newdoc.SetID(olddoc.ID())
@@ -219,6 +244,10 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		newdoc.ByteSize = 0
 	}
 
+	// The encryption at rest is only done for the local storage: the objects
+	// on Swift are stored as is.
+	newdoc.Encryption = nil
+
 	if olddoc == nil {
 		var exists bool
 		exists, err = sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
@@ -257,18 +286,24 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &swiftFileCreation{
-		f:       f,
-		fs:      sfs,
-		w:       0,
-		size:    newsize,
-		name:    objName,
-		meta:    vfs.NewMetaExtractor(newdoc),
-		newdoc:  newdoc,
-		olddoc:  olddoc,
-		maxsize: maxsize,
-		capsize: capsize,
-	}, nil
+	var file vfs.File = &swiftFileCreation{
+		f:          f,
+		fs:         sfs,
+		w:          0,
+		size:       newsize,
+		name:       objName,
+		meta:       vfs.NewMetaExtractor(newdoc),
+		newdoc:     newdoc,
+		olddoc:     olddoc,
+		maxsize:    maxsize,
+		uploadsize: uploadsize,
+		capsize:    capsize,
+		sha256:     sha256.New(),
+	}
+	if transformer != nil {
+		file = transformer.Wrap(file)
+	}
+	return file, nil
 }
 
 func (sfs *swiftVFS) DestroyDirContent(doc *vfs.DirDoc) error {
@@ -560,7 +595,8 @@ func objectToFileDocV1(dir *vfs.DirDoc, object swift.Object) (filePath string, f
 func (sfs *swiftVFS) fsckPrune(logbook []*vfs.FsckLog, dryrun bool) {
 	for _, entry := range logbook {
 		switch entry.Type {
-		case vfs.IndexOrphanTree, vfs.IndexBadFullpath, vfs.FileMissing, vfs.IndexMissing:
+		case vfs.IndexOrphanTree, vfs.IndexBadFullpath, vfs.FileMissing, vfs.IndexMissing,
+			vfs.ContentCorrupted:
 			vfs.FsckPrune(sfs, sfs.Indexer, entry, dryrun)
 		case vfs.TypeMismatch:
 			if entry.IsFile {
@@ -733,17 +769,19 @@ func (sfs *swiftVFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, er
 }
 
 type swiftFileCreation struct {
-	f       *swift.ObjectCreateFile
-	w       int64
-	size    int64
-	fs      *swiftVFS
-	name    string
-	err     error
-	meta    *vfs.MetaExtractor
-	newdoc  *vfs.FileDoc
-	olddoc  *vfs.FileDoc
-	maxsize int64
-	capsize int64
+	f          *swift.ObjectCreateFile
+	w          int64
+	size       int64
+	fs         *swiftVFS
+	name       string
+	err        error
+	meta       *vfs.MetaExtractor
+	newdoc     *vfs.FileDoc
+	olddoc     *vfs.FileDoc
+	maxsize    int64
+	uploadsize int64
+	capsize    int64
+	sha256     hash.Hash // sha256 of the content, for the lookups by hash
 }
 
 func (f *swiftFileCreation) Read(p []byte) (int, error) {
@@ -772,12 +810,18 @@ func (f *swiftFileCreation) Write(p []byte) (int, error) {
 		return n, err
 	}
 
+	f.sha256.Write(p[:n]) // #nosec
 	f.w += int64(n)
 	if f.maxsize >= 0 && f.w > f.maxsize {
 		f.err = vfs.ErrFileTooBig
 		return n, f.err
 	}
 
+	if f.uploadsize >= 0 && f.w > f.uploadsize {
+		f.err = vfs.ErrUploadTooBig
+		return n, f.err
+	}
+
 	if f.size >= 0 && f.w > f.size {
 		f.err = vfs.ErrContentLengthMismatch
 		return n, f.err
@@ -786,6 +830,13 @@ func (f *swiftFileCreation) Write(p []byte) (int, error) {
 	return n, nil
 }
 
+// Abort implements vfs.FileAborter
+func (f *swiftFileCreation) Abort(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
 func (f *swiftFileCreation) Close() (err error) {
 	defer func() {
 		if err == nil {
@@ -854,6 +905,8 @@ func (f *swiftFileCreation) Close() (err error) {
 		}
 	}
 
+	newdoc.SHA256Sum = f.sha256.Sum(nil)
+
 	if f.size < 0 {
 		newdoc.ByteSize = written
 	}
@@ -870,6 +923,12 @@ func (f *swiftFileCreation) Close() (err error) {
 	}
 	if olddoc == nil {
 		olddoc = newdoc.Clone().(*vfs.FileDoc)
+		// The document was indexed with the size announced at its creation,
+		// or 0 if it was unknown.
+		olddoc.ByteSize = f.size
+		if olddoc.ByteSize < 0 {
+			olddoc.ByteSize = 0
+		}
 	}
 	lockerr := f.fs.mu.Lock()
 	if lockerr != nil {
@@ -928,7 +987,8 @@ func (f *swiftFileOpen) Close() error {
 }
 
 var (
-	_ vfs.VFS  = &swiftVFS{}
-	_ vfs.File = &swiftFileCreation{}
-	_ vfs.File = &swiftFileOpen{}
+	_ vfs.VFS         = &swiftVFS{}
+	_ vfs.File        = &swiftFileCreation{}
+	_ vfs.FileAborter = &swiftFileCreation{}
+	_ vfs.File        = &swiftFileOpen{}
 )
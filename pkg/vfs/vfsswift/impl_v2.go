@@ -2,8 +2,10 @@ package vfsswift
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -35,6 +37,9 @@ type swiftVFSV2 struct {
 	dataContainer string
 	mu            lock.ErrorRWLocker
 	log           *logrus.Entry
+
+	// true for the VFS used by the sharing replication (see UseSharingIndexer)
+	replication bool
 }
 
 const (
@@ -76,6 +81,61 @@ func MakeObjectName(docID string) string {
 	return docID[:22] + "/" + docID[22:27] + "/" + docID[27:]
 }
 
+// blobsPrefix is the prefix of the swift objects for the contents shared by
+// several files, when the deduplication is enabled.
+const blobsPrefix = "blobs/"
+
+func blobObjectName(key string) string {
+	return blobsPrefix + key
+}
+
+// contentObjectName returns the name of the swift object with the content of
+// the given file.
+func contentObjectName(doc *vfs.FileDoc) string {
+	if doc.Blob != "" {
+		return blobObjectName(doc.Blob)
+	}
+	return MakeObjectName(doc.DocID)
+}
+
+// releaseBlob removes a reference to a shared content, and deletes the swift
+// object when it was the last one.
+func (sfs *swiftVFSV2) releaseBlob(key string) {
+	last, err := sfs.Indexer.ReleaseBlob(key)
+	if err != nil {
+		sfs.log.Warnf("Cannot release blob %s: %s", key, err)
+		return
+	}
+	if last {
+		if err = sfs.c.ObjectDelete(sfs.container, blobObjectName(key)); err != nil && err != swift.ObjectNotFound {
+			sfs.log.Warnf("Cannot delete blob %s: %s", key, err)
+		}
+	}
+}
+
+// collectBlobs returns the keys of the shared contents used by the files
+// inside the given directory.
+func (sfs *swiftVFSV2) collectBlobs(doc *vfs.DirDoc) []string {
+	var blobs []string
+	iter := sfs.Indexer.DirIterator(doc, nil)
+	for {
+		d, f, err := iter.Next()
+		if err != nil {
+			if err != vfs.ErrIteratorDone {
+				sfs.log.Warnf("Cannot list the blobs of %s: %s", doc.DocID, err)
+			}
+			return blobs
+		}
+		if f != nil {
+			if f.Blob != "" {
+				blobs = append(blobs, f.Blob)
+			}
+		} else {
+			blobs = append(blobs, sfs.collectBlobs(d)...)
+		}
+	}
+}
+
 func makeDocID(objName string) string {
 	if len(objName) != 34 {
 		return objName
@@ -98,6 +158,7 @@ func (sfs *swiftVFSV2) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
 		dataContainer:   sfs.dataContainer,
 		mu:              sfs.mu,
 		log:             sfs.log,
+		replication:     true,
 	}
 }
 
@@ -235,6 +296,25 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 	if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
 		return nil, vfs.ErrFileTooBig
 	}
+	uploadsize := vfs.MaxUploadSize()
+	if uploadsize >= 0 && newsize > uploadsize {
+		return nil, vfs.ErrUploadTooBig
+	}
+
+	// The transformed content has a size and a hash that are known only at
+	// the end of the upload. The content replicated by a sharing is not
+	// transformed again: it was when it was uploaded on the other instance.
+	var transformer *vfs.Transformer
+	var err error
+	if !sfs.replication {
+		transformer, err = vfs.NewTransformer(newdoc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if transformer != nil {
+		newsize = -1
+	}
 
 	if olddoc != nil {
 		newdoc.SetID(olddoc.ID())
@@ -255,6 +335,10 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 		newdoc.ByteSize = 0
 	}
 
+	// The encryption at rest is only done for the local storage: the objects
+	// on Swift are stored as is.
+	newdoc.Encryption = nil
+
 	if olddoc == nil {
 		var exists bool
 		exists, err = sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
@@ -298,18 +382,24 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 	if err != nil {
 		return nil, err
 	}
-	return &swiftFileCreationV2{
-		f:       f,
-		fs:      sfs,
-		w:       0,
-		size:    newsize,
-		name:    objName,
-		meta:    vfs.NewMetaExtractor(newdoc),
-		newdoc:  newdoc,
-		olddoc:  olddoc,
-		maxsize: maxsize,
-		capsize: capsize,
-	}, nil
+	var file vfs.File = &swiftFileCreationV2{
+		f:          f,
+		fs:         sfs,
+		w:          0,
+		size:       newsize,
+		name:       objName,
+		meta:       vfs.NewMetaExtractor(newdoc),
+		newdoc:     newdoc,
+		olddoc:     olddoc,
+		maxsize:    maxsize,
+		uploadsize: uploadsize,
+		capsize:    capsize,
+		sha256:     sha256.New(),
+	}
+	if transformer != nil {
+		file = transformer.Wrap(file)
+	}
+	return file, nil
 }
 
 func (sfs *swiftVFSV2) DestroyDirContent(doc *vfs.DirDoc) error {
@@ -318,11 +408,15 @@ func (sfs *swiftVFSV2) DestroyDirContent(doc *vfs.DirDoc) error {
 	}
 	defer sfs.mu.Unlock()
 	diskUsage, _ := sfs.Indexer.DiskUsage()
+	blobs := sfs.collectBlobs(doc)
 	destroyed, ids, err := sfs.Indexer.DeleteDirDocAndContent(doc, true)
 	if err != nil {
 		return err
 	}
 	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	for _, key := range blobs {
+		sfs.releaseBlob(key)
+	}
 	objNames := make([]string, len(ids))
 	for i, id := range ids {
 		objNames[i] = MakeObjectName(id)
@@ -345,11 +439,15 @@ func (sfs *swiftVFSV2) DestroyDirAndContent(doc *vfs.DirDoc) error {
 	}
 	defer sfs.mu.Unlock()
 	diskUsage, _ := sfs.Indexer.DiskUsage()
+	blobs := sfs.collectBlobs(doc)
 	destroyed, ids, err := sfs.Indexer.DeleteDirDocAndContent(doc, false)
 	if err != nil {
 		return err
 	}
 	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	for _, key := range blobs {
+		sfs.releaseBlob(key)
+	}
 	objNames := make([]string, len(ids))
 	for i, id := range ids {
 		objNames[i] = MakeObjectName(id)
@@ -375,6 +473,9 @@ func (sfs *swiftVFSV2) DestroyFile(doc *vfs.FileDoc) error {
 	err := sfs.Indexer.DeleteFileDoc(doc)
 	if err == nil {
 		vfs.DiskQuotaAfterDestroy(sfs, diskUsage, doc.ByteSize)
+		if doc.Blob != "" {
+			sfs.releaseBlob(doc.Blob)
+		}
 	}
 	return err
 }
@@ -384,7 +485,7 @@ func (sfs *swiftVFSV2) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 		return nil, lockerr
 	}
 	defer sfs.mu.RUnlock()
-	objName := MakeObjectName(doc.DocID)
+	objName := contentObjectName(doc)
 	f, _, err := sfs.c.ObjectOpen(sfs.container, objName, false, nil)
 	if err == swift.ObjectNotFound {
 		return nil, os.ErrNotExist
@@ -435,6 +536,9 @@ func (sfs *swiftVFSV2) Fsck(opts vfs.FsckOptions) (logbook []*vfs.FsckLog, err e
 			return nil, err
 		}
 		for _, obj := range objs {
+			if strings.HasPrefix(obj.Name, blobsPrefix) {
+				continue
+			}
 			docID := makeDocID(obj.Name)
 			f, ok := entries[docID]
 			if !ok {
@@ -516,6 +620,10 @@ func (sfs *swiftVFSV2) fsckWalk(dir *vfs.DirDoc, entries map[string]fsckFile) er
 			return err
 		}
 		if f != nil {
+			// The shared contents are not checked by fsck
+			if f.Blob != "" {
+				continue
+			}
 			fullpath := path.Join(dir.Fullpath, f.DocName)
 			entries[f.DocID] = fsckFile{f, fullpath}
 		} else if err = sfs.fsckWalk(d, entries); err != nil {
@@ -635,17 +743,20 @@ func (sfs *swiftVFSV2) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc,
 }
 
 type swiftFileCreationV2 struct {
-	f       *swift.ObjectCreateFile
-	w       int64
-	size    int64
-	fs      *swiftVFSV2
-	name    string
-	err     error
-	meta    *vfs.MetaExtractor
-	newdoc  *vfs.FileDoc
-	olddoc  *vfs.FileDoc
-	maxsize int64
-	capsize int64
+	f          *swift.ObjectCreateFile
+	w          int64
+	size       int64
+	fs         *swiftVFSV2
+	name       string
+	err        error
+	meta       *vfs.MetaExtractor
+	newdoc     *vfs.FileDoc
+	olddoc     *vfs.FileDoc
+	maxsize    int64
+	uploadsize int64
+	capsize    int64
+	sha256     hash.Hash // sha256 of the content, for the lookups by hash
+	blob       string    // the key of the shared content acquired by dedup
 }
 
 func (f *swiftFileCreationV2) Read(p []byte) (int, error) {
@@ -674,12 +785,18 @@ func (f *swiftFileCreationV2) Write(p []byte) (int, error) {
 		return n, err
 	}
 
+	f.sha256.Write(p[:n]) // #nosec
 	f.w += int64(n)
 	if f.maxsize >= 0 && f.w > f.maxsize {
 		f.err = vfs.ErrFileTooBig
 		return n, f.err
 	}
 
+	if f.uploadsize >= 0 && f.w > f.uploadsize {
+		f.err = vfs.ErrUploadTooBig
+		return n, f.err
+	}
+
 	if f.size >= 0 && f.w > f.size {
 		f.err = vfs.ErrContentLengthMismatch
 		return n, f.err
@@ -688,6 +805,13 @@ func (f *swiftFileCreationV2) Write(p []byte) (int, error) {
 	return n, nil
 }
 
+// Abort implements vfs.FileAborter
+func (f *swiftFileCreationV2) Abort(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
 func (f *swiftFileCreationV2) Close() (err error) {
 	defer func() {
 		if err == nil {
@@ -697,7 +821,9 @@ func (f *swiftFileCreationV2) Close() (err error) {
 		} else {
 			// Deleting the object should be secure since we use X-Versions-Location
 			// on the container and the old object should be restored.
-			f.fs.c.ObjectDelete(f.fs.container, f.name) // #nosec
+			if f.blob == "" {
+				f.fs.c.ObjectDelete(f.fs.container, f.name) // #nosec
+			}
 
 			// If an error has occured that is not due to the index update, we should
 			// delete the file from the index.
@@ -705,6 +831,13 @@ func (f *swiftFileCreationV2) Close() (err error) {
 			if !isCouchErr && f.olddoc == nil {
 				f.fs.Indexer.DeleteFileDoc(f.newdoc) // #nosec
 			}
+
+			// The reference acquired for this upload is released, even if
+			// the old version of the file has the same content, as it keeps
+			// its own reference.
+			if f.blob != "" {
+				f.fs.releaseBlob(f.blob)
+			}
 		}
 	}()
 
@@ -756,6 +889,8 @@ func (f *swiftFileCreationV2) Close() (err error) {
 		}
 	}
 
+	newdoc.SHA256Sum = f.sha256.Sum(nil)
+
 	if f.size < 0 {
 		newdoc.ByteSize = written
 	}
@@ -764,6 +899,17 @@ func (f *swiftFileCreationV2) Close() (err error) {
 		return vfs.ErrContentLengthMismatch
 	}
 
+	// With the deduplication, the content is moved to a shared object, and the
+	// object uploaded for this file is deleted. Deleting it can restore an old
+	// version of this object, as we use X-Versions-Location on the container,
+	// that will stay as an orphan.
+	newdoc.Blob = ""
+	if config.GetConfig().Fs.Dedup && newdoc.MD5Sum != nil {
+		if err = f.dedup(newdoc); err != nil {
+			return err
+		}
+	}
+
 	// The document is already added to the index when closing the file creation
 	// handler. When updating the content of the document with the final
 	// informations (size, md5, ...) we can reuse the same document as olddoc.
@@ -772,6 +918,12 @@ func (f *swiftFileCreationV2) Close() (err error) {
 	}
 	if olddoc == nil {
 		olddoc = newdoc.Clone().(*vfs.FileDoc)
+		// The document was indexed with the size announced at its creation,
+		// or 0 if it was unknown.
+		olddoc.ByteSize = f.size
+		if olddoc.ByteSize < 0 {
+			olddoc.ByteSize = 0
+		}
 	}
 	lockerr := f.fs.mu.Lock()
 	if lockerr != nil {
@@ -785,17 +937,46 @@ func (f *swiftFileCreationV2) Close() (err error) {
 	// TODO: remove dep on couchdb, with a generalized conflict error for
 	// UpdateFileDoc/UpdateDirDoc.
 	if couchdb.IsConflictError(err) {
-		resdoc, err := f.fs.Indexer.FileByID(olddoc.ID())
+		var resdoc *vfs.FileDoc
+		resdoc, err = f.fs.Indexer.FileByID(olddoc.ID())
 		if err != nil {
 			return err
 		}
 		resdoc.Metadata = newdoc.Metadata
 		resdoc.ByteSize = newdoc.ByteSize
-		return f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+		resdoc.Blob = newdoc.Blob
+		err = f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+	}
+	// A new reference has been acquired for the new content: the one of the
+	// old content is released, even if it is the same shared content.
+	if err == nil && f.olddoc != nil && f.olddoc.Blob != "" {
+		f.fs.releaseBlob(f.olddoc.Blob)
 	}
 	return
 }
 
+// dedup moves the uploaded content to the shared object for this content, or
+// just deletes it if the same content was already stored.
+func (f *swiftFileCreationV2) dedup(newdoc *vfs.FileDoc) error {
+	key, existed, err := f.fs.Indexer.AcquireBlob(newdoc.MD5Sum, newdoc.ByteSize)
+	if err != nil {
+		return err
+	}
+	if !existed {
+		_, err = f.fs.c.ObjectCopy(f.fs.container, f.name, f.fs.container, blobObjectName(key), nil)
+		if err != nil {
+			f.fs.releaseBlob(key)
+			return err
+		}
+	}
+	newdoc.Blob = key
+	f.blob = key
+	if err = f.fs.c.ObjectDelete(f.fs.container, f.name); err != nil && err != swift.ObjectNotFound {
+		f.fs.log.Warnf("Cannot delete the deduplicated object %s: %s", f.name, err)
+	}
+	return nil
+}
+
 type swiftFileOpenV2 struct {
 	f  *swift.ObjectOpenFile
 	br *bytes.Reader
@@ -869,7 +1050,8 @@ func objectToFileDocV2(c *swift.Connection, container string, object swift.Objec
 }
 
 var (
-	_ vfs.VFS  = &swiftVFSV2{}
-	_ vfs.File = &swiftFileCreationV2{}
-	_ vfs.File = &swiftFileOpenV2{}
+	_ vfs.VFS         = &swiftVFSV2{}
+	_ vfs.File        = &swiftFileCreationV2{}
+	_ vfs.FileAborter = &swiftFileCreationV2{}
+	_ vfs.File        = &swiftFileOpenV2{}
 )
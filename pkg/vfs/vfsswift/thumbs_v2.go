@@ -108,8 +108,7 @@ func (t *thumbsV2) ServeThumbContent(w http.ResponseWriter, req *http.Request, i
 	}
 	defer f.Close()
 
-	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, o["Etag"]))
-	http.ServeContent(w, req, name, unixEpochZero, f)
+	vfs.ServeContent(w, req, name, unixEpochZero, o["Etag"], f)
 	return nil
 }
 
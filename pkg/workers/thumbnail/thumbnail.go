@@ -3,6 +3,7 @@ package thumbnail
 import (
 	"bytes"
 	"fmt"
+	"image"
 	"io"
 	"io/ioutil"
 	"os"
@@ -10,6 +11,9 @@ import (
 	"runtime"
 	"time"
 
+	// The thumbnails are JPEG images, decoded to compute the perceptual hash
+	_ "image/jpeg"
+
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
@@ -53,7 +57,8 @@ func init() {
 	})
 }
 
-// Worker is a worker that creates thumbnails for photos and images.
+// Worker is a worker that creates thumbnails for photos and images, and
+// previews of the first page of the PDFs.
 func Worker(ctx *jobs.WorkerContext) error {
 	var img imageEvent
 	if err := ctx.UnmarshalEvent(&img); err != nil {
@@ -73,6 +78,12 @@ func Worker(ctx *jobs.WorkerContext) error {
 	case "CREATED":
 		return generateThumbnails(ctx, i, &img.Doc)
 	case "UPDATED":
+		// The thumbnails are still valid when the content of the file has not
+		// changed, for example when it is renamed or when its perceptual hash
+		// is saved in its metadata by this worker.
+		if img.OldDoc != nil && bytes.Equal(img.OldDoc.MD5Sum, img.Doc.MD5Sum) {
+			return nil
+		}
 		if err = removeThumbnails(i, &img.Doc); err != nil {
 			log.WithField("nspace", "thumbnail").Debugf("failed to remove thumbnails for %s: %s", img.Doc.ID(), err)
 		}
@@ -87,8 +98,9 @@ type thumbnailMsg struct {
 	WithMetadata bool `json:"with_metadata"`
 }
 
-// WorkerCheck is a worker function that checks all the images to generate
-// missing thumbnails.
+// WorkerCheck is a worker function that checks all the images and PDFs to
+// generate missing thumbnails. The thumbnail trigger of the instance is
+// updated first, for the instances created before the previews of the PDFs.
 func WorkerCheck(ctx *jobs.WorkerContext) error {
 	i, err := instance.Get(ctx.Domain())
 	if err != nil {
@@ -98,6 +110,14 @@ func WorkerCheck(ctx *jobs.WorkerContext) error {
 	if err = ctx.UnmarshalMessage(&msg); err != nil {
 		return err
 	}
+	added, err := instance.UpdateTriggers(i.Domain)
+	if err != nil {
+		return err
+	}
+	for _, t := range added {
+		ctx.Logger().WithField("nspace", "thumbnail").
+			Infof("Trigger added for the %s worker: %s", t.WorkerType, t.Arguments)
+	}
 	fs := i.VFS()
 	fsThumb := i.ThumbsFS()
 	var errm error
@@ -105,7 +125,7 @@ func WorkerCheck(ctx *jobs.WorkerContext) error {
 		if err != nil {
 			return err
 		}
-		if dir != nil || img.Class != "image" {
+		if dir != nil || !vfs.HasThumbnails(img) {
 			return nil
 		}
 		allExists := true
@@ -120,18 +140,30 @@ func WorkerCheck(ctx *jobs.WorkerContext) error {
 				allExists = false
 			}
 		}
-		if !allExists {
+		// The perceptual hash is computed with the thumbnails, so they are
+		// generated again for the images uploaded before it was computed.
+		_, hasPHash := img.Metadata["phash"]
+		missingPHash := msg.WithMetadata && img.Class == "image" && !hasPHash
+		if !allExists || missingPHash {
 			if err = generateThumbnails(ctx, i, img); err != nil {
 				errm = multierror.Append(errm, err)
 			}
 		}
-		if msg.WithMetadata {
+		if msg.WithMetadata && img.Class == "image" {
+			// The document may have been updated with its perceptual hash
+			if img, err = fs.FileByID(img.ID()); err != nil {
+				errm = multierror.Append(errm, err)
+				return nil
+			}
 			var meta *vfs.Metadata
 			meta, err = calculateMetadata(fs, img)
 			if err != nil {
 				errm = multierror.Append(errm, err)
 			}
 			if meta != nil {
+				if phash, ok := img.Metadata["phash"]; ok {
+					(*meta)["phash"] = phash
+				}
 				newImg := img.Clone().(*vfs.FileDoc)
 				newImg.Metadata = *meta
 				if err = fs.UpdateFileDoc(img, newImg); err != nil {
@@ -186,19 +218,56 @@ func generateThumbnails(ctx *jobs.WorkerContext, i *instance.Instance, img *vfs.
 		}
 	}
 
-	in, err = recGenerateThub(ctx, in, fs, img, "large", env, false)
+	// Only the large thumbnail is generated from the file: the next ones are
+	// generated from the previous thumbnail, which is a JPEG image.
+	fromPDF := img.Class == "pdf"
+	in, err = recGenerateThub(ctx, in, fs, img, "large", env, fromPDF, false)
 	if err != nil {
 		return err
 	}
-	in, err = recGenerateThub(ctx, in, fs, img, "medium", env, false)
+	in, err = recGenerateThub(ctx, in, fs, img, "medium", env, false, false)
 	if err != nil {
 		return err
 	}
-	_, err = recGenerateThub(ctx, in, fs, img, "small", env, true)
-	return err
+	withPHash := img.Class == "image"
+	in, err = recGenerateThub(ctx, in, fs, img, "small", env, false, !withPHash)
+	if err != nil || !withPHash {
+		return err
+	}
+	return savePHash(i, img, in)
 }
 
-func recGenerateThub(ctx *jobs.WorkerContext, in io.Reader, fs vfs.Thumbser, img *vfs.FileDoc, format string, env []string, noOuput bool) (r io.Reader, err error) {
+// savePHash computes the perceptual hash of an image from its small
+// thumbnail, and saves it in the metadata of the file. It is done here, and
+// not when the file is uploaded, as ImageMagick can read more formats than Go
+// (HEIC for example), and the thumbnail is small enough to be decoded in
+// memory, whatever the size of the original image.
+func savePHash(i *instance.Instance, img *vfs.FileDoc, thumb io.Reader) error {
+	decoded, _, err := image.Decode(thumb)
+	if err != nil {
+		return err
+	}
+	phash := vfs.FormatPHash(vfs.PHash(decoded))
+
+	fs := i.VFS()
+	olddoc, err := fs.FileByID(img.ID())
+	if err != nil {
+		return err
+	}
+	// The content of the file may have changed since the thumbnails were
+	// generated: another job will compute its hash.
+	if !bytes.Equal(olddoc.MD5Sum, img.MD5Sum) || olddoc.Metadata["phash"] == phash {
+		return nil
+	}
+	newdoc := olddoc.Clone().(*vfs.FileDoc)
+	if newdoc.Metadata == nil {
+		newdoc.Metadata = vfs.NewMetadata()
+	}
+	newdoc.Metadata["phash"] = phash
+	return fs.UpdateFileDoc(olddoc, newdoc)
+}
+
+func recGenerateThub(ctx *jobs.WorkerContext, in io.Reader, fs vfs.Thumbser, img *vfs.FileDoc, format string, env []string, fromPDF, noOuput bool) (r io.Reader, err error) {
 	defer func() {
 		if inCloser, ok := in.(io.Closer); ok {
 			if errc := inCloser.Close(); errc != nil && err == nil {
@@ -225,7 +294,7 @@ func recGenerateThub(ctx *jobs.WorkerContext, in io.Reader, fs vfs.Thumbser, img
 		buffer = new(bytes.Buffer)
 		out = io.MultiWriter(th, buffer)
 	}
-	err = generateThumb(ctx, in, out, img.ID(), format, env)
+	err = generateThumb(ctx, in, out, img.ID(), format, env, fromPDF)
 	if err != nil {
 		return nil, err
 	}
@@ -239,7 +308,11 @@ func recGenerateThub(ctx *jobs.WorkerContext, in io.Reader, fs vfs.Thumbser, img
 // We are using some complicated ImageMagick options to optimize the speed and
 // quality of the generated thumbnails.
 // See https://www.smashingmagazine.com/2015/06/efficient-image-resizing-with-imagemagick/
-func generateThumb(ctx *jobs.WorkerContext, in io.Reader, out io.Writer, fileID string, format string, env []string) error {
+//
+// For a PDF, only its first page is rendered (ImageMagick delegates it to
+// ghostscript). An encrypted PDF can't be rendered: the command fails, and
+// the default icon of the class is used instead of the thumbnails.
+func generateThumb(ctx *jobs.WorkerContext, in io.Reader, out io.Writer, fileID string, format string, env []string, fromPDF bool) error {
 	convertCmd := config.GetConfig().Jobs.ImageMagickConvertCmd
 	if convertCmd == "" {
 		convertCmd = "convert"
@@ -247,7 +320,18 @@ func generateThumb(ctx *jobs.WorkerContext, in io.Reader, out io.Writer, fileID
 	args := []string{
 		"-limit", "Memory", "2GB",
 		"-limit", "Map", "3GB",
-		"-",              // Takes the input from stdin
+	}
+	if fromPDF {
+		args = append(args,
+			"-density", "150", // The resolution used to rasterize the page
+			"pdf:-[0]",             // Takes the first page of the PDF from stdin
+			"-background", "white", // Replace the transparent background
+			"-alpha", "remove", // by a white one (JPEG has no transparency)
+		)
+	} else {
+		args = append(args, "-") // Takes the input from stdin
+	}
+	args = append(args,
 		"-auto-orient",   // Rotate image according to the EXIF metadata
 		"-strip",         // Strip the EXIF metadata
 		"-quality", "82", // A good compromise between file size and quality
@@ -255,7 +339,7 @@ func generateThumb(ctx *jobs.WorkerContext, in io.Reader, out io.Writer, fileID
 		"-thumbnail", formats[format], // Makes a thumbnail that fits inside the given format
 		"-colorspace", "sRGB", // Use the colorspace recommended for web, sRGB
 		"jpg:-", // Send the output on stdout, in JPEG format
-	}
+	)
 	var stderr bytes.Buffer
 	cmd := exec.CommandContext(ctx, convertCmd, args...) // #nosec
 	cmd.Env = env
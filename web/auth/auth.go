@@ -386,12 +386,12 @@ func checkRedirectParam(c echo.Context, defaultRedirect *url.URL) (*url.URL, err
 	}
 
 	instance := middlewares.GetInstance(c)
-	if u.Host != instance.Domain {
-		instanceHost, appSlug, _ := middlewares.SplitHost(u.Host)
-		if instanceHost != instance.Domain || appSlug == "" {
-			return nil, echo.NewHTTPError(http.StatusBadRequest,
-				"bad url: should be subdomain")
-		}
+	kind, _ := middlewares.ClassifyHost(instance.Domain, u.Host)
+	switch kind {
+	case middlewares.OriginExternal:
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			"bad url: should be subdomain")
+	case middlewares.OriginSibling:
 		return u, nil
 	}
 
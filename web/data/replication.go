@@ -192,6 +192,12 @@ func changesFeed(c echo.Context) error {
 			return jsonapi.NewError(http.StatusBadRequest, "Invalid limit value '%s': %s", limitString, err.Error())
 		}
 	}
+	// The clients of the changes feed usually don't paginate: they use the
+	// pending field of the response to know if they should ask for more. A
+	// limit of 0 is still no limit, like in CouchDB.
+	if max := jsonapi.MaxPageSize(); limit > max {
+		limit = max
+	}
 
 	seqIntervalString := c.QueryParam("seq_interval")
 	seqInterval := 0
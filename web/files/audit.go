@@ -0,0 +1,114 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+type apiAuditEntry struct {
+	*vfs.AuditEntry
+}
+
+func (a *apiAuditEntry) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiAuditEntry) Included() []jsonapi.Object             { return nil }
+func (a *apiAuditEntry) Links() *jsonapi.LinksList              { return nil }
+func (a *apiAuditEntry) Clone() couchdb.Doc {
+	cloned := *a.AuditEntry
+	return &apiAuditEntry{&cloned}
+}
+
+// auditOperation records an operation on a file or directory in the audit
+// trail. It is best-effort: the record is written in the background, and a
+// failure is only logged, as it must not block the operation itself.
+func auditOperation(c echo.Context, operation, fileID string) {
+	if !vfs.AuditEnabled() {
+		return
+	}
+	instance := middlewares.GetInstance(c)
+	subject, _ := permissions.GetSourceID(c)
+	entry := &vfs.AuditEntry{
+		Operation: operation,
+		FileID:    fileID,
+		Subject:   subject,
+		CreatedAt: time.Now(),
+	}
+	go func() {
+		if err := vfs.WriteAuditEntry(instance, entry); err != nil {
+			instance.Logger().WithField("nspace", "files").
+				Warnf("Cannot write the audit trail for %s: %s", fileID, err)
+		}
+	}()
+}
+
+// ReadAuditHandler handles GET requests on /files/_audit. It returns the
+// records of the audit trail for the file or directory given in the file-id
+// parameter, the most recent first.
+func ReadAuditHandler(c echo.Context) error {
+	fileID := c.QueryParam("file-id")
+	if fileID == "" {
+		return jsonapi.InvalidParameter("file-id", errors.New("Missing file-id"))
+	}
+
+	limit, err := limitFromReq(c, defaultAuditLimit, maxAuditLimit)
+	if err != nil {
+		return err
+	}
+
+	// The trail of a destroyed file can only be read with a permission on the
+	// whole files doctype
+	instance := middlewares.GetInstance(c)
+	dir, file, err := instance.VFS().DirOrFileByID(fileID)
+	if os.IsNotExist(err) {
+		err = permissions.AllowWholeType(c, permissions.GET, consts.Files)
+	} else if err == nil {
+		err = checkPerm(c, permissions.GET, dir, file)
+	} else {
+		err = WrapVfsError(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	entries, err := vfs.AuditEntries(instance, fileID, limit)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	objs := make([]jsonapi.Object, len(entries))
+	for i, entry := range entries {
+		objs[i] = &apiAuditEntry{entry}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// limitFromReq returns the limit given in the query-string, capped to max,
+// or def if there is no limit parameter.
+func limitFromReq(c echo.Context, def, max int) (int, error) {
+	l := c.QueryParam("limit")
+	if l == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(l)
+	if err != nil || n <= 0 {
+		return 0, jsonapi.InvalidParameter("limit", errors.New("Invalid limit"))
+	}
+	if n > max {
+		return max, nil
+	}
+	return n, nil
+}
@@ -0,0 +1,114 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// maxBulkMkdir is the maximal number of directories that can be created with
+// a single request on /files/_bulk_mkdir.
+const maxBulkMkdir = 100
+
+// bulkMkdirEntry is a directory to create with /files/_bulk_mkdir.
+type bulkMkdirEntry struct {
+	Path string   `json:"path"`
+	Tags []string `json:"tags"`
+}
+
+// BulkMkdirHandler handles POST requests on /files/_bulk_mkdir. It creates
+// the directories with the given paths, and their missing parents, like
+// MkdirAll. The directories that already exist are returned without error, so
+// the request can be sent again safely. The permissions are checked for all
+// the directories before creating any of them.
+func BulkMkdirHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	var body struct {
+		Directories []bulkMkdirEntry `json:"directories"`
+	}
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if len(body.Directories) == 0 {
+		return jsonapi.InvalidParameter("directories", errors.New("The list of directories is empty"))
+	}
+	if len(body.Directories) > maxBulkMkdir {
+		return jsonapi.InvalidParameter("directories", errors.New("Too many directories"))
+	}
+
+	entries := make([]bulkMkdirEntry, len(body.Directories))
+	for i, entry := range body.Directories {
+		if !path.IsAbs(entry.Path) {
+			return WrapVfsError(vfs.ErrNonAbsolutePath)
+		}
+		name := path.Clean(entry.Path)
+		if name == "/" || name == vfs.TrashDirName || strings.HasPrefix(name, vfs.TrashDirName+"/") {
+			return jsonapi.InvalidParameter("path", errors.New("Invalid path "+entry.Path))
+		}
+		doc, err := bulkMkdirDoc(fs, name, entry.Tags)
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		if err = checkPerm(c, permissions.POST, doc, nil); err != nil {
+			return err
+		}
+		entries[i] = bulkMkdirEntry{Path: name, Tags: entry.Tags}
+	}
+
+	// The directories are created in order, so the parents shared by several
+	// paths are created by the first one, and found by the next ones.
+	created := make(map[string]*vfs.DirDoc)
+	objs := make([]jsonapi.Object, 0, len(entries))
+	for _, entry := range entries {
+		doc, ok := created[entry.Path]
+		if !ok {
+			var err error
+			doc, err = vfs.MkdirAll(fs, entry.Path, entry.Tags)
+			if err != nil {
+				return WrapVfsError(err)
+			}
+			created[entry.Path] = doc
+		}
+		objs = append(objs, newDir(doc))
+	}
+	return jsonapi.DataList(c, http.StatusOK, withFields(objs, fieldsFromReq(c)), nil)
+}
+
+// bulkMkdirDoc returns the directory with the given path if it exists, or
+// else a document for it (not saved), to check the permissions before
+// creating it.
+func bulkMkdirDoc(fs vfs.VFS, name string, tags []string) (*vfs.DirDoc, error) {
+	doc, err := fs.DirByPath(name)
+	if err == nil {
+		return doc, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	// The ID of the closest existing ancestor is used as the parent, as the
+	// permissions are inherited from the ancestors.
+	ancestorID := consts.RootDirID
+	for base := path.Dir(name); base != "/"; base = path.Dir(base) {
+		ancestor, err := fs.DirByPath(base)
+		if err == nil {
+			ancestorID = ancestor.ID()
+			break
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return vfs.NewDirDocWithPath(path.Base(name), ancestorID, path.Dir(name), tags)
+}
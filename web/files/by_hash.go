@@ -0,0 +1,62 @@
+package files
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const (
+	defaultByHashLimit = 100
+	maxByHashLimit     = 1000
+)
+
+// FindByHashHandler handles GET requests on /files/_by_hash/:algo/:hash. It
+// returns the files, not in the trash, whose content has the given hash, in
+// hexadecimal. A sync client can use it to skip the upload of a content that
+// the stack already has.
+func FindByHashHandler(c echo.Context) error {
+	if err := permissions.AllowWholeType(c, permissions.GET, consts.Files); err != nil {
+		return err
+	}
+
+	algo := c.Param("algo")
+	var size int
+	switch algo {
+	case vfs.HashMD5:
+		size = md5.Size
+	case vfs.HashSHA256:
+		size = sha256.Size
+	default:
+		return WrapVfsError(vfs.ErrUnknownHashAlgo)
+	}
+	sum, err := hex.DecodeString(c.Param("hash"))
+	if err != nil || len(sum) != size {
+		return jsonapi.InvalidParameter("hash", errors.New("Invalid hash"))
+	}
+
+	limit, err := limitFromReq(c, defaultByHashLimit, maxByHashLimit)
+	if err != nil {
+		return err
+	}
+
+	instance := middlewares.GetInstance(c)
+	files, err := vfs.FilesByHash(instance, algo, sum, limit)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	objs := make([]jsonapi.Object, len(files))
+	for i, doc := range files {
+		objs[i] = newFile(doc, instance)
+	}
+	return jsonapi.DataList(c, http.StatusOK, withFields(objs, fieldsFromReq(c)), nil)
+}
@@ -0,0 +1,124 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// Headers used to send the capabilities of the files API
+const (
+	capabilitiesHeader  = "Cozy-Files-Capabilities"
+	maxUploadSizeHeader = "Cozy-Files-Max-Upload-Size"
+)
+
+// rootAllowedMethods are the methods supported on /files/, for OPTIONS.
+var rootAllowedMethods = []string{
+	http.MethodHead, http.MethodPost, http.MethodOptions,
+}
+
+// apiCapabilities describes the optional features of the files API for an
+// instance, so that a client can adapt its behavior after a single request.
+type apiCapabilities struct {
+	// MaxUploadSize is the maximal size of a file in bytes, or an empty
+	// string if there is no limit other than the disk quota
+	MaxUploadSize    string   `json:"max_upload_size,omitempty"`
+	ArchiveFormats   []string `json:"archive_formats"`
+	ContentEncodings []string `json:"content_encodings"`
+	// Versioning is false: the old versions of the files are not kept
+	Versioning bool `json:"versioning"`
+	Encryption bool `json:"encryption"`
+	Dedup      bool `json:"dedup"`
+	Audit      bool `json:"audit"`
+	Locks      bool `json:"locks"`
+	// IdempotencyKeys is true when the Idempotency-Key header is supported
+	// for the creation of files and directories
+	IdempotencyKeys bool `json:"idempotency_keys"`
+	// PartialUpdates is true when the content of a file can be written by
+	// ranges (PATCH /files/:file-id/content)
+	PartialUpdates bool `json:"partial_updates"`
+	// ResumableUploads is false: an interrupted upload must be restarted
+	ResumableUploads bool `json:"resumable_uploads"`
+	// PermanentDelete is true when a file can be destroyed without going
+	// through the trash (DELETE /files/:file-id?permanent=true)
+	PermanentDelete bool `json:"permanent_delete"`
+}
+
+func capabilities(c echo.Context) *apiCapabilities {
+	instance := middlewares.GetInstance(c)
+	fsConf := config.GetConfig().Fs
+	caps := &apiCapabilities{
+		ArchiveFormats:   []string{"zip"},
+		ContentEncodings: []string{"gzip", "deflate"},
+		Encryption:       vfs.EncryptionEnabled(),
+		Dedup:            fsConf.Dedup && config.FsURL().Scheme == config.SchemeSwift && instance.SwiftCluster > 0,
+		Audit:            fsConf.Audit,
+		Locks:            true,
+		IdempotencyKeys:  true,
+		PartialUpdates:   true,
+		PermanentDelete:  fsConf.PermanentDelete,
+	}
+	if max := vfs.MaxUploadSize(); max >= 0 {
+		caps.MaxUploadSize = strconv.FormatInt(max, 10)
+	}
+	return caps
+}
+
+// features returns the list of the enabled features, for the header.
+func (caps *apiCapabilities) features() []string {
+	var list []string
+	for _, f := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"versioning", caps.Versioning},
+		{"encryption", caps.Encryption},
+		{"dedup", caps.Dedup},
+		{"audit", caps.Audit},
+		{"locks", caps.Locks},
+		{"idempotency-keys", caps.IdempotencyKeys},
+		{"partial-updates", caps.PartialUpdates},
+		{"resumable-uploads", caps.ResumableUploads},
+		{"permanent-delete", caps.PermanentDelete},
+	} {
+		if f.enabled {
+			list = append(list, f.name)
+		}
+	}
+	return list
+}
+
+// CapabilitiesHandler handles HEAD and OPTIONS requests on /files/. It sends
+// the capabilities of the files API in the headers, and in the meta of the
+// response for OPTIONS.
+func CapabilitiesHandler(c echo.Context) error {
+	if _, err := permissions.GetPermission(c); err != nil {
+		return err
+	}
+	caps := capabilities(c)
+	h := c.Response().Header()
+	h.Set(echo.HeaderAllow, strings.Join(rootAllowedMethods, ", "))
+	h.Set(capabilitiesHeader, strings.Join(caps.features(), ", "))
+	if caps.MaxUploadSize != "" {
+		h.Set(maxUploadSizeHeader, caps.MaxUploadSize)
+	}
+	if c.Request().Method == http.MethodHead {
+		return c.NoContent(http.StatusOK)
+	}
+	body := struct {
+		Meta *apiCapabilities `json:"meta"`
+	}{
+		Meta: caps,
+	}
+	h.Set(echo.HeaderContentType, jsonapi.ContentType)
+	c.Response().WriteHeader(http.StatusOK)
+	return json.NewEncoder(c.Response()).Encode(body)
+}
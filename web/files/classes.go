@@ -0,0 +1,81 @@
+package files
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// ClassesID is the id of the JSON-API response for the classes taxonomy
+const ClassesID = "io.cozy.files.classes"
+
+type apiClasses struct {
+	Classes     []string          `json:"classes"`
+	Rules       map[string]string `json:"rules"`
+	CustomRules map[string]string `json:"custom_rules,omitempty"`
+}
+
+func (a *apiClasses) ID() string                             { return ClassesID }
+func (a *apiClasses) Rev() string                            { return "" }
+func (a *apiClasses) DocType() string                        { return consts.Files }
+func (a *apiClasses) Clone() couchdb.Doc                     { return a }
+func (a *apiClasses) SetID(_ string)                         {}
+func (a *apiClasses) SetRev(_ string)                        {}
+func (a *apiClasses) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiClasses) Included() []jsonapi.Object             { return nil }
+func (a *apiClasses) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/_classes"}
+}
+
+// ReadClassesHandler handles GET requests on /files/_classes. It returns the
+// taxonomy of the classes of files, with the rules used to associate a mime
+// type to a class.
+func ReadClassesHandler(c echo.Context) error {
+	if _, err := permissions.GetPermission(c); err != nil {
+		return err
+	}
+	instance := middlewares.GetInstance(c)
+	custom := instance.FileClassRules()
+	return jsonapi.Data(c, http.StatusOK, &apiClasses{
+		Classes:     vfs.Classes(custom),
+		Rules:       vfs.ClassRules(),
+		CustomRules: custom,
+	}, nil)
+}
+
+// ReclassifyHandler handles POST requests on /files/_reclassify. It starts a
+// job that computes again the class of the files, with the current rules, and
+// updates the files with a class that has changed. The dir-id parameter can
+// be used to do it only for the files inside a directory.
+func ReclassifyHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+	rootID := consts.RootDirID
+	if dirID := c.QueryParam("dir-id"); dirID != "" {
+		dir, err := fs.DirByID(dirID)
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		if err = checkPerm(c, permissions.PATCH, dir, nil); err != nil {
+			return err
+		}
+		rootID = dir.ID()
+	} else if err := permissions.AllowWholeType(c, permissions.PATCH, consts.Files); err != nil {
+		return err
+	}
+	rules := instance.FileClassRules()
+	job, err := startJob(c, "reclassify", func(progress func(int)) (interface{}, string, error) {
+		report, err := vfs.ReclassifyFiles(fs, rootID, rules, progress)
+		return report, "", err
+	})
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return jobData(c, http.StatusAccepted, job)
+}
@@ -0,0 +1,54 @@
+package files
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/echo"
+)
+
+// conflictStrategy returns the strategy for the name conflicts asked with the
+// on_conflict parameter: error (the default), rename or replace.
+func conflictStrategy(c echo.Context) (vfs.ConflictStrategy, error) {
+	strategy, err := vfs.ParseConflictStrategy(c.QueryParam("on_conflict"))
+	if err != nil {
+		return "", jsonapi.InvalidParameter("on_conflict", err)
+	}
+	if strategy == vfs.ConflictReplace &&
+		(c.QueryParam("Type") != consts.FileType || c.QueryParam("Source") != "") {
+		return "", jsonapi.InvalidParameter("on_conflict", errors.New("Only the uploaded files can be replaced"))
+	}
+	if strategy != vfs.ConflictError && c.QueryParam("Path") != "" {
+		return "", jsonapi.InvalidParameter("on_conflict", errors.New("It can't be used with a path"))
+	}
+	return strategy, nil
+}
+
+// fileToReplace returns the file that has the name of the request in the
+// directory, for the replace strategy, or nil if there is no such file. A
+// directory with this name is not replaced: the creation will fail with a
+// conflict.
+func fileToReplace(c echo.Context, fs vfs.VFS) (*vfs.FileDoc, error) {
+	name := c.QueryParam("Name")
+	if name == "" || strings.ContainsAny(name, vfs.ForbiddenFilenameChars) {
+		return nil, nil
+	}
+	dirID := c.Param("file-id")
+	if dirID == "" {
+		dirID = consts.RootDirID
+	}
+	parent, err := fs.DirByID(dirID)
+	if err != nil {
+		return nil, err
+	}
+	olddoc, err := fs.FileByPath(path.Join(parent.Fullpath, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return olddoc, err
+}
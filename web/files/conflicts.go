@@ -0,0 +1,100 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// apiConflict is a revision of a file in conflict with its current revision.
+// It has the attributes that can help the user to choose the revision to
+// keep.
+type apiConflict struct {
+	doc              *vfs.FileDoc
+	Name             string    `json:"name"`
+	DirID            string    `json:"dir_id"`
+	Size             int64     `json:"size,string"`
+	MD5Sum           []byte    `json:"md5sum"`
+	UpdatedAt        time.Time `json:"updated_at"`
+	Trashed          bool      `json:"trashed"`
+	ContentAvailable bool      `json:"content_available"`
+}
+
+func (a *apiConflict) ID() string                             { return a.doc.Rev() }
+func (a *apiConflict) Rev() string                            { return "" }
+func (a *apiConflict) DocType() string                        { return consts.FilesConflicts }
+func (a *apiConflict) Clone() couchdb.Doc                     { cloned := *a; return &cloned }
+func (a *apiConflict) SetID(_ string)                         {}
+func (a *apiConflict) SetRev(_ string)                        {}
+func (a *apiConflict) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiConflict) Included() []jsonapi.Object             { return nil }
+func (a *apiConflict) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Related: "/files/" + a.doc.ID()}
+}
+
+// ReadConflictsHandler handles GET requests on /files/:file-id/conflicts. It
+// returns the revisions of the file that are in conflict with its current
+// revision.
+func ReadConflictsHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+	conflicts, err := instance.VFS().FileConflicts(doc)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	objs := make([]jsonapi.Object, len(conflicts))
+	for i, conflict := range conflicts {
+		objs[i] = &apiConflict{
+			doc:              conflict,
+			Name:             conflict.DocName,
+			DirID:            conflict.DirID,
+			Size:             conflict.ByteSize,
+			MD5Sum:           conflict.MD5Sum,
+			UpdatedAt:        conflict.UpdatedAt,
+			Trashed:          conflict.Trashed,
+			ContentAvailable: bytes.Equal(conflict.MD5Sum, doc.MD5Sum),
+		}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// ResolveConflictHandler handles POST requests on /files/:file-id/resolve. The
+// revision given in the rev parameter is kept, and the other revisions in
+// conflict are deleted.
+func ResolveConflictHandler(c echo.Context) error {
+	rev := c.QueryParam("rev")
+	if rev == "" {
+		return jsonapi.InvalidParameter("rev", errors.New("Missing rev"))
+	}
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = CheckIfMatch(c, doc.Rev()); err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.PATCH, nil, doc); err != nil {
+		return err
+	}
+	newdoc, err := vfs.ResolveFileConflict(instance.VFS(), doc, rev)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return fileData(c, http.StatusOK, newdoc, nil)
+}
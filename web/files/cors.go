@@ -0,0 +1,70 @@
+package files
+
+import (
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// CORSOptions returns the options of the CORS middleware for the files
+// routes. The apps of the instance are allowed, with the cookies, and the
+// origins from the config, without them.
+func CORSOptions() middlewares.CORSOptions {
+	return middlewares.CORSOptions{
+		Routes: []string{"/files/"},
+		AllowedMethods: []string{
+			echo.GET,
+			echo.HEAD,
+			echo.POST,
+			echo.PUT,
+			echo.PATCH,
+			echo.DELETE,
+		},
+		AllowedHeaders: []string{
+			echo.HeaderAccept,
+			echo.HeaderAuthorization,
+			echo.HeaderContentType,
+			"Content-MD5",
+			"Content-Range",
+			"Date",
+			idempotencyKeyHeader,
+			"If-Match",
+			"If-None-Match",
+			"If-Modified-Since",
+			preferHeader,
+			"Range",
+		},
+		ExposedHeaders: []string{
+			"Content-Disposition",
+			echo.HeaderContentLength,
+			"Content-Range",
+			capabilitiesHeader,
+			maxUploadSizeHeader,
+			"Etag",
+			"Idempotent-Replayed",
+			vfs.ArchiveFilesHeader,
+			echo.HeaderLastModified,
+			"Link",
+			echo.HeaderLocation,
+			preferenceAppliedHeader,
+			restoredToHeader,
+			warningHeader,
+		},
+		AllowOrigin: allowOrigin,
+	}
+}
+
+// allowOrigin accepts the origins of the instance and of its apps (both the
+// nested and flat subdomains), and the origins listed in the config.
+func allowOrigin(c echo.Context, origin string) (allowed, credentials bool) {
+	if kind, _ := middlewares.ClassifyOrigin(c.Request().Host, origin); kind != middlewares.OriginExternal {
+		return true, true
+	}
+	for _, o := range config.GetConfig().Fs.CORSOrigins {
+		if o == origin {
+			return true, false
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,86 @@
+package files
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// warningHeader is the header used to warn the client that the disk usage of
+// the instance is above the soft quota.
+const warningHeader = "Warning"
+
+// apiDiskUsage is the meta of the responses for an upload, with the disk
+// usage of the instance after it, so that the client doesn't have to ask for
+// it on the settings. The sizes are serialized as strings, like for the
+// settings, because JS has some issues with big numbers.
+type apiDiskUsage struct {
+	DiskUsage string `json:"disk_usage"`
+	Quota     string `json:"quota,omitempty"`
+	Remaining string `json:"remaining,omitempty"`
+	Warning   string `json:"warning,omitempty"`
+}
+
+// diskUsageMeta returns the disk usage of the instance, with its quota and
+// the remaining space if there is a quota. A warning is added when the disk
+// usage is above the soft quota (a percentage of the quota, configured with
+// fs.soft_quota).
+func diskUsageMeta(fs vfs.VFS) (*apiDiskUsage, error) {
+	used, err := fs.DiskUsage()
+	if err != nil {
+		return nil, err
+	}
+	meta := &apiDiskUsage{DiskUsage: strconv.FormatInt(used, 10)}
+	if quota := fs.DiskQuota(); quota > 0 {
+		remaining := quota - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		meta.Quota = strconv.FormatInt(quota, 10)
+		meta.Remaining = strconv.FormatInt(remaining, 10)
+		if percent := config.GetConfig().Fs.SoftQuota; percent > 0 && used*100 > quota*int64(percent) {
+			meta.Warning = fmt.Sprintf("The disk usage is above %d%% of the quota", percent)
+		}
+	}
+	return meta, nil
+}
+
+// uploadData sends the JSON-API document for a file that has been uploaded,
+// with the disk usage of the instance in its meta. The disk usage is only
+// informative: if it can't be computed, the meta is just omitted.
+func uploadData(c echo.Context, statusCode int, doc *vfs.FileDoc) error {
+	instance := middlewares.GetInstance(c)
+	meta, err := diskUsageMeta(instance.VFS())
+	if err != nil {
+		instance.Logger().WithField("nspace", "files").
+			Infof("Cannot compute the disk usage: %s", err)
+	}
+	if meta != nil && meta.Warning != "" {
+		// 199 is the code for the miscellaneous warnings (RFC 7234)
+		c.Response().Header().Set(warningHeader, fmt.Sprintf("199 - %q", meta.Warning))
+	}
+	if preferMinimal(c) {
+		return minimalData(c, statusCode, doc)
+	}
+	data, err := jsonapi.MarshalObject(newFileWithLock(instance, doc))
+	if err != nil {
+		return err
+	}
+	body := struct {
+		Data json.RawMessage `json:"data"`
+		Meta *apiDiskUsage   `json:"meta,omitempty"`
+	}{
+		Data: data,
+		Meta: meta,
+	}
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, jsonapi.ContentType)
+	resp.WriteHeader(statusCode)
+	return json.NewEncoder(resp).Encode(body)
+}
@@ -0,0 +1,41 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/echo"
+)
+
+// opDestroy is the operation of a dry run for the permanent deletion of files
+// and directories
+const opDestroy = "destroy"
+
+// apiPlan is the meta of the JSON-API document sent for a dry run
+type apiPlan struct {
+	DryRun    bool   `json:"dry_run"`
+	Operation string `json:"operation"`
+	*vfs.Plan
+}
+
+// isDryRun returns true if the client has asked to only compute what would
+// be affected by a destructive operation.
+func isDryRun(c echo.Context) bool {
+	return c.QueryParam("dry_run") == "true"
+}
+
+// dryRunData sends the plan of an operation as the meta of a JSON-API
+// document, without data.
+func dryRunData(c echo.Context, operation string, plan *vfs.Plan) error {
+	doc := struct {
+		Meta apiPlan `json:"meta"`
+	}{
+		Meta: apiPlan{DryRun: true, Operation: operation, Plan: plan},
+	}
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, jsonapi.ContentType)
+	resp.WriteHeader(http.StatusOK)
+	return json.NewEncoder(resp).Encode(doc)
+}
@@ -0,0 +1,57 @@
+package files
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiExif struct {
+	doc *vfs.FileDoc
+	*vfs.ExifData
+}
+
+func (a *apiExif) ID() string                             { return a.doc.ID() }
+func (a *apiExif) Rev() string                            { return "" }
+func (a *apiExif) DocType() string                        { return consts.FilesExif }
+func (a *apiExif) Clone() couchdb.Doc                     { cloned := *a; return &cloned }
+func (a *apiExif) SetID(_ string)                         {}
+func (a *apiExif) SetRev(_ string)                        {}
+func (a *apiExif) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiExif) Included() []jsonapi.Object             { return nil }
+func (a *apiExif) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{
+		Self:    "/files/" + a.doc.ID() + "/exif",
+		Related: "/files/" + a.doc.ID(),
+	}
+}
+
+// ReadExifHandler handles GET requests on /files/:file-id/exif. It returns the
+// EXIF metadata of an image. The GPS coordinates are only included when the
+// gps=true parameter is given.
+func ReadExifHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+	if doc.Class != "image" {
+		return jsonapi.InvalidParameter("file-id", ErrNotAnImage)
+	}
+
+	withGPS := c.QueryParam("gps") == "true"
+	data, err := vfs.ReadExif(instance.VFS(), doc, withGPS)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiExif{doc, data}, nil)
+}
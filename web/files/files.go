@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	mimetype "mime"
 	"net/http"
 	"net/url"
 	"os"
@@ -17,10 +18,14 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/magic"
+	"github.com/cozy/cozy-stack/pkg/metrics"
 	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/pkg/vfs"
@@ -40,28 +45,98 @@ var ErrDocTypeInvalid = errors.New("Invalid document type")
 // CreationHandler handle all POST requests on /files/:file-id
 // aiming at creating a new document in the FS. Given the Type
 // parameter of the request, it will either upload a new file or
-// create a new directory.
+// create a new directory. With the UploadID parameter, the content
+// of the file is taken from the parts of a multipart upload.
 func CreationHandler(c echo.Context) error {
+	if uploadID := c.QueryParam("UploadID"); uploadID != "" {
+		return completeUpload(c, uploadID, creation)
+	}
+	return creation(c)
+}
+
+func creation(c echo.Context) error {
+	start := time.Now()
 	instance := middlewares.GetInstance(c)
+
+	strategy, err := conflictStrategy(c)
+	if err != nil {
+		return err
+	}
+	// With the replace strategy, an existing file is overwritten, like with
+	// a PUT on this file.
+	if strategy == vfs.ConflictReplace {
+		olddoc, errr := fileToReplace(c, instance.VFS())
+		if errr != nil {
+			return WrapVfsError(errr)
+		}
+		if olddoc != nil {
+			return overwriteFileContent(c, start, olddoc)
+		}
+	}
+
+	key, err := idempotencyKeyFromReq(c)
+	if err != nil {
+		return err
+	}
+	if key != "" {
+		docID, err := vfs.ReserveIdempotencyKey(instance.Domain, key)
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		if docID != "" {
+			return replayCreation(c, docID)
+		}
+	}
+
 	var doc jsonapi.Object
-	var err error
 	switch c.QueryParam("Type") {
 	case consts.FileType:
-		doc, err = createFileHandler(c, instance.VFS())
+		if c.QueryParam("Source") != "" {
+			doc, err = createFileFromSourceHandler(c, instance.VFS(), strategy)
+		} else {
+			doc, err = createFileHandler(c, instance.VFS(), strategy)
+		}
 	case consts.DirType:
-		doc, err = createDirHandler(c, instance.VFS())
+		doc, err = createDirHandler(c, instance.VFS(), strategy)
 	default:
 		err = ErrDocTypeInvalid
 	}
 
+	if key != "" {
+		if err != nil {
+			err2 := vfs.ReleaseIdempotencyKey(instance.Domain, key)
+			if err2 != nil {
+				instance.Logger().WithField("nspace", "files").
+					Warnf("Cannot release the idempotency key: %s", err2)
+			}
+		} else {
+			err2 := vfs.SaveIdempotencyKey(instance.Domain, key, doc.ID())
+			if err2 != nil {
+				instance.Logger().WithField("nspace", "files").
+					Warnf("Cannot save the idempotency key: %s", err2)
+			}
+		}
+	}
+
 	if err != nil {
 		return WrapVfsError(err)
 	}
 
+	switch d := doc.(type) {
+	case *file:
+		logOperation(c, opCreate, start, nil, d.doc)
+		return uploadData(c, http.StatusCreated, d.doc)
+	case *dir:
+		logOperation(c, opCreate, start, d.doc, nil)
+		if preferMinimal(c) {
+			return minimalData(c, http.StatusCreated, d.doc)
+		}
+	}
+
 	return jsonapi.Data(c, http.StatusCreated, doc, nil)
 }
 
-func createFileHandler(c echo.Context, fs vfs.VFS) (f *file, err error) {
+func createFileHandler(c echo.Context, fs vfs.VFS, strategy vfs.ConflictStrategy) (f *file, err error) {
 	tags := strings.Split(c.QueryParam("Tags"), TagSeparator)
 
 	dirID := c.Param("file-id")
@@ -77,12 +152,42 @@ func createFileHandler(c echo.Context, fs vfs.VFS) (f *file, err error) {
 		return
 	}
 
-	file, err := fs.CreateFile(doc, nil)
+	parent, err := fs.DirByID(doc.DirID)
 	if err != nil {
 		return
 	}
+	vfs.InheritTags(doc, parent)
 
+	var exists bool
+	if strategy == vfs.ConflictRename || hasExistencePreconditions(c) {
+		exists, err = fs.DirChildExists(doc.DirID, doc.DocName)
+		if err != nil {
+			return
+		}
+		if err = checkExistencePreconditions(c, exists); err != nil {
+			return
+		}
+	}
+	if exists && strategy == vfs.ConflictRename {
+		if doc.DocName, err = vfs.UniqueName(fs, doc.DirID, doc.DocName); err != nil {
+			return
+		}
+		doc.ResetFullpath()
+	}
+
+	// The body is read only when everything that can be checked without it
+	// has been checked (name, parent, quota, ...): it is the first read that
+	// sends the 100 Continue response to a client that expects it.
 	instance := middlewares.GetInstance(c)
+	if err = checkUploadPolicyType(instance, doc); err != nil {
+		return
+	}
+
+	file, err := fs.CreateFile(doc, nil)
+	if err != nil {
+		return
+	}
+
 	defer func() {
 		if cerr := file.Close(); cerr != nil && (err == nil || err == io.ErrUnexpectedEOF) {
 			instance.Logger().WithField("nspace", "files").
@@ -91,7 +196,12 @@ func createFileHandler(c echo.Context, fs vfs.VFS) (f *file, err error) {
 		}
 	}()
 
-	_, err = io.Copy(file, c.Request().Body)
+	body, err := sniffUploadPolicy(instance, doc, c.Request().Body)
+	if err != nil {
+		abortFile(file, err)
+		return
+	}
+	err = copyContent(c, file, body)
 	if err != nil {
 		instance.Logger().WithField("nspace", "files").
 			Warnf("Error on uploading file (copy): %s", err)
@@ -101,14 +211,44 @@ func createFileHandler(c echo.Context, fs vfs.VFS) (f *file, err error) {
 	return
 }
 
-func createDirHandler(c echo.Context, fs vfs.VFS) (*dir, error) {
+func createDirHandler(c echo.Context, fs vfs.VFS, strategy vfs.ConflictStrategy) (*dir, error) {
 	path := c.QueryParam("Path")
 	tags := utils.SplitTrimString(c.QueryParam("Tags"), TagSeparator)
 
 	var doc *vfs.DirDoc
 	var err error
+	id := c.QueryParam("id")
+	if id != "" {
+		if path != "" {
+			return nil, jsonapi.InvalidParameter("id", errors.New("The id can't be used with a path"))
+		}
+		if err = checkDirID(id); err != nil {
+			return nil, err
+		}
+	}
+
 	if path != "" {
-		if c.QueryParam("Recursive") == "true" {
+		resolver, err := pathResolverFromReq(c)
+		if err != nil {
+			return nil, err
+		}
+		if hasExistencePreconditions(c) {
+			_, err = resolver.DirByPath(path)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			if err = checkExistencePreconditions(c, err == nil); err != nil {
+				return nil, err
+			}
+		}
+		recursive := c.QueryParam("Recursive") == "true"
+		if sub, ok := resolver.(*vfs.Subtree); ok {
+			if recursive {
+				doc, err = sub.MkdirAll(path, tags)
+			} else {
+				doc, err = sub.Mkdir(path, tags)
+			}
+		} else if recursive {
 			doc, err = vfs.MkdirAll(fs, path, tags)
 		} else {
 			doc, err = vfs.Mkdir(fs, path, tags)
@@ -125,8 +265,14 @@ func createDirHandler(c echo.Context, fs vfs.VFS) (*dir, error) {
 	if err != nil {
 		return nil, err
 	}
+	if id != "" {
+		doc.SetID(id)
+	}
 	if date := c.Request().Header.Get("Date"); date != "" {
 		if t, err2 := time.Parse(time.RFC1123, date); err2 == nil {
+			if !legalImportDate(t) {
+				return nil, vfs.ErrIllegalTime
+			}
 			doc.CreatedAt = t
 			doc.UpdatedAt = t
 		}
@@ -137,31 +283,115 @@ func createDirHandler(c echo.Context, fs vfs.VFS) (*dir, error) {
 		return nil, err
 	}
 
+	var exists bool
+	if strategy == vfs.ConflictRename || hasExistencePreconditions(c) {
+		exists, err = fs.DirChildExists(doc.DirID, doc.DocName)
+		if err != nil {
+			return nil, err
+		}
+		if err = checkExistencePreconditions(c, exists); err != nil {
+			return nil, err
+		}
+	}
+	if exists && strategy == vfs.ConflictRename {
+		name, err = vfs.UniqueName(fs, doc.DirID, doc.DocName)
+		if err != nil {
+			return nil, err
+		}
+		doc.Fullpath = strings.TrimSuffix(doc.Fullpath, doc.DocName) + name
+		doc.DocName = name
+	}
+
 	if err = fs.CreateDir(doc); err != nil {
+		if id != "" && couchdb.IsConflictError(err) {
+			return nil, jsonapi.Conflict(errors.New("The id is already taken"))
+		}
 		return nil, err
 	}
 
 	return newDir(doc), nil
 }
 
+// maxDirIDLength is the maximal length of an ID given by the client for a new
+// directory.
+const maxDirIDLength = 64
+
+// checkDirID checks that an ID given by the client for a new directory can be
+// used: only letters, digits, dashes, dots and underscores are allowed, and
+// the IDs starting with an underscore or io.cozy are reserved.
+func checkDirID(id string) error {
+	if len(id) > maxDirIDLength ||
+		strings.HasPrefix(id, "_") ||
+		strings.HasPrefix(id, "io.cozy") {
+		return jsonapi.InvalidParameter("id", errors.New("Invalid id"))
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '.', r == '_':
+		default:
+			return jsonapi.InvalidParameter("id", errors.New("Invalid id"))
+		}
+	}
+	return nil
+}
+
 // OverwriteFileContentHandler handles PUT requests on /files/:file-id
 // to overwrite the content of a file given its identifier.
-func OverwriteFileContentHandler(c echo.Context) (err error) {
-	var instance = middlewares.GetInstance(c)
-	var olddoc *vfs.FileDoc
-	var newdoc *vfs.FileDoc
+func OverwriteFileContentHandler(c echo.Context) error {
+	start := time.Now()
+	instance := middlewares.GetInstance(c)
 
 	fileID := c.Param("file-id")
 	if fileID == "" {
 		fileID = c.Param("docid") // Used by sharings.updateDocument
 	}
 
-	olddoc, err = instance.VFS().FileByID(fileID)
+	olddoc, err := instance.VFS().FileByID(fileID)
+	if os.IsNotExist(err) {
+		if errp := checkExistencePreconditions(c, false); errp != nil {
+			return errp
+		}
+	}
 	if err != nil {
 		return WrapVfsError(err)
 	}
 
-	newdoc, err = FileDocFromReq(
+	return overwriteFileContent(c, start, olddoc)
+}
+
+// OverwriteFileContentByPathHandler handles PUT requests on /files/overwrite
+// to overwrite the content of a file given its path, for the clients that
+// work with paths rather than identifiers.
+func OverwriteFileContentByPathHandler(c echo.Context) error {
+	start := time.Now()
+
+	resolver, err := pathResolverFromReq(c)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	dir, olddoc, err := resolver.DirOrFileByPath(c.QueryParam("Path"))
+	if os.IsNotExist(err) {
+		if errp := checkExistencePreconditions(c, false); errp != nil {
+			return errp
+		}
+	}
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if dir != nil {
+		return jsonapi.BadRequest(errors.New("The path is a directory"))
+	}
+
+	return overwriteFileContent(c, start, olddoc)
+}
+
+// overwriteFileContent replaces the content of the given file by the body of
+// the request.
+func overwriteFileContent(c echo.Context, start time.Time, olddoc *vfs.FileDoc) (err error) {
+	instance := middlewares.GetInstance(c)
+
+	newdoc, err := FileDocFromReq(
 		c,
 		olddoc.DocName,
 		olddoc.DirID,
@@ -172,10 +402,16 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 	}
 
 	newdoc.ReferencedBy = olddoc.ReferencedBy
+	if c.QueryParam("UpdatedAt") != "" && newdoc.UpdatedAt.Before(olddoc.CreatedAt) {
+		return WrapVfsError(vfs.ErrIllegalTime)
+	}
 
 	if err = CheckIfMatch(c, olddoc.Rev()); err != nil {
 		return WrapVfsError(err)
 	}
+	if err = checkExistencePreconditions(c, true); err != nil {
+		return WrapVfsError(err)
+	}
 
 	err = checkPerm(c, permissions.PUT, nil, olddoc)
 	if err != nil {
@@ -188,6 +424,15 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 		return
 	}
 
+	if err = checkFileLock(c, olddoc); err != nil {
+		return
+	}
+
+	// Like for createFileHandler, the body is read only after the checks
+	if err = checkUploadPolicyType(instance, newdoc); err != nil {
+		return WrapVfsError(err)
+	}
+
 	file, err := instance.VFS().CreateFile(newdoc, olddoc)
 	if err != nil {
 		return WrapVfsError(err)
@@ -201,13 +446,161 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 			err = WrapVfsError(err)
 			return
 		}
-		err = fileData(c, http.StatusOK, newdoc, nil)
+		logOperation(c, opOverwrite, start, nil, newdoc)
+		err = uploadData(c, http.StatusOK, newdoc)
 	}()
 
-	_, err = io.Copy(file, c.Request().Body)
+	body, err := sniffUploadPolicy(instance, newdoc, c.Request().Body)
+	if err != nil {
+		abortFile(file, err)
+		return
+	}
+	err = copyContent(c, file, body)
 	return
 }
 
+// WriteFileRangeHandler handles PATCH requests on /files/:file-id/content to
+// write a part of the content of a file, given by the Content-Range header:
+// `bytes <start>-*/*` appends the body at the end of the file, and
+// `bytes <start>-<end>/*` overwrites this region of the file.
+func WriteFileRangeHandler(c echo.Context) error {
+	start := time.Now()
+	instance := middlewares.GetInstance(c)
+
+	from, length, err := parseContentRange(c.Request().Header.Get("Content-Range"))
+	if err != nil {
+		return jsonapi.InvalidParameter("Content-Range", err)
+	}
+	if length >= 0 {
+		size, errl := parseContentLength(c.Request().Header.Get("Content-Length"))
+		if errl != nil || (size >= 0 && size != length) {
+			return WrapVfsError(vfs.ErrContentLengthMismatch)
+		}
+	}
+
+	olddoc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = CheckIfMatch(c, olddoc.Rev()); err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.PUT, nil, olddoc); err != nil {
+		return err
+	}
+	if err = checkFileLock(c, olddoc); err != nil {
+		return err
+	}
+
+	newdoc, err := vfs.WriteFileRange(instance.VFS(), olddoc, from, length, c.Request().Body)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if length < 0 {
+		logOperation(c, opAppend, start, nil, newdoc)
+	} else {
+		logOperation(c, opOverwrite, start, nil, newdoc)
+	}
+	if preferMinimal(c) {
+		return minimalData(c, http.StatusOK, newdoc)
+	}
+	return fileData(c, http.StatusOK, newdoc, nil)
+}
+
+// TouchFileHandler handles POST requests on /files/:file-id/touch to change
+// the modification date of a file to now, or to the date given in the
+// UpdatedAt parameter (RFC3339).
+func TouchFileHandler(c echo.Context) error {
+	var date *time.Time
+	if param := c.QueryParam("UpdatedAt"); param != "" {
+		t, err := time.Parse(time.RFC3339, param)
+		if err != nil {
+			return WrapVfsError(vfs.ErrIllegalTime)
+		}
+		date = &t
+	}
+
+	instance := middlewares.GetInstance(c)
+	olddoc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = CheckIfMatch(c, olddoc.Rev()); err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.PATCH, nil, olddoc); err != nil {
+		return err
+	}
+
+	newdoc, err := vfs.TouchFile(instance.VFS(), olddoc, date)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return fileData(c, http.StatusOK, newdoc, nil)
+}
+
+// checkUploadPolicy checks that the type of an uploaded file is allowed by
+// the upload policy of the instance. The type given by the client (or guessed
+// from the extension) is not enough, as a file can be renamed: the beginning
+// of the content is also sniffed. It returns a reader with the whole content.
+func checkUploadPolicy(instance *instance.Instance, doc *vfs.FileDoc, body io.Reader) (io.Reader, error) {
+	if err := checkUploadPolicyType(instance, doc); err != nil {
+		return nil, err
+	}
+	return sniffUploadPolicy(instance, doc, body)
+}
+
+// checkUploadPolicyType is the part of checkUploadPolicy that doesn't read
+// the content: it can be done before replying 100 Continue to a client that
+// has sent an Expect: 100-continue header.
+func checkUploadPolicyType(instance *instance.Instance, doc *vfs.FileDoc) error {
+	policy := instance.UploadPolicy()
+	if policy == nil {
+		return nil
+	}
+	for _, t := range knownUploadTypes(instance, doc) {
+		if err := policy.Check(t[0], t[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// knownUploadTypes returns the mime types and classes of a file given by the
+// client and guessed from the extension. The unknown types, like for a file
+// without extension, are left out: they don't say anything about the file.
+func knownUploadTypes(instance *instance.Instance, doc *vfs.FileDoc) [][2]string {
+	var types [][2]string
+	if doc.Mime != "" && doc.Mime != vfs.DefaultContentType {
+		types = append(types, [2]string{doc.Mime, doc.Class})
+	}
+	rules := instance.FileClassRules()
+	mime, class := vfs.ExtractMimeAndClassWithRules(mimetype.TypeByExtension(path.Ext(doc.DocName)), rules)
+	if mime != vfs.DefaultContentType {
+		types = append(types, [2]string{mime, class})
+	}
+	return types
+}
+
+// sniffUploadPolicy is the part of checkUploadPolicy that sniffs the
+// beginning of the content. When neither the client nor the extension give a
+// known type, the decision is made on the sniffed type, and a content that
+// can't be sniffed is checked as application/octet-stream.
+func sniffUploadPolicy(instance *instance.Instance, doc *vfs.FileDoc, body io.Reader) (io.Reader, error) {
+	policy := instance.UploadPolicy()
+	if policy == nil {
+		return body, nil
+	}
+	sniffed, body := magic.MIMETypeFromReader(body)
+	if sniffed != "" || len(knownUploadTypes(instance, doc)) == 0 {
+		mime, class := vfs.ExtractMimeAndClassWithRules(sniffed, instance.FileClassRules())
+		if err := policy.Check(mime, class); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
 // ModifyMetadataByIDHandler handles PATCH requests on /files/:file-id
 //
 // It can be used to modify the file or directory metadata, as well as
@@ -238,7 +631,11 @@ func ModifyMetadataByPathHandler(c echo.Context) error {
 	}
 
 	instance := middlewares.GetInstance(c)
-	dir, file, err := instance.VFS().DirOrFileByPath(c.QueryParam("Path"))
+	resolver, err := pathResolverFromReq(c)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	dir, file, err := resolver.DirOrFileByPath(c.QueryParam("Path"))
 	if err != nil {
 		return WrapVfsError(err)
 	}
@@ -246,7 +643,54 @@ func ModifyMetadataByPathHandler(c echo.Context) error {
 	return applyPatch(c, instance, patch, dir, file)
 }
 
+// MoveUpHandler handles POST requests on /files/:file-id/move-up. It moves
+// the file or directory to the parent of its parent directory, like a PATCH
+// with this directory as the new parent. It fails for the documents at the
+// root, and for those in the trash (they should be restored instead).
+func MoveUpHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+	dir, file, err := fs.DirOrFileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+
+	var dirID string
+	if dir != nil {
+		dirID = dir.DirID
+	} else {
+		dirID = file.DirID
+	}
+	if dirID == "" || dirID == consts.RootDirID {
+		return jsonapi.BadRequest(errors.New("The document is already at the root"))
+	}
+	if dirID == consts.TrashDirID {
+		return WrapVfsError(vfs.ErrFileInTrash)
+	}
+	parent, err := fs.DirByID(dirID)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	grandparent, err := fs.DirByID(parent.DirID)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	// The document leaves its parent, so the permission on the destination
+	// is checked too.
+	if err = checkPerm(c, permissions.POST, grandparent, nil); err != nil {
+		return err
+	}
+
+	grandparentID := grandparent.ID()
+	patch := &vfs.DocPatch{DirID: &grandparentID}
+	return applyPatch(c, instance, patch, dir, file)
+}
+
 func getPatch(c echo.Context) (*vfs.DocPatch, error) {
+	if isMergePatch(c) {
+		return getMergePatch(c)
+	}
+
 	var patch vfs.DocPatch
 
 	obj, err := jsonapi.Bind(c.Request().Body, &patch)
@@ -267,6 +711,8 @@ func getPatch(c echo.Context) (*vfs.DocPatch, error) {
 }
 
 func applyPatch(c echo.Context, instance *instance.Instance, patch *vfs.DocPatch, dir *vfs.DirDoc, file *vfs.FileDoc) error {
+	start := time.Now()
+	moved := patch.DirID != nil || patch.Name != nil || patch.ParentPath != nil
 	var rev string
 	if dir != nil {
 		rev = dir.Rev()
@@ -281,22 +727,110 @@ func applyPatch(c echo.Context, instance *instance.Instance, patch *vfs.DocPatch
 	if err := checkPerm(c, permissions.PATCH, dir, file); err != nil {
 		return err
 	}
+	if file != nil {
+		if err := checkFileLock(c, file); err != nil {
+			return err
+		}
+	}
+	if err := resolveParentPath(c, instance.VFS(), patch); err != nil {
+		return err
+	}
+
+	if isDryRun(c) {
+		return dryRunMove(c, instance, patch, dir, file)
+	}
+
+	// With retryOnConflict, the patch is applied again on the last revision
+	// if another request has modified the document in the meantime. It makes
+	// no sense when the client has asked for a specific revision.
+	retry := c.QueryParam("retryOnConflict") == "true" && c.Request().Header.Get("If-Match") == ""
 
 	if dir != nil {
-		doc, err := vfs.ModifyDirMetadata(instance.VFS(), dir, patch)
+		var doc *vfs.DirDoc
+		var err error
+		if retry {
+			doc, err = vfs.ModifyDirMetadataWithRetry(instance.VFS(), dir, patch)
+		} else {
+			doc, err = vfs.ModifyDirMetadata(instance.VFS(), dir, patch)
+		}
 		if err != nil {
 			return WrapVfsError(err)
 		}
+		if moved {
+			logOperation(c, opMove, start, doc, nil)
+		}
+		if preferMinimal(c) {
+			return minimalData(c, http.StatusOK, doc)
+		}
 		return dirData(c, http.StatusOK, doc)
 	}
 
-	doc, err := vfs.ModifyFileMetadata(instance.VFS(), file, patch)
+	var doc *vfs.FileDoc
+	var err error
+	if retry {
+		doc, err = vfs.ModifyFileMetadataWithRetry(instance.VFS(), file, patch)
+	} else {
+		doc, err = vfs.ModifyFileMetadata(instance.VFS(), file, patch)
+	}
 	if err != nil {
 		return WrapVfsError(err)
 	}
+	if moved {
+		logOperation(c, opMove, start, nil, doc)
+	}
+	if preferMinimal(c) {
+		return minimalData(c, http.StatusOK, doc)
+	}
 	return fileData(c, http.StatusOK, doc, nil)
 }
 
+// resolveParentPath sets the new parent of the patch from its parent_path
+// attribute. With Recursive=true, the missing directories are created, and it
+// requires the permission to create directories anywhere.
+func resolveParentPath(c echo.Context, fs vfs.VFS, patch *vfs.DocPatch) error {
+	if patch.ParentPath == nil {
+		return nil
+	}
+	if patch.DirID != nil {
+		return jsonapi.InvalidAttribute("parent_path",
+			errors.New("parent_path can't be used with a parent relationship"))
+	}
+	create := c.QueryParam("Recursive") == "true" && !isDryRun(c)
+	if create {
+		if _, err := fs.DirByPath(path.Clean(*patch.ParentPath)); os.IsNotExist(err) {
+			if err = permissions.AllowWholeType(c, permissions.POST, consts.Files); err != nil {
+				return err
+			}
+		}
+	}
+	if err := vfs.ResolveParentPath(fs, patch, create); err != nil {
+		return WrapVfsError(err)
+	}
+	return nil
+}
+
+// dryRunMove responds with the files and directories that would be moved by
+// the patch, without applying it.
+func dryRunMove(c echo.Context, instance *instance.Instance, patch *vfs.DocPatch, dir *vfs.DirDoc, file *vfs.FileDoc) error {
+	if patch.DirID == nil && patch.Name == nil {
+		return jsonapi.InvalidParameter("dry_run",
+			errors.New("dry_run can only be used to move or rename"))
+	}
+	var dirID string
+	if patch.DirID != nil {
+		dirID = *patch.DirID
+	} else if dir != nil {
+		dirID = dir.DirID
+	} else {
+		dirID = file.DirID
+	}
+	plan, err := vfs.PlanMove(instance.VFS(), dir, file, dirID)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return dryRunData(c, opMove, plan)
+}
+
 // ReadMetadataFromIDHandler handles all GET requests on /files/:file-
 // id aiming at getting file metadata from its id.
 func ReadMetadataFromIDHandler(c echo.Context) error {
@@ -316,6 +850,7 @@ func ReadMetadataFromIDHandler(c echo.Context) error {
 	if dir != nil {
 		return dirData(c, http.StatusOK, dir)
 	}
+	c.Response().Header().Set("Etag", vfs.RevETag(file.Rev()))
 	return fileData(c, http.StatusOK, file, nil)
 }
 
@@ -340,11 +875,12 @@ func GetChildrenHandler(c echo.Context) error {
 // ReadMetadataFromPathHandler handles all GET requests on
 // /files/metadata aiming at getting file metadata from its path.
 func ReadMetadataFromPathHandler(c echo.Context) error {
-	var err error
-
-	instance := middlewares.GetInstance(c)
+	resolver, err := pathResolverFromReq(c)
+	if err != nil {
+		return WrapVfsError(err)
+	}
 
-	dir, file, err := instance.VFS().DirOrFileByPath(c.QueryParam("Path"))
+	dir, file, err := resolver.DirOrFileByPath(c.QueryParam("Path"))
 	if err != nil {
 		return WrapVfsError(err)
 	}
@@ -356,6 +892,7 @@ func ReadMetadataFromPathHandler(c echo.Context) error {
 	if dir != nil {
 		return dirData(c, http.StatusOK, dir)
 	}
+	c.Response().Header().Set("Etag", vfs.RevETag(file.Rev()))
 	return fileData(c, http.StatusOK, file, nil)
 }
 
@@ -375,9 +912,18 @@ func ReadFileContentFromIDHandler(c echo.Context) error {
 		return err
 	}
 
-	disposition := "inline"
-	if c.QueryParam("Dl") == "1" {
-		disposition = "attachment"
+	disposition, err := dispositionFromReq(c, "inline")
+	if err != nil {
+		return err
+	}
+	if doc, err = overrideContentType(c, doc, disposition); err != nil {
+		return err
+	}
+	// The filename used for the download can be overridden, without changing
+	// the name of the file in the VFS.
+	if filename := sanitizeDownloadName(c.QueryParam("filename")); filename != "" {
+		c.Response().Header().Set("Content-Disposition", vfs.ContentDisposition(disposition, filename))
+		disposition = ""
 	}
 	err = vfs.ServeFileContent(instance.VFS(), doc, disposition, c.Request(), c.Response())
 	if err != nil {
@@ -387,6 +933,105 @@ func ReadFileContentFromIDHandler(c echo.Context) error {
 	return nil
 }
 
+// dispositionFromReq returns the content disposition asked by the client,
+// with the disposition query parameter (inline or attachment), or with the
+// Dl=1 shortcut for attachment. The given default is used if none is given.
+func dispositionFromReq(c echo.Context, def string) (string, error) {
+	switch c.QueryParam("disposition") {
+	case "inline":
+		return "inline", nil
+	case "attachment":
+		return "attachment", nil
+	case "":
+	default:
+		return "", jsonapi.InvalidParameter("disposition",
+			errors.New("disposition must be inline or attachment"))
+	}
+	if c.QueryParam("Dl") == "1" || c.QueryParam("dl") == "1" {
+		return "attachment", nil
+	}
+	return def, nil
+}
+
+// Content types that can be used to override the type of a file for a
+// download. The types that can run scripts in a browser are accepted only
+// for an attachment, to prevent a stored XSS.
+var (
+	safeContentTypeFamilies = []string{"image/", "audio/", "video/", "font/"}
+	safeContentTypes        = []string{
+		"application/json",
+		"application/octet-stream",
+		"application/pdf",
+		"application/zip",
+		"text/csv",
+		"text/markdown",
+		"text/plain",
+	}
+	attachmentOnlyContentTypes = []string{
+		"application/javascript",
+		"application/xhtml+xml",
+		"application/xml",
+		"image/svg+xml",
+		"text/html",
+		"text/javascript",
+		"text/xml",
+	}
+)
+
+// overrideContentType returns the file to serve with the type given in the
+// content_type query parameter, if any. The document in the VFS is not
+// modified.
+func overrideContentType(c echo.Context, doc *vfs.FileDoc, disposition string) (*vfs.FileDoc, error) {
+	value := c.QueryParam("content_type")
+	if value == "" {
+		return doc, nil
+	}
+	mime, params, err := mimetype.ParseMediaType(value)
+	if err != nil {
+		return nil, jsonapi.InvalidParameter("content_type", err)
+	}
+	for key := range params {
+		if key != "charset" {
+			return nil, jsonapi.InvalidParameter("content_type",
+				fmt.Errorf("The %s parameter is not allowed", key))
+		}
+	}
+
+	allowed := false
+	if utils.IsInArray(mime, attachmentOnlyContentTypes) {
+		allowed = disposition == "attachment"
+	} else if utils.IsInArray(mime, safeContentTypes) {
+		allowed = true
+	} else {
+		for _, family := range safeContentTypeFamilies {
+			if strings.HasPrefix(mime, family) {
+				allowed = true
+				break
+			}
+		}
+	}
+	if !allowed {
+		return nil, jsonapi.InvalidParameter("content_type",
+			fmt.Errorf("The content type %s is not allowed", mime))
+	}
+
+	overridden := doc.Clone().(*vfs.FileDoc)
+	overridden.Mime = mimetype.FormatMediaType(mime, params)
+	return overridden, nil
+}
+
+// sanitizeDownloadName removes the path separators and the control characters
+// from a filename given by the client for a download.
+func sanitizeDownloadName(filename string) string {
+	filename = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filename)
+	return strings.TrimSpace(filename)
+}
+
 // HeadDirOrFile handles HEAD requests on directory or file to check their
 // existence
 func HeadDirOrFile(c echo.Context) error {
@@ -409,7 +1054,51 @@ func HeadDirOrFile(c echo.Context) error {
 	return nil
 }
 
-// ThumbnailHandler serves thumbnails of the images/photos
+// Methods supported by the routes on a file or a directory, for OPTIONS
+var (
+	fileAllowedMethods = []string{
+		http.MethodGet, http.MethodHead, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions,
+	}
+	dirAllowedMethods = []string{
+		http.MethodGet, http.MethodHead, http.MethodPost,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions,
+	}
+	// The root and trash directories can't be moved or deleted
+	specialDirAllowedMethods = []string{
+		http.MethodGet, http.MethodHead, http.MethodPost, http.MethodOptions,
+	}
+)
+
+// OptionsDirOrFile handles OPTIONS requests on a directory or a file, and
+// responds with the methods supported for this type of resource in the Allow
+// header.
+func OptionsDirOrFile(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	dir, file, err := instance.VFS().DirOrFileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.GET, dir, file); err != nil {
+		return err
+	}
+
+	methods := fileAllowedMethods
+	if dir != nil {
+		if id := dir.ID(); id == consts.RootDirID || id == consts.TrashDirID {
+			methods = specialDirAllowedMethods
+		} else {
+			methods = dirAllowedMethods
+		}
+	}
+	c.Response().Header().Set(echo.HeaderAllow, strings.Join(methods, ", "))
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ThumbnailHandler serves thumbnails of the images/photos, and the previews
+// of the PDFs
 func ThumbnailHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 
@@ -436,13 +1125,20 @@ func ThumbnailHandler(c echo.Context) error {
 	}
 
 	fs := instance.ThumbsFS()
-	return fs.ServeThumbContent(c.Response(), c.Request(), doc, c.Param("format"))
+	format := c.Param("format")
+	err = fs.ServeThumbContent(c.Response(), c.Request(), doc, format)
+	if os.IsNotExist(err) && doc.Class == "pdf" &&
+		(format == "small" || format == "medium" || format == "large") {
+		// A PDF can't always be rendered (encrypted for example): the default
+		// icon is served instead of the preview.
+		serveClassIcon(c, doc)
+		return nil
+	}
+	return err
 }
 
-func sendFileFromPath(c echo.Context, path string, checkPermission bool) error {
-	instance := middlewares.GetInstance(c)
-
-	doc, err := instance.VFS().FileByPath(path)
+func sendFileFromPath(c echo.Context, resolver pathResolver, path string, checkPermission bool) error {
+	doc, err := resolver.FileByPath(path)
 	if err != nil {
 		return WrapVfsError(err)
 	}
@@ -454,10 +1150,22 @@ func sendFileFromPath(c echo.Context, path string, checkPermission bool) error {
 		}
 	}
 
-	disposition := "inline"
-	if c.QueryParam("Dl") == "1" {
-		disposition = "attachment"
-	} else if !checkPermission {
+	return sendFile(c, doc, checkPermission)
+}
+
+// sendFile serves the content of a file, inline by default. When the
+// permission has not been checked (a download link), some files can be
+// displayed by the browser in the client-side apps.
+func sendFile(c echo.Context, doc *vfs.FileDoc, checkPermission bool) error {
+	instance := middlewares.GetInstance(c)
+	disposition, err := dispositionFromReq(c, "inline")
+	if err != nil {
+		return err
+	}
+	if doc, err = overrideContentType(c, doc, disposition); err != nil {
+		return err
+	}
+	if disposition == "inline" && !checkPermission {
 		// Allow some files to be displayed by the browser in the client-side apps
 		if doc.Mime == "text/plain" || doc.Class == "image" || doc.Class == "audio" || doc.Class == "video" || doc.Mime == "application/pdf" {
 			c.Response().Header().Del(echo.HeaderXFrameOptions)
@@ -475,7 +1183,11 @@ func sendFileFromPath(c echo.Context, path string, checkPermission bool) error {
 // aiming at downloading a file given its path. It serves the file in in
 // attachment mode.
 func ReadFileContentFromPathHandler(c echo.Context) error {
-	return sendFileFromPath(c, c.QueryParam("Path"), true)
+	resolver, err := pathResolverFromReq(c)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return sendFileFromPath(c, resolver, c.QueryParam("Path"), true)
 }
 
 // ArchiveDownloadCreateHandler handles requests to /files/archive and stores the
@@ -494,6 +1206,11 @@ func ArchiveDownloadCreateHandler(c echo.Context) error {
 	if archive.Name == "" {
 		archive.Name = "archive"
 	}
+	switch archive.Compression {
+	case "", vfs.ArchiveDeflate, vfs.ArchiveStore:
+	default:
+		return jsonapi.InvalidAttribute("compression", errors.New("The compression must be deflate or store"))
+	}
 	instance := middlewares.GetInstance(c)
 
 	entries, err := archive.GetEntries(instance.VFS())
@@ -510,7 +1227,7 @@ func ArchiveDownloadCreateHandler(c echo.Context) error {
 
 	// if accept header is application/zip, send the archive immediately
 	if c.Request().Header.Get("Accept") == "application/zip" {
-		return archive.Serve(instance.VFS(), c.Response())
+		return archive.Serve(instance.VFS(), c.Response(), c.Request())
 	}
 
 	secret, err := vfs.GetStore().AddArchive(instance.Domain, archive)
@@ -537,7 +1254,15 @@ func FileDownloadCreateHandler(c echo.Context) error {
 	var path string
 
 	if path = c.QueryParam("Path"); path != "" {
-		if doc, err = instance.VFS().FileByPath(path); err != nil {
+		resolver, errr := pathResolverFromReq(c)
+		if errr != nil {
+			return WrapVfsError(errr)
+		}
+		if doc, err = resolver.FileByPath(path); err != nil {
+			return WrapVfsError(err)
+		}
+		// The secret is for the full path, not the one relative to the root
+		if path, err = doc.Path(instance.VFS()); err != nil {
 			return WrapVfsError(err)
 		}
 	} else if id := c.QueryParam("Id"); id != "" {
@@ -578,7 +1303,31 @@ func ArchiveDownloadHandler(c echo.Context) error {
 	if archive == nil {
 		return jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
 	}
-	return archive.Serve(instance.VFS(), c.Response())
+	return archive.Serve(instance.VFS(), c.Response(), c.Request())
+}
+
+// ArchiveManifestHandler handles requests to /files/archive/:secret/manifest
+// and returns the list of the files that will be put in the archive, with
+// their sizes, checksums and revisions, without generating it.
+func ArchiveManifestHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	secret := c.Param("secret")
+	archive, err := vfs.GetStore().GetArchive(instance.Domain, secret)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if archive == nil {
+		return jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
+	}
+	files, err := archive.ManifestFiles(c.Request().Context(), instance.VFS())
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	objs := make([]jsonapi.Object, len(files))
+	for i, f := range files {
+		objs[i] = &archiveFile{f}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
 }
 
 // FileDownloadHandler send a file that have previously be defined
@@ -593,13 +1342,14 @@ func FileDownloadHandler(c echo.Context) error {
 	if path == "" {
 		return jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
 	}
-	return sendFileFromPath(c, path, false)
+	return sendFileFromPath(c, instance.VFS(), path, false)
 }
 
 // TrashHandler handles all DELETE requests on /files/:file-id and
 // moves the file or directory with the specified file-id to the
 // trash.
 func TrashHandler(c echo.Context) error {
+	start := time.Now()
 	instance := middlewares.GetInstance(c)
 
 	fileID := c.Param("file-id")
@@ -612,6 +1362,10 @@ func TrashHandler(c echo.Context) error {
 		return WrapVfsError(err)
 	}
 
+	if c.QueryParam("permanent") == "true" {
+		return destroyPermanently(c, start, dir, file)
+	}
+
 	err = checkPerm(c, permissions.PUT, dir, file)
 	if err != nil {
 		return err
@@ -627,24 +1381,183 @@ func TrashHandler(c echo.Context) error {
 	if err := CheckIfMatch(c, rev); err != nil {
 		return WrapVfsError(err)
 	}
+	if err := checkOnlyIfEmpty(c, instance.VFS(), dir); err != nil {
+		return WrapVfsError(err)
+	}
+	reason := strings.TrimSpace(c.QueryParam("reason"))
+	if err := vfs.CheckTrashReason(reason); err != nil {
+		return WrapVfsError(err)
+	}
+
+	if isDryRun(c) {
+		plan, errp := vfs.PlanTrash(instance.VFS(), dir, file)
+		if errp != nil {
+			return WrapVfsError(errp)
+		}
+		return dryRunData(c, opTrash, plan)
+	}
 
 	if dir != nil {
-		doc, errt := vfs.TrashDir(instance.VFS(), dir)
+		if c.QueryParam("async") == "true" {
+			return trashDirAsync(c, dir, reason)
+		}
+		doc, errt := vfs.TrashDirWithReason(instance.VFS(), dir, reason)
+		if partial, ok := errt.(*vfs.PartialTrashError); ok {
+			logOperation(c, opTrash, start, doc, nil)
+			return jsonapi.Data(c, http.StatusMultiStatus, &apiTrashResult{
+				doc:      doc,
+				Trashed:  partial.Trashed,
+				Failures: partial.Failures,
+			}, nil)
+		}
 		if errt != nil {
 			return WrapVfsError(errt)
 		}
+		logOperation(c, opTrash, start, doc, nil)
 		return dirData(c, http.StatusOK, doc)
 	}
 
-	doc, errt := vfs.TrashFile(instance.VFS(), file)
+	doc, errt := vfs.TrashFileWithReason(instance.VFS(), file, reason)
 	if errt != nil {
 		return WrapVfsError(errt)
 	}
+	logOperation(c, opTrash, start, nil, doc)
 	return fileData(c, http.StatusOK, doc, nil)
 }
 
+// destroyPermanently destroys a file, or a directory with its content,
+// without putting it in the trash first. It must be enabled in the config,
+// and it requires the same permission as the destruction from the trash.
+func destroyPermanently(c echo.Context, start time.Time, dir *vfs.DirDoc, file *vfs.FileDoc) error {
+	instance := middlewares.GetInstance(c)
+
+	if !config.GetConfig().Fs.PermanentDelete {
+		return jsonapi.Forbidden(errors.New("Permanent deletion is disabled"))
+	}
+
+	if err := checkPerm(c, permissions.DELETE, dir, file); err != nil {
+		return err
+	}
+
+	var rev string
+	if dir != nil {
+		if id := dir.ID(); id == consts.RootDirID || id == consts.TrashDirID {
+			return jsonapi.BadRequest(errors.New("This directory can't be destroyed"))
+		}
+		rev = dir.Rev()
+	} else {
+		rev = file.Rev()
+	}
+
+	if err := CheckIfMatch(c, rev); err != nil {
+		return WrapVfsError(err)
+	}
+	if err := checkOnlyIfEmpty(c, instance.VFS(), dir); err != nil {
+		return WrapVfsError(err)
+	}
+
+	if isDryRun(c) {
+		plan, errp := vfs.PlanDestroy(instance.VFS(), dir, file, false)
+		if errp != nil {
+			return WrapVfsError(errp)
+		}
+		return dryRunData(c, opDestroy, plan)
+	}
+
+	var err error
+	if dir != nil {
+		err = instance.VFS().DestroyDirAndContent(dir)
+	} else {
+		err = instance.VFS().DestroyFile(file)
+	}
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	logOperation(c, opDestroy, start, dir, file)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// checkOnlyIfEmpty returns ErrDirNotEmpty when the client has asked, with
+// only_if_empty=true, to delete a directory only if it has no children.
+func checkOnlyIfEmpty(c echo.Context, fs vfs.VFS, dir *vfs.DirDoc) error {
+	if dir == nil || c.QueryParam("only_if_empty") != "true" {
+		return nil
+	}
+	empty, err := dir.IsEmpty(fs)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return vfs.ErrDirNotEmpty
+	}
+	return nil
+}
+
+// trashDirAsync puts a directory in the trash in the background, and responds
+// with a job that can be used to follow the operation.
+func trashDirAsync(c echo.Context, dir *vfs.DirDoc, reason string) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+	job, err := startJob(c, "trash", func(_ func(int)) (interface{}, string, error) {
+		doc, err := vfs.TrashDirWithReason(fs, dir, reason)
+		if partial, ok := err.(*vfs.PartialTrashError); ok {
+			return partial, "/files/" + doc.ID(), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return nil, "/files/" + doc.ID(), nil
+	})
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return jobData(c, http.StatusAccepted, job)
+}
+
+// apiTrashResult is the JSON-API response when a directory has been put in
+// the trash (or restored), but some files inside it have not been marked as
+// trashed (or no longer trashed).
+type apiTrashResult struct {
+	doc      *vfs.DirDoc
+	Trashed  []string           `json:"trashed"`
+	Failures []vfs.TrashFailure `json:"failures"`
+}
+
+func (a *apiTrashResult) ID() string                             { return a.doc.ID() }
+func (a *apiTrashResult) Rev() string                            { return a.doc.Rev() }
+func (a *apiTrashResult) DocType() string                        { return consts.Files }
+func (a *apiTrashResult) Clone() couchdb.Doc                     { cloned := *a; return &cloned }
+func (a *apiTrashResult) SetID(_ string)                         {}
+func (a *apiTrashResult) SetRev(_ string)                        {}
+func (a *apiTrashResult) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiTrashResult) Included() []jsonapi.Object             { return nil }
+func (a *apiTrashResult) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/" + a.doc.ID()}
+}
+
+// TrashSummaryID is the id of the JSON-API response for the summary of the
+// trash
+const TrashSummaryID = "io.cozy.files.trash_summary"
+
+type apiTrashSummary struct {
+	*vfs.TrashSummary
+}
+
+func (a *apiTrashSummary) ID() string                             { return TrashSummaryID }
+func (a *apiTrashSummary) Rev() string                            { return "" }
+func (a *apiTrashSummary) DocType() string                        { return consts.Files }
+func (a *apiTrashSummary) Clone() couchdb.Doc                     { return a }
+func (a *apiTrashSummary) SetID(_ string)                         {}
+func (a *apiTrashSummary) SetRev(_ string)                        {}
+func (a *apiTrashSummary) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiTrashSummary) Included() []jsonapi.Object             { return nil }
+func (a *apiTrashSummary) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/trash?summary=true"}
+}
+
 // ReadTrashFilesHandler handle GET requests on /files/trash and return the
-// list of trashed files and directories
+// list of trashed files and directories. With summary=true, only the counts
+// are returned.
 func ReadTrashFilesHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 
@@ -658,12 +1571,21 @@ func ReadTrashFilesHandler(c echo.Context) error {
 		return err
 	}
 
+	if summary, _ := strconv.ParseBool(c.QueryParam("summary")); summary {
+		res, err := vfs.GetTrashSummary(instance)
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		return jsonapi.Data(c, http.StatusOK, &apiTrashSummary{res}, nil)
+	}
+
 	return dirDataList(c, http.StatusOK, trash)
 }
 
 // RestoreTrashFileHandler handle POST requests on /files/trash/file-id and
 // can be used to restore a file or directory from the trash.
 func RestoreTrashFileHandler(c echo.Context) error {
+	start := time.Now()
 	instance := middlewares.GetInstance(c)
 
 	fileID := c.Param("file-id")
@@ -678,11 +1600,33 @@ func RestoreTrashFileHandler(c echo.Context) error {
 		return err
 	}
 
+	var rev string
+	if dir != nil {
+		rev = dir.Rev()
+	} else {
+		rev = file.Rev()
+	}
+
+	if err = CheckIfMatch(c, rev); err != nil {
+		return WrapVfsError(err)
+	}
+
 	if dir != nil {
 		doc, errt := vfs.RestoreDir(instance.VFS(), dir)
+		if partial, ok := errt.(*vfs.PartialTrashError); ok {
+			logOperation(c, opRestore, start, doc, nil)
+			c.Response().Header().Set(restoredToHeader, doc.DirID)
+			return jsonapi.Data(c, http.StatusMultiStatus, &apiTrashResult{
+				doc:      doc,
+				Trashed:  partial.Trashed,
+				Failures: partial.Failures,
+			}, nil)
+		}
 		if errt != nil {
 			return WrapVfsError(errt)
 		}
+		logOperation(c, opRestore, start, doc, nil)
+		c.Response().Header().Set(restoredToHeader, doc.DirID)
 		return dirData(c, http.StatusOK, doc)
 	}
 
@@ -690,9 +1634,16 @@ func RestoreTrashFileHandler(c echo.Context) error {
 	if errt != nil {
 		return WrapVfsError(errt)
 	}
+	logOperation(c, opRestore, start, nil, doc)
+	c.Response().Header().Set(restoredToHeader, doc.DirID)
 	return fileData(c, http.StatusOK, doc, nil)
 }
 
+// restoredToHeader is the header with the id of the directory where a file or
+// a directory has been restored from the trash. It is not always its original
+// directory (see the fs.restore_fallback_dir parameter of the config).
+const restoredToHeader = "Cozy-Files-Restored-To"
+
 // ClearTrashHandler handles DELETE request to clear the trash
 func ClearTrashHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
@@ -707,6 +1658,14 @@ func ClearTrashHandler(c echo.Context) error {
 		return err
 	}
 
+	if isDryRun(c) {
+		plan, errp := vfs.PlanDestroy(instance.VFS(), trash, nil, true)
+		if errp != nil {
+			return WrapVfsError(errp)
+		}
+		return dryRunData(c, opDestroy, plan)
+	}
+
 	err = instance.VFS().DestroyDirContent(trash)
 	if err != nil {
 		return WrapVfsError(err)
@@ -742,6 +1701,14 @@ func DestroyFileHandler(c echo.Context) error {
 		return WrapVfsError(err)
 	}
 
+	if isDryRun(c) {
+		plan, errp := vfs.PlanDestroy(instance.VFS(), dir, file, false)
+		if errp != nil {
+			return WrapVfsError(errp)
+		}
+		return dryRunData(c, opDestroy, plan)
+	}
+
 	if dir != nil {
 		err = instance.VFS().DestroyDirAndContent(dir)
 	} else {
@@ -754,6 +1721,8 @@ func DestroyFileHandler(c echo.Context) error {
 	return c.NoContent(204)
 }
 
+// maxMangoLimit is the maximal number of results sent by _find, and the
+// number of results sent when the client has not asked for a limit.
 const maxMangoLimit = 100
 
 // FindFilesMango is the route POST /files/_find
@@ -774,9 +1743,10 @@ func FindFilesMango(c echo.Context) error {
 	// TODO : optimization potential, necessary fields so far are class & type
 	delete(findRequest, "fields")
 
-	limit, hasLimit := findRequest["limit"].(float64)
-	if !hasLimit || limit > maxMangoLimit {
-		limit = 100
+	reqLimit, _ := findRequest["limit"].(float64)
+	limit := jsonapi.CapPageLimit(int(reqLimit), maxMangoLimit)
+	if limit > maxMangoLimit {
+		limit = maxMangoLimit
 	}
 	skip := 0
 	skipF64, hasSkip := findRequest["skip"].(float64)
@@ -787,6 +1757,24 @@ func FindFilesMango(c echo.Context) error {
 	// add 1 so we know if there is more.
 	findRequest["limit"] = limit + 1
 
+	// The date filters are added to the selector given by the client.
+	selectors := []interface{}{findRequest["selector"]}
+	for _, param := range []string{"updated_since", "created_since"} {
+		since, err := dateFilterFromReq(c, param)
+		if err != nil {
+			return err
+		}
+		if since != nil {
+			field := strings.TrimSuffix(param, "_since") + "_at"
+			selectors = append(selectors, map[string]interface{}{
+				field: map[string]interface{}{"$gte": vfs.DateFilterKey(*since)},
+			})
+		}
+	}
+	if len(selectors) > 1 {
+		findRequest["selector"] = map[string]interface{}{"$and": selectors}
+	}
+
 	var results []vfs.DirOrFileDoc
 	err := couchdb.FindDocsRaw(instance, consts.Files, &findRequest, &results)
 	if err != nil {
@@ -794,7 +1782,7 @@ func FindFilesMango(c echo.Context) error {
 	}
 
 	var total int
-	if len(results) > int(limit) {
+	if len(results) > limit {
 		total = math.MaxInt32 - 1          // we dont know the actual number
 		results = results[:len(results)-1] // loose the last item
 	} else {
@@ -811,20 +1799,49 @@ func FindFilesMango(c echo.Context) error {
 		}
 	}
 
-	return jsonapi.DataListWithTotal(c, http.StatusOK, total, out, nil)
+	return jsonapi.DataListPage(c, http.StatusOK, total, limit, withFields(out, fieldsFromReq(c)), nil)
 
 }
 
+// compressMinSize is the size under which the JSON responses are not
+// compressed.
+const compressMinSize = 1024
+
 // Routes sets the routing for the files service
 func Routes(router *echo.Group) {
+	router.Use(middlewares.Compress(middlewares.CompressOptions{
+		MinSize:      compressMinSize,
+		ContentTypes: []string{jsonapi.ContentType, echo.MIMEApplicationJSON},
+	}))
+
 	router.HEAD("/download", ReadFileContentFromPathHandler)
-	router.GET("/download", ReadFileContentFromPathHandler)
+	router.GET("/download", ReadFileContentFromPathHandler, instrument(opDownload, metrics.FilesTransferDownload))
 	router.HEAD("/download/:file-id", ReadFileContentFromIDHandler)
-	router.GET("/download/:file-id", ReadFileContentFromIDHandler)
+	router.GET("/download/:file-id", ReadFileContentFromIDHandler, instrument(opDownload, metrics.FilesTransferDownload))
 
 	router.POST("/_find", FindFilesMango)
-
+	router.POST("/_bulk_mkdir", BulkMkdirHandler)
+	router.GET("/_classes", ReadClassesHandler)
+	router.GET("/_jobs/:job-id", ReadJobHandler)
+	router.GET("/_upload_policy", ReadUploadPolicyHandler)
+	router.GET("/_audit", ReadAuditHandler)
+	router.GET("/_starred", ListStarredHandler)
+	router.GET("/_recent", ListRecentHandler)
+	router.GET("/_by_hash/:algo/:hash", FindByHashHandler)
+	router.POST("/_verify", VerifyAllFilesHandler)
+	router.POST("/_reclassify", ReclassifyHandler)
+	router.GET("/_tags", ListTagsHandler)
+	router.POST("/_tags/rename", RenameTagHandler)
+	router.POST("/_uploads", CreateUploadHandler)
+	router.PUT("/_uploads/:upload-id/:part", UploadPartHandler, instrument(opUploadPart, metrics.FilesTransferUpload))
+	router.DELETE("/_uploads/:upload-id", AbortUploadHandler)
+
+	router.HEAD("", CapabilitiesHandler)
+	router.HEAD("/", CapabilitiesHandler)
+	router.OPTIONS("", CapabilitiesHandler)
+	router.OPTIONS("/", CapabilitiesHandler)
 	router.HEAD("/:file-id", HeadDirOrFile)
+	router.OPTIONS("/:file-id", OptionsDirOrFile)
 
 	router.GET("/metadata", ReadMetadataFromPathHandler)
 	router.GET("/:file-id", ReadMetadataFromIDHandler)
@@ -833,17 +1850,35 @@ func Routes(router *echo.Group) {
 	router.PATCH("/metadata", ModifyMetadataByPathHandler)
 	router.PATCH("/:file-id", ModifyMetadataByIDHandler)
 
-	router.POST("/", CreationHandler)
-	router.POST("/:file-id", CreationHandler)
-	router.PUT("/:file-id", OverwriteFileContentHandler)
+	router.POST("/", CreationHandler, instrument(opCreate, metrics.FilesTransferUpload))
+	router.POST("/:file-id", CreationHandler, instrument(opCreate, metrics.FilesTransferUpload))
+	router.PUT("/overwrite", OverwriteFileContentByPathHandler, instrument(opOverwrite, metrics.FilesTransferUpload))
+	router.PUT("/:file-id", OverwriteFileContentHandler, instrument(opOverwrite, metrics.FilesTransferUpload))
+	router.PATCH("/:file-id/content", WriteFileRangeHandler, instrument(opAppend, metrics.FilesTransferUpload))
 
 	router.GET("/:file-id/thumbnails/:secret/:format", ThumbnailHandler)
+	router.GET("/:file-id/icon", IconHandler)
+	router.GET("/:file-id/similar", SimilarImagesHandler)
+	router.GET("/:file-id/exif", ReadExifHandler)
+	router.POST("/:file-id/verify", VerifyFileHandler)
+	router.GET("/:file-id/conflicts", ReadConflictsHandler)
+	router.POST("/:file-id/resolve", ResolveConflictHandler)
+	router.POST("/:file-id/touch", TouchFileHandler)
+	router.POST("/:file-id/move-up", MoveUpHandler)
+	router.POST("/:file-id/lock", LockFileHandler)
+	router.DELETE("/:file-id/lock", UnlockFileHandler)
+	router.POST("/:file-id/share/public", CreatePublicLinkHandler)
+	router.GET("/:file-id/share/public", ReadPublicLinkHandler)
+	router.DELETE("/:file-id/share/public", RevokePublicLinkHandler)
+	router.GET("/:file-id/share/public/accesses", ListPublicAccessesHandler)
 
 	router.POST("/archive", ArchiveDownloadCreateHandler)
+	router.GET("/archive/:secret/manifest", ArchiveManifestHandler)
 	router.GET("/archive/:secret/:fake-name", ArchiveDownloadHandler)
 
 	router.POST("/downloads", FileDownloadCreateHandler)
-	router.GET("/downloads/:secret/:fake-name", FileDownloadHandler)
+	router.GET("/downloads/:secret/:fake-name", FileDownloadHandler, instrument(opDownload, metrics.FilesTransferDownload))
+	router.GET("/public/:token", PublicLinkHandler, instrument(opDownload, metrics.FilesTransferDownload))
 
 	router.POST("/:file-id/relationships/referenced_by", AddReferencedHandler)
 	router.DELETE("/:file-id/relationships/referenced_by", RemoveReferencedHandler)
@@ -854,7 +1889,7 @@ func Routes(router *echo.Group) {
 	router.POST("/trash/:file-id", RestoreTrashFileHandler)
 	router.DELETE("/trash/:file-id", DestroyFileHandler)
 
-	router.DELETE("/:file-id", TrashHandler)
+	router.DELETE("/:file-id", TrashHandler, instrument(opTrash, ""))
 }
 
 // WrapVfsError returns a formatted error from a golang error emitted by the vfs
@@ -870,21 +1905,64 @@ func WrapVfsError(err error) error {
 		return jsonapi.NotFound(err)
 	case vfs.ErrForbiddenDocMove:
 		return jsonapi.PreconditionFailed("dir-id", err)
-	case vfs.ErrIllegalFilename:
+	case vfs.ErrOutsideSubtree:
+		return jsonapi.Forbidden(err)
+	case vfs.ErrIllegalFilename, vfs.ErrFilenameTooLong:
 		return jsonapi.InvalidParameter("name", err)
 	case vfs.ErrIllegalTime:
 		return jsonapi.InvalidParameter("UpdatedAt", err)
+	case vfs.ErrTrashReasonTooLong:
+		return jsonapi.InvalidParameter("reason", err)
 	case vfs.ErrInvalidHash:
 		return jsonapi.PreconditionFailed("Content-MD5", err)
+	case vfs.ErrTransformFailed:
+		return jsonapi.NewError(http.StatusUnprocessableEntity, err)
+	case vfs.ErrInvalidConflictStrategy:
+		return jsonapi.InvalidParameter("on_conflict", err)
+	case vfs.ErrUnknownHashAlgo:
+		return jsonapi.InvalidParameter("algo", err)
 	case vfs.ErrContentLengthMismatch:
 		return jsonapi.PreconditionFailed("Content-Length", err)
+	case io.ErrUnexpectedEOF:
+		return jsonapi.BadRequest(err)
 	case vfs.ErrConflict:
 		return jsonapi.Conflict(err)
-	case vfs.ErrFileInTrash, vfs.ErrNonAbsolutePath,
-		vfs.ErrDirNotEmpty:
+	case vfs.ErrFileInTrash, vfs.ErrNonAbsolutePath, vfs.ErrPathTraversal,
+		vfs.ErrDirNotEmpty, vfs.ErrMaxDepthExceeded:
 		return jsonapi.BadRequest(err)
 	case vfs.ErrFileTooBig:
 		return jsonapi.NewError(http.StatusRequestEntityTooLarge, err)
+	case vfs.ErrUploadTooBig:
+		return jsonapi.NewError(http.StatusRequestEntityTooLarge,
+			"%s (%d bytes)", err, vfs.MaxUploadSize())
+	case vfs.ErrForbiddenMimeType:
+		return jsonapi.NewError(http.StatusUnsupportedMediaType, err)
+	case vfs.ErrInvalidRange:
+		return jsonapi.NewError(http.StatusRequestedRangeNotSatisfiable, err)
+	case vfs.ErrUnknownRevision:
+		return jsonapi.NotFound(err)
+	case vfs.ErrConflictContent, vfs.ErrIdempotencyKeyInUse:
+		return jsonapi.Conflict(err)
+	case vfs.ErrFileLocked:
+		return jsonapi.NewError(http.StatusLocked, err)
+	case ErrSourceInvalid:
+		return jsonapi.InvalidParameter("Source", err)
+	case ErrSourceForbidden:
+		return jsonapi.Forbidden(err)
+	case ErrSourceNotAllowed:
+		jerr := jsonapi.Forbidden(err)
+		jerr.Code = sourceNotAllowedCode
+		return jerr
+	case ErrSourceUnreachable, ErrSourceTooManyRedirects:
+		return jsonapi.BadGateway(err)
+	case ErrSourceTooBig:
+		return jsonapi.NewError(http.StatusRequestEntityTooLarge, err)
+	case ErrUploadNotFound:
+		return jsonapi.NotFound(err)
+	case ErrUploadPartInvalid:
+		return jsonapi.InvalidParameter("part", err)
+	case ErrUploadIncomplete:
+		return jsonapi.NewError(http.StatusUnprocessableEntity, err)
 	}
 	return err
 }
@@ -898,6 +1976,9 @@ func FileDocFromReq(c echo.Context, name, dirID string, tags []string) (*vfs.Fil
 		err = jsonapi.InvalidParameter("Content-Length", err)
 		return nil, err
 	}
+	if max := vfs.MaxUploadSize(); max >= 0 && size > max {
+		return nil, vfs.ErrUploadTooBig
+	}
 
 	var md5Sum []byte
 	if md5Str := header.Get("Content-MD5"); md5Str != "" {
@@ -911,14 +1992,16 @@ func FileDocFromReq(c echo.Context, name, dirID string, tags []string) (*vfs.Fil
 	cdate := time.Now()
 	if date := header.Get("Date"); date != "" {
 		if t, err := time.Parse(time.RFC1123, date); err == nil {
+			if !legalImportDate(t) {
+				return nil, vfs.ErrIllegalTime
+			}
 			cdate = t
 		}
 	}
 
-	var mime, class string
 	contentType := header.Get("Content-Type")
 	if contentType == "" {
-		mime, class = vfs.ExtractMimeAndClassFromFilename(name)
+		contentType = mimetype.TypeByExtension(path.Ext(name))
 	} else if contentType == "application/octet-stream" {
 		// TODO: remove this special path for the heic/heif file extensions with
 		// when we deal with a better detection of the files magic numbers.
@@ -928,14 +2011,16 @@ func FileDocFromReq(c echo.Context, name, dirID string, tags []string) (*vfs.Fil
 		case ".heic":
 			contentType = "image/heic"
 		}
-		mime, class = vfs.ExtractMimeAndClass(contentType)
-	} else {
-		mime, class = vfs.ExtractMimeAndClass(contentType)
 	}
+	var rules map[string]string
+	if i, ok := middlewares.GetInstanceSafe(c); ok {
+		rules = i.FileClassRules()
+	}
+	mime, class := vfs.ExtractMimeAndClassWithRules(contentType, rules)
 
 	executable := c.QueryParam("Executable") == "true"
 	trashed := false
-	return vfs.NewFileDoc(
+	doc, err := vfs.NewFileDoc(
 		name,
 		dirID,
 		size,
@@ -947,12 +2032,80 @@ func FileDocFromReq(c echo.Context, name, dirID string, tags []string) (*vfs.Fil
 		trashed,
 		tags,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt, updatedAt, err := importDates(c)
+	if err != nil {
+		return nil, err
+	}
+	if createdAt != nil {
+		doc.CreatedAt = *createdAt
+		doc.UpdatedAt = *createdAt
+	}
+	if updatedAt != nil {
+		doc.UpdatedAt = *updatedAt
+	}
+	if doc.UpdatedAt.Before(doc.CreatedAt) {
+		return nil, vfs.ErrIllegalTime
+	}
+	return doc, nil
+}
+
+// importDates returns the dates given in the CreatedAt and UpdatedAt
+// parameters (RFC3339). They are used to keep the dates of the files imported
+// from another system, and only the trusted tokens can set them: the CLI
+// tokens, and the OAuth clients with a permission on the whole io.cozy.files
+// doctype.
+func importDates(c echo.Context) (createdAt, updatedAt *time.Time, err error) {
+	cparam, uparam := c.QueryParam("CreatedAt"), c.QueryParam("UpdatedAt")
+	if cparam == "" && uparam == "" {
+		return nil, nil, nil
+	}
+
+	pdoc, err := permissions.GetPermission(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	trusted := pdoc.Type == pkgperm.TypeCLI ||
+		(pdoc.Type == pkgperm.TypeOauth && pdoc.Permissions.AllowWholeType(permissions.POST, consts.Files))
+	if !trusted {
+		return nil, nil, jsonapi.Forbidden(errors.New("Only the import tokens can set the dates"))
+	}
+
+	parse := func(param string) (*time.Time, error) {
+		if param == "" {
+			return nil, nil
+		}
+		t, err := time.Parse(time.RFC3339, param)
+		if err != nil || !legalImportDate(t) {
+			return nil, vfs.ErrIllegalTime
+		}
+		return &t, nil
+	}
+	if createdAt, err = parse(cparam); err != nil {
+		return nil, nil, err
+	}
+	if updatedAt, err = parse(uparam); err != nil {
+		return nil, nil, err
+	}
+	return createdAt, updatedAt, nil
+}
+
+// legalImportDate returns true if the date given by a client for a file can
+// be used: it can't be before 1970 or in the future (with a tolerance for the
+// clock skew). It is used for the CreatedAt and UpdatedAt parameters, and for
+// the legacy Date header.
+func legalImportDate(t time.Time) bool {
+	return t.Unix() >= 0 && !t.After(time.Now().Add(vfs.MaxTouchSkew))
 }
 
 // CheckIfMatch checks if the revision provided matches the revision number
-// given in the request, in the header and/or the query.
+// given in the request, in the header and/or the query. The header can be the
+// raw revision or the value of the Etag header sent by the stack.
 func CheckIfMatch(c echo.Context, rev string) error {
-	ifMatch := c.Request().Header.Get("If-Match")
+	ifMatch := strings.Trim(c.Request().Header.Get("If-Match"), `"`)
 	revQuery := c.QueryParam("rev")
 	var wantedRev string
 	if ifMatch != "" {
@@ -961,12 +2114,52 @@ func CheckIfMatch(c echo.Context, rev string) error {
 	if revQuery != "" && wantedRev == "" {
 		wantedRev = revQuery
 	}
-	if wantedRev != "" && rev != wantedRev {
+	if wantedRev != "" && wantedRev != "*" && rev != wantedRev {
 		return jsonapi.PreconditionFailed("If-Match", fmt.Errorf("Revision does not match"))
 	}
 	return nil
 }
 
+// checkIfNoneMatch returns true if the If-None-Match header of the request
+// matches the given ETag, with the weak comparison: the response can be a 304
+// Not Modified.
+func checkIfNoneMatch(c echo.Context, etag string) bool {
+	header := c.Request().Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// hasExistencePreconditions returns true if the request has one of the
+// wildcard forms of the conditional headers. It avoids to look for an
+// existing file on creation when the client doesn't need it.
+func hasExistencePreconditions(c echo.Context) bool {
+	header := c.Request().Header
+	return header.Get("If-Match") == "*" || header.Get("If-None-Match") == "*"
+}
+
+// checkExistencePreconditions implements the wildcard forms of the
+// conditional headers: "If-Match: *" requires that the target exists, and
+// "If-None-Match: *" requires that it doesn't exist (safe creation).
+func checkExistencePreconditions(c echo.Context, exists bool) error {
+	header := c.Request().Header
+	if !exists && header.Get("If-Match") == "*" {
+		return jsonapi.PreconditionFailed("If-Match", fmt.Errorf("The file does not exist"))
+	}
+	if exists && header.Get("If-None-Match") == "*" {
+		return jsonapi.PreconditionFailed("If-None-Match", fmt.Errorf("The file already exists"))
+	}
+	return nil
+}
+
 func checkPerm(c echo.Context, v pkgperm.Verb, d *vfs.DirDoc, f *vfs.FileDoc) error {
 	if d != nil {
 		return permissions.AllowVFS(c, v, d)
@@ -1005,3 +2198,53 @@ func parseContentLength(contentLength string) (int64, error) {
 	}
 	return size, err
 }
+
+// copyContent copies the body of the request to the file. A body that is
+// shorter than its Content-Length is reported as ErrContentLengthMismatch. A
+// longer body is refused by the file itself, as its size is the declared one.
+// If the copy fails, the file is aborted, so that closing it doesn't commit a
+// partial content.
+func copyContent(c echo.Context, file vfs.File, body io.Reader) error {
+	_, err := io.Copy(file, body)
+	if err == io.ErrUnexpectedEOF && c.Request().ContentLength >= 0 {
+		err = vfs.ErrContentLengthMismatch
+	}
+	if err != nil {
+		abortFile(file, err)
+	}
+	return err
+}
+
+// abortFile cancels the creation of a file, so that closing it doesn't
+// commit a partial content.
+func abortFile(file vfs.File, err error) {
+	if aborter, ok := file.(vfs.FileAborter); ok {
+		aborter.Abort(err)
+	}
+}
+
+// parseContentRange parses a Content-Range header of the form
+// `bytes <start>-*/*` or `bytes <start>-<end>/*`. The length is -1 for the
+// first form.
+func parseContentRange(contentRange string) (start, length int64, err error) {
+	err = fmt.Errorf("Invalid content range")
+	if !strings.HasPrefix(contentRange, "bytes ") || !strings.HasSuffix(contentRange, "/*") {
+		return
+	}
+	parts := strings.SplitN(strings.TrimSuffix(contentRange[6:], "/*"), "-", 2)
+	if len(parts) != 2 {
+		return
+	}
+	start, errs := strconv.ParseInt(parts[0], 10, 64)
+	if errs != nil || start < 0 {
+		return
+	}
+	if parts[1] == "*" {
+		return start, -1, nil
+	}
+	end, erre := strconv.ParseInt(parts[1], 10, 64)
+	if erre != nil || end < start {
+		return
+	}
+	return start, end - start + 1, nil
+}
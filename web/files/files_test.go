@@ -1,26 +1,39 @@
 package files
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/echo"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 
 	_ "github.com/cozy/cozy-stack/pkg/workers/thumbnail"
@@ -29,6 +42,7 @@ import (
 var ts *httptest.Server
 var testInstance *instance.Instance
 var token string
+var otherToken string
 var clientID string
 var imgID string
 
@@ -167,6 +181,15 @@ func extractDirData(t *testing.T, data map[string]interface{}) (string, map[stri
 	return id, data
 }
 
+func extractAttributes(t *testing.T, data map[string]interface{}) (string, map[string]interface{}) {
+	id, data := extractDirData(t, data)
+	attrs, ok := data["attributes"].(map[string]interface{})
+	if !assert.True(t, ok) {
+		return id, nil
+	}
+	return id, attrs
+}
+
 type jsonData struct {
 	Type  string                 `json:"type"`
 	ID    string                 `json:"id"`
@@ -270,6 +293,26 @@ func TestCreateDirRootSuccess(t *testing.T) {
 	assert.True(t, exists)
 }
 
+func TestCreateDirWithID(t *testing.T) {
+	res, v := createDir(t, "/files/?Name=dir-with-id&Type=directory&id=stable-dir-id")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	id, attrs := extractAttributes(t, v)
+	assert.Equal(t, "stable-dir-id", id)
+	assert.Equal(t, "dir-with-id", attrs["name"])
+
+	res, _ = createDir(t, "/files/?Name=another-dir-with-id&Type=directory&id=stable-dir-id")
+	assert.Equal(t, 409, res.StatusCode)
+
+	res, _ = createDir(t, "/files/?Name=bad-id&Type=directory&id=_design")
+	assert.Equal(t, 422, res.StatusCode)
+	res, _ = createDir(t, "/files/?Name=bad-id&Type=directory&id=io.cozy.files.root-dir")
+	assert.Equal(t, 422, res.StatusCode)
+	res, _ = createDir(t, "/files/?Name=bad-id&Type=directory&id=with%2Fslash")
+	assert.Equal(t, 422, res.StatusCode)
+}
+
 func TestCreateDirWithDateSuccess(t *testing.T) {
 	req, _ := http.NewRequest("POST", ts.URL+"/files/?Type=directory&Name=dir-with-date", strings.NewReader(""))
 	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
@@ -384,6 +427,231 @@ func TestUploadBadHash(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestUploadTooBig(t *testing.T) {
+	config.GetConfig().Fs.MaxUploadSize = 10
+	defer func() { config.GetConfig().Fs.MaxUploadSize = 0 }()
+
+	body := "this content is too big"
+	res, v := upload(t, "/files/?Type=file&Name=too-big", "text/plain", body, "")
+	assert.Equal(t, 413, res.StatusCode)
+	errs, _ := v["errors"].([]interface{})
+	if assert.Len(t, errs, 1) {
+		detail := errs[0].(map[string]interface{})["detail"]
+		assert.Contains(t, detail, "10 bytes")
+	}
+
+	// Without a Content-Length, the upload is aborted when the limit is reached
+	req, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Name=too-big-chunked", strings.NewReader(body))
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.ContentLength = -1
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, _ = doUploadOrMod(t, req, "text/plain", "")
+	assert.Equal(t, 413, res.StatusCode)
+
+	storage := testInstance.VFS()
+	_, err = readFile(storage, "/too-big-chunked")
+	assert.Error(t, err)
+
+	res, _ = upload(t, "/files/?Type=file&Name=small-enough", "text/plain", "foo", "")
+	assert.Equal(t, 201, res.StatusCode)
+}
+
+func TestUploadContentLengthMismatch(t *testing.T) {
+	u, err := url.Parse(ts.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// The body is shorter than the Content-Length: the http client of Go
+	// refuses to send such a request, so it is written on the connection.
+	sendTruncated := func(method, path string) *http.Response {
+		conn, err := net.Dial("tcp", u.Host)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "%s %s HTTP/1.1\r\n", method, path)
+		fmt.Fprintf(conn, "Host: %s\r\n", u.Host)
+		fmt.Fprintf(conn, "Authorization: Bearer %s\r\n", token)
+		fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
+		fmt.Fprintf(conn, "Content-Length: 10\r\n\r\n")
+		fmt.Fprintf(conn, "foo")
+		conn.(*net.TCPConn).CloseWrite() // #nosec
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		ioutil.ReadAll(res.Body) // #nosec
+		res.Body.Close()
+		return res
+	}
+
+	res := sendTruncated("POST", "/files/?Type=file&Name=truncated")
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 412, res.StatusCode)
+	}
+	storage := testInstance.VFS()
+	_, err = readFile(storage, "/truncated")
+	assert.Error(t, err)
+
+	res, data := upload(t, "/files/?Type=file&Name=truncated-overwrite", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data)
+	res = sendTruncated("PUT", "/files/"+fileID)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 412, res.StatusCode)
+	}
+	buf, err := readFile(storage, "/truncated-overwrite")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "foo", string(buf))
+	}
+}
+
+func TestUploadWithoutContentLength(t *testing.T) {
+	body := strings.Repeat("chunked content ", 1000)
+	req, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Name=chunked", strings.NewReader(body))
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.ContentLength = -1
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, data := doUploadOrMod(t, req, "text/plain", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	_, attrs := extractAttributes(t, data)
+	assert.Equal(t, strconv.Itoa(len(body)), attrs["size"])
+
+	storage := testInstance.VFS()
+	buf, err := readFile(storage, "/chunked")
+	if assert.NoError(t, err) {
+		assert.Equal(t, body, string(buf))
+	}
+}
+
+func TestUploadInterrupted(t *testing.T) {
+	u, err := url.Parse(ts.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	// A chunked body that is cut in the middle of its second chunk
+	fmt.Fprintf(conn, "POST /files/?Type=file&Name=interrupted HTTP/1.1\r\n")
+	fmt.Fprintf(conn, "Host: %s\r\n", u.Host)
+	fmt.Fprintf(conn, "Authorization: Bearer %s\r\n", token)
+	fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
+	fmt.Fprintf(conn, "Transfer-Encoding: chunked\r\n\r\n")
+	fmt.Fprintf(conn, "3\r\nfoo\r\n10\r\nbar")
+	conn.(*net.TCPConn).CloseWrite() // #nosec
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 400, res.StatusCode)
+	}
+
+	storage := testInstance.VFS()
+	_, err = storage.FileByPath("/interrupted")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(config.GetConfig().Fs.URL.Path, testInstance.DirName(), "interrupted"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUploadExpectContinue(t *testing.T) {
+	u, err := url.Parse(ts.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	sendHeaders := func(name string, length int) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", u.Host)
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		fmt.Fprintf(conn, "POST /files/?Type=file&Name=%s HTTP/1.1\r\n", name)
+		fmt.Fprintf(conn, "Host: %s\r\n", u.Host)
+		fmt.Fprintf(conn, "Authorization: Bearer %s\r\n", token)
+		fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
+		fmt.Fprintf(conn, "Content-Length: %d\r\n", length)
+		fmt.Fprintf(conn, "Expect: 100-continue\r\n\r\n")
+		return conn, bufio.NewReader(conn)
+	}
+
+	// The server approves the upload before the body is sent
+	conn, r := sendHeaders("expect-continue", 3)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	res, err := http.ReadResponse(r, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 100, res.StatusCode)
+	fmt.Fprintf(conn, "foo")
+	res, err = http.ReadResponse(r, nil)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 201, res.StatusCode)
+	}
+
+	// The upload is rejected without waiting for the body
+	conn2, r2 := sendHeaders("expect-continue", 3)
+	if conn2 == nil {
+		return
+	}
+	defer conn2.Close()
+	res, err = http.ReadResponse(r2, nil)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 409, res.StatusCode)
+	}
+
+	config.GetConfig().Fs.MaxUploadSize = 10
+	defer func() { config.GetConfig().Fs.MaxUploadSize = 0 }()
+	conn3, r3 := sendHeaders("expect-continue-too-big", 1<<30)
+	if conn3 == nil {
+		return
+	}
+	defer conn3.Close()
+	res, err = http.ReadResponse(r3, nil)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 413, res.StatusCode)
+	}
+}
+
+func TestFilesMetrics(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=metrics", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data)
+	res, err := httpGet(ts.URL + "/files/download/" + fileID)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+	}
+	res, _ = upload(t, "/files/?Type=file&Name=metrics", "text/plain", "foo", "")
+	assert.Equal(t, 409, res.StatusCode)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	promhttp.Handler().ServeHTTP(rec, req)
+	body := rec.Body.String()
+	assert.Contains(t, body, `files_operations_count{code="201",operation="create"}`)
+	assert.Contains(t, body, `files_operations_count{code="409",operation="create"}`)
+	assert.Contains(t, body, `files_operations_count{code="200",operation="download"}`)
+	assert.Contains(t, body, `files_operations_durations_bucket{code="201",operation="create"`)
+	assert.Contains(t, body, `files_transfers_sizes_bucket{operation="download"`)
+	assert.Contains(t, body, `files_transfers_active{direction="upload"} 0`)
+}
+
 func TestUploadAtRootSuccess(t *testing.T) {
 	body := "foo"
 	res, _ := upload(t, "/files/?Type=file&Name=goodhash", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
@@ -476,6 +744,72 @@ func TestUploadAtRootAlreadyExists(t *testing.T) {
 	assert.Equal(t, 409, res2.StatusCode)
 }
 
+func TestUploadOnConflict(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Type=directory&Name=onconflict")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+
+	res2, data2 := upload(t, "/files/"+dirID+"?Type=file&Name=doc.txt", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data2)
+
+	res3, _ := upload(t, "/files/"+dirID+"?Type=file&Name=doc.txt&on_conflict=error", "text/plain", "foo", "")
+	assert.Equal(t, 409, res3.StatusCode)
+	res4, _ := upload(t, "/files/"+dirID+"?Type=file&Name=doc.txt&on_conflict=foo", "text/plain", "foo", "")
+	assert.Equal(t, 400, res4.StatusCode)
+
+	for _, expected := range []string{"doc (2).txt", "doc (3).txt", "doc (4).txt"} {
+		res, data := upload(t, "/files/"+dirID+"?Type=file&Name=doc.txt&on_conflict=rename", "text/plain", "foo", "")
+		if assert.Equal(t, 201, res.StatusCode) {
+			_, attrs := extractAttributes(t, data)
+			assert.Equal(t, expected, attrs["name"])
+		}
+	}
+
+	res5, data5 := upload(t, "/files/"+dirID+"?Type=file&Name=doc.txt&on_conflict=replace", "text/plain", "replaced", "")
+	if assert.Equal(t, 200, res5.StatusCode) {
+		id, attrs := extractAttributes(t, data5)
+		assert.Equal(t, fileID, id)
+		assert.Equal(t, "doc.txt", attrs["name"])
+		assert.Equal(t, "8", attrs["size"])
+	}
+	res6, data6 := upload(t, "/files/"+dirID+"?Type=file&Name=new.txt&on_conflict=replace", "text/plain", "new", "")
+	if assert.Equal(t, 201, res6.StatusCode) {
+		_, attrs := extractAttributes(t, data6)
+		assert.Equal(t, "new.txt", attrs["name"])
+	}
+
+	res7, _ := createDir(t, "/files/"+dirID+"?Type=directory&Name=sub")
+	assert.Equal(t, 201, res7.StatusCode)
+	res8, _ := createDir(t, "/files/"+dirID+"?Type=directory&Name=sub")
+	assert.Equal(t, 409, res8.StatusCode)
+	res9, data9 := createDir(t, "/files/"+dirID+"?Type=directory&Name=sub&on_conflict=rename")
+	if assert.Equal(t, 201, res9.StatusCode) {
+		_, attrs := extractAttributes(t, data9)
+		assert.Equal(t, "sub (2)", attrs["name"])
+		assert.Equal(t, "/onconflict/sub (2)", attrs["path"])
+	}
+	res10, _ := createDir(t, "/files/"+dirID+"?Type=directory&Name=sub&on_conflict=replace")
+	assert.Equal(t, 400, res10.StatusCode)
+	res11, _ := upload(t, "/files/"+dirID+"?Type=file&Name=sub&on_conflict=replace", "text/plain", "foo", "")
+	assert.Equal(t, 409, res11.StatusCode)
+
+	// A restored file with the name of an existing one is renamed
+	res12, _ := trash(t, "/files/"+fileID)
+	assert.Equal(t, 200, res12.StatusCode)
+	res13, _ := upload(t, "/files/"+dirID+"?Type=file&Name=doc.txt", "text/plain", "foo", "")
+	assert.Equal(t, 201, res13.StatusCode)
+	res14, data14 := restore(t, "/files/trash/"+fileID)
+	if assert.Equal(t, 200, res14.StatusCode) {
+		_, attrs := extractAttributes(t, data14)
+		assert.Equal(t, "doc (5).txt", attrs["name"])
+	}
+}
+
 func TestUploadWithParentAlreadyExists(t *testing.T) {
 	_, dirdata := createDir(t, "/files/?Type=directory&Name=container")
 
@@ -556,6 +890,289 @@ func TestModifyMetadataFileMove(t *testing.T) {
 	assert.Equal(t, "3", attrs3["size"])
 }
 
+func TestModifyMetadataFileRenameAndMove(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=renameandmoveme", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	fileID, _ := extractDirData(t, data1)
+	rev1 := data1["data"].(map[string]interface{})["meta"].(map[string]interface{})["rev"].(string)
+	assert.True(t, strings.HasPrefix(rev1, "1-"))
+
+	res2, data2 := createDir(t, "/files/?Name=renameandmoveinme&Type=directory")
+	assert.Equal(t, 201, res2.StatusCode)
+	dirID, _ := extractDirData(t, data2)
+
+	attrs := map[string]interface{}{
+		"name": "renamedandmoved",
+	}
+	parent := &jsonData{
+		ID:   dirID,
+		Type: "io.cozy.files",
+	}
+	res3, data3 := patchFile(t, "/files/"+fileID, "file", fileID, attrs, parent)
+	if !assert.Equal(t, 200, res3.StatusCode) {
+		return
+	}
+	doc := data3["data"].(map[string]interface{})
+	attrs3 := doc["attributes"].(map[string]interface{})
+	assert.Equal(t, "renamedandmoved", attrs3["name"])
+	assert.Equal(t, dirID, attrs3["dir_id"])
+	rev2 := doc["meta"].(map[string]interface{})["rev"].(string)
+	assert.True(t, strings.HasPrefix(rev2, "2-"))
+
+	storage := testInstance.VFS()
+	_, err := storage.FileByPath("/renameandmoveinme/renamedandmoved")
+	assert.NoError(t, err)
+	_, err = storage.FileByPath("/renameandmoveme")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUploadDiskUsageMeta(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=diskusage-file", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	meta, ok := data["meta"].(map[string]interface{})
+	if !assert.True(t, ok) {
+		return
+	}
+	used, err := strconv.ParseInt(meta["disk_usage"].(string), 10, 64)
+	assert.NoError(t, err)
+	assert.True(t, used >= 3)
+	assert.Nil(t, meta["quota"])
+	assert.Nil(t, meta["remaining"])
+	fileID, _ := extractDirData(t, data)
+
+	quota := int64(1 << 40)
+	err = instance.Patch(testInstance, &instance.Options{DiskQuota: quota})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		testInstance.BytesDiskQuota = 0
+		_ = couchdb.UpdateDoc(couchdb.GlobalDB, testInstance)
+	}()
+
+	res, data = uploadMod(t, "/files/"+fileID, "text/plain", "foobar", "")
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	meta, ok = data["meta"].(map[string]interface{})
+	if !assert.True(t, ok) {
+		return
+	}
+	used, err = strconv.ParseInt(meta["disk_usage"].(string), 10, 64)
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.FormatInt(quota, 10), meta["quota"])
+	assert.Equal(t, strconv.FormatInt(quota-used, 10), meta["remaining"])
+}
+
+func TestUploadSoftQuotaWarning(t *testing.T) {
+	used, err := testInstance.VFS().DiskUsage()
+	if !assert.NoError(t, err) {
+		return
+	}
+	// The soft quota is reached at used+10 bytes
+	quota := 2 * (used + 10)
+	err = instance.Patch(testInstance, &instance.Options{DiskQuota: quota})
+	if !assert.NoError(t, err) {
+		return
+	}
+	config.GetConfig().Fs.SoftQuota = 50
+	defer func() {
+		config.GetConfig().Fs.SoftQuota = 0
+		testInstance.BytesDiskQuota = 0
+		_ = couchdb.UpdateDoc(couchdb.GlobalDB, testInstance)
+	}()
+
+	res, data := upload(t, "/files/?Type=file&Name=softquota-below", "text/plain", "123456789", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	assert.Empty(t, res.Header.Get("Warning"))
+	meta := data["meta"].(map[string]interface{})
+	assert.Equal(t, strconv.FormatInt(used+9, 10), meta["disk_usage"])
+	assert.Nil(t, meta["warning"])
+
+	res, data = upload(t, "/files/?Type=file&Name=softquota-above", "text/plain", "12", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	assert.Equal(t, `199 - "The disk usage is above 50% of the quota"`, res.Header.Get("Warning"))
+	meta = data["meta"].(map[string]interface{})
+	assert.Equal(t, strconv.FormatInt(used+11, 10), meta["disk_usage"])
+	assert.Equal(t, "The disk usage is above 50% of the quota", meta["warning"])
+}
+
+func TestCreateFileFromSource(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/docs/report.pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Write([]byte("%PDF-1.4 fake")) // #nosec
+		case "/attachment":
+			w.Header().Set("Content-Disposition", `attachment; filename="source-notes.txt"`)
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("notes")) // #nosec
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer remote.Close()
+
+	create := func(source string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Source="+url.QueryEscape(source), nil)
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		return doUploadOrMod(t, req, "", "")
+	}
+
+	// Only https is allowed by default
+	res0, data0 := create(remote.URL + "/docs/report.pdf")
+	assert.Equal(t, 403, res0.StatusCode)
+	errs := data0["errors"].([]interface{})
+	assert.Equal(t, "source_not_allowed", errs[0].(map[string]interface{})["code"])
+
+	fsConf := &config.GetConfig().Fs
+	previousConf := *fsConf
+	defer func() { *fsConf = previousConf }()
+	fsConf.ImportSchemes = []string{"http", "https"}
+
+	// The local server is on a private network
+	res1, _ := create(remote.URL + "/docs/report.pdf")
+	assert.Equal(t, 403, res1.StatusCode)
+
+	previous := isPublicIP
+	isPublicIP = func(ip net.IP) bool { return true }
+	defer func() { isPublicIP = previous }()
+
+	res2, data2 := create(remote.URL + "/docs/report.pdf")
+	if assert.Equal(t, 201, res2.StatusCode) {
+		_, attrs := extractAttributes(t, data2)
+		assert.Equal(t, "report.pdf", attrs["name"])
+		assert.Equal(t, "application/pdf", attrs["mime"])
+		assert.Equal(t, "pdf", attrs["class"])
+		assert.Equal(t, "13", attrs["size"])
+	}
+
+	res3, data3 := create(remote.URL + "/attachment")
+	if assert.Equal(t, 201, res3.StatusCode) {
+		_, attrs := extractAttributes(t, data3)
+		assert.Equal(t, "source-notes.txt", attrs["name"])
+		assert.Equal(t, "text/plain", attrs["mime"])
+	}
+	buf, err := readFile(testInstance.VFS(), "/source-notes.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "notes", string(buf))
+
+	res4, _ := create(remote.URL + "/not-found")
+	assert.Equal(t, 502, res4.StatusCode)
+
+	res5, _ := create("ftp://example.com/file.txt")
+	assert.Equal(t, 400, res5.StatusCode)
+
+	fsConf.ImportMaxSize = 5
+	res6, _ := create(remote.URL + "/docs/report.pdf")
+	assert.Equal(t, 413, res6.StatusCode)
+	fsConf.ImportMaxSize = 0
+
+	fsConf.ImportAllowedHosts = []string{"*.example.com"}
+	res7, _ := create(remote.URL + "/docs/report.pdf")
+	assert.Equal(t, 403, res7.StatusCode)
+	fsConf.ImportAllowedHosts = nil
+	fsConf.ImportDeniedHosts = []string{"127.0.0.1"}
+	res8, _ := create(remote.URL + "/docs/report.pdf")
+	assert.Equal(t, 403, res8.StatusCode)
+}
+
+func TestUploadWithIdempotencyKey(t *testing.T) {
+	send := func(name, key string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Name="+name, strings.NewReader("foo"))
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		req.Header.Add("Idempotency-Key", key)
+		return doUploadOrMod(t, req, "text/plain", "")
+	}
+
+	res1, data1 := send("idempotent-file", "idem-key-1")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data1)
+	assert.Empty(t, res1.Header.Get("Idempotent-Replayed"))
+
+	// The retry returns the same file, even with another name
+	res2, data2 := send("idempotent-file-retry", "idem-key-1")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	assert.Equal(t, "true", res2.Header.Get("Idempotent-Replayed"))
+	retryID, attrs := extractAttributes(t, data2)
+	assert.Equal(t, fileID, retryID)
+	assert.Equal(t, "idempotent-file", attrs["name"])
+
+	res3, _ := httpGet(ts.URL + "/files/metadata?Path=/idempotent-file-retry")
+	assert.Equal(t, 404, res3.StatusCode)
+
+	// A failed request can be retried with the same key
+	res4, _ := send("idempotent-file", "idem-key-2")
+	assert.Equal(t, 409, res4.StatusCode)
+	res5, data5 := send("idempotent-file-2", "idem-key-2")
+	if assert.Equal(t, 201, res5.StatusCode) {
+		otherID, _ := extractDirData(t, data5)
+		assert.NotEqual(t, fileID, otherID)
+	}
+}
+
+func TestModifyMetadataFileMoveByPath(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=movemebypath", "text/plain", "foo", "")
+	assert.Equal(t, 201, res1.StatusCode)
+	fileID, _ := extractDirData(t, data1)
+
+	res2, data2 := createDir(t, "/files/?Name=moveinmebypath&Type=directory")
+	assert.Equal(t, 201, res2.StatusCode)
+	dirID, _ := extractDirData(t, data2)
+
+	attrs := map[string]interface{}{
+		"parent_path": "/moveinmebypath/",
+	}
+	res3, data3 := patchFile(t, "/files/"+fileID, "file", fileID, attrs, nil)
+	if !assert.Equal(t, 200, res3.StatusCode) {
+		return
+	}
+	attrs3 := data3["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, dirID, attrs3["dir_id"])
+
+	attrs = map[string]interface{}{
+		"parent_path": "/moveinmebypath/foo/bar",
+	}
+	res4, _ := patchFile(t, "/files/"+fileID, "file", fileID, attrs, nil)
+	assert.Equal(t, 404, res4.StatusCode)
+
+	attrs = map[string]interface{}{
+		"parent_path": "moveinmebypath",
+	}
+	res5, _ := patchFile(t, "/files/"+fileID, "file", fileID, attrs, nil)
+	assert.Equal(t, 400, res5.StatusCode)
+
+	attrs = map[string]interface{}{
+		"parent_path": "/moveinmebypath/foo/bar",
+	}
+	res6, data6 := patchFile(t, "/files/"+fileID+"?Recursive=true", "file", fileID, attrs, nil)
+	if !assert.Equal(t, 200, res6.StatusCode) {
+		return
+	}
+	attrs6 := data6["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.NotEqual(t, dirID, attrs6["dir_id"])
+
+	storage := testInstance.VFS()
+	_, err := storage.FileByPath("/moveinmebypath/foo/bar/movemebypath")
+	assert.NoError(t, err)
+}
+
 func TestModifyMetadataFileConflict(t *testing.T) {
 	body := "foo"
 	res1, data1 := upload(t, "/files/?Type=file&Name=fmodme1&Tags=foo,bar", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
@@ -618,6 +1235,81 @@ func TestModifyMetadataDirMove(t *testing.T) {
 	assert.Equal(t, 412, res5.StatusCode)
 }
 
+func TestModifyMetadataDirMoveDeepTree(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=deeptree&Type=directory")
+	assert.Equal(t, 201, res1.StatusCode)
+	rootID, _ := extractDirData(t, data1)
+
+	parentID := rootID
+	for _, name := range []string{"level1", "level2", "level3"} {
+		res, data := createDir(t, "/files/"+parentID+"?Name="+name+"&Type=directory")
+		assert.Equal(t, 201, res.StatusCode)
+		parentID, _ = extractDirData(t, data)
+	}
+	res2, _ := upload(t, "/files/"+parentID+"?Type=file&Name=leaf.txt", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res2.StatusCode)
+
+	res3, data3 := createDir(t, "/files/?Name=deeptreedest&Type=directory")
+	assert.Equal(t, 201, res3.StatusCode)
+	destID, _ := extractDirData(t, data3)
+
+	attrs := map[string]interface{}{
+		"dir_id": destID,
+	}
+	res4, _ := patchFile(t, "/files/"+rootID, "directory", rootID, attrs, nil)
+	assert.Equal(t, 200, res4.StatusCode)
+
+	storage := testInstance.VFS()
+	dirs := []string{
+		"/deeptreedest/deeptree",
+		"/deeptreedest/deeptree/level1",
+		"/deeptreedest/deeptree/level1/level2",
+		"/deeptreedest/deeptree/level1/level2/level3",
+	}
+	for _, name := range dirs {
+		dir, err := storage.DirByPath(name)
+		if assert.NoError(t, err) {
+			assert.Equal(t, name, dir.Fullpath)
+		}
+		exists, err := vfs.DirExists(storage, strings.TrimPrefix(name, "/deeptreedest"))
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	}
+	leaf, err := storage.FileByPath("/deeptreedest/deeptree/level1/level2/level3/leaf.txt")
+	if assert.NoError(t, err) {
+		leafPath, err := leaf.Path(storage)
+		assert.NoError(t, err)
+		assert.Equal(t, "/deeptreedest/deeptree/level1/level2/level3/leaf.txt", leafPath)
+	}
+	_, err = storage.FileByPath("/deeptree/level1/level2/level3/leaf.txt")
+	assert.Error(t, err)
+}
+
+func TestModifyMetadataDirMoveInDescendant(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=cyclea&Type=directory")
+	assert.Equal(t, 201, res1.StatusCode)
+	aID, _ := extractDirData(t, data1)
+
+	res2, data2 := createDir(t, "/files/"+aID+"?Name=b&Type=directory")
+	assert.Equal(t, 201, res2.StatusCode)
+	bID, _ := extractDirData(t, data2)
+
+	res3, data3 := createDir(t, "/files/"+bID+"?Name=c&Type=directory")
+	assert.Equal(t, 201, res3.StatusCode)
+	cID, _ := extractDirData(t, data3)
+
+	attrs := map[string]interface{}{
+		"dir_id": cID,
+	}
+	res4, _ := patchFile(t, "/files/"+bID, "directory", bID, attrs, nil)
+	assert.Equal(t, 412, res4.StatusCode)
+
+	storage := testInstance.VFS()
+	exists, err := vfs.DirExists(storage, "/cyclea/b/c")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
 func TestModifyMetadataDirMoveWithRel(t *testing.T) {
 	res1, data1 := createDir(t, "/files/?Name=dirmodmewithrel&Type=directory&Tags=foo,bar,bar")
 	assert.Equal(t, 201, res1.StatusCode)
@@ -711,10 +1403,131 @@ func TestModifyContentBadRev(t *testing.T) {
 	assert.Equal(t, 200, res3.StatusCode)
 }
 
-func TestModifyContentSuccess(t *testing.T) {
-	var err error
-	var buf []byte
-	var fileInfo os.FileInfo
+func TestModifyContentByPath(t *testing.T) {
+	res1, _ := upload(t, "/files/?Type=file&Name=overwritebypath", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	req2, err := http.NewRequest("PUT", ts.URL+"/files/overwrite?Path=/overwritebypath", strings.NewReader("bar"))
+	assert.NoError(t, err)
+	req2.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req2.Header.Add("If-Match", "badrev")
+	res2, _ := doUploadOrMod(t, req2, "text/plain", "")
+	assert.Equal(t, 412, res2.StatusCode)
+
+	res3, data3 := uploadMod(t, "/files/overwrite?Path=/overwritebypath", "text/plain", "newcontent :)", "")
+	assert.Equal(t, 200, res3.StatusCode)
+	attrs3 := data3["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, "overwritebypath", attrs3["name"])
+	buf, err := readFile(testInstance.VFS(), "/overwritebypath")
+	assert.NoError(t, err)
+	assert.Equal(t, "newcontent :)", string(buf))
+
+	res4, _ := uploadMod(t, "/files/overwrite?Path=/nothere", "text/plain", "foo", "")
+	assert.Equal(t, 404, res4.StatusCode)
+
+	res5, _ := createDir(t, "/files/?Name=overwritebypathdir&Type=directory")
+	if !assert.Equal(t, 201, res5.StatusCode) {
+		return
+	}
+	res6, _ := uploadMod(t, "/files/overwrite?Path=/overwritebypathdir", "text/plain", "foo", "")
+	assert.Equal(t, 400, res6.StatusCode)
+}
+
+func TestPreferReturnMinimal(t *testing.T) {
+	req1, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Name=preferminimal", strings.NewReader("foo"))
+	assert.NoError(t, err)
+	req1.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req1.Header.Add("Prefer", "respond-async, return=minimal")
+	res1, data1 := doUploadOrMod(t, req1, "text/plain", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	assert.Equal(t, "return=minimal", res1.Header.Get("Preference-Applied"))
+	data := data1["data"].(map[string]interface{})
+	assert.Equal(t, consts.Files, data["type"])
+	assert.NotEmpty(t, data["id"])
+	assert.NotEmpty(t, data["meta"].(map[string]interface{})["rev"])
+	assert.NotContains(t, data, "attributes")
+	assert.NotContains(t, data1, "meta")
+	fileID := data["id"].(string)
+
+	attrs := `{"data": {"type": "io.cozy.files", "id": "` + fileID + `", "attributes": {"tags": ["minimal"]}}}`
+	req2, err := http.NewRequest("PATCH", ts.URL+"/files/"+fileID, strings.NewReader(attrs))
+	assert.NoError(t, err)
+	req2.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req2.Header.Add("Prefer", "return=minimal")
+	res2, data2 := doUploadOrMod(t, req2, "application/vnd.api+json", "")
+	if !assert.Equal(t, 200, res2.StatusCode) {
+		return
+	}
+	assert.Equal(t, "return=minimal", res2.Header.Get("Preference-Applied"))
+	data = data2["data"].(map[string]interface{})
+	assert.Equal(t, fileID, data["id"])
+	assert.NotContains(t, data, "attributes")
+	doc, err := testInstance.VFS().FileByID(fileID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"minimal"}, doc.Tags)
+		assert.Equal(t, doc.Rev(), data["meta"].(map[string]interface{})["rev"])
+	}
+
+	// Without the header, the full representation is sent
+	res3, data3 := uploadMod(t, "/files/"+fileID, "text/plain", "bar", "")
+	assert.Equal(t, 200, res3.StatusCode)
+	assert.Empty(t, res3.Header.Get("Preference-Applied"))
+	assert.Contains(t, data3["data"], "attributes")
+}
+
+func TestModifyMetadataMergePatch(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=mergepatch&Tags=foo", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data1)
+
+	mergePatch := func(body string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest("PATCH", ts.URL+"/files/"+fileID, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		return doUploadOrMod(t, req, "application/merge-patch+json", "")
+	}
+
+	res2, data2 := mergePatch(`{"name": "mergepatched", "tags": ["bar", "baz"], "parent_path": "/"}`)
+	if assert.Equal(t, 200, res2.StatusCode) {
+		attrs := data2["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+		assert.Equal(t, "mergepatched", attrs["name"])
+		assert.EqualValues(t, []interface{}{"bar", "baz"}, attrs["tags"])
+	}
+
+	res3, data3 := mergePatch(`{"tags": null, "executable": true}`)
+	if assert.Equal(t, 200, res3.StatusCode) {
+		attrs := data3["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+		assert.Equal(t, "mergepatched", attrs["name"])
+		assert.Empty(t, attrs["tags"])
+		assert.Equal(t, true, attrs["executable"])
+	}
+
+	res4, _ := mergePatch(`{"size": "3"}`)
+	assert.Equal(t, 422, res4.StatusCode)
+	res5, _ := mergePatch(`{"name": null}`)
+	assert.Equal(t, 422, res5.StatusCode)
+	res6, _ := mergePatch(`{"name": 42}`)
+	assert.Equal(t, 422, res6.StatusCode)
+	res7, _ := mergePatch(`not json`)
+	assert.Equal(t, 400, res7.StatusCode)
+
+	doc, err := testInstance.VFS().FileByID(fileID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "mergepatched", doc.DocName)
+		assert.True(t, doc.Executable)
+	}
+}
+
+func TestModifyContentSuccess(t *testing.T) {
+	var err error
+	var buf []byte
+	var fileInfo os.FileInfo
 
 	storage := testInstance.VFS()
 	res1, data1 := upload(t, "/files/?Type=file&Name=willbemodified&Executable=true", "text/plain", "foo", "")
@@ -800,957 +1613,4102 @@ func TestModifyContentSuccess(t *testing.T) {
 	assert.Equal(t, "2006-01-02T15:04:05Z", attrs3["updated_at"])
 }
 
-func TestModifyContentConcurrently(t *testing.T) {
-	type result struct {
-		rev string
-		idx int64
-	}
-
-	done := make(chan *result)
-	errs := make(chan *http.Response)
-
-	res, data := upload(t, "/files/?Type=file&Name=willbemodifiedconcurrently&Executable=true", "text/plain", "foo", "")
-	if !assert.Equal(t, 201, res.StatusCode) {
+func TestConditionalWildcards(t *testing.T) {
+	buf := strings.NewReader("foo")
+	req1, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Name=safecreate", buf)
+	assert.NoError(t, err)
+	req1.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req1.Header.Add("If-None-Match", "*")
+	res1, data1 := doUploadOrMod(t, req1, "text/plain", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
 		return
 	}
+	fileID, _ := extractDirData(t, data1)
 
-	var ok bool
-	data, ok = data["data"].(map[string]interface{})
-	assert.True(t, ok)
+	buf = strings.NewReader("bar")
+	req2, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Name=safecreate", buf)
+	assert.NoError(t, err)
+	req2.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req2.Header.Add("If-None-Match", "*")
+	res2, _ := doUploadOrMod(t, req2, "text/plain", "")
+	assert.Equal(t, 412, res2.StatusCode)
 
-	fileID, ok := data["id"].(string)
-	assert.True(t, ok)
+	req3, err := http.NewRequest("POST", ts.URL+"/files/?Type=directory&Name=safecreatedir", nil)
+	assert.NoError(t, err)
+	req3.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req3.Header.Add("If-Match", "*")
+	res3, err := http.DefaultClient.Do(req3)
+	assert.NoError(t, err)
+	res3.Body.Close()
+	assert.Equal(t, 412, res3.StatusCode)
 
-	var c int64
+	buf = strings.NewReader("baz")
+	req4, err := http.NewRequest("PUT", ts.URL+"/files/"+fileID, buf)
+	assert.NoError(t, err)
+	req4.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req4.Header.Add("If-Match", "*")
+	res4, _ := doUploadOrMod(t, req4, "text/plain", "")
+	assert.Equal(t, 200, res4.StatusCode)
 
-	doModContent := func() {
-		idx := atomic.AddInt64(&c, 1)
-		res, data := uploadMod(t, "/files/"+fileID, "plain/text", "newcontent "+strconv.FormatInt(idx, 10), "")
-		if res.StatusCode == 200 {
-			data = data["data"].(map[string]interface{})
-			meta := data["meta"].(map[string]interface{})
-			done <- &result{meta["rev"].(string), idx}
-		} else {
-			errs <- res
-		}
-	}
+	buf = strings.NewReader("qux")
+	req5, err := http.NewRequest("PUT", ts.URL+"/files/"+fileID, buf)
+	assert.NoError(t, err)
+	req5.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req5.Header.Add("If-None-Match", "*")
+	res5, _ := doUploadOrMod(t, req5, "text/plain", "")
+	assert.Equal(t, 412, res5.StatusCode)
 
-	n := 100
+	buf = strings.NewReader("quux")
+	req6, err := http.NewRequest("PUT", ts.URL+"/files/unknown-file-id", buf)
+	assert.NoError(t, err)
+	req6.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req6.Header.Add("If-Match", "*")
+	res6, _ := doUploadOrMod(t, req6, "text/plain", "")
+	assert.Equal(t, 412, res6.StatusCode)
 
-	for i := 0; i < n; i++ {
-		go doModContent()
+	content, err := readFile(testInstance.VFS(), "/safecreate")
+	assert.NoError(t, err)
+	assert.Equal(t, "baz", string(content))
+}
+
+func TestWriteFileRange(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=ranged-file", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
 	}
+	id, _ := extractDirData(t, data)
 
-	var successes []*result
-	for i := 0; i < n; i++ {
-		select {
-		case res := <-errs:
-			assert.True(t, res.StatusCode == 409 || res.StatusCode == 503, "status code is %v and not 409 or 503", res.StatusCode)
-		case res := <-done:
-			successes = append(successes, res)
+	patchContent := func(contentRange, body string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest("PATCH", ts.URL+"/files/"+id+"/content", strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		req.Header.Add("Content-Range", contentRange)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, nil
 		}
+		defer res.Body.Close()
+		var v map[string]interface{}
+		_ = json.NewDecoder(res.Body).Decode(&v)
+		return res, v
 	}
 
-	assert.True(t, len(successes) >= 1, "there is at least one success")
-
-	for i, s := range successes {
-		assert.True(t, strings.HasPrefix(s.rev, strconv.Itoa(i+3)+"-"))
+	res, data = patchContent("bytes 3-*/*", "bar")
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
 	}
+	_, attrs := extractAttributes(t, data)
+	assert.Equal(t, "6", attrs["size"])
+	assert.Equal(t, "OFj2IjCsPJFfMAxmQxLGPw==", attrs["md5sum"])
+	buf, err := readFile(testInstance.VFS(), "/ranged-file")
+	assert.NoError(t, err)
+	assert.Equal(t, "foobar", string(buf))
 
-	storage := testInstance.VFS()
-	buf, err := readFile(storage, "/willbemodifiedconcurrently")
+	res, _ = patchContent("bytes 2-*/*", "baz")
+	assert.Equal(t, 416, res.StatusCode)
+	res, _ = patchContent("bytes 7-8/*", "ba")
+	assert.Equal(t, 416, res.StatusCode)
+	res, _ = patchContent("bytes 1-2/*", "XYZ")
+	assert.Equal(t, 412, res.StatusCode)
+	res, _ = patchContent("bytes=0-", "foo")
+	assert.Equal(t, 422, res.StatusCode)
+
+	res, _ = patchContent("bytes 1-2/*", "XY")
+	assert.Equal(t, 200, res.StatusCode)
+	res, _ = patchContent("bytes 5-7/*", "RRR")
+	assert.Equal(t, 200, res.StatusCode)
+	buf, err = readFile(testInstance.VFS(), "/ranged-file")
 	assert.NoError(t, err)
+	assert.Equal(t, "fXYbaRRR", string(buf))
+}
 
-	found := false
-	for _, s := range successes {
-		if string(buf) == "newcontent "+strconv.FormatInt(s.idx, 10) {
-			found = true
-			break
+func TestMultipartUpload(t *testing.T) {
+	do := func(method, path, body string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, nil
 		}
+		defer res.Body.Close()
+		var v map[string]interface{}
+		_ = json.NewDecoder(res.Body).Decode(&v)
+		return res, v
 	}
 
-	assert.True(t, found)
-}
+	res, data := do("POST", "/files/_uploads", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	uploadID, _ := data["id"].(string)
+	assert.Len(t, uploadID, 32)
 
-func TestDownloadFileBadID(t *testing.T) {
-	res, _ := download(t, "/files/download/badid", "")
+	// The parts can be sent in any order, and sent again
+	res, data = do("PUT", "/files/_uploads/"+uploadID+"/2", "baz")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.EqualValues(t, 2, data["part"])
+	assert.EqualValues(t, 3, data["size"])
+	res, _ = do("PUT", "/files/_uploads/"+uploadID+"/2", "bar")
+	assert.Equal(t, 200, res.StatusCode)
+	res, _ = do("PUT", "/files/_uploads/"+uploadID+"/0", "bar")
+	assert.Equal(t, 422, res.StatusCode)
+
+	// A missing part or a wrong md5sum fails, and the parts are kept
+	res, _ = upload(t, "/files/?Type=file&Name=multipart-file&UploadID="+uploadID, "text/plain", "", "")
+	assert.Equal(t, 422, res.StatusCode)
+	res, _ = do("PUT", "/files/_uploads/"+uploadID+"/1", "foo")
+	assert.Equal(t, 200, res.StatusCode)
+	res, _ = upload(t, "/files/?Type=file&Name=multipart-file&UploadID="+uploadID, "text/plain", "", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 412, res.StatusCode)
+	_, err := testInstance.VFS().FileByPath("/multipart-file")
+	assert.Error(t, err)
+
+	res, data = upload(t, "/files/?Type=file&Name=multipart-file&UploadID="+uploadID, "text/plain", "", "OFj2IjCsPJFfMAxmQxLGPw==")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	_, attrs := extractAttributes(t, data)
+	assert.Equal(t, "6", attrs["size"])
+	buf, err := readFile(testInstance.VFS(), "/multipart-file")
+	assert.NoError(t, err)
+	assert.Equal(t, "foobar", string(buf))
+
+	// The parts are removed when the file has been created
+	res, _ = do("PUT", "/files/_uploads/"+uploadID+"/3", "qux")
 	assert.Equal(t, 404, res.StatusCode)
-}
 
-func TestDownloadFileBadPath(t *testing.T) {
-	res, _ := download(t, "/files/download?Path=/i/do/not/exist", "")
+	res, data = do("POST", "/files/_uploads", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	uploadID, _ = data["id"].(string)
+	res, _ = do("PUT", "/files/_uploads/"+uploadID+"/1", "foo")
+	assert.Equal(t, 200, res.StatusCode)
+	res, _ = do("DELETE", "/files/_uploads/"+uploadID, "")
+	assert.Equal(t, 204, res.StatusCode)
+	res, _ = upload(t, "/files/?Type=file&Name=multipart-aborted&UploadID="+uploadID, "text/plain", "", "")
 	assert.Equal(t, 404, res.StatusCode)
 }
 
-func TestDownloadFileByIDSuccess(t *testing.T) {
-	body := "foo"
-	res1, filedata := upload(t, "/files/?Type=file&Name=downloadme1", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
-	assert.Equal(t, 201, res1.StatusCode)
-
-	var ok bool
-	filedata, ok = filedata["data"].(map[string]interface{})
-	assert.True(t, ok)
+func TestFileConflicts(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=conflicting-file", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	id, _ := extractDirData(t, data)
 
-	fileID, ok := filedata["id"].(string)
-	assert.True(t, ok)
+	// Simulate a conflict, as it can be created by a replication
+	var raw couchdb.JSONDoc
+	assert.NoError(t, couchdb.GetDoc(testInstance, consts.Files, id, &raw))
+	raw.M["_rev"] = "1-0123456789abcdef0123456789abcdef"
+	raw.M["name"] = "conflicting-name"
+	assert.NoError(t, couchdb.BulkForceUpdateDocs(testInstance, consts.Files, []map[string]interface{}{raw.M}))
 
-	res2, resbody := download(t, "/files/download/"+fileID, "")
-	assert.Equal(t, 200, res2.StatusCode)
-	assert.True(t, strings.HasPrefix(res2.Header.Get("Content-Disposition"), "inline"))
-	assert.True(t, strings.Contains(res2.Header.Get("Content-Disposition"), "filename=downloadme1"))
-	assert.True(t, strings.HasPrefix(res2.Header.Get("Content-Type"), "text/plain"))
-	assert.NotEmpty(t, res2.Header.Get("Etag"))
-	assert.Equal(t, res2.Header.Get("Etag")[:1], `"`)
-	assert.Equal(t, res2.Header.Get("Content-Length"), "3")
-	assert.Equal(t, res2.Header.Get("Accept-Ranges"), "bytes")
-	assert.Equal(t, body, string(resbody))
-}
+	res, err := httpGet(ts.URL + "/files/" + id + "/conflicts")
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	var result struct {
+		Data []struct {
+			ID         string                 `json:"id"`
+			Attributes map[string]interface{} `json:"attributes"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	res.Body.Close()
+	if !assert.Len(t, result.Data, 1) {
+		return
+	}
+	assert.Equal(t, "1-0123456789abcdef0123456789abcdef", result.Data[0].ID)
+	assert.Equal(t, "conflicting-name", result.Data[0].Attributes["name"])
+	assert.Equal(t, "3", result.Data[0].Attributes["size"])
+	assert.Equal(t, true, result.Data[0].Attributes["content_available"])
 
-func TestDownloadFileByPathSuccess(t *testing.T) {
-	body := "foo"
-	res1, _ := upload(t, "/files/?Type=file&Name=downloadme2", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
-	assert.Equal(t, 201, res1.StatusCode)
+	resolve := func(rev string) *http.Response {
+		req, _ := http.NewRequest("POST", ts.URL+"/files/"+id+"/resolve?rev="+rev, nil)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return res
+	}
+	res = resolve("1-ffffffffffffffffffffffffffffffff")
+	assert.Equal(t, 404, res.StatusCode)
+	res = resolve("1-0123456789abcdef0123456789abcdef")
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	var resolved map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&resolved))
+	res.Body.Close()
+	_, attrs := extractAttributes(t, resolved)
+	assert.Equal(t, "conflicting-name", attrs["name"])
 
-	res2, resbody := download(t, "/files/download?Dl=1&Path="+url.QueryEscape("/downloadme2"), "")
-	assert.Equal(t, 200, res2.StatusCode)
-	assert.True(t, strings.HasPrefix(res2.Header.Get("Content-Disposition"), "attachment"))
-	assert.True(t, strings.Contains(res2.Header.Get("Content-Disposition"), "filename=downloadme2"))
-	assert.True(t, strings.HasPrefix(res2.Header.Get("Content-Type"), "text/plain"))
-	assert.Equal(t, res2.Header.Get("Content-Length"), "3")
-	assert.Equal(t, res2.Header.Get("Accept-Ranges"), "bytes")
-	assert.Equal(t, body, string(resbody))
+	res, err = httpGet(ts.URL + "/files/" + id + "/conflicts")
+	assert.NoError(t, err)
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	res.Body.Close()
+	assert.Len(t, result.Data, 0)
 }
 
-func TestDownloadRangeSuccess(t *testing.T) {
-	body := "foo,bar"
-	res1, _ := upload(t, "/files/?Type=file&Name=downloadmebyrange", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
-	assert.Equal(t, 201, res1.StatusCode)
+func TestFileLock(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=locked-file", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	id, _ := extractDirData(t, data)
 
-	res2, _ := download(t, "/files/download?Path="+url.QueryEscape("/downloadmebyrange"), "nimp")
-	assert.Equal(t, 416, res2.StatusCode)
+	lockReq := func(method, query string) (*http.Response, map[string]interface{}) {
+		req, _ := http.NewRequest(method, ts.URL+"/files/"+id+"/lock"+query, nil)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		defer res.Body.Close()
+		var v map[string]interface{}
+		_ = json.NewDecoder(res.Body).Decode(&v)
+		return res, v
+	}
 
-	res3, res3body := download(t, "/files/download?Path="+url.QueryEscape("/downloadmebyrange"), "bytes=0-2")
-	assert.Equal(t, 206, res3.StatusCode)
-	assert.Equal(t, "foo", string(res3body))
+	res, _ = lockReq("POST", "?ttl=foo")
+	assert.Equal(t, 422, res.StatusCode)
 
-	res4, res4body := download(t, "/files/download?Path="+url.QueryEscape("/downloadmebyrange"), "bytes=4-")
-	assert.Equal(t, 206, res4.StatusCode)
-	assert.Equal(t, "bar", string(res4body))
-}
+	res, data = lockReq("POST", "?ttl=60")
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	_, attrs := extractAttributes(t, data)
+	lock, ok := attrs["lock"].(map[string]interface{})
+	if assert.True(t, ok) {
+		assert.NotEmpty(t, lock["owner"])
+		assert.NotEmpty(t, lock["expires_at"])
+	}
 
-func TestGetFileMetadataFromPath(t *testing.T) {
-	res1, _ := httpGet(ts.URL + "/files/metadata?Path=/noooooop")
-	assert.Equal(t, 404, res1.StatusCode)
+	// The client that holds the lock can still modify the file
+	res, _ = uploadMod(t, "/files/"+id, "text/plain", "bar", "")
+	assert.Equal(t, 200, res.StatusCode)
 
-	body := "foo,bar"
-	res2, _ := upload(t, "/files/?Type=file&Name=getmetadata", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
-	assert.Equal(t, 201, res2.StatusCode)
+	res, _ = lockReq("DELETE", "")
+	assert.Equal(t, 204, res.StatusCode)
+	res, err := httpGet(ts.URL + "/files/" + id)
+	if assert.NoError(t, err) && assert.Equal(t, 200, res.StatusCode) {
+		var v map[string]interface{}
+		assert.NoError(t, extractJSONRes(res, &v))
+		_, attrs = extractAttributes(t, v)
+		assert.Nil(t, attrs["lock"])
+	}
 
-	res3, _ := httpGet(ts.URL + "/files/metadata?Path=/getmetadata")
-	assert.Equal(t, 200, res3.StatusCode)
+	// A lock held by another client
+	_, err = vfs.LockFile(testInstance.Domain, id, "another-editor", time.Minute)
+	assert.NoError(t, err)
+	defer func() { _ = vfs.UnlockFile(testInstance.Domain, id, "another-editor") }()
+
+	res, _ = lockReq("POST", "")
+	assert.Equal(t, 423, res.StatusCode)
+	res, _ = lockReq("DELETE", "")
+	assert.Equal(t, 423, res.StatusCode)
+	res, _ = uploadMod(t, "/files/"+id, "text/plain", "baz", "")
+	assert.Equal(t, 423, res.StatusCode)
+	res, _ = patchFile(t, "/files/"+id, "file", id, map[string]interface{}{
+		"name": "renamed-locked-file",
+	}, nil)
+	assert.Equal(t, 423, res.StatusCode)
+
+	res, err = httpGet(ts.URL + "/files/" + id)
+	if assert.NoError(t, err) && assert.Equal(t, 200, res.StatusCode) {
+		var v map[string]interface{}
+		assert.NoError(t, extractJSONRes(res, &v))
+		_, attrs = extractAttributes(t, v)
+		lock, ok = attrs["lock"].(map[string]interface{})
+		if assert.True(t, ok) {
+			assert.Equal(t, "another-editor", lock["owner"])
+		}
+	}
 }
 
-func TestGetDirMetadataFromPath(t *testing.T) {
-	res1, _ := createDir(t, "/files/?Name=getdirmeta&Type=directory")
-	assert.Equal(t, 201, res1.StatusCode)
+func TestTouchFile(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=touched-file", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	id, attrs := extractAttributes(t, data)
+	before := attrs["updated_at"]
 
-	res2, _ := httpGet(ts.URL + "/files/metadata?Path=/getdirmeta")
-	assert.Equal(t, 200, res2.StatusCode)
-}
+	touch := func(query string) (*http.Response, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", ts.URL+"/files/"+id+"/touch"+query, nil)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		defer res.Body.Close()
+		var v map[string]interface{}
+		_ = json.NewDecoder(res.Body).Decode(&v)
+		return res, v
+	}
 
-func TestGetFileMetadataFromID(t *testing.T) {
-	res1, _ := httpGet(ts.URL + "/files/qsdqsd")
+	res, data = touch("")
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	_, attrs = extractAttributes(t, data)
+	assert.NotEqual(t, before, attrs["updated_at"])
+	assert.Equal(t, "3", attrs["size"])
+
+	soon := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+	res, data = touch("?UpdatedAt=" + soon.Format(time.RFC3339))
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	_, attrs = extractAttributes(t, data)
+	assert.Equal(t, soon.Format(time.RFC3339), attrs["updated_at"])
+
+	future := time.Now().Add(time.Hour).UTC()
+	res, _ = touch("?UpdatedAt=" + future.Format(time.RFC3339))
+	assert.Equal(t, 422, res.StatusCode)
+	res, _ = touch("?UpdatedAt=2000-01-01T00:00:00Z")
+	assert.Equal(t, 422, res.StatusCode)
+	res, _ = touch("?UpdatedAt=yesterday")
+	assert.Equal(t, 422, res.StatusCode)
+}
+
+func TestMoveUp(t *testing.T) {
+	res, data := createDir(t, "/files/?Name=moveup-parent&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	parentID, _ := extractDirData(t, data)
+	res, data = createDir(t, "/files/"+parentID+"?Name=moveup-child&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	childID, _ := extractDirData(t, data)
+	res, data = upload(t, "/files/"+childID+"?Type=file&Name=moveup-file", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data)
+
+	moveUp := func(id string) (*http.Response, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", ts.URL+"/files/"+id+"/move-up", nil)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		defer res.Body.Close()
+		var v map[string]interface{}
+		_ = json.NewDecoder(res.Body).Decode(&v)
+		return res, v
+	}
+
+	res, data = moveUp(fileID)
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	_, attrs := extractAttributes(t, data)
+	assert.Equal(t, parentID, attrs["dir_id"])
+
+	res, data = moveUp(childID)
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	_, attrs = extractAttributes(t, data)
+	assert.Equal(t, consts.RootDirID, attrs["dir_id"])
+	assert.Equal(t, "/moveup-child", attrs["path"])
+
+	res, _ = moveUp(childID)
+	assert.Equal(t, 400, res.StatusCode)
+	res, _ = moveUp(consts.RootDirID)
+	assert.Equal(t, 400, res.StatusCode)
+
+	res, _ = upload(t, "/files/?Type=file&Name=moveup-file", "text/plain", "bar", "")
+	assert.Equal(t, 201, res.StatusCode)
+	res, _ = moveUp(fileID)
+	assert.Equal(t, 409, res.StatusCode)
+}
+
+func TestPublicLink(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=public-link.txt", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data)
+
+	share := func(method, suffix string) (*http.Response, map[string]interface{}) {
+		req, _ := http.NewRequest(method, ts.URL+"/files/"+fileID+"/share/public"+suffix, nil)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		var v map[string]interface{}
+		if res.StatusCode != 204 {
+			assert.NoError(t, extractJSONRes(res, &v))
+		}
+		res.Body.Close()
+		return res, v
+	}
+
+	res, data = share("POST", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	_, attrs := extractAttributes(t, data)
+	linkToken := attrs["token"].(string)
+	assert.NotEmpty(t, linkToken)
+	links := data["data"].(map[string]interface{})["links"].(map[string]interface{})
+	related := links["related"].(string)
+	assert.Equal(t, "/files/public/"+linkToken, related)
+
+	res, data = share("POST", "")
+	assert.Equal(t, 200, res.StatusCode)
+	_, attrs = extractAttributes(t, data)
+	assert.Equal(t, linkToken, attrs["token"])
+
+	res, err := http.Get(ts.URL + related)
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(body))
+
+	var accesses []interface{}
+	for i := 0; i < 50; i++ {
+		res, data = share("GET", "/accesses")
+		if !assert.Equal(t, 200, res.StatusCode) {
+			return
+		}
+		accesses = data["data"].([]interface{})
+		if len(accesses) > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if assert.Len(t, accesses, 1) {
+		access := accesses[0].(map[string]interface{})["attributes"].(map[string]interface{})
+		assert.Equal(t, fileID, access["file_id"])
+		assert.NotEmpty(t, access["ip_hash"])
+	}
+
+	res, _ = share("DELETE", "")
+	assert.Equal(t, 204, res.StatusCode)
+	res, err = http.Get(ts.URL + related)
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+	res.Body.Close()
+	res, _ = share("GET", "")
+	assert.Equal(t, 404, res.StatusCode)
+
+	res, data = share("GET", "/accesses")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Len(t, data["data"].([]interface{}), 1)
+}
+
+func TestPublicAccessClientIP(t *testing.T) {
+	proxies := config.GetConfig().Fs.TrustedProxies
+	defer func() { config.GetConfig().Fs.TrustedProxies = proxies }()
+
+	req := httptest.NewRequest("GET", "/files/public/token", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Add("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+
+	config.GetConfig().Fs.TrustedProxies = nil
+	assert.Equal(t, "10.0.0.2", clientIP(req))
+
+	config.GetConfig().Fs.TrustedProxies = []string{"10.0.0.0/8"}
+	assert.Equal(t, "5.6.7.8", clientIP(req))
+	config.GetConfig().Fs.TrustedProxies = []string{"10.0.0.2", "5.6.7.8"}
+	assert.Equal(t, "1.2.3.4", clientIP(req))
+}
+
+func TestStarred(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=starred-file", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data)
+	res, data = createDir(t, "/files/?Name=starred-dir&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data)
+
+	attrs := map[string]interface{}{"starred": true}
+	res, data = patchFile(t, "/files/"+fileID, "file", fileID, attrs, nil)
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	_, fileAttrs := extractAttributes(t, data)
+	assert.Equal(t, true, fileAttrs["starred"])
+	res, _ = patchFile(t, "/files/"+dirID, "directory", dirID, attrs, nil)
+	assert.Equal(t, 200, res.StatusCode)
+
+	listStarred := func() []string {
+		res, err := httpGet(ts.URL + "/files/_starred")
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		var v struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&v))
+		ids := make([]string, len(v.Data))
+		for i, d := range v.Data {
+			ids[i] = d.ID
+		}
+		return ids
+	}
+	ids := listStarred()
+	assert.Contains(t, ids, fileID)
+	assert.Contains(t, ids, dirID)
+
+	// The other modifications keep the flag
+	attrs = map[string]interface{}{"name": "starred-file-renamed"}
+	res, data = patchFile(t, "/files/"+fileID, "file", fileID, attrs, nil)
+	assert.Equal(t, 200, res.StatusCode)
+	_, fileAttrs = extractAttributes(t, data)
+	assert.Equal(t, true, fileAttrs["starred"])
+
+	// Trashing a file clears the flag
+	res, _ = trash(t, "/files/"+fileID)
+	assert.Equal(t, 200, res.StatusCode)
+	ids = listStarred()
+	assert.NotContains(t, ids, fileID)
+	assert.Contains(t, ids, dirID)
+
+	attrs = map[string]interface{}{"starred": true}
+	res, _ = patchFile(t, "/files/"+fileID, "file", fileID, attrs, nil)
+	assert.Equal(t, 400, res.StatusCode)
+
+	attrs = map[string]interface{}{"starred": false}
+	res, _ = patchFile(t, "/files/"+dirID, "directory", dirID, attrs, nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.NotContains(t, listStarred(), dirID)
+}
+
+func TestRecentFiles(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=recent-text", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	textID, _ := extractDirData(t, data)
+	res, data = upload(t, "/files/?Type=file&Name=recent-image.png", "image/png", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	imageID, _ := extractDirData(t, data)
+
+	listRecent := func(query string) []string {
+		res, err := httpGet(ts.URL + "/files/_recent" + query)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		var v struct {
+			Data []struct {
+				ID    string                 `json:"id"`
+				Attrs map[string]interface{} `json:"attributes"`
+			} `json:"data"`
+		}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&v))
+		ids := make([]string, len(v.Data))
+		for i, d := range v.Data {
+			assert.Equal(t, "file", d.Attrs["type"])
+			ids[i] = d.ID
+		}
+		return ids
+	}
+
+	indexOf := func(ids []string, id string) int {
+		for i := range ids {
+			if ids[i] == id {
+				return i
+			}
+		}
+		return -1
+	}
+
+	ids := listRecent("?limit=100")
+	if assert.Contains(t, ids, imageID) && assert.Contains(t, ids, textID) {
+		assert.True(t, indexOf(ids, imageID) < indexOf(ids, textID))
+	}
+	ids = listRecent("?limit=100&class=image")
+	assert.Contains(t, ids, imageID)
+	assert.NotContains(t, ids, textID)
+
+	res, _ = trash(t, "/files/"+imageID)
+	assert.Equal(t, 200, res.StatusCode)
+	ids = listRecent("?limit=100")
+	assert.NotContains(t, ids, imageID)
+	assert.Contains(t, ids, textID)
+}
+
+func TestFindByHash(t *testing.T) {
+	content := "content to find by its hash"
+	res, data := upload(t, "/files/?Type=file&Name=by-hash", "text/plain", content, "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID, attrs := extractAttributes(t, data)
+	sha256sum := sha256.Sum256([]byte(content))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(sha256sum[:]), attrs["sha256sum"])
+
+	findByHash := func(algo, hash string) (int, []string) {
+		res, err := httpGet(ts.URL + "/files/_by_hash/" + algo + "/" + hash)
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		defer res.Body.Close()
+		var v struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		if res.StatusCode != 200 {
+			return res.StatusCode, nil
+		}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&v))
+		ids := make([]string, len(v.Data))
+		for i, d := range v.Data {
+			ids[i] = d.ID
+		}
+		return res.StatusCode, ids
+	}
+
+	md5sum := md5.Sum([]byte(content)) // #nosec
+	status, ids := findByHash("md5", hex.EncodeToString(md5sum[:]))
+	assert.Equal(t, 200, status)
+	assert.Equal(t, []string{fileID}, ids)
+	status, ids = findByHash("sha256", hex.EncodeToString(sha256sum[:]))
+	assert.Equal(t, 200, status)
+	assert.Equal(t, []string{fileID}, ids)
+
+	other := sha256.Sum256([]byte("not uploaded"))
+	status, ids = findByHash("sha256", hex.EncodeToString(other[:]))
+	assert.Equal(t, 200, status)
+	assert.Empty(t, ids)
+
+	status, _ = findByHash("sha1", hex.EncodeToString(md5sum[:]))
+	assert.Equal(t, 400, status)
+	status, _ = findByHash("md5", "not-an-hexa-hash")
+	assert.Equal(t, 400, status)
+	status, _ = findByHash("sha256", hex.EncodeToString(md5sum[:]))
+	assert.Equal(t, 400, status)
+
+	res, _ = trash(t, "/files/"+fileID)
+	assert.Equal(t, 200, res.StatusCode)
+	status, ids = findByHash("md5", hex.EncodeToString(md5sum[:]))
+	assert.Equal(t, 200, status)
+	assert.Empty(t, ids)
+}
+
+func TestInheritTags(t *testing.T) {
+	res, data := createDir(t, "/files/?Name=dir-inherit-tags&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data)
+	attrs := map[string]interface{}{
+		"tags":         []string{"bills", "2018"},
+		"inherit_tags": true,
+	}
+	res, data = patchFile(t, "/files/"+dirID, "directory", dirID, attrs, nil)
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	_, dirAttrs := extractAttributes(t, data)
+	assert.Equal(t, true, dirAttrs["inherit_tags"])
+
+	res, data = upload(t, "/files/"+dirID+"?Type=file&Name=bill.txt&Tags=2018,energy", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	_, fileAttrs := extractAttributes(t, data)
+	assert.Equal(t, []interface{}{"2018", "energy", "bills"}, fileAttrs["tags"])
+	assert.Equal(t, []interface{}{"bills"}, fileAttrs["inherited_tags"])
+
+	// Moving a file in the directory also adds the tags
+	res, data = upload(t, "/files/?Type=file&Name=moved-bill.txt", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data)
+	parent := &jsonData{ID: dirID, Type: "io.cozy.files"}
+	res, data = patchFile(t, "/files/"+fileID, "file", fileID, nil, parent)
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	_, fileAttrs = extractAttributes(t, data)
+	assert.Equal(t, []interface{}{"bills", "2018"}, fileAttrs["tags"])
+	assert.Equal(t, []interface{}{"bills", "2018"}, fileAttrs["inherited_tags"])
+
+	// Without the flag, the tags are not inherited
+	res, data = createDir(t, "/files/?Name=dir-no-inherit-tags&Type=directory&Tags=bills")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	otherID, _ := extractDirData(t, data)
+	res, data = upload(t, "/files/"+otherID+"?Type=file&Name=bill.txt", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	_, fileAttrs = extractAttributes(t, data)
+	assert.Empty(t, fileAttrs["tags"])
+	assert.Nil(t, fileAttrs["inherited_tags"])
+}
+
+func TestImportDates(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=imported-file&CreatedAt=2010-01-02T03:04:05Z&UpdatedAt=2012-03-04T05:06:07Z", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	_, attrs := extractAttributes(t, data)
+	assert.Equal(t, "2010-01-02T03:04:05Z", attrs["created_at"])
+	assert.Equal(t, "2012-03-04T05:06:07Z", attrs["updated_at"])
+
+	res, _ = upload(t, "/files/?Type=file&Name=imported-file-2&CreatedAt=2012-03-04T05:06:07Z&UpdatedAt=2010-01-02T03:04:05Z", "text/plain", "foo", "")
+	assert.Equal(t, 422, res.StatusCode)
+
+	future := time.Now().Add(time.Hour).UTC()
+	res, _ = upload(t, "/files/?Type=file&Name=imported-file-3&CreatedAt="+future.Format(time.RFC3339), "text/plain", "foo", "")
+	assert.Equal(t, 422, res.StatusCode)
+
+	// The legacy Date header is checked like the parameters
+	req, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Name=imported-file-4", strings.NewReader("foo"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req.Header.Add("Date", future.Format(time.RFC1123))
+	res, _ = doUploadOrMod(t, req, "text/plain", "")
+	assert.Equal(t, 422, res.StatusCode)
+}
+
+func TestVerifyFile(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=verified-file", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	id, _ := extractDirData(t, data)
+
+	req, _ := http.NewRequest("POST", ts.URL+"/files/"+id+"/verify", nil)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	var result map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	res.Body.Close()
+	_, attrs := extractAttributes(t, result)
+	assert.Equal(t, "ok", attrs["status"])
+	assert.Equal(t, attrs["expected_md5sum"], attrs["computed_md5sum"])
+
+	req, _ = http.NewRequest("POST", ts.URL+"/files/_verify", nil)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 202, res.StatusCode)
+	res.Body.Close()
+}
+
+func TestReclassify(t *testing.T) {
+	res, data := createDir(t, "/files/?Name=reclassified-dir&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data)
+	res, data = upload(t, "/files/"+dirID+"?Type=file&Name=notes.md", "text/markdown", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID, attrs := extractAttributes(t, data)
+	assert.Equal(t, "text", attrs["class"])
+
+	cfg := config.GetConfig()
+	contexts := cfg.Contexts
+	defer func() { cfg.Contexts = contexts }()
+	cfg.Contexts = map[string]interface{}{
+		"default": map[string]interface{}{
+			"file_classes": map[string]interface{}{
+				"text/markdown": "notes",
+			},
+		},
+	}
+
+	req, _ := http.NewRequest("POST", ts.URL+"/files/_reclassify?dir-id="+dirID, nil)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) || !assert.Equal(t, 202, res.StatusCode) {
+		return
+	}
+	var v map[string]interface{}
+	assert.NoError(t, extractJSONRes(res, &v))
+	jobID := v["data"].(map[string]interface{})["id"].(string)
+	for i := 0; i < 50; i++ {
+		res, err = httpGet(ts.URL + "/files/_jobs/" + jobID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, extractJSONRes(res, &v))
+		res.Body.Close()
+		attrs = v["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+		if attrs["state"] == "done" || attrs["state"] == "error" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, "done", attrs["state"])
+	result := attrs["result"].(map[string]interface{})
+	assert.EqualValues(t, 1, result["checked"])
+	assert.EqualValues(t, 1, result["updated"])
+
+	res, err = httpGet(ts.URL + "/files/" + fileID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, extractJSONRes(res, &v))
+	_, attrs = extractAttributes(t, v)
+	assert.Equal(t, "notes", attrs["class"])
+
+	req, _ = http.NewRequest("POST", ts.URL+"/files/_reclassify?dir-id=unknown", nil)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+	res.Body.Close()
+}
+
+func TestUploadPolicy(t *testing.T) {
+	cfg := config.GetConfig()
+	contexts := cfg.Contexts
+	defer func() { cfg.Contexts = contexts }()
+	cfg.Contexts = map[string]interface{}{
+		"default": map[string]interface{}{
+			"upload_policy": map[string]interface{}{
+				"deny": []interface{}{"binary"},
+			},
+		},
+	}
+
+	res1, err := httpGet(ts.URL + "/files/_upload_policy")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res1.StatusCode)
+	var v map[string]interface{}
+	assert.NoError(t, extractJSONRes(res1, &v))
+	attrs := v["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"binary"}, attrs["deny"])
+
+	res2, _ := upload(t, "/files/?Type=file&Name=setup.exe", "application/x-msdownload", "foo", "")
+	assert.Equal(t, 415, res2.StatusCode)
+
+	exe := "MZ\x90\x00\x03\x00\x00\x00"
+	res3, _ := upload(t, "/files/?Type=file&Name=renamed.txt", "text/plain", exe, "")
+	assert.Equal(t, 415, res3.StatusCode)
+
+	res4, _ := upload(t, "/files/?Type=file&Name=allowed.txt", "text/plain", "foo", "")
+	assert.Equal(t, 201, res4.StatusCode)
+
+	// Without extension, the decision is made on the sniffed type
+	cfg.Contexts = map[string]interface{}{
+		"default": map[string]interface{}{
+			"upload_policy": map[string]interface{}{
+				"allow": []interface{}{"image"},
+			},
+		},
+	}
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"
+	res5, _ := upload(t, "/files/?Type=file&Name=photo-without-ext", "application/octet-stream", png, "")
+	assert.Equal(t, 201, res5.StatusCode)
+	res6, _ := upload(t, "/files/?Type=file&Name=unknown-without-ext", "application/octet-stream", "foo", "")
+	assert.Equal(t, 415, res6.StatusCode)
+}
+
+func TestModifyContentConcurrently(t *testing.T) {
+	type result struct {
+		rev string
+		idx int64
+	}
+
+	done := make(chan *result)
+	errs := make(chan *http.Response)
+
+	res, data := upload(t, "/files/?Type=file&Name=willbemodifiedconcurrently&Executable=true", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+
+	var ok bool
+	data, ok = data["data"].(map[string]interface{})
+	assert.True(t, ok)
+
+	fileID, ok := data["id"].(string)
+	assert.True(t, ok)
+
+	var c int64
+
+	doModContent := func() {
+		idx := atomic.AddInt64(&c, 1)
+		res, data := uploadMod(t, "/files/"+fileID, "plain/text", "newcontent "+strconv.FormatInt(idx, 10), "")
+		if res.StatusCode == 200 {
+			data = data["data"].(map[string]interface{})
+			meta := data["meta"].(map[string]interface{})
+			done <- &result{meta["rev"].(string), idx}
+		} else {
+			errs <- res
+		}
+	}
+
+	n := 100
+
+	for i := 0; i < n; i++ {
+		go doModContent()
+	}
+
+	var successes []*result
+	for i := 0; i < n; i++ {
+		select {
+		case res := <-errs:
+			assert.True(t, res.StatusCode == 409 || res.StatusCode == 503, "status code is %v and not 409 or 503", res.StatusCode)
+		case res := <-done:
+			successes = append(successes, res)
+		}
+	}
+
+	assert.True(t, len(successes) >= 1, "there is at least one success")
+
+	for i, s := range successes {
+		assert.True(t, strings.HasPrefix(s.rev, strconv.Itoa(i+3)+"-"))
+	}
+
+	storage := testInstance.VFS()
+	buf, err := readFile(storage, "/willbemodifiedconcurrently")
+	assert.NoError(t, err)
+
+	found := false
+	for _, s := range successes {
+		if string(buf) == "newcontent "+strconv.FormatInt(s.idx, 10) {
+			found = true
+			break
+		}
+	}
+
+	assert.True(t, found)
+}
+
+func TestDownloadFileBadID(t *testing.T) {
+	res, _ := download(t, "/files/download/badid", "")
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestDownloadFileBadPath(t *testing.T) {
+	res, _ := download(t, "/files/download?Path=/i/do/not/exist", "")
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestDownloadFileByIDSuccess(t *testing.T) {
+	body := "foo"
+	res1, filedata := upload(t, "/files/?Type=file&Name=downloadme1", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+
+	var ok bool
+	filedata, ok = filedata["data"].(map[string]interface{})
+	assert.True(t, ok)
+
+	fileID, ok := filedata["id"].(string)
+	assert.True(t, ok)
+
+	res2, resbody := download(t, "/files/download/"+fileID, "")
+	assert.Equal(t, 200, res2.StatusCode)
+	assert.True(t, strings.HasPrefix(res2.Header.Get("Content-Disposition"), "inline"))
+	assert.True(t, strings.Contains(res2.Header.Get("Content-Disposition"), "filename=downloadme1"))
+	assert.True(t, strings.HasPrefix(res2.Header.Get("Content-Type"), "text/plain"))
+	assert.NotEmpty(t, res2.Header.Get("Etag"))
+	assert.Equal(t, res2.Header.Get("Etag")[:1], `"`)
+	assert.Equal(t, res2.Header.Get("Content-Length"), "3")
+	assert.Equal(t, res2.Header.Get("Accept-Ranges"), "bytes")
+	assert.Equal(t, body, string(resbody))
+}
+
+func TestDownloadFileByIDWithFilename(t *testing.T) {
+	body := "foo"
+	res1, filedata := upload(t, "/files/?Type=file&Name=invoice.txt", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	data := filedata["data"].(map[string]interface{})
+	fileID := data["id"].(string)
+
+	res2, resbody := download(t, "/files/download/"+fileID+"?filename="+url.QueryEscape("invoice-2017.txt"), "")
+	assert.Equal(t, 200, res2.StatusCode)
+	assert.Equal(t, "inline; filename=invoice-2017.txt", res2.Header.Get("Content-Disposition"))
+	assert.Equal(t, body, string(resbody))
+
+	res3, _ := download(t, "/files/download/"+fileID+"?Dl=1&filename="+url.QueryEscape("../../etc/pass\nwd"), "")
+	assert.Equal(t, 200, res3.StatusCode)
+	assert.Equal(t, "attachment; filename=....etcpasswd", res3.Header.Get("Content-Disposition"))
+
+	res4, _ := httpGet(ts.URL + "/files/" + fileID)
+	assert.Equal(t, 200, res4.StatusCode)
+	var obj map[string]interface{}
+	assert.NoError(t, extractJSONRes(res4, &obj))
+	attrs := obj["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, "invoice.txt", attrs["name"])
+}
+
+func TestDownloadFileWithDisposition(t *testing.T) {
+	body := "foo"
+	res1, filedata := upload(t, "/files/?Type=file&Name=disposition.txt", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	fileID := filedata["data"].(map[string]interface{})["id"].(string)
+
+	res2, _ := download(t, "/files/download/"+fileID, "")
+	assert.Equal(t, 200, res2.StatusCode)
+	assert.Equal(t, "inline; filename=disposition.txt", res2.Header.Get("Content-Disposition"))
+
+	res3, _ := download(t, "/files/download/"+fileID+"?dl=1", "")
+	assert.Equal(t, 200, res3.StatusCode)
+	assert.Equal(t, "attachment; filename=disposition.txt", res3.Header.Get("Content-Disposition"))
+
+	res4, _ := download(t, "/files/download?Path=/disposition.txt&disposition=attachment", "")
+	assert.Equal(t, 200, res4.StatusCode)
+	assert.Equal(t, "attachment; filename=disposition.txt", res4.Header.Get("Content-Disposition"))
+
+	res5, _ := download(t, "/files/download?Path=/disposition.txt&Dl=1&disposition=inline", "")
+	assert.Equal(t, 200, res5.StatusCode)
+	assert.Equal(t, "inline; filename=disposition.txt", res5.Header.Get("Content-Disposition"))
+
+	res6, _ := download(t, "/files/download/"+fileID+"?disposition=foo", "")
+	assert.Equal(t, 422, res6.StatusCode)
+}
+
+func TestDownloadFileByPathSuccess(t *testing.T) {
+	body := "foo"
+	res1, _ := upload(t, "/files/?Type=file&Name=downloadme2", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+
+	res2, resbody := download(t, "/files/download?Dl=1&Path="+url.QueryEscape("/downloadme2"), "")
+	assert.Equal(t, 200, res2.StatusCode)
+	assert.True(t, strings.HasPrefix(res2.Header.Get("Content-Disposition"), "attachment"))
+	assert.True(t, strings.Contains(res2.Header.Get("Content-Disposition"), "filename=downloadme2"))
+	assert.True(t, strings.HasPrefix(res2.Header.Get("Content-Type"), "text/plain"))
+	assert.Equal(t, res2.Header.Get("Content-Length"), "3")
+	assert.Equal(t, res2.Header.Get("Accept-Ranges"), "bytes")
+	assert.Equal(t, body, string(resbody))
+}
+
+func TestStableETags(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=etag-file", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data)
+	rev := data["data"].(map[string]interface{})["meta"].(map[string]interface{})["rev"].(string)
+
+	res1, _ := download(t, "/files/download/"+fileID, "")
+	assert.Equal(t, `"rL0Y20zC+Fzt72VPzMSk2A=="`, res1.Header.Get("Etag"))
+	res2, _ := download(t, "/files/download/"+fileID, "bytes=0-1")
+	assert.Equal(t, 206, res2.StatusCode)
+	assert.Equal(t, res1.Header.Get("Etag"), res2.Header.Get("Etag"))
+
+	res3, err := httpGet(ts.URL + "/files/" + fileID)
+	assert.NoError(t, err)
+	res3.Body.Close()
+	assert.Equal(t, `"`+rev+`"`, res3.Header.Get("Etag"))
+
+	// The ETags are computed from the documents in CouchDB, so loading them
+	// again, like after a restart, gives the same values
+	doc, err := testInstance.VFS().FileByID(fileID)
+	assert.NoError(t, err)
+	assert.Equal(t, res1.Header.Get("Etag"), vfs.ContentETag(doc))
+	assert.Equal(t, res3.Header.Get("Etag"), vfs.RevETag(doc.Rev()))
+}
+
+func TestCompressedDownload(t *testing.T) {
+	compressible := config.GetConfig().Fs.Compressible
+	config.GetConfig().Fs.Compressible = []string{"text/*"}
+	defer func() { config.GetConfig().Fs.Compressible = compressible }()
+
+	body := strings.Repeat("Hello, compressed world! ", 100)
+	res, data := upload(t, "/files/?Type=file&Name=compressme.txt", "text/plain", body, "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data)
+
+	get := func(encoding, byteRange string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", ts.URL+"/files/download/"+fileID, nil)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		req.Header.Add("Accept-Encoding", encoding)
+		if byteRange != "" {
+			req.Header.Add("Range", byteRange)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		defer res.Body.Close()
+		buf, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		return res, buf
+	}
+
+	res, buf := get("deflate;q=0.5, gzip", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.True(t, len(buf) < len(body))
+	gr, err := gzip.NewReader(bytes.NewReader(buf))
+	if assert.NoError(t, err) {
+		unzipped, err := ioutil.ReadAll(gr)
+		assert.NoError(t, err)
+		assert.Equal(t, body, string(unzipped))
+	}
+
+	res, buf = get("gzip", "bytes=0-4")
+	assert.Equal(t, 206, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Hello", string(buf))
+
+	res, buf = get("identity", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, body, string(buf))
+
+	req, _ := http.NewRequest("HEAD", ts.URL+"/files/download/"+fileID, nil)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req.Header.Add("Accept-Encoding", "gzip")
+	res, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+		assert.Empty(t, res.Header.Get("Content-Length"))
+	}
+
+	res, data = upload(t, "/files/?Type=file&Name=compressme.png", "image/png", body, "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID, _ = extractDirData(t, data)
+	res, buf = get("gzip", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, body, string(buf))
+}
+
+func TestCompressedListing(t *testing.T) {
+	res, data := createDir(t, "/files/?Name=compressed-listing&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data)
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("compressed-listing-%d.txt", i)
+		res, _ = upload(t, "/files/"+dirID+"?Type=file&Name="+name, "text/plain", "foo", "")
+		assert.Equal(t, 201, res.StatusCode)
+	}
+
+	list := func(encoding, ifNoneMatch string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", ts.URL+"/files/"+dirID+"/relationships/contents", nil)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		req.Header.Add("Accept-Encoding", encoding)
+		if ifNoneMatch != "" {
+			req.Header.Add("If-None-Match", ifNoneMatch)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		defer res.Body.Close()
+		buf, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		return res, buf
+	}
+
+	res, plain := list("identity", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	etag := res.Header.Get("Etag")
+
+	res, buf := list("gzip", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Equal(t, etag, res.Header.Get("Etag"))
+	assert.True(t, len(buf) < len(plain))
+	gr, err := gzip.NewReader(bytes.NewReader(buf))
+	if assert.NoError(t, err) {
+		unzipped, err := ioutil.ReadAll(gr)
+		assert.NoError(t, err)
+		var v map[string]interface{}
+		assert.NoError(t, json.Unmarshal(unzipped, &v))
+		assert.Len(t, v["data"], 5)
+	}
+
+	res, buf = list("gzip", etag)
+	assert.Equal(t, 304, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Empty(t, buf)
+}
+
+func TestHeadFileDownload(t *testing.T) {
+	body := "foo"
+	res1, filedata := upload(t, "/files/?Type=file&Name=headme.txt", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	fileID := filedata["data"].(map[string]interface{})["id"].(string)
+
+	for _, path := range []string{"/files/download/" + fileID, "/files/download?Path=/headme.txt"} {
+		req, _ := http.NewRequest("HEAD", ts.URL+path, nil)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		res2, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res2.StatusCode)
+		assert.Equal(t, "3", res2.Header.Get("Content-Length"))
+		assert.Equal(t, "bytes", res2.Header.Get("Accept-Ranges"))
+		assert.Equal(t, `"rL0Y20zC+Fzt72VPzMSk2A=="`, res2.Header.Get("Etag"))
+		assert.True(t, strings.HasPrefix(res2.Header.Get("Content-Type"), "text/plain"))
+		resbody, err := ioutil.ReadAll(res2.Body)
+		assert.NoError(t, err)
+		assert.Len(t, resbody, 0)
+		res2.Body.Close()
+	}
+}
+
+func TestHeadFileDownloadNotModified(t *testing.T) {
+	body := "foo"
+	res1, filedata := upload(t, "/files/?Type=file&Name=headnotmodified.txt", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	fileID := filedata["data"].(map[string]interface{})["id"].(string)
+
+	head := func(name, value string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("HEAD", ts.URL+"/files/download/"+fileID, nil)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		req.Header.Add(name, value)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		resbody, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		return res, resbody
+	}
+
+	res2, resbody := head("If-None-Match", `"rL0Y20zC+Fzt72VPzMSk2A=="`)
+	assert.Equal(t, 304, res2.StatusCode)
+	assert.Equal(t, `"rL0Y20zC+Fzt72VPzMSk2A=="`, res2.Header.Get("Etag"))
+	assert.NotEmpty(t, res2.Header.Get("Last-Modified"))
+	assert.Empty(t, res2.Header.Get("Content-Type"))
+	assert.Empty(t, res2.Header.Get("Content-Length"))
+	assert.Len(t, resbody, 0)
+
+	res3, _ := head("If-None-Match", `"foo", W/"rL0Y20zC+Fzt72VPzMSk2A=="`)
+	assert.Equal(t, 304, res3.StatusCode)
+
+	res4, resbody := head("If-None-Match", `"bar"`)
+	assert.Equal(t, 200, res4.StatusCode)
+	assert.Equal(t, "3", res4.Header.Get("Content-Length"))
+	assert.Len(t, resbody, 0)
+
+	lastModified := res2.Header.Get("Last-Modified")
+	res5, resbody := head("If-Modified-Since", lastModified)
+	assert.Equal(t, 304, res5.StatusCode)
+	assert.Len(t, resbody, 0)
+
+	res6, _ := head("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+	assert.Equal(t, 200, res6.StatusCode)
+}
+
+func TestDownloadFileWithNonASCIIName(t *testing.T) {
+	body := "foo"
+	for _, name := range []string{"Привет.txt", "🐧.txt"} {
+		res1, filedata := upload(t, "/files/?Type=file&Name="+url.QueryEscape(name), "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+		if !assert.Equal(t, 201, res1.StatusCode) {
+			continue
+		}
+		data := filedata["data"].(map[string]interface{})
+		fileID := data["id"].(string)
+		encoded := strings.Replace(url.QueryEscape(name), "+", "%20", -1)
+
+		res2, resbody := download(t, "/files/download/"+fileID, "")
+		assert.Equal(t, 200, res2.StatusCode)
+		disposition := res2.Header.Get("Content-Disposition")
+		assert.True(t, strings.HasPrefix(disposition, "inline"))
+		assert.Contains(t, disposition, `filename="`)
+		assert.Contains(t, disposition, "filename*=UTF-8''"+encoded)
+		assert.Equal(t, body, string(resbody))
+
+		res3, _ := download(t, "/files/download?Dl=1&Path="+url.QueryEscape("/"+name), "")
+		assert.Equal(t, 200, res3.StatusCode)
+		disposition = res3.Header.Get("Content-Disposition")
+		assert.True(t, strings.HasPrefix(disposition, "attachment"))
+		assert.Contains(t, disposition, "filename*=UTF-8''"+encoded)
+	}
+}
+
+func TestDownloadRangeSuccess(t *testing.T) {
+	body := "foo,bar"
+	res1, _ := upload(t, "/files/?Type=file&Name=downloadmebyrange", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	assert.Equal(t, 201, res1.StatusCode)
+
+	res2, _ := download(t, "/files/download?Path="+url.QueryEscape("/downloadmebyrange"), "nimp")
+	assert.Equal(t, 416, res2.StatusCode)
+
+	res3, res3body := download(t, "/files/download?Path="+url.QueryEscape("/downloadmebyrange"), "bytes=0-2")
+	assert.Equal(t, 206, res3.StatusCode)
+	assert.Equal(t, "foo", string(res3body))
+
+	res4, res4body := download(t, "/files/download?Path="+url.QueryEscape("/downloadmebyrange"), "bytes=4-")
+	assert.Equal(t, 206, res4.StatusCode)
+	assert.Equal(t, "bar", string(res4body))
+}
+
+func TestGetFileMetadataFromPath(t *testing.T) {
+	res1, _ := httpGet(ts.URL + "/files/metadata?Path=/noooooop")
+	assert.Equal(t, 404, res1.StatusCode)
+
+	body := "foo,bar"
+	res2, _ := upload(t, "/files/?Type=file&Name=getmetadata", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	assert.Equal(t, 201, res2.StatusCode)
+
+	res3, _ := httpGet(ts.URL + "/files/metadata?Path=/getmetadata")
+	assert.Equal(t, 200, res3.StatusCode)
+}
+
+func TestGetDirMetadataFromPath(t *testing.T) {
+	res1, _ := createDir(t, "/files/?Name=getdirmeta&Type=directory")
+	assert.Equal(t, 201, res1.StatusCode)
+
+	res2, _ := httpGet(ts.URL + "/files/metadata?Path=/getdirmeta")
+	assert.Equal(t, 200, res2.StatusCode)
+}
+
+func TestGetMetadataFromPathWithRoot(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=pathroot&Type=directory")
+	assert.Equal(t, 201, res1.StatusCode)
+	rootID, _ := extractDirData(t, data1)
+	res2, _ := upload(t, "/files/"+rootID+"?Type=file&Name=inroot", "text/plain", "foo", "")
+	assert.Equal(t, 201, res2.StatusCode)
+	res3, _ := upload(t, "/files/?Type=file&Name=outroot", "text/plain", "foo", "")
+	assert.Equal(t, 201, res3.StatusCode)
+
+	res4, _ := httpGet(ts.URL + "/files/metadata?Root=" + rootID + "&Path=/inroot")
+	assert.Equal(t, 200, res4.StatusCode)
+	res5, _ := httpGet(ts.URL + "/files/metadata?Root=" + rootID + "&Path=/outroot")
+	assert.Equal(t, 404, res5.StatusCode)
+	res6, _ := httpGet(ts.URL + "/files/metadata?Root=" + rootID + "&Path=/")
+	assert.Equal(t, 200, res6.StatusCode)
+	res7, _ := httpGet(ts.URL + "/files/metadata?Root=not-a-dir&Path=/inroot")
+	assert.Equal(t, 404, res7.StatusCode)
+}
+
+func TestPathTraversalFromPath(t *testing.T) {
+	res1, _ := createDir(t, "/files/?Name=traversal&Type=directory")
+	assert.Equal(t, 201, res1.StatusCode)
+	res2, _ := upload(t, "/files/?Type=file&Name=traversed", "text/plain", "foo", "")
+	assert.Equal(t, 201, res2.StatusCode)
+
+	for _, p := range []string{"/a/../../etc", "/traversal/../traversed", "/traversal/..", "traversed"} {
+		res3, _ := httpGet(ts.URL + "/files/metadata?Path=" + url.QueryEscape(p))
+		assert.Equal(t, 400, res3.StatusCode, p)
+		res4, _ := download(t, "/files/download?Path="+url.QueryEscape(p), "")
+		assert.Equal(t, 400, res4.StatusCode, p)
+		attrs := map[string]interface{}{"tags": []string{"bar"}}
+		res5, _ := patchFile(t, "/files/metadata?Path="+url.QueryEscape(p), "file", "", attrs, nil)
+		assert.Equal(t, 400, res5.StatusCode, p)
+	}
+
+	res6, _ := httpGet(ts.URL + "/files/metadata?Path=" + url.QueryEscape("/traversal/./"))
+	assert.Equal(t, 200, res6.StatusCode)
+}
+
+func TestGetFileMetadataFromID(t *testing.T) {
+	res1, _ := httpGet(ts.URL + "/files/qsdqsd")
 	assert.Equal(t, 404, res1.StatusCode)
 
 	body := "foo,bar"
-	res2, data2 := upload(t, "/files/?Type=file&Name=getmetadatafromid", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
-	assert.Equal(t, 201, res2.StatusCode)
+	res2, data2 := upload(t, "/files/?Type=file&Name=getmetadatafromid", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	assert.Equal(t, 201, res2.StatusCode)
+
+	fileID, _ := extractDirData(t, data2)
+
+	res3, _ := httpGet(ts.URL + "/files/" + fileID)
+	assert.Equal(t, 200, res3.StatusCode)
+}
+
+func TestGetDirMetadataFromID(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=getdirmetafromid&Type=directory")
+	assert.Equal(t, 201, res1.StatusCode)
+
+	parentID, _ := extractDirData(t, data1)
+
+	body := "foo"
+	res2, data2 := upload(t, "/files/"+parentID+"?Type=file&Name=firstfile", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res2.StatusCode)
+
+	fileID, _ := extractDirData(t, data2)
+
+	res3, _ := httpGet(ts.URL + "/files/" + fileID)
+	assert.Equal(t, 200, res3.StatusCode)
+}
+
+func TestGetDirMetadataWithDateFilters(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=datefilters&Type=directory")
+	assert.Equal(t, 201, res1.StatusCode)
+	dirID, _ := extractDirData(t, data1)
+
+	for _, name := range []string{"first", "second"} {
+		res, _ := upload(t, "/files/"+dirID+"?Type=file&Name="+name, "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+		assert.Equal(t, 201, res.StatusCode)
+	}
+
+	past := url.QueryEscape("2000-01-01T00:00:00Z")
+	future := url.QueryEscape("2100-01-01T00:00:00Z")
+	zoned := url.QueryEscape("2100-01-01T02:00:00.5+02:00")
+	queries := map[string]int{
+		"updated_since=" + past:                              2,
+		"updated_since=" + zoned:                             0,
+		"created_since=" + past:                              2,
+		"updated_since=" + future:                            0,
+		"updated_since=" + past + "&created_since=" + future: 0,
+		"updated_since=" + past + "&trashed=only":            0,
+	}
+	for query, expected := range queries {
+		res, err := httpGet(ts.URL + "/files/" + dirID + "/relationships/contents?" + query)
+		if !assert.NoError(t, err) || !assert.Equal(t, 200, res.StatusCode) {
+			continue
+		}
+		var obj map[string]interface{}
+		assert.NoError(t, extractJSONRes(res, &obj))
+		assert.Len(t, obj["data"].([]interface{}), expected, query)
+	}
+
+	res2, err := httpGet(ts.URL + "/files/" + dirID + "?updated_since=yesterday")
+	assert.NoError(t, err)
+	assert.Equal(t, 422, res2.StatusCode)
+
+	// The trash is hidden from the filtered listing of the root
+	res3, err := httpGet(ts.URL + "/files/" + consts.RootDirID + "/relationships/contents?updated_since=" + past + "&page[limit]=100")
+	if assert.NoError(t, err) && assert.Equal(t, 200, res3.StatusCode) {
+		var obj map[string]interface{}
+		assert.NoError(t, extractJSONRes(res3, &obj))
+		for _, item := range obj["data"].([]interface{}) {
+			assert.NotEqual(t, consts.TrashDirID, item.(map[string]interface{})["id"])
+		}
+	}
+}
+
+func TestGetMetadataWithSparseFields(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=sparsefields&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	res2, data2 := upload(t, "/files/"+dirID+"?Type=file&Name=sparse", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data2)
+
+	fields := url.QueryEscape("fields[io.cozy.files]") + "=name,size,unknown"
+	res3, err := httpGet(ts.URL + "/files/" + fileID + "?" + fields)
+	if assert.NoError(t, err) && assert.Equal(t, 200, res3.StatusCode) {
+		var obj map[string]interface{}
+		assert.NoError(t, extractJSONRes(res3, &obj))
+		data := obj["data"].(map[string]interface{})
+		assert.Equal(t, fileID, data["id"])
+		attrs := data["attributes"].(map[string]interface{})
+		assert.Equal(t, map[string]interface{}{"name": "sparse", "size": "3"}, attrs)
+	}
+
+	res4, err := httpGet(ts.URL + "/files/" + dirID + "?" + fields)
+	if assert.NoError(t, err) && assert.Equal(t, 200, res4.StatusCode) {
+		var obj map[string]interface{}
+		assert.NoError(t, extractJSONRes(res4, &obj))
+		attrs := obj["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+		assert.Equal(t, map[string]interface{}{"name": "sparsefields"}, attrs)
+		included := obj["included"].([]interface{})
+		if assert.Len(t, included, 1) {
+			attrs = included[0].(map[string]interface{})["attributes"].(map[string]interface{})
+			assert.Equal(t, map[string]interface{}{"name": "sparse", "size": "3"}, attrs)
+		}
+	}
+
+	res5, err := httpGet(ts.URL + "/files/" + dirID + "/relationships/contents?" + fields)
+	if assert.NoError(t, err) && assert.Equal(t, 200, res5.StatusCode) {
+		var obj map[string]interface{}
+		assert.NoError(t, extractJSONRes(res5, &obj))
+		list := obj["data"].([]interface{})
+		if assert.Len(t, list, 1) {
+			attrs := list[0].(map[string]interface{})["attributes"].(map[string]interface{})
+			assert.Equal(t, map[string]interface{}{"name": "sparse", "size": "3"}, attrs)
+		}
+	}
+}
+
+func TestGetMetadataWithInclude(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=includeparent&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	res2, data2 := upload(t, "/files/"+dirID+"?Type=file&Name=included", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data2)
+
+	res3, err := httpGet(ts.URL + "/files/" + fileID + "?include=parent")
+	if assert.NoError(t, err) && assert.Equal(t, 200, res3.StatusCode) {
+		var obj map[string]interface{}
+		assert.NoError(t, extractJSONRes(res3, &obj))
+		included := obj["included"].([]interface{})
+		if assert.Len(t, included, 1) {
+			parent := included[0].(map[string]interface{})
+			assert.Equal(t, dirID, parent["id"])
+			attrs := parent["attributes"].(map[string]interface{})
+			assert.Equal(t, "includeparent", attrs["name"])
+		}
+	}
+
+	res4, err := httpGet(ts.URL + "/files/" + dirID + "?include=parent")
+	if assert.NoError(t, err) && assert.Equal(t, 200, res4.StatusCode) {
+		var obj map[string]interface{}
+		assert.NoError(t, extractJSONRes(res4, &obj))
+		included := obj["included"].([]interface{})
+		if assert.Len(t, included, 1) {
+			assert.Equal(t, consts.RootDirID, included[0].(map[string]interface{})["id"])
+		}
+		rels := obj["data"].(map[string]interface{})["relationships"].(map[string]interface{})
+		contents := rels["contents"].(map[string]interface{})["data"].([]interface{})
+		assert.Len(t, contents, 1)
+	}
+
+	res5, err := httpGet(ts.URL + "/files/" + dirID + "?include=parent,contents")
+	if assert.NoError(t, err) && assert.Equal(t, 200, res5.StatusCode) {
+		var obj map[string]interface{}
+		assert.NoError(t, extractJSONRes(res5, &obj))
+		included := obj["included"].([]interface{})
+		assert.Len(t, included, 2)
+	}
+
+	res6, err := httpGet(ts.URL + "/files/" + fileID + "?include=referenced_by")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 400, res6.StatusCode)
+		res6.Body.Close()
+	}
+}
+
+func TestBulkMkdir(t *testing.T) {
+	bulk := func(body string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest("POST", ts.URL+"/files/_bulk_mkdir", strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		return doUploadOrMod(t, req, "application/json", "")
+	}
+	body := `{"directories": [
+		{"path": "/bulkmkdir/app/photos", "tags": ["bulk"]},
+		{"path": "/bulkmkdir/app/docs"},
+		{"path": "/bulkmkdir/app/photos/"}
+	]}`
+
+	res1, data1 := bulk(body)
+	if !assert.Equal(t, 200, res1.StatusCode) {
+		return
+	}
+	list := data1["data"].([]interface{})
+	if !assert.Len(t, list, 3) {
+		return
+	}
+	ids := make([]string, len(list))
+	for i, item := range list {
+		ids[i] = item.(map[string]interface{})["id"].(string)
+	}
+	assert.NotEqual(t, ids[0], ids[1])
+	assert.Equal(t, ids[0], ids[2])
+	attrs := list[0].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, "/bulkmkdir/app/photos", attrs["path"])
+	assert.Equal(t, []interface{}{"bulk"}, attrs["tags"])
+
+	// The parents are shared
+	parent, err := testInstance.VFS().DirByPath("/bulkmkdir/app")
+	if assert.NoError(t, err) {
+		assert.Equal(t, parent.ID(), attrs["dir_id"])
+		attrs = list[1].(map[string]interface{})["attributes"].(map[string]interface{})
+		assert.Equal(t, parent.ID(), attrs["dir_id"])
+	}
+
+	// The request is idempotent
+	res2, data2 := bulk(body)
+	if assert.Equal(t, 200, res2.StatusCode) {
+		list = data2["data"].([]interface{})
+		if assert.Len(t, list, 3) {
+			assert.Equal(t, ids[0], list[0].(map[string]interface{})["id"])
+			assert.Equal(t, ids[1], list[1].(map[string]interface{})["id"])
+		}
+	}
+
+	res3, _ := bulk(`{"directories": [{"path": "/bulkmkdir/ok"}, {"path": "relative/path"}]}`)
+	assert.Equal(t, 400, res3.StatusCode)
+	_, err = testInstance.VFS().DirByPath("/bulkmkdir/ok")
+	assert.True(t, os.IsNotExist(err))
+
+	res4, _ := bulk(`{"directories": []}`)
+	assert.Equal(t, 422, res4.StatusCode)
+}
+
+func TestArchiveNoFiles(t *testing.T) {
+	body := bytes.NewBufferString(`{
+		"data": {
+			"attributes": {}
+		}
+	}`)
+	req, err := http.NewRequest("POST", ts.URL+"/files/archive", body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, err)
+	assert.Equal(t, 400, res.StatusCode)
+	msg, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `"Can't create an archive with no files"`, string(msg))
+}
+
+func TestArchiveDirectDownload(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=archive&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	names := []string{"foo", "bar", "baz"}
+	for _, name := range names {
+		res2, _ := createDir(t, "/files/"+dirID+"?Name="+name+".jpg&Type=file")
+		if !assert.Equal(t, 201, res2.StatusCode) {
+			return
+		}
+	}
+
+	// direct download
+	body := bytes.NewBufferString(`{
+		"data": {
+			"attributes": {
+				"files": [
+					"/archive/foo.jpg",
+					"/archive/bar.jpg",
+					"/archive/baz.jpg"
+				]
+			}
+		}
+	}`)
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/archive", body)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req.Header.Add("Content-Type", "application/zip")
+	req.Header.Add("Accept", "application/zip")
+	assert.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "application/zip", res.Header.Get("Content-Type"))
+	assert.Equal(t, "none", res.Header.Get("Accept-Ranges"))
+	assert.Equal(t, "3", res.Header.Get("X-Archive-Files"))
+
+	// The trailers are available once the body has been read
+	zipped, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, strconv.Itoa(len(zipped)), res.Trailer.Get("X-Archive-Bytes"))
+	assert.Equal(t, "3", res.Trailer.Get("X-Archive-Files-Written"))
+	manifest, err := base64.StdEncoding.DecodeString(res.Trailer.Get("X-Archive-Manifest"))
+	assert.NoError(t, err)
+	var entries []vfs.ArchiveManifestEntry
+	assert.NoError(t, json.Unmarshal(manifest, &entries))
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, "archive/foo.jpg", entries[0].Name)
+		assert.EqualValues(t, 0, entries[0].Size)
+	}
+}
+
+func TestArchiveCreateAndDownload(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=archive2&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	names := []string{"foo", "bar", "baz"}
+	for _, name := range names {
+		res2, _ := createDir(t, "/files/"+dirID+"?Name="+name+".jpg&Type=file")
+		if !assert.Equal(t, 201, res2.StatusCode) {
+			return
+		}
+	}
+
+	body := bytes.NewBufferString(`{
+		"data": {
+			"attributes": {
+				"files": [
+					"/archive/foo.jpg",
+					"/archive/bar.jpg",
+					"/archive/baz.jpg"
+				]
+			}
+		}
+	}`)
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/archive", body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var data map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&data)
+	assert.NoError(t, err)
+
+	downloadURL := ts.URL + data["links"].(map[string]interface{})["related"].(string)
+	res2, err := httpGet(downloadURL)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res2.StatusCode)
+	disposition := res2.Header.Get("Content-Disposition")
+	assert.Equal(t, `attachment; filename=archive.zip`, disposition)
+}
+
+func TestArchiveManifest(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=archivemanifest&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	res2, data2 := upload(t, "/files/"+dirID+"?Type=file&Name=foo.txt", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data2)
+
+	body := bytes.NewBufferString(`{
+		"data": {
+			"attributes": {
+				"name": "backup",
+				"ids": ["` + dirID + `"]
+			}
+		}
+	}`)
+	req, err := http.NewRequest("POST", ts.URL+"/files/archive", body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res.StatusCode)
+	var data map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&data)
+	assert.NoError(t, err)
+	secret := data["data"].(map[string]interface{})["id"].(string)
+
+	res3, err := httpGet(ts.URL + "/files/archive/" + secret + "/manifest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res3.StatusCode)
+	var manifest map[string]interface{}
+	err = json.NewDecoder(res3.Body).Decode(&manifest)
+	assert.NoError(t, err)
+	list := manifest["data"].([]interface{})
+	if assert.Len(t, list, 1) {
+		item := list[0].(map[string]interface{})
+		assert.Equal(t, fileID, item["id"])
+		assert.Equal(t, consts.Files, item["type"])
+		assert.NotEmpty(t, item["meta"].(map[string]interface{})["rev"])
+		attrs := item["attributes"].(map[string]interface{})
+		assert.Equal(t, "backup/archivemanifest/foo.txt", attrs["path"])
+		assert.Equal(t, "foo.txt", attrs["name"])
+		assert.Equal(t, "3", attrs["size"])
+		assert.Equal(t, "rL0Y20zC+Fzt72VPzMSk2A==", attrs["md5sum"])
+	}
+
+	res4, err := httpGet(ts.URL + "/files/archive/wrongsecret/manifest")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 400, res4.StatusCode)
+	}
+}
+
+func TestArchiveResumableDownload(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=archiveresume&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	for _, name := range []string{"one.txt", "two.txt"} {
+		res, _ := upload(t, "/files/"+dirID+"?Type=file&Name="+name, "text/plain", "content of "+name, "")
+		if !assert.Equal(t, 201, res.StatusCode) {
+			return
+		}
+	}
+
+	body := bytes.NewBufferString(`{
+		"data": {
+			"attributes": {
+				"compression": "store",
+				"files": ["/archiveresume"]
+			}
+		}
+	}`)
+	req, err := http.NewRequest("POST", ts.URL+"/files/archive", body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res.StatusCode)
+	var data map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&data)
+	assert.NoError(t, err)
+	downloadURL := ts.URL + data["links"].(map[string]interface{})["related"].(string)
+
+	res2, err := httpGet(downloadURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res2.StatusCode)
+	assert.Equal(t, "bytes", res2.Header.Get("Accept-Ranges"))
+	assert.Equal(t, "2", res2.Header.Get("X-Archive-Files"))
+	etag := res2.Header.Get("Etag")
+	assert.NotEmpty(t, etag)
+	full, err := ioutil.ReadAll(res2.Body)
+	assert.NoError(t, err)
+	res2.Body.Close()
+	assert.Equal(t, strconv.Itoa(len(full)), res2.Header.Get("Content-Length"))
+	zr, err := zip.NewReader(bytes.NewReader(full), int64(len(full)))
+	if assert.NoError(t, err) && assert.Len(t, zr.File, 2) {
+		assert.Equal(t, zip.Store, zr.File[0].Method)
+	}
+
+	// The download is resumed from an offset
+	req3, err := http.NewRequest("GET", downloadURL, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req3.Header.Add("Range", "bytes=40-")
+	req3.Header.Add("If-Range", etag)
+	res3, err := http.DefaultClient.Do(req3)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 206, res3.StatusCode)
+	part, err := ioutil.ReadAll(res3.Body)
+	assert.NoError(t, err)
+	res3.Body.Close()
+	assert.Equal(t, full[40:], part)
+
+	// The whole archive is sent if it has changed
+	res4, _ := upload(t, "/files/"+dirID+"?Type=file&Name=three.txt", "text/plain", "three", "")
+	assert.Equal(t, 201, res4.StatusCode)
+	res5, err := http.DefaultClient.Do(req3)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res5.StatusCode)
+		assert.NotEqual(t, etag, res5.Header.Get("Etag"))
+		res5.Body.Close()
+	}
+}
+
+func TestFileCreateAndDownloadByPath(t *testing.T) {
+	body := "foo,bar"
+	res1, _ := upload(t, "/files/?Type=file&Name=todownload2steps", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	path := "/todownload2steps"
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/downloads?Path="+path, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add("Content-Type", "")
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var data map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&data)
+	assert.NoError(t, err)
+
+	displayURL := ts.URL + data["links"].(map[string]interface{})["related"].(string)
+	res2, err := http.Get(displayURL)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res2.StatusCode)
+	disposition := res2.Header.Get("Content-Disposition")
+	assert.Equal(t, `inline; filename=todownload2steps`, disposition)
+
+	downloadURL := ts.URL + data["links"].(map[string]interface{})["related"].(string) + "?Dl=1"
+	res3, err := http.Get(downloadURL)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res3.StatusCode)
+	disposition = res3.Header.Get("Content-Disposition")
+	assert.Equal(t, `attachment; filename=todownload2steps`, disposition)
+}
+
+func TestFileCreateAndDownloadByID(t *testing.T) {
+	body := "foo,bar"
+	res1, v := upload(t, "/files/?Type=file&Name=todownload2stepsbis", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	id := v["data"].(map[string]interface{})["id"].(string)
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/downloads?Id="+id, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add("Content-Type", "")
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var data map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&data)
+	assert.NoError(t, err)
+
+	displayURL := ts.URL + data["links"].(map[string]interface{})["related"].(string)
+	res2, err := http.Get(displayURL)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res2.StatusCode)
+	disposition := res2.Header.Get("Content-Disposition")
+	assert.Equal(t, `inline; filename=todownload2stepsbis`, disposition)
+}
+
+func TestHeadDirOrFileNotFound(t *testing.T) {
+	req, _ := http.NewRequest("HEAD", ts.URL+"/files/fakeid/?Type=directory", strings.NewReader(""))
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestHeadDirOrFileExists(t *testing.T) {
+	res, _ := createDir(t, "/files/?Name=hellothere&Type=directory")
+	assert.Equal(t, 201, res.StatusCode)
+
+	storage := testInstance.VFS()
+	dir, err := storage.DirByPath("/hellothere")
+	assert.NoError(t, err)
+	id := dir.ID()
+	req, _ := http.NewRequest("HEAD", ts.URL+"/files/"+id+"?Type=directory", strings.NewReader(""))
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+}
+
+func TestArchiveNotFound(t *testing.T) {
+	body := bytes.NewBufferString(`{
+		"data": {
+			"attributes": {
+				"files": [
+					"/archive/foo.jpg",
+					"/no/such/file",
+					"/archive/baz.jpg"
+				]
+			}
+		}
+	}`)
+	req, err := http.NewRequest("POST", ts.URL+"/files/archive", body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestDirTrash(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=totrashdir&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	dirID, _ := extractDirData(t, data1)
+
+	res2, _ := createDir(t, "/files/"+dirID+"?Name=child1&Type=file")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	res3, _ := createDir(t, "/files/"+dirID+"?Name=child2&Type=file")
+	if !assert.Equal(t, 201, res3.StatusCode) {
+		return
+	}
+
+	res4, _ := trash(t, "/files/"+dirID)
+	if !assert.Equal(t, 200, res4.StatusCode) {
+		return
+	}
+
+	res5, err := httpGet(ts.URL + "/files/" + dirID)
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, res5.StatusCode) {
+		return
+	}
+
+	res6, err := httpGet(ts.URL + "/files/download?Path=" + url.QueryEscape(vfs.TrashDirName+"/totrashdir/child1"))
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, res6.StatusCode) {
+		return
+	}
+
+	res7, err := httpGet(ts.URL + "/files/download?Path=" + url.QueryEscape(vfs.TrashDirName+"/totrashdir/child2"))
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, res7.StatusCode) {
+		return
+	}
+
+	res8, _ := trash(t, "/files/"+dirID)
+	if !assert.Equal(t, 400, res8.StatusCode) {
+		return
+	}
+}
+
+func TestDirTrashedFilter(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=trashedfilter&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+
+	res2, _ := upload(t, "/files/"+dirID+"?Type=file&Name=child1", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res2.StatusCode)
+	res3, _ := upload(t, "/files/"+dirID+"?Type=file&Name=child2", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res3.StatusCode)
+
+	res4, _ := trash(t, "/files/"+dirID)
+	if !assert.Equal(t, 200, res4.StatusCode) {
+		return
+	}
+
+	counts := map[string]int{"": 2, "include": 2, "only": 2, "exclude": 0}
+	for filter, expected := range counts {
+		res, err := httpGet(ts.URL + "/files/" + dirID + "?trashed=" + filter)
+		if !assert.NoError(t, err) || !assert.Equal(t, 200, res.StatusCode) {
+			continue
+		}
+		var obj map[string]interface{}
+		assert.NoError(t, extractJSONRes(res, &obj))
+		rels := obj["data"].(map[string]interface{})["relationships"].(map[string]interface{})
+		contents := rels["contents"].(map[string]interface{})["data"].([]interface{})
+		assert.Len(t, contents, expected, "trashed=%s", filter)
+	}
+
+	res5, err := httpGet(ts.URL + "/files/" + dirID + "?trashed=foo")
+	assert.NoError(t, err)
+	assert.Equal(t, 422, res5.StatusCode)
+}
+
+func TestFileTrash(t *testing.T) {
+	body := "foo,bar"
+	res1, data1 := upload(t, "/files/?Type=file&Name=totrashfile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	fileID, _ := extractDirData(t, data1)
+
+	res2, _ := trash(t, "/files/"+fileID)
+	if !assert.Equal(t, 200, res2.StatusCode) {
+		return
+	}
+
+	res3, err := httpGet(ts.URL + "/files/download?Path=" + url.QueryEscape(vfs.TrashDirName+"/totrashfile"))
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, res3.StatusCode) {
+		return
+	}
+
+	res4, _ := trash(t, "/files/"+fileID)
+	if !assert.Equal(t, 400, res4.StatusCode) {
+		return
+	}
+
+	res5, data2 := upload(t, "/files/?Type=file&Name=totrashfile2", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res5.StatusCode) {
+		return
+	}
+
+	fileID, v2 := extractDirData(t, data2)
+	meta2 := v2["meta"].(map[string]interface{})
+	rev2 := meta2["rev"].(string)
+
+	req6, err := http.NewRequest("DELETE", ts.URL+"/files/"+fileID, nil)
+	req6.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	assert.NoError(t, err)
+
+	req6.Header.Add("If-Match", "badrev")
+	res6, err := http.DefaultClient.Do(req6)
+	assert.NoError(t, err)
+	assert.Equal(t, 412, res6.StatusCode)
+
+	res7, err := httpGet(ts.URL + "/files/download?Path=" + url.QueryEscape(vfs.TrashDirName+"/totrashfile"))
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, res7.StatusCode) {
+		return
+	}
+
+	req8, err := http.NewRequest("DELETE", ts.URL+"/files/"+fileID, nil)
+	req8.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	assert.NoError(t, err)
+
+	req8.Header.Add("If-Match", rev2)
+	res8, err := http.DefaultClient.Do(req8)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res8.StatusCode)
+
+	res9, _ := trash(t, "/files/"+fileID)
+	if !assert.Equal(t, 400, res9.StatusCode) {
+		return
+	}
+}
+
+func TestFileRestore(t *testing.T) {
+	body := "foo,bar"
+	res1, data1 := upload(t, "/files/?Type=file&Name=torestorefile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	fileID, _ := extractDirData(t, data1)
+
+	res2, body2 := trash(t, "/files/"+fileID)
+	if !assert.Equal(t, 200, res2.StatusCode) {
+		return
+	}
+	data2 := body2["data"].(map[string]interface{})
+	attrs2 := data2["attributes"].(map[string]interface{})
+	trashed := attrs2["trashed"].(bool)
+	assert.True(t, trashed)
+
+	res3, body3 := restore(t, "/files/trash/"+fileID)
+	if !assert.Equal(t, 200, res3.StatusCode) {
+		return
+	}
+	data3 := body3["data"].(map[string]interface{})
+	attrs3 := data3["attributes"].(map[string]interface{})
+	trashed = attrs3["trashed"].(bool)
+	assert.False(t, trashed)
+
+	res4, err := httpGet(ts.URL + "/files/download?Path=" + url.QueryEscape("/torestorefile"))
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, res4.StatusCode) {
+		return
+	}
+}
+
+func TestTrashedAtAndRestorePath(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=trashedatparent&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	parentID, _ := extractDirData(t, data1)
+	res2, data2 := createDir(t, "/files/"+parentID+"?Name=trashedatdir&Type=directory")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data2)
+	res3, data3 := upload(t, "/files/"+parentID+"?Type=file&Name=trashedatfile", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res3.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data3)
+
+	getAttrs := func(id string) map[string]interface{} {
+		res, err := httpGet(ts.URL + "/files/" + id)
+		assert.NoError(t, err)
+		var body map[string]interface{}
+		assert.NoError(t, extractJSONRes(res, &body))
+		_, attrs := extractAttributes(t, body)
+		return attrs
+	}
+
+	for _, id := range []string{dirID, fileID} {
+		before := time.Now().Add(-time.Second)
+		res, body := trash(t, "/files/"+id)
+		if !assert.Equal(t, 200, res.StatusCode) {
+			return
+		}
+		_, attrs := extractAttributes(t, body)
+		assert.Equal(t, "/trashedatparent", attrs["restore_path"])
+		trashedAt, err := time.Parse(time.RFC3339, attrs["trashed_at"].(string))
+		assert.NoError(t, err)
+		assert.True(t, trashedAt.After(before))
+
+		attrs = getAttrs(id)
+		assert.Equal(t, "/trashedatparent", attrs["restore_path"])
+		assert.NotEmpty(t, attrs["trashed_at"])
+
+		res, body = restore(t, "/files/trash/"+id)
+		if !assert.Equal(t, 200, res.StatusCode) {
+			return
+		}
+		_, attrs = extractAttributes(t, body)
+		assert.NotContains(t, attrs, "restore_path")
+		assert.NotContains(t, attrs, "trashed_at")
+
+		attrs = getAttrs(id)
+		assert.NotContains(t, attrs, "restore_path")
+		assert.NotContains(t, attrs, "trashed_at")
+	}
+}
+
+func TestTrashReason(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=trashreasondir&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	res2, data2 := upload(t, "/files/?Type=file&Name=trashreasonfile", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data2)
+
+	res3, _ := trash(t, "/files/"+fileID+"?reason="+strings.Repeat("x", vfs.MaxTrashReasonLength+1))
+	assert.Equal(t, 400, res3.StatusCode)
+
+	for _, id := range []string{dirID, fileID} {
+		res, body := trash(t, "/files/"+id+"?reason=Old+draft")
+		if !assert.Equal(t, 200, res.StatusCode) {
+			return
+		}
+		_, attrs := extractAttributes(t, body)
+		assert.Equal(t, "Old draft", attrs["trash_reason"])
+
+		res, err := httpGet(ts.URL + "/files/" + id)
+		assert.NoError(t, err)
+		assert.NoError(t, extractJSONRes(res, &body))
+		_, attrs = extractAttributes(t, body)
+		assert.Equal(t, "Old draft", attrs["trash_reason"])
+
+		res, body = restore(t, "/files/trash/"+id)
+		if !assert.Equal(t, 200, res.StatusCode) {
+			return
+		}
+		_, attrs = extractAttributes(t, body)
+		assert.NotContains(t, attrs, "trash_reason")
+	}
+}
+
+func TestRestoreOrphanToFallbackDir(t *testing.T) {
+	config.GetConfig().Fs.RestoreFallbackDir = "/Restored"
+	defer func() { config.GetConfig().Fs.RestoreFallbackDir = "" }()
+
+	res1, data1 := createDir(t, "/files/?Name=orphanparent&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	res2, data2 := upload(t, "/files/"+dirID+"?Type=file&Name=orphan.txt", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data2)
+
+	// The file is trashed, and then its parent is permanently deleted
+	res3, _ := trash(t, "/files/"+fileID)
+	assert.Equal(t, 200, res3.StatusCode)
+	res4, _ := trash(t, "/files/"+dirID)
+	assert.Equal(t, 200, res4.StatusCode)
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+"/files/trash/"+dirID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res5, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 204, res5.StatusCode)
+		res5.Body.Close()
+	}
+
+	res6, data6 := restore(t, "/files/trash/"+fileID)
+	if !assert.Equal(t, 200, res6.StatusCode) {
+		return
+	}
+	restored, err := testInstance.VFS().DirByPath("/Restored")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, restored.ID(), res6.Header.Get("Cozy-Files-Restored-To"))
+	_, attrs := extractAttributes(t, data6)
+	assert.Equal(t, restored.ID(), attrs["dir_id"])
+	_, err = testInstance.VFS().FileByPath("/Restored/orphan.txt")
+	assert.NoError(t, err)
+	exists, err := vfs.DirExists(testInstance.VFS(), "/orphanparent")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestFileRestoreWithConflicts(t *testing.T) {
+	body := "foo,bar"
+	res1, data1 := upload(t, "/files/?Type=file&Name=torestorefilewithconflict", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	fileID, _ := extractDirData(t, data1)
+
+	res2, _ := trash(t, "/files/"+fileID)
+	if !assert.Equal(t, 200, res2.StatusCode) {
+		return
+	}
+
+	res1, _ = upload(t, "/files/?Type=file&Name=torestorefilewithconflict", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	res3, data3 := restore(t, "/files/trash/"+fileID)
+	if !assert.Equal(t, 200, res3.StatusCode) {
+		return
+	}
+
+	restoredID, restoredData := extractDirData(t, data3)
+	if !assert.Equal(t, fileID, restoredID) {
+		return
+	}
+	restoredData = restoredData["attributes"].(map[string]interface{})
+	assert.True(t, strings.HasPrefix(restoredData["name"].(string), "torestorefilewithconflict"))
+	assert.NotEqual(t, "torestorefilewithconflict", restoredData["name"].(string))
+}
+
+func TestFileRestoreWithWithoutParent(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Type=directory&Name=torestorein")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	dirID, _ := extractDirData(t, data1)
+
+	body := "foo,bar"
+	res1, data1 = upload(t, "/files/"+dirID+"?Type=file&Name=torestorefilewithconflict", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	fileID, _ := extractDirData(t, data1)
+
+	res2, _ := trash(t, "/files/"+fileID)
+	if !assert.Equal(t, 200, res2.StatusCode) {
+		return
+	}
+
+	res2, _ = trash(t, "/files/"+dirID)
+	if !assert.Equal(t, 200, res2.StatusCode) {
+		return
+	}
+
+	res3, data3 := restore(t, "/files/trash/"+fileID)
+	if !assert.Equal(t, 200, res3.StatusCode) {
+		return
+	}
+
+	restoredID, restoredData := extractDirData(t, data3)
+	if !assert.Equal(t, fileID, restoredID) {
+		return
+	}
+	restoredData = restoredData["attributes"].(map[string]interface{})
+	assert.Equal(t, "torestorefilewithconflict", restoredData["name"].(string))
+	assert.NotEqual(t, consts.RootDirID, restoredData["dir_id"].(string))
+}
+
+func TestFileRestoreWithWithoutParent2(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Type=directory&Name=torestorein2")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	dirID, _ := extractDirData(t, data1)
+
+	body := "foo,bar"
+	res1, data1 = upload(t, "/files/"+dirID+"?Type=file&Name=torestorefilewithconflict2", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	fileID, _ := extractDirData(t, data1)
+
+	res2, _ := trash(t, "/files/"+dirID)
+	if !assert.Equal(t, 200, res2.StatusCode) {
+		return
+	}
+
+	res3, data3 := restore(t, "/files/trash/"+fileID)
+	if !assert.Equal(t, 200, res3.StatusCode) {
+		return
+	}
+
+	restoredID, restoredData := extractDirData(t, data3)
+	if !assert.Equal(t, fileID, restoredID) {
+		return
+	}
+	restoredData = restoredData["attributes"].(map[string]interface{})
+	assert.Equal(t, "torestorefilewithconflict2", restoredData["name"].(string))
+	assert.NotEqual(t, consts.RootDirID, restoredData["dir_id"].(string))
+}
+
+func TestDirRestore(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Type=directory&Name=torestoredir")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	dirID, _ := extractDirData(t, data1)
+
+	body := "foo,bar"
+	res2, data2 := upload(t, "/files/"+dirID+"?Type=file&Name=totrashfile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
 
 	fileID, _ := extractDirData(t, data2)
 
-	res3, _ := httpGet(ts.URL + "/files/" + fileID)
-	assert.Equal(t, 200, res3.StatusCode)
+	res3, _ := trash(t, "/files/"+dirID)
+	if !assert.Equal(t, 200, res3.StatusCode) {
+		return
+	}
+
+	res4, err := httpGet(ts.URL + "/files/" + fileID)
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, res4.StatusCode) {
+		return
+	}
+
+	var v map[string]interface{}
+	err = extractJSONRes(res4, &v)
+	assert.NoError(t, err)
+	data := v["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	trashed := attrs["trashed"].(bool)
+	assert.True(t, trashed)
+
+	res5, _ := restore(t, "/files/trash/"+dirID)
+	if !assert.Equal(t, 200, res5.StatusCode) {
+		return
+	}
+
+	res6, err := httpGet(ts.URL + "/files/" + fileID)
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, res6.StatusCode) {
+		return
+	}
+
+	err = extractJSONRes(res6, &v)
+	assert.NoError(t, err)
+	data = v["data"].(map[string]interface{})
+	attrs = data["attributes"].(map[string]interface{})
+	trashed = attrs["trashed"].(bool)
+	assert.False(t, trashed)
 }
 
-func TestGetDirMetadataFromID(t *testing.T) {
-	res1, data1 := createDir(t, "/files/?Name=getdirmetafromid&Type=directory")
-	assert.Equal(t, 201, res1.StatusCode)
+func TestDirRestoreWithConflicts(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Type=directory&Name=torestoredirwithconflict")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
 
-	parentID, _ := extractDirData(t, data1)
+	dirID, _ := extractDirData(t, data1)
 
-	body := "foo"
-	res2, data2 := upload(t, "/files/"+parentID+"?Type=file&Name=firstfile", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
-	assert.Equal(t, 201, res2.StatusCode)
+	res2, _ := trash(t, "/files/"+dirID)
+	if !assert.Equal(t, 200, res2.StatusCode) {
+		return
+	}
+
+	res1, _ = createDir(t, "/files/?Type=directory&Name=torestoredirwithconflict")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	res3, data3 := restore(t, "/files/trash/"+dirID)
+	if !assert.Equal(t, 200, res3.StatusCode) {
+		return
+	}
+
+	restoredID, restoredData := extractDirData(t, data3)
+	if !assert.Equal(t, dirID, restoredID) {
+		return
+	}
+	restoredData = restoredData["attributes"].(map[string]interface{})
+	assert.True(t, strings.HasPrefix(restoredData["name"].(string), "torestoredirwithconflict"))
+	assert.NotEqual(t, "torestoredirwithconflict", restoredData["name"].(string))
+}
 
+func TestTrashList(t *testing.T) {
+	body := "foo,bar"
+	res1, data1 := upload(t, "/files/?Type=file&Name=tolistfile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+
+	res2, data2 := createDir(t, "/files/?Name=tolistdir&Type=directory")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+
+	dirID, _ := extractDirData(t, data1)
 	fileID, _ := extractDirData(t, data2)
 
-	res3, _ := httpGet(ts.URL + "/files/" + fileID)
-	assert.Equal(t, 200, res3.StatusCode)
+	res3, _ := trash(t, "/files/"+dirID)
+	if !assert.Equal(t, 200, res3.StatusCode) {
+		return
+	}
+
+	res4, _ := trash(t, "/files/"+fileID)
+	if !assert.Equal(t, 200, res4.StatusCode) {
+		return
+	}
+
+	res5, err := httpGet(ts.URL + "/files/trash")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res5.Body.Close()
+
+	var v struct {
+		Data []interface{} `json:"data"`
+	}
+
+	err = json.NewDecoder(res5.Body).Decode(&v)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.True(t, len(v.Data) >= 2, "response should contains at least 2 items")
 }
 
-func TestArchiveNoFiles(t *testing.T) {
-	body := bytes.NewBufferString(`{
-		"data": {
-			"attributes": {}
+func TestTrashSummary(t *testing.T) {
+	getSummary := func() (int, int, int64, bool) {
+		res, err := httpGet(ts.URL + "/files/trash?summary=true")
+		if !assert.NoError(t, err) {
+			return 0, 0, 0, false
 		}
-	}`)
-	req, err := http.NewRequest("POST", ts.URL+"/files/archive", body)
-	if !assert.NoError(t, err) {
+		defer res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		var v struct {
+			Data struct {
+				ID    string `json:"id"`
+				Attrs struct {
+					Files  int    `json:"files"`
+					Dirs   int    `json:"directories"`
+					Size   string `json:"size"`
+					Oldest string `json:"oldest"`
+				} `json:"attributes"`
+			} `json:"data"`
+		}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&v))
+		assert.Equal(t, "io.cozy.files.trash_summary", v.Data.ID)
+		size, _ := strconv.ParseInt(v.Data.Attrs.Size, 10, 64)
+		return v.Data.Attrs.Files, v.Data.Attrs.Dirs, size, v.Data.Attrs.Oldest != ""
+	}
+	files, dirs, size, _ := getSummary()
+
+	res, data := createDir(t, "/files/?Name=summarydir&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-	req.Header.Add("Content-Type", "application/vnd.api+json")
-	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
-	res, err := http.DefaultClient.Do(req)
+	dirID, _ := extractDirData(t, data)
+	res, data = createDir(t, "/files/"+dirID+"?Name=subdir&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	subdirID, _ := extractDirData(t, data)
+	res, _ = upload(t, "/files/"+subdirID+"?Type=file&Name=foo", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	res, data = upload(t, "/files/?Type=file&Name=summaryfile", "text/plain", "summary", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data)
+
+	res, _ = trash(t, "/files/"+dirID)
+	assert.Equal(t, 200, res.StatusCode)
+	res, _ = trash(t, "/files/"+fileID)
+	assert.Equal(t, 200, res.StatusCode)
+
+	files2, dirs2, size2, hasOldest := getSummary()
+	assert.Equal(t, files+2, files2)
+	assert.Equal(t, dirs+2, dirs2)
+	assert.Equal(t, size+10, size2)
+	assert.True(t, hasOldest)
+}
+
+func TestTrashEvictOldest(t *testing.T) {
+	fs := testInstance.VFS()
+	trashDir, err := fs.DirByID(consts.TrashDirID)
 	if !assert.NoError(t, err) {
 		return
 	}
+	if !assert.NoError(t, fs.DestroyDirContent(trashDir)) {
+		return
+	}
+	defer func() {
+		config.GetConfig().Fs.TrashMaxCount = 0
+		config.GetConfig().Fs.TrashMaxSize = 0
+	}()
 
-	assert.NoError(t, err)
-	assert.Equal(t, 400, res.StatusCode)
-	msg, err := ioutil.ReadAll(res.Body)
-	assert.NoError(t, err)
-	assert.Equal(t, `"Can't create an archive with no files"`, string(msg))
+	trashNew := func(name, content string) string {
+		res, data := upload(t, "/files/?Type=file&Name="+name, "text/plain", content, "")
+		if !assert.Equal(t, 201, res.StatusCode) {
+			return ""
+		}
+		id, _ := extractDirData(t, data)
+		res, _ = trash(t, "/files/"+id)
+		assert.Equal(t, 200, res.StatusCode)
+		return id
+	}
+	inTrash := func(id string) bool {
+		_, err := fs.FileByID(id)
+		return err == nil
+	}
+
+	// By number of items
+	config.GetConfig().Fs.TrashMaxCount = 2
+	first := trashNew("evict-count-1", "foo")
+	second := trashNew("evict-count-2", "foo")
+	third := trashNew("evict-count-3", "foo")
+	assert.False(t, inTrash(first))
+	assert.True(t, inTrash(second))
+	assert.True(t, inTrash(third))
+	config.GetConfig().Fs.TrashMaxCount = 0
+
+	// By size, the oldest items are evicted first
+	config.GetConfig().Fs.TrashMaxSize = 10
+	fourth := trashNew("evict-size-1", "12345")
+	assert.False(t, inTrash(second))
+	assert.True(t, inTrash(third))
+	assert.True(t, inTrash(fourth))
+
+	// The item that has just been trashed is kept, even if it is too large
+	large := trashNew("evict-size-2", "0123456789abcdef")
+	assert.False(t, inTrash(third))
+	assert.False(t, inTrash(fourth))
+	assert.True(t, inTrash(large))
+	config.GetConfig().Fs.TrashMaxSize = 0
+
+	// The items trashed without a date are evicted first
+	config.GetConfig().Fs.TrashMaxCount = 2
+	legacyID := trashNew("evict-legacy", "foo")
+	legacy, err := fs.FileByID(legacyID)
+	if assert.NoError(t, err) {
+		newdoc := legacy.Clone().(*vfs.FileDoc)
+		newdoc.TrashedAt = nil
+		assert.NoError(t, fs.UpdateFileDoc(legacy, newdoc))
+	}
+	last := trashNew("evict-legacy-2", "foo")
+	assert.False(t, inTrash(legacyID))
+	assert.True(t, inTrash(large))
+	assert.True(t, inTrash(last))
 }
 
-func TestArchiveDirectDownload(t *testing.T) {
-	res1, data1 := createDir(t, "/files/?Name=archive&Type=directory")
-	if !assert.Equal(t, 201, res1.StatusCode) {
+func TestTrashListManyItems(t *testing.T) {
+	fs := testInstance.VFS()
+	res, data := createDir(t, "/files/?Name=trash-many&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-	dirID, _ := extractDirData(t, data1)
-	names := []string{"foo", "bar", "baz"}
-	for _, name := range names {
-		res2, _ := createDir(t, "/files/"+dirID+"?Name="+name+".jpg&Type=file")
-		if !assert.Equal(t, 201, res2.StatusCode) {
+	dirID, _ := extractDirData(t, data)
+
+	// The files are trashed from the VFS, as it is a lot faster than doing
+	// it via HTTP requests
+	var all, images, texts []string
+	for i := 0; i < 300; i++ {
+		class, mime := "text", "text/plain"
+		if i%3 == 0 {
+			class, mime = "image", "image/png"
+		}
+		name := fmt.Sprintf("trash-many-%03d", i)
+		doc, err := vfs.NewFileDoc(name, dirID, 0, nil, mime, class, time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		f, err := fs.CreateFile(doc, nil)
+		if !assert.NoError(t, err) || !assert.NoError(t, f.Close()) {
+			return
+		}
+		doc, err = fs.FileByID(doc.ID())
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = vfs.TrashFile(fs, doc)
+		if !assert.NoError(t, err) {
 			return
 		}
+		all = append(all, doc.ID())
+		if class == "image" {
+			images = append(images, doc.ID())
+		} else {
+			texts = append(texts, doc.ID())
+		}
 	}
 
-	// direct download
-	body := bytes.NewBufferString(`{
-		"data": {
-			"attributes": {
-				"files": [
-					"/archive/foo.jpg",
-					"/archive/bar.jpg",
-					"/archive/baz.jpg"
-				]
+	type item struct {
+		ID    string                 `json:"id"`
+		Attrs map[string]interface{} `json:"attributes"`
+	}
+	listTrash := func(query string) ([]item, int) {
+		var items []item
+		pages := 0
+		next := "/files/trash" + query
+		for next != "" {
+			res, err := httpGet(ts.URL + next)
+			if !assert.NoError(t, err) {
+				return nil, 0
+			}
+			var v struct {
+				Data  []item `json:"data"`
+				Links struct {
+					Next string `json:"next"`
+				} `json:"links"`
 			}
+			err = json.NewDecoder(res.Body).Decode(&v)
+			if !assert.NoError(t, err) || !assert.Equal(t, 200, res.StatusCode) {
+				return nil, 0
+			}
+			items = append(items, v.Data...)
+			next = v.Links.Next
+			pages++
+		}
+		return items, pages
+	}
+	ours := func(items []item, ids []string) []string {
+		var filtered []string
+		for _, it := range items {
+			for _, id := range ids {
+				if it.ID == id {
+					filtered = append(filtered, id)
+					break
+				}
+			}
+		}
+		return filtered
+	}
+	reversed := func(ids []string) []string {
+		rev := make([]string, len(ids))
+		for i, id := range ids {
+			rev[len(ids)-1-i] = id
 		}
-	}`)
+		return rev
+	}
 
-	req, err := http.NewRequest("POST", ts.URL+"/files/archive", body)
-	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
-	req.Header.Add("Content-Type", "application/zip")
-	req.Header.Add("Accept", "application/zip")
+	items, pages := listTrash("?page[limit]=50")
+	assert.True(t, pages >= 6)
+	assert.Len(t, ours(items, images), len(images))
+	assert.Len(t, ours(items, texts), len(texts))
+
+	items, pages = listTrash("?class=image&page[limit]=30")
+	assert.True(t, pages >= 4)
+	assert.Len(t, ours(items, texts), 0)
+	assert.Equal(t, images, ours(items, images))
+	for _, it := range items {
+		assert.Equal(t, "image", it.Attrs["class"])
+	}
+
+	items, _ = listTrash("?sort=-trashed_at&page[limit]=40")
+	if assert.NotEmpty(t, items) {
+		assert.Equal(t, all[len(all)-1], items[0].ID)
+	}
+	assert.Equal(t, reversed(all), ours(items, all))
+	for _, it := range items {
+		if len(ours([]item{it}, all)) == 1 {
+			assert.NotEmpty(t, it.Attrs["trashed_at"])
+			assert.Equal(t, "/trash-many", it.Attrs["restore_path"])
+		}
+	}
+
+	items, _ = listTrash("?sort=trashed_at&class=text,image&page[limit]=100")
+	assert.Equal(t, all, ours(items, all))
+
+	res, err := httpGet(ts.URL + "/files/" + dirID + "?sort=trashed_at")
 	assert.NoError(t, err)
-	res, err := http.DefaultClient.Do(req)
+	assert.Equal(t, 422, res.StatusCode)
+	res, err = httpGet(ts.URL + "/files/trash?sort=name")
 	assert.NoError(t, err)
-	assert.Equal(t, 200, res.StatusCode)
-	assert.Equal(t, "application/zip", res.Header.Get("Content-Type"))
+	assert.Equal(t, 422, res.StatusCode)
 
+	// An item trashed before the trashed_at attribute was introduced is
+	// considered as the oldest one
+	legacyID := all[len(all)-1]
+	legacy, err := fs.FileByID(legacyID)
+	if assert.NoError(t, err) {
+		newdoc := legacy.Clone().(*vfs.FileDoc)
+		newdoc.TrashedAt = nil
+		assert.NoError(t, fs.UpdateFileDoc(legacy, newdoc))
+	}
+	sorted := append([]string{legacyID}, all[:len(all)-1]...)
+	items, _ = listTrash("?sort=trashed_at&page[limit]=7")
+	assert.Equal(t, sorted, ours(items, all))
+	items, _ = listTrash("?sort=-trashed_at&page[limit]=7")
+	assert.Equal(t, reversed(sorted), ours(items, all))
 }
 
-func TestArchiveCreateAndDownload(t *testing.T) {
-	res1, data1 := createDir(t, "/files/?Name=archive2&Type=directory")
+func TestMaxPageSize(t *testing.T) {
+	max := config.GetConfig().Pagination.MaxPageSize
+	defer func() { config.GetConfig().Pagination.MaxPageSize = max }()
+	config.GetConfig().Pagination.MaxPageSize = 2
+
+	res1, data1 := createDir(t, "/files/?Name=maxpagesize&Type=directory")
 	if !assert.Equal(t, 201, res1.StatusCode) {
 		return
 	}
 	dirID, _ := extractDirData(t, data1)
-	names := []string{"foo", "bar", "baz"}
-	for _, name := range names {
-		res2, _ := createDir(t, "/files/"+dirID+"?Name="+name+".jpg&Type=file")
-		if !assert.Equal(t, 201, res2.StatusCode) {
-			return
-		}
+	for _, name := range []string{"one", "two", "three"} {
+		res, _ := upload(t, "/files/"+dirID+"?Type=file&Name="+name, "text/plain", "foo", "")
+		assert.Equal(t, 201, res.StatusCode)
 	}
 
-	body := bytes.NewBufferString(`{
-		"data": {
-			"attributes": {
-				"files": [
-					"/archive/foo.jpg",
-					"/archive/bar.jpg",
-					"/archive/baz.jpg"
-				]
-			}
-		}
-	}`)
+	res2, err := httpGet(ts.URL + "/files/" + dirID + "?page[limit]=100")
+	assert.NoError(t, err)
+	var v2 struct {
+		Data struct {
+			Rels struct {
+				Contents struct {
+					Data []interface{} `json:"data"`
+					Meta struct {
+						Count int `json:"count"`
+						Limit int `json:"limit"`
+					} `json:"meta"`
+				} `json:"contents"`
+			} `json:"relationships"`
+		} `json:"data"`
+		Links struct {
+			Next string `json:"next"`
+		} `json:"links"`
+	}
+	assert.Equal(t, 200, res2.StatusCode)
+	assert.NoError(t, json.NewDecoder(res2.Body).Decode(&v2))
+	assert.Len(t, v2.Data.Rels.Contents.Data, 2)
+	assert.Equal(t, 3, v2.Data.Rels.Contents.Meta.Count)
+	assert.Equal(t, 2, v2.Data.Rels.Contents.Meta.Limit)
+	assert.NotEmpty(t, v2.Links.Next)
 
-	req, err := http.NewRequest("POST", ts.URL+"/files/archive", body)
-	if !assert.NoError(t, err) {
+	res3, err := httpGet(ts.URL + "/files/" + dirID + "/relationships/contents?page[limit]=100")
+	assert.NoError(t, err)
+	var v3 struct {
+		Data []interface{} `json:"data"`
+		Meta struct {
+			Count int `json:"count"`
+			Limit int `json:"limit"`
+		} `json:"meta"`
+	}
+	assert.Equal(t, 200, res3.StatusCode)
+	assert.NoError(t, json.NewDecoder(res3.Body).Decode(&v3))
+	assert.Len(t, v3.Data, 2)
+	assert.Equal(t, 3, v3.Meta.Count)
+	assert.Equal(t, 2, v3.Meta.Limit)
+}
+
+func TestPreloadThumbnails(t *testing.T) {
+	res, data := createDir(t, "/files/?Name=preload-thumbnails&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-	req.Header.Add("Content-Type", "application/vnd.api+json")
-	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
-	res, err := http.DefaultClient.Do(req)
-	if !assert.NoError(t, err) {
+	dirID, _ := extractDirData(t, data)
+	res, data = upload(t, "/files/"+dirID+"?Type=file&Name=preload.png", "image/png", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
+	imageID, _ := extractDirData(t, data)
+	res, _ = upload(t, "/files/"+dirID+"?Type=file&Name=preload.txt", "text/plain", "foo", "")
+	assert.Equal(t, 201, res.StatusCode)
 
-	assert.NoError(t, err)
+	list := func() *http.Response {
+		res, err := httpGet(ts.URL + "/files/" + dirID + "/relationships/contents")
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	res = list()
 	assert.Equal(t, 200, res.StatusCode)
-	var data map[string]interface{}
-	err = json.NewDecoder(res.Body).Decode(&data)
-	assert.NoError(t, err)
+	links := res.Header["Link"]
+	if assert.Len(t, links, 1) {
+		assert.True(t, strings.HasPrefix(links[0], "</files/"+imageID+"/thumbnails/"))
+		assert.True(t, strings.HasSuffix(links[0], "/small>; rel=preload; as=image"))
+	}
 
-	downloadURL := ts.URL + data["links"].(map[string]interface{})["related"].(string)
-	res2, err := httpGet(downloadURL)
-	assert.NoError(t, err)
-	assert.Equal(t, 200, res2.StatusCode)
-	disposition := res2.Header.Get("Content-Disposition")
-	assert.Equal(t, `attachment; filename=archive.zip`, disposition)
+	cfg := config.GetConfig()
+	preload := cfg.Fs.PreloadThumbnails
+	defer func() { cfg.Fs.PreloadThumbnails = preload }()
+	cfg.Fs.PreloadThumbnails = 0
+	res = list()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Empty(t, res.Header["Link"])
 }
 
-func TestFileCreateAndDownloadByPath(t *testing.T) {
-	body := "foo,bar"
-	res1, _ := upload(t, "/files/?Type=file&Name=todownload2steps", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+func TestListingETag(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=listingetag&Type=directory")
 	if !assert.Equal(t, 201, res1.StatusCode) {
 		return
 	}
+	dirID, _ := extractDirData(t, data1)
+	res2, _ := upload(t, "/files/"+dirID+"?Type=file&Name=one", "text/plain", "foo", "")
+	assert.Equal(t, 201, res2.StatusCode)
 
-	path := "/todownload2steps"
+	get := func(path, ifNoneMatch string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		assert.NoError(t, err)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		if ifNoneMatch != "" {
+			req.Header.Add("If-None-Match", ifNoneMatch)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+	list := func(query, ifNoneMatch string) *http.Response {
+		return get("/files/"+dirID+"/relationships/contents"+query, ifNoneMatch)
+	}
 
-	req, err := http.NewRequest("POST", ts.URL+"/files/downloads?Path="+path, nil)
-	if !assert.NoError(t, err) {
+	res3 := list("", "")
+	assert.Equal(t, 200, res3.StatusCode)
+	etag := res3.Header.Get("Etag")
+	assert.True(t, strings.HasPrefix(etag, `W/"`))
+
+	res4 := list("", etag)
+	assert.Equal(t, 304, res4.StatusCode)
+	assert.Equal(t, etag, res4.Header.Get("Etag"))
+	res5 := list("", `"foo", `+etag)
+	assert.Equal(t, 304, res5.StatusCode)
+
+	res6 := list("?page[limit]=1", etag)
+	assert.Equal(t, 200, res6.StatusCode)
+	assert.NotEqual(t, etag, res6.Header.Get("Etag"))
+
+	res7, _ := upload(t, "/files/"+dirID+"?Type=file&Name=two", "text/plain", "bar", "")
+	assert.Equal(t, 201, res7.StatusCode)
+	res8 := list("", etag)
+	assert.Equal(t, 200, res8.StatusCode)
+	assert.NotEqual(t, etag, res8.Header.Get("Etag"))
+
+	// The document of the directory, with its children, has its own ETag
+	res9 := get("/files/"+dirID, "")
+	assert.Equal(t, 200, res9.StatusCode)
+	dirETag := res9.Header.Get("Etag")
+	assert.True(t, strings.HasPrefix(dirETag, `W/"`))
+	assert.NotEqual(t, res8.Header.Get("Etag"), dirETag)
+	res10 := get("/files/"+dirID, dirETag)
+	assert.Equal(t, 304, res10.StatusCode)
+	res11, _ := upload(t, "/files/"+dirID+"?Type=file&Name=three", "text/plain", "baz", "")
+	assert.Equal(t, 201, res11.StatusCode)
+	res12 := get("/files/"+dirID, dirETag)
+	assert.Equal(t, 200, res12.StatusCode)
+}
+
+func TestDryRun(t *testing.T) {
+	res, data := createDir(t, "/files/?Name=dry-run&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-	req.Header.Add("Content-Type", "")
-	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
-	res, err := http.DefaultClient.Do(req)
-	if !assert.NoError(t, err) {
+	dirID, _ := extractDirData(t, data)
+	res, data = createDir(t, "/files/"+dirID+"?Name=sub&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	subID, _ := extractDirData(t, data)
+	res, data = upload(t, "/files/"+dirID+"?Type=file&Name=foo", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
+	fooID, _ := extractDirData(t, data)
+	res, data = upload(t, "/files/"+subID+"?Type=file&Name=bar", "text/plain", "barbar", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	barID, _ := extractDirData(t, data)
+	res, data = createDir(t, "/files/?Name=dry-run-dest&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	destID, _ := extractDirData(t, data)
 
-	assert.NoError(t, err)
+	checkPlan := func(data map[string]interface{}, operation string, dirs, files []interface{}, size float64) {
+		assert.Nil(t, data["data"])
+		meta, _ := data["meta"].(map[string]interface{})
+		if !assert.NotNil(t, meta) {
+			return
+		}
+		assert.Equal(t, true, meta["dry_run"])
+		assert.Equal(t, operation, meta["operation"])
+		// The order depends on the walk, only the content is checked
+		assert.Len(t, meta["directories"], len(dirs))
+		for _, id := range dirs {
+			assert.Contains(t, meta["directories"], id)
+		}
+		assert.Len(t, meta["files"], len(files))
+		for _, id := range files {
+			assert.Contains(t, meta["files"], id)
+		}
+		assert.EqualValues(t, len(dirs), meta["directories_count"])
+		assert.EqualValues(t, len(files), meta["files_count"])
+		assert.EqualValues(t, size, meta["size"])
+	}
+	checkUntouched := func(trashed bool) {
+		dir, err := testInstance.VFS().DirByID(dirID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, trashed, strings.HasPrefix(dir.Fullpath, vfs.TrashDirName))
+			assert.Equal(t, consts.RootDirID == dir.DirID, !trashed)
+		}
+		file, err := testInstance.VFS().FileByID(barID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, trashed, file.Trashed)
+			assert.Equal(t, subID, file.DirID)
+		}
+	}
+
+	res, data = trash(t, "/files/"+dirID+"?dry_run=true")
 	assert.Equal(t, 200, res.StatusCode)
-	var data map[string]interface{}
-	err = json.NewDecoder(res.Body).Decode(&data)
-	assert.NoError(t, err)
+	checkPlan(data, "trash", []interface{}{dirID}, []interface{}{fooID, barID}, 9)
+	checkUntouched(false)
 
-	displayURL := ts.URL + data["links"].(map[string]interface{})["related"].(string)
-	res2, err := http.Get(displayURL)
-	assert.NoError(t, err)
-	assert.Equal(t, 200, res2.StatusCode)
-	disposition := res2.Header.Get("Content-Disposition")
-	assert.Equal(t, `inline; filename=todownload2steps`, disposition)
+	res, data = trash(t, "/files/"+fooID+"?dry_run=true")
+	assert.Equal(t, 200, res.StatusCode)
+	checkPlan(data, "trash", []interface{}{}, []interface{}{fooID}, 3)
 
-	downloadURL := ts.URL + data["links"].(map[string]interface{})["related"].(string) + "?Dl=1"
-	res3, err := http.Get(downloadURL)
-	assert.NoError(t, err)
-	assert.Equal(t, 200, res3.StatusCode)
-	disposition = res3.Header.Get("Content-Disposition")
-	assert.Equal(t, `attachment; filename=todownload2steps`, disposition)
+	parent := &jsonData{Type: consts.Files, ID: destID}
+	res, data = patchFile(t, "/files/"+dirID+"?dry_run=true", consts.DirType, dirID, nil, parent)
+	assert.Equal(t, 200, res.StatusCode)
+	checkPlan(data, "move", []interface{}{dirID, subID}, []interface{}{fooID, barID}, 9)
+	checkUntouched(false)
+
+	parent = &jsonData{Type: consts.Files, ID: subID}
+	res, _ = patchFile(t, "/files/"+dirID+"?dry_run=true", consts.DirType, dirID, nil, parent)
+	assert.Equal(t, 412, res.StatusCode)
+	res, _ = patchFile(t, "/files/"+dirID+"?dry_run=true", consts.DirType, dirID, map[string]interface{}{
+		"tags": []string{"foo"},
+	}, nil)
+	assert.Equal(t, 422, res.StatusCode)
+
+	res, _ = trash(t, "/files/"+dirID)
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	res, _ = trash(t, "/files/"+dirID+"?dry_run=true")
+	assert.Equal(t, 400, res.StatusCode)
+
+	res, data = trash(t, "/files/trash/"+dirID+"?dry_run=true")
+	assert.Equal(t, 200, res.StatusCode)
+	checkPlan(data, "destroy", []interface{}{dirID, subID}, []interface{}{fooID, barID}, 9)
+	checkUntouched(true)
+
+	res, data = trash(t, "/files/trash?dry_run=true")
+	assert.Equal(t, 200, res.StatusCode)
+	meta := data["meta"].(map[string]interface{})
+	assert.Equal(t, "destroy", meta["operation"])
+	assert.Contains(t, meta["directories"], dirID)
+	assert.Contains(t, meta["directories"], subID)
+	assert.Contains(t, meta["files"], barID)
+	assert.NotContains(t, meta["directories"], consts.TrashDirID)
+	checkUntouched(true)
 }
 
-func TestFileCreateAndDownloadByID(t *testing.T) {
-	body := "foo,bar"
-	res1, v := upload(t, "/files/?Type=file&Name=todownload2stepsbis", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+func TestTrashDirAsync(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=totrashasync&Type=directory")
 	if !assert.Equal(t, 201, res1.StatusCode) {
 		return
 	}
-	id := v["data"].(map[string]interface{})["id"].(string)
-
-	req, err := http.NewRequest("POST", ts.URL+"/files/downloads?Id="+id, nil)
-	if !assert.NoError(t, err) {
+	dirID, _ := extractDirData(t, data1)
+	res2, _ := upload(t, "/files/"+dirID+"?Type=file&Name=child", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
 		return
 	}
-	req.Header.Add("Content-Type", "")
-	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
-	res, err := http.DefaultClient.Do(req)
-	if !assert.NoError(t, err) {
+
+	res3, data3 := trash(t, "/files/"+dirID+"?async=true")
+	if !assert.Equal(t, 202, res3.StatusCode) {
 		return
 	}
+	data := data3["data"].(map[string]interface{})
+	assert.Equal(t, consts.FilesJobs, data["type"])
+	jobID := data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "trash", attrs["operation"])
 
-	assert.NoError(t, err)
-	assert.Equal(t, 200, res.StatusCode)
-	var data map[string]interface{}
-	err = json.NewDecoder(res.Body).Decode(&data)
-	assert.NoError(t, err)
+	var state string
+	for i := 0; i < 50; i++ {
+		res4, err := httpGet(ts.URL + "/files/_jobs/" + jobID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		var v map[string]interface{}
+		err = extractJSONRes(res4, &v)
+		assert.NoError(t, err)
+		if !assert.Equal(t, 200, res4.StatusCode) {
+			return
+		}
+		attrs = v["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+		state = attrs["state"].(string)
+		if state == "done" || state == "error" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, "done", state)
+	assert.EqualValues(t, 100, attrs["progress"])
+	assert.Equal(t, "/files/"+dirID, attrs["related"])
 
-	displayURL := ts.URL + data["links"].(map[string]interface{})["related"].(string)
-	res2, err := http.Get(displayURL)
+	dir, err := testInstance.VFS().DirByID(dirID)
 	assert.NoError(t, err)
-	assert.Equal(t, 200, res2.StatusCode)
-	disposition := res2.Header.Get("Content-Disposition")
-	assert.Equal(t, `inline; filename=todownload2stepsbis`, disposition)
-}
+	assert.True(t, strings.HasPrefix(dir.Fullpath, vfs.TrashDirName))
 
-func TestHeadDirOrFileNotFound(t *testing.T) {
-	req, _ := http.NewRequest("HEAD", ts.URL+"/files/fakeid/?Type=directory", strings.NewReader(""))
-	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
-	res, err := http.DefaultClient.Do(req)
+	res5, err := httpGet(ts.URL + "/files/_jobs/unknown")
 	assert.NoError(t, err)
-	assert.Equal(t, 404, res.StatusCode)
-}
-
-func TestHeadDirOrFileExists(t *testing.T) {
-	res, _ := createDir(t, "/files/?Name=hellothere&Type=directory")
-	assert.Equal(t, 201, res.StatusCode)
+	assert.Equal(t, 404, res5.StatusCode)
 
-	storage := testInstance.VFS()
-	dir, err := storage.DirByPath("/hellothere")
-	assert.NoError(t, err)
-	id := dir.ID()
-	req, _ := http.NewRequest("HEAD", ts.URL+"/files/"+id+"?Type=directory", strings.NewReader(""))
-	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
-	res, err = http.DefaultClient.Do(req)
-	assert.NoError(t, err)
-	assert.Equal(t, 200, res.StatusCode)
+	// The job can't be read by another client
+	req, _ := http.NewRequest("GET", ts.URL+"/files/_jobs/"+jobID, nil)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+otherToken)
+	res6, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		res6.Body.Close()
+		assert.Equal(t, 404, res6.StatusCode)
+	}
 }
 
-func TestArchiveNotFound(t *testing.T) {
-	body := bytes.NewBufferString(`{
-		"data": {
-			"attributes": {
-				"files": [
-					"/archive/foo.jpg",
-					"/no/such/file",
-					"/archive/baz.jpg"
-				]
-			}
-		}
-	}`)
-	req, err := http.NewRequest("POST", ts.URL+"/files/archive", body)
-	if !assert.NoError(t, err) {
+func TestTrashDirOnlyIfEmpty(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=onlyifempty&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
 		return
 	}
-	req.Header.Add("Content-Type", "application/vnd.api+json")
-	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
-	res, err := http.DefaultClient.Do(req)
-	if !assert.NoError(t, err) {
+	dirID, _ := extractDirData(t, data1)
+	res2, data2 := upload(t, "/files/"+dirID+"?Type=file&Name=child", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
 		return
 	}
-	assert.Equal(t, 404, res.StatusCode)
+	childID, _ := extractDirData(t, data2)
+
+	res3, _ := trash(t, "/files/"+dirID+"?only_if_empty=true")
+	assert.Equal(t, 400, res3.StatusCode)
+	dir, err := testInstance.VFS().DirByID(dirID)
+	assert.NoError(t, err)
+	assert.False(t, strings.HasPrefix(dir.Fullpath, vfs.TrashDirName))
+
+	res4, _ := trash(t, "/files/"+childID)
+	assert.Equal(t, 200, res4.StatusCode)
+
+	res5, _ := trash(t, "/files/"+dirID+"?only_if_empty=true")
+	assert.Equal(t, 200, res5.StatusCode)
+	dir, err = testInstance.VFS().DirByID(dirID)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(dir.Fullpath, vfs.TrashDirName))
 }
 
-func TestDirTrash(t *testing.T) {
-	res1, data1 := createDir(t, "/files/?Name=totrashdir&Type=directory")
+func TestTrashClear(t *testing.T) {
+	body := "foo,bar"
+	res1, data1 := upload(t, "/files/?Type=file&Name=tolistfile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
 	if !assert.Equal(t, 201, res1.StatusCode) {
 		return
 	}
 
-	dirID, _ := extractDirData(t, data1)
-
-	res2, _ := createDir(t, "/files/"+dirID+"?Name=child1&Type=file")
+	res2, data2 := createDir(t, "/files/?Name=tolistdir&Type=directory")
 	if !assert.Equal(t, 201, res2.StatusCode) {
 		return
 	}
-	res3, _ := createDir(t, "/files/"+dirID+"?Name=child2&Type=file")
-	if !assert.Equal(t, 201, res3.StatusCode) {
+
+	dirID, _ := extractDirData(t, data1)
+	fileID, _ := extractDirData(t, data2)
+
+	res3, _ := trash(t, "/files/"+dirID)
+	if !assert.Equal(t, 200, res3.StatusCode) {
 		return
 	}
 
-	res4, _ := trash(t, "/files/"+dirID)
+	res4, _ := trash(t, "/files/"+fileID)
 	if !assert.Equal(t, 200, res4.StatusCode) {
 		return
 	}
 
-	res5, err := httpGet(ts.URL + "/files/" + dirID)
-	if !assert.NoError(t, err) || !assert.Equal(t, 200, res5.StatusCode) {
+	path := "/files/trash"
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+path, nil)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	if !assert.NoError(t, err) {
 		return
 	}
 
-	res6, err := httpGet(ts.URL + "/files/download?Path=" + url.QueryEscape(vfs.TrashDirName+"/totrashdir/child1"))
-	if !assert.NoError(t, err) || !assert.Equal(t, 200, res6.StatusCode) {
+	_, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
 		return
 	}
 
-	res7, err := httpGet(ts.URL + "/files/download?Path=" + url.QueryEscape(vfs.TrashDirName+"/totrashdir/child2"))
-	if !assert.NoError(t, err) || !assert.Equal(t, 200, res7.StatusCode) {
+	res5, err := httpGet(ts.URL + "/files/trash")
+	if !assert.NoError(t, err) {
 		return
 	}
+	defer res5.Body.Close()
+
+	var v struct {
+		Data []interface{} `json:"data"`
+	}
 
-	res8, _ := trash(t, "/files/"+dirID)
-	if !assert.Equal(t, 400, res8.StatusCode) {
+	err = json.NewDecoder(res5.Body).Decode(&v)
+	if !assert.NoError(t, err) {
 		return
 	}
+
+	assert.True(t, len(v.Data) == 0)
 }
 
-func TestFileTrash(t *testing.T) {
+func TestDestroyFile(t *testing.T) {
 	body := "foo,bar"
-	res1, data1 := upload(t, "/files/?Type=file&Name=totrashfile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	res1, data1 := upload(t, "/files/?Type=file&Name=tolistfile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
 	if !assert.Equal(t, 201, res1.StatusCode) {
 		return
 	}
 
-	fileID, _ := extractDirData(t, data1)
-
-	res2, _ := trash(t, "/files/"+fileID)
-	if !assert.Equal(t, 200, res2.StatusCode) {
+	res2, data2 := createDir(t, "/files/?Name=tolistdir&Type=directory")
+	if !assert.Equal(t, 201, res2.StatusCode) {
 		return
 	}
 
-	res3, err := httpGet(ts.URL + "/files/download?Path=" + url.QueryEscape(vfs.TrashDirName+"/totrashfile"))
-	if !assert.NoError(t, err) || !assert.Equal(t, 200, res3.StatusCode) {
+	dirID, _ := extractDirData(t, data1)
+	fileID, _ := extractDirData(t, data2)
+
+	res3, _ := trash(t, "/files/"+dirID)
+	if !assert.Equal(t, 200, res3.StatusCode) {
 		return
 	}
 
 	res4, _ := trash(t, "/files/"+fileID)
-	if !assert.Equal(t, 400, res4.StatusCode) {
+	if !assert.Equal(t, 200, res4.StatusCode) {
 		return
 	}
 
-	res5, data2 := upload(t, "/files/?Type=file&Name=totrashfile2", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
-	if !assert.Equal(t, 201, res5.StatusCode) {
+	path := "/files/trash/" + fileID
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+path, nil)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	if !assert.NoError(t, err) {
 		return
 	}
 
-	fileID, v2 := extractDirData(t, data2)
-	meta2 := v2["meta"].(map[string]interface{})
-	rev2 := meta2["rev"].(string)
-
-	req6, err := http.NewRequest("DELETE", ts.URL+"/files/"+fileID, nil)
-	req6.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
-	assert.NoError(t, err)
-
-	req6.Header.Add("If-Match", "badrev")
-	res6, err := http.DefaultClient.Do(req6)
-	assert.NoError(t, err)
-	assert.Equal(t, 412, res6.StatusCode)
-
-	res7, err := httpGet(ts.URL + "/files/download?Path=" + url.QueryEscape(vfs.TrashDirName+"/totrashfile"))
-	if !assert.NoError(t, err) || !assert.Equal(t, 200, res7.StatusCode) {
+	_, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
 		return
 	}
 
-	req8, err := http.NewRequest("DELETE", ts.URL+"/files/"+fileID, nil)
-	req8.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
-	assert.NoError(t, err)
+	res5, err := httpGet(ts.URL + "/files/trash")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res5.Body.Close()
 
-	req8.Header.Add("If-Match", rev2)
-	res8, err := http.DefaultClient.Do(req8)
-	assert.NoError(t, err)
-	assert.Equal(t, 200, res8.StatusCode)
+	var v struct {
+		Data []interface{} `json:"data"`
+	}
 
-	res9, _ := trash(t, "/files/"+fileID)
-	if !assert.Equal(t, 400, res9.StatusCode) {
+	err = json.NewDecoder(res5.Body).Decode(&v)
+	if !assert.NoError(t, err) {
 		return
 	}
-}
+	assert.True(t, len(v.Data) == 1)
 
-func TestFileRestore(t *testing.T) {
-	body := "foo,bar"
-	res1, data1 := upload(t, "/files/?Type=file&Name=torestorefile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
-	if !assert.Equal(t, 201, res1.StatusCode) {
+	path = "/files/trash/" + dirID
+	req, err = http.NewRequest(http.MethodDelete, ts.URL+path, nil)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	if !assert.NoError(t, err) {
 		return
 	}
 
-	fileID, _ := extractDirData(t, data1)
-
-	res2, body2 := trash(t, "/files/"+fileID)
-	if !assert.Equal(t, 200, res2.StatusCode) {
+	_, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
 		return
 	}
-	data2 := body2["data"].(map[string]interface{})
-	attrs2 := data2["attributes"].(map[string]interface{})
-	trashed := attrs2["trashed"].(bool)
-	assert.True(t, trashed)
 
-	res3, body3 := restore(t, "/files/trash/"+fileID)
-	if !assert.Equal(t, 200, res3.StatusCode) {
+	res5, err = httpGet(ts.URL + "/files/trash")
+	if !assert.NoError(t, err) {
 		return
 	}
-	data3 := body3["data"].(map[string]interface{})
-	attrs3 := data3["attributes"].(map[string]interface{})
-	trashed = attrs3["trashed"].(bool)
-	assert.False(t, trashed)
+	defer res5.Body.Close()
 
-	res4, err := httpGet(ts.URL + "/files/download?Path=" + url.QueryEscape("/torestorefile"))
-	if !assert.NoError(t, err) || !assert.Equal(t, 200, res4.StatusCode) {
+	err = json.NewDecoder(res5.Body).Decode(&v)
+	if !assert.NoError(t, err) {
 		return
 	}
+	assert.True(t, len(v.Data) == 0)
 }
 
-func TestFileRestoreWithConflicts(t *testing.T) {
-	body := "foo,bar"
-	res1, data1 := upload(t, "/files/?Type=file&Name=torestorefilewithconflict", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+func TestDestroyPermanently(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=topermanentdelete", "text/plain", "foo", "")
 	if !assert.Equal(t, 201, res1.StatusCode) {
 		return
 	}
-
 	fileID, _ := extractDirData(t, data1)
 
-	res2, _ := trash(t, "/files/"+fileID)
-	if !assert.Equal(t, 200, res2.StatusCode) {
+	res2, data2 := createDir(t, "/files/?Name=topermanentdeletedir&Type=directory")
+	if !assert.Equal(t, 201, res2.StatusCode) {
 		return
 	}
-
-	res1, _ = upload(t, "/files/?Type=file&Name=torestorefilewithconflict", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
-	if !assert.Equal(t, 201, res1.StatusCode) {
+	dirID, _ := extractDirData(t, data2)
+	res3, data3 := upload(t, "/files/"+dirID+"?Type=file&Name=child", "text/plain", "bar", "")
+	if !assert.Equal(t, 201, res3.StatusCode) {
 		return
 	}
+	childID, _ := extractDirData(t, data3)
 
-	res3, data3 := restore(t, "/files/trash/"+fileID)
-	if !assert.Equal(t, 200, res3.StatusCode) {
-		return
+	destroy := func(id string) *http.Response {
+		req, err := http.NewRequest(http.MethodDelete, ts.URL+"/files/"+id+"?permanent=true", nil)
+		assert.NoError(t, err)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res
 	}
 
-	restoredID, restoredData := extractDirData(t, data3)
-	if !assert.Equal(t, fileID, restoredID) {
-		return
-	}
-	restoredData = restoredData["attributes"].(map[string]interface{})
-	assert.True(t, strings.HasPrefix(restoredData["name"].(string), "torestorefilewithconflict"))
-	assert.NotEqual(t, "torestorefilewithconflict", restoredData["name"].(string))
-}
+	// Disabled by default
+	res4 := destroy(fileID)
+	assert.Equal(t, 403, res4.StatusCode)
+	_, err := testInstance.VFS().FileByID(fileID)
+	assert.NoError(t, err)
 
-func TestFileRestoreWithWithoutParent(t *testing.T) {
-	res1, data1 := createDir(t, "/files/?Type=directory&Name=torestorein")
-	if !assert.Equal(t, 201, res1.StatusCode) {
-		return
-	}
+	config.GetConfig().Fs.PermanentDelete = true
+	defer func() { config.GetConfig().Fs.PermanentDelete = false }()
 
-	dirID, _ := extractDirData(t, data1)
+	res5 := destroy(consts.RootDirID)
+	assert.Equal(t, 400, res5.StatusCode)
 
-	body := "foo,bar"
-	res1, data1 = upload(t, "/files/"+dirID+"?Type=file&Name=torestorefilewithconflict", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	res6 := destroy(fileID)
+	assert.Equal(t, 204, res6.StatusCode)
+	_, err = testInstance.VFS().FileByID(fileID)
+	assert.True(t, os.IsNotExist(err))
+
+	res7 := destroy(dirID)
+	assert.Equal(t, 204, res7.StatusCode)
+	_, err = testInstance.VFS().DirByID(dirID)
+	assert.True(t, os.IsNotExist(err))
+	_, err = testInstance.VFS().FileByID(childID)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTrashAndRestoreWithIfMatch(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=ifmatchtrash", "text/plain", "foo", "")
 	if !assert.Equal(t, 201, res1.StatusCode) {
 		return
 	}
-
 	fileID, _ := extractDirData(t, data1)
+	rev1 := data1["data"].(map[string]interface{})["meta"].(map[string]interface{})["rev"].(string)
 
-	res2, _ := trash(t, "/files/"+fileID)
-	if !assert.Equal(t, 200, res2.StatusCode) {
-		return
+	withIfMatch := func(method, path, rev string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		req.Header.Add("If-Match", rev)
+		return doUploadOrMod(t, req, "", "")
 	}
 
-	res2, _ = trash(t, "/files/"+dirID)
-	if !assert.Equal(t, 200, res2.StatusCode) {
+	res2, _ := withIfMatch(http.MethodDelete, "/files/"+fileID, "1-badrev")
+	assert.Equal(t, 412, res2.StatusCode)
+	res3, data3 := withIfMatch(http.MethodDelete, "/files/"+fileID, `"`+rev1+`"`)
+	if !assert.Equal(t, 200, res3.StatusCode) {
 		return
 	}
+	rev2 := data3["data"].(map[string]interface{})["meta"].(map[string]interface{})["rev"].(string)
 
-	res3, data3 := restore(t, "/files/trash/"+fileID)
-	if !assert.Equal(t, 200, res3.StatusCode) {
+	// The revision before the trash is stale
+	res4, _ := withIfMatch(http.MethodPost, "/files/trash/"+fileID, rev1)
+	assert.Equal(t, 412, res4.StatusCode)
+	res5, data5 := withIfMatch(http.MethodPost, "/files/trash/"+fileID, rev2)
+	if !assert.Equal(t, 200, res5.StatusCode) {
 		return
 	}
+	rev3 := data5["data"].(map[string]interface{})["meta"].(map[string]interface{})["rev"].(string)
 
-	restoredID, restoredData := extractDirData(t, data3)
-	if !assert.Equal(t, fileID, restoredID) {
+	res6, data6 := withIfMatch(http.MethodDelete, "/files/"+fileID, rev3)
+	if !assert.Equal(t, 200, res6.StatusCode) {
 		return
 	}
-	restoredData = restoredData["attributes"].(map[string]interface{})
-	assert.Equal(t, "torestorefilewithconflict", restoredData["name"].(string))
-	assert.NotEqual(t, consts.RootDirID, restoredData["dir_id"].(string))
-}
-
-func TestFileRestoreWithWithoutParent2(t *testing.T) {
-	res1, data1 := createDir(t, "/files/?Type=directory&Name=torestorein2")
-	if !assert.Equal(t, 201, res1.StatusCode) {
+	rev4 := data6["data"].(map[string]interface{})["meta"].(map[string]interface{})["rev"].(string)
+	res7, _ := withIfMatch(http.MethodDelete, "/files/trash/"+fileID, rev3)
+	assert.Equal(t, 412, res7.StatusCode)
+	req8, err := http.NewRequest(http.MethodDelete, ts.URL+"/files/trash/"+fileID, nil)
+	if !assert.NoError(t, err) {
 		return
 	}
+	req8.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req8.Header.Add("If-Match", rev4)
+	res8, err := http.DefaultClient.Do(req8)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 204, res8.StatusCode)
+		res8.Body.Close()
+	}
+}
 
-	dirID, _ := extractDirData(t, data1)
+func TestThumbnail(t *testing.T) {
+	res1, _ := httpGet(ts.URL + "/files/" + imgID)
+	assert.Equal(t, 200, res1.StatusCode)
+	var obj map[string]interface{}
+	err := extractJSONRes(res1, &obj)
+	assert.NoError(t, err)
+	data := obj["data"].(map[string]interface{})
+	links := data["links"].(map[string]interface{})
+	large := links["large"].(string)
+	medium := links["medium"].(string)
+	small := links["small"].(string)
 
-	body := "foo,bar"
-	res1, data1 = upload(t, "/files/"+dirID+"?Type=file&Name=torestorefilewithconflict2", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
-	if !assert.Equal(t, 201, res1.StatusCode) {
-		return
-	}
+	res2, _ := download(t, large, "")
+	assert.Equal(t, 200, res2.StatusCode)
+	assert.True(t, strings.HasPrefix(res2.Header.Get("Content-Type"), "image/jpeg"))
+	res3, _ := download(t, medium, "")
+	assert.Equal(t, 200, res3.StatusCode)
+	assert.True(t, strings.HasPrefix(res3.Header.Get("Content-Type"), "image/jpeg"))
+	res4, _ := download(t, small, "")
+	assert.Equal(t, 200, res4.StatusCode)
+	assert.True(t, strings.HasPrefix(res4.Header.Get("Content-Type"), "image/jpeg"))
 
-	fileID, _ := extractDirData(t, data1)
+	res5, body5 := download(t, small, "bytes=0-9")
+	assert.Equal(t, 206, res5.StatusCode)
+	assert.Equal(t, "bytes", res5.Header.Get("Accept-Ranges"))
+	assert.True(t, strings.HasPrefix(res5.Header.Get("Content-Range"), "bytes 0-9/"))
+	assert.Len(t, body5, 10)
+}
 
-	res2, _ := trash(t, "/files/"+dirID)
-	if !assert.Equal(t, 200, res2.StatusCode) {
+func TestThumbnailOfUnrenderablePDF(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=unrenderable.pdf", "application/pdf", "%PDF-1.4 this is not a real PDF", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
 		return
 	}
-
-	res3, data3 := restore(t, "/files/trash/"+fileID)
-	if !assert.Equal(t, 200, res3.StatusCode) {
+	fileID, attrs := extractAttributes(t, data1)
+	assert.Equal(t, "pdf", attrs["class"])
+	links := data1["data"].(map[string]interface{})["links"].(map[string]interface{})
+	small, ok := links["small"].(string)
+	if !assert.True(t, ok) {
 		return
 	}
 
-	restoredID, restoredData := extractDirData(t, data3)
-	if !assert.Equal(t, fileID, restoredID) {
-		return
-	}
-	restoredData = restoredData["attributes"].(map[string]interface{})
-	assert.Equal(t, "torestorefilewithconflict2", restoredData["name"].(string))
-	assert.NotEqual(t, consts.RootDirID, restoredData["dir_id"].(string))
+	res2, _ := download(t, small, "")
+	assert.Equal(t, 200, res2.StatusCode)
+	assert.True(t, strings.HasPrefix(res2.Header.Get("Content-Type"), "image/svg+xml"))
+	res3, _ := download(t, "/files/"+fileID+"/icon", "")
+	assert.Equal(t, 200, res3.StatusCode)
+	assert.True(t, strings.HasPrefix(res3.Header.Get("Content-Type"), "image/svg+xml"))
 }
 
-func TestDirRestore(t *testing.T) {
-	res1, data1 := createDir(t, "/files/?Type=directory&Name=torestoredir")
+func TestSimilarImages(t *testing.T) {
+	f, err := os.Open("../../tests/fixtures/wet-cozy_20160910__©M4Dz.jpg")
+	assert.NoError(t, err)
+	defer f.Close()
+	req, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Name=wet-copy.jpg", f)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res1, obj := doUploadOrMod(t, req, "image/jpeg", "")
 	if !assert.Equal(t, 201, res1.StatusCode) {
 		return
 	}
-
-	dirID, _ := extractDirData(t, data1)
-
-	body := "foo,bar"
-	res2, data2 := upload(t, "/files/"+dirID+"?Type=file&Name=totrashfile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
-	if !assert.Equal(t, 201, res2.StatusCode) {
-		return
+	data := obj["data"].(map[string]interface{})
+	copyID := data["id"].(string)
+
+	// The perceptual hashes are computed by the thumbnail worker
+	fs := testInstance.VFS()
+	for _, id := range []string{imgID, copyID} {
+		var phash interface{}
+		for i := 0; i < 100 && phash == nil; i++ {
+			doc, err := fs.FileByID(id)
+			if !assert.NoError(t, err) {
+				return
+			}
+			if phash = doc.Metadata["phash"]; phash == nil {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		if !assert.NotNil(t, phash, "phash of %s", id) {
+			return
+		}
 	}
 
-	fileID, _ := extractDirData(t, data2)
-
-	res3, _ := trash(t, "/files/"+dirID)
-	if !assert.Equal(t, 200, res3.StatusCode) {
-		return
+	res2, err := httpGet(ts.URL + "/files/" + imgID + "/similar")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res2.StatusCode)
+	var v struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.NewDecoder(res2.Body).Decode(&v))
+	res2.Body.Close()
+	var ids []string
+	for _, item := range v.Data {
+		ids = append(ids, item.ID)
 	}
+	assert.Contains(t, ids, copyID)
+	assert.NotContains(t, ids, imgID)
 
-	res4, err := httpGet(ts.URL + "/files/" + fileID)
-	if !assert.NoError(t, err) || !assert.Equal(t, 200, res4.StatusCode) {
+	res3, data3 := upload(t, "/files/?Type=file&Name=notanimage.txt", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res3.StatusCode) {
 		return
 	}
+	txtID, _ := extractDirData(t, data3)
+	res4, err := httpGet(ts.URL + "/files/" + txtID + "/similar")
+	assert.NoError(t, err)
+	res4.Body.Close()
+	assert.Equal(t, 422, res4.StatusCode)
+}
 
-	var v map[string]interface{}
-	err = extractJSONRes(res4, &v)
+func TestReadExif(t *testing.T) {
+	res1, err := httpGet(ts.URL + "/files/" + imgID + "/exif")
 	assert.NoError(t, err)
+	assert.Equal(t, 200, res1.StatusCode)
+	var v map[string]interface{}
+	assert.NoError(t, extractJSONRes(res1, &v))
 	data := v["data"].(map[string]interface{})
+	assert.Equal(t, consts.FilesExif, data["type"])
+	assert.Equal(t, imgID, data["id"])
 	attrs := data["attributes"].(map[string]interface{})
-	trashed := attrs["trashed"].(bool)
-	assert.True(t, trashed)
-
-	res5, _ := restore(t, "/files/trash/"+dirID)
-	if !assert.Equal(t, 200, res5.StatusCode) {
-		return
-	}
+	assert.True(t, strings.HasPrefix(attrs["datetime"].(string), "2016-09-10"))
+	assert.EqualValues(t, 440, attrs["width"])
+	assert.Nil(t, attrs["gps"])
 
-	res6, err := httpGet(ts.URL + "/files/" + fileID)
-	if !assert.NoError(t, err) || !assert.Equal(t, 200, res6.StatusCode) {
+	res2, data2 := upload(t, "/files/?Type=file&Name=noexif.txt", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
 		return
 	}
-
-	err = extractJSONRes(res6, &v)
+	txtID, _ := extractDirData(t, data2)
+	res3, err := httpGet(ts.URL + "/files/" + txtID + "/exif")
 	assert.NoError(t, err)
-	data = v["data"].(map[string]interface{})
-	attrs = data["attributes"].(map[string]interface{})
-	trashed = attrs["trashed"].(bool)
-	assert.False(t, trashed)
+	res3.Body.Close()
+	assert.Equal(t, 422, res3.StatusCode)
 }
 
-func TestDirRestoreWithConflicts(t *testing.T) {
-	res1, data1 := createDir(t, "/files/?Type=directory&Name=torestoredirwithconflict")
-	if !assert.Equal(t, 201, res1.StatusCode) {
+func TestAuditTrail(t *testing.T) {
+	config.GetConfig().Fs.Audit = true
+	defer func() { config.GetConfig().Fs.Audit = false }()
+
+	res, data := upload(t, "/files/?Type=file&Name=audited-file", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
+	id, _ := extractDirData(t, data)
+	res, _ = trash(t, "/files/"+id)
+	assert.Equal(t, 200, res.StatusCode)
+	req, _ := http.NewRequest("POST", ts.URL+"/files/trash/"+id, nil)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
 
-	dirID, _ := extractDirData(t, data1)
+	res, err = httpGet(ts.URL + "/files/_audit")
+	assert.NoError(t, err)
+	assert.Equal(t, 400, res.StatusCode)
 
-	res2, _ := trash(t, "/files/"+dirID)
-	if !assert.Equal(t, 200, res2.StatusCode) {
-		return
+	// The records are written in the background
+	var ops []string
+	for i := 0; i < 20; i++ {
+		res, err = httpGet(ts.URL + "/files/_audit?file-id=" + id)
+		if !assert.NoError(t, err) || !assert.Equal(t, 200, res.StatusCode) {
+			return
+		}
+		var result struct {
+			Data []struct {
+				Attributes struct {
+					Operation string `json:"operation"`
+					FileID    string `json:"file_id"`
+					Subject   string `json:"subject"`
+				} `json:"attributes"`
+			} `json:"data"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		assert.NoError(t, err)
+		ops = ops[:0]
+		for _, entry := range result.Data {
+			assert.Equal(t, id, entry.Attributes.FileID)
+			assert.NotEmpty(t, entry.Attributes.Subject)
+			ops = append(ops, entry.Attributes.Operation)
+		}
+		if len(ops) == 3 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
 	}
+	assert.Equal(t, []string{"restore", "trash", "create"}, ops)
+}
 
-	res1, _ = createDir(t, "/files/?Type=directory&Name=torestoredirwithconflict")
-	if !assert.Equal(t, 201, res1.StatusCode) {
-		return
-	}
+func TestLogOperations(t *testing.T) {
+	var buf bytes.Buffer
+	std := logrus.StandardLogger()
+	out, level := std.Out, std.Level
+	std.Out, std.Level = &buf, logrus.InfoLevel
+	defer func() { std.Out, std.Level = out, level }()
 
-	res3, data3 := restore(t, "/files/trash/"+dirID)
-	if !assert.Equal(t, 200, res3.StatusCode) {
+	res, data := upload(t, "/files/?Type=file&Name=logged-file", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
+	id, _ := extractDirData(t, data)
+	res, _ = trash(t, "/files/"+id)
+	assert.Equal(t, 200, res.StatusCode)
 
-	restoredID, restoredData := extractDirData(t, data3)
-	if !assert.Equal(t, dirID, restoredID) {
-		return
-	}
-	restoredData = restoredData["attributes"].(map[string]interface{})
-	assert.True(t, strings.HasPrefix(restoredData["name"].(string), "torestoredirwithconflict"))
-	assert.NotEqual(t, "torestoredirwithconflict", restoredData["name"].(string))
+	logs := buf.String()
+	assert.Contains(t, logs, "operation=create")
+	assert.Contains(t, logs, "operation=trash")
+	assert.Contains(t, logs, "doc_id="+id)
+	assert.Contains(t, logs, "size=3")
+	assert.Contains(t, logs, "duration_ms=")
+	assert.NotContains(t, logs, "logged-file")
 }
 
-func TestTrashList(t *testing.T) {
-	body := "foo,bar"
-	res1, data1 := upload(t, "/files/?Type=file&Name=tolistfile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
-	if !assert.Equal(t, 201, res1.StatusCode) {
+func TestRenameTag(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=tag-rename-1&Tags=tag-old", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-
-	res2, data2 := createDir(t, "/files/?Name=tolistdir&Type=directory")
-	if !assert.Equal(t, 201, res2.StatusCode) {
+	file1, _ := extractDirData(t, data)
+	res, data = upload(t, "/files/?Type=file&Name=tag-rename-2&Tags=tag-old,tag-new", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-
-	dirID, _ := extractDirData(t, data1)
-	fileID, _ := extractDirData(t, data2)
-
-	res3, _ := trash(t, "/files/"+dirID)
-	if !assert.Equal(t, 200, res3.StatusCode) {
+	file2, _ := extractDirData(t, data)
+	res, data = upload(t, "/files/?Type=file&Name=tag-rename-3&Tags=tag-other", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-
-	res4, _ := trash(t, "/files/"+fileID)
-	if !assert.Equal(t, 200, res4.StatusCode) {
+	file3, _ := extractDirData(t, data)
+	res, data = createDir(t, "/files/?Name=tag-rename-dir&Type=directory&Tags=tag-old")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
+	dirID, _ := extractDirData(t, data)
 
-	res5, err := httpGet(ts.URL + "/files/trash")
-	if !assert.NoError(t, err) {
-		return
+	rename := func(query, from, to string) (*http.Response, map[string]interface{}) {
+		body := fmt.Sprintf(`{"from": %q, "to": %q}`, from, to)
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/files/_tags/rename"+query, strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		req.Header.Add(echo.HeaderContentType, "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		defer res.Body.Close()
+		var v map[string]interface{}
+		assert.NoError(t, extractJSONRes(res, &v))
+		return res, v
+	}
+	tagsOf := func(id string) []string {
+		dir, file, err := testInstance.VFS().DirOrFileByID(id)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		if dir != nil {
+			return dir.Tags
+		}
+		return file.Tags
 	}
-	defer res5.Body.Close()
 
-	var v struct {
-		Data []interface{} `json:"data"`
+	res, _ = rename("", "tag-old", "tag-a,tag-b")
+	assert.Equal(t, 422, res.StatusCode)
+	res, _ = rename("", "", "tag-new")
+	assert.Equal(t, 422, res.StatusCode)
+
+	res, data = rename("", "tag-old", "tag-new")
+	if assert.Equal(t, 200, res.StatusCode) {
+		meta := data["meta"].(map[string]interface{})
+		assert.EqualValues(t, 3, meta["count"])
 	}
+	assert.Equal(t, []string{"tag-new"}, tagsOf(file1))
+	assert.Equal(t, []string{"tag-new"}, tagsOf(file2))
+	assert.Equal(t, []string{"tag-other"}, tagsOf(file3))
+	assert.Equal(t, []string{"tag-new"}, tagsOf(dirID))
 
-	err = json.NewDecoder(res5.Body).Decode(&v)
-	if !assert.NoError(t, err) {
+	res, data = rename("?async=true", "tag-new", "tag-renamed")
+	if !assert.Equal(t, 202, res.StatusCode) {
 		return
 	}
-
-	assert.True(t, len(v.Data) >= 2, "response should contains at least 2 items")
+	jobID := data["data"].(map[string]interface{})["id"].(string)
+	var attrs map[string]interface{}
+	for i := 0; i < 50; i++ {
+		res, err := httpGet(ts.URL + "/files/_jobs/" + jobID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		var v map[string]interface{}
+		assert.NoError(t, extractJSONRes(res, &v))
+		res.Body.Close()
+		attrs = v["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+		if attrs["state"] == "done" || attrs["state"] == "error" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, "done", attrs["state"])
+	assert.EqualValues(t, 3, attrs["result"].(map[string]interface{})["count"])
+	assert.Equal(t, []string{"tag-renamed"}, tagsOf(file1))
+	assert.Equal(t, []string{"tag-renamed"}, tagsOf(dirID))
 }
 
-func TestTrashClear(t *testing.T) {
-	body := "foo,bar"
-	res1, data1 := upload(t, "/files/?Type=file&Name=tolistfile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
-	if !assert.Equal(t, 201, res1.StatusCode) {
+func TestListTags(t *testing.T) {
+	res, _ := upload(t, "/files/?Type=file&Name=tags-cloud-1&Tags=cloud-a,cloud-b", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-
-	res2, data2 := createDir(t, "/files/?Name=tolistdir&Type=directory")
-	if !assert.Equal(t, 201, res2.StatusCode) {
+	res, data := upload(t, "/files/?Type=file&Name=tags-cloud-2&Tags=cloud-a", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-
-	dirID, _ := extractDirData(t, data1)
-	fileID, _ := extractDirData(t, data2)
-
-	res3, _ := trash(t, "/files/"+dirID)
-	if !assert.Equal(t, 200, res3.StatusCode) {
+	trashedID, _ := extractDirData(t, data)
+	res, _ = upload(t, "/files/?Type=file&Name=tags-cloud-3&Tags=other-c", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-
-	res4, _ := trash(t, "/files/"+fileID)
-	if !assert.Equal(t, 200, res4.StatusCode) {
+	res, _ = createDir(t, "/files/?Name=tags-cloud-dir&Type=directory&Tags=cloud-b")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-
-	path := "/files/trash"
-	req, err := http.NewRequest(http.MethodDelete, ts.URL+path, nil)
-	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
-	if !assert.NoError(t, err) {
+	res, _ = trash(t, "/files/"+trashedID)
+	if !assert.Equal(t, 200, res.StatusCode) {
 		return
 	}
 
-	_, err = http.DefaultClient.Do(req)
-	if !assert.NoError(t, err) {
-		return
+	listTags := func(query string) map[string]float64 {
+		res, err := httpGet(ts.URL + "/files/_tags" + query)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		var v struct {
+			Data []struct {
+				Type  string                 `json:"type"`
+				ID    string                 `json:"id"`
+				Attrs map[string]interface{} `json:"attributes"`
+			} `json:"data"`
+		}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&v))
+		counts := make(map[string]float64)
+		for _, d := range v.Data {
+			assert.Equal(t, consts.FilesTags, d.Type)
+			assert.Equal(t, d.ID, d.Attrs["name"])
+			counts[d.ID] = d.Attrs["count"].(float64)
+		}
+		return counts
 	}
 
-	res5, err := httpGet(ts.URL + "/files/trash")
-	if !assert.NoError(t, err) {
+	counts := listTags("?prefix=cloud-")
+	assert.Equal(t, map[string]float64{"cloud-a": 1, "cloud-b": 1}, counts)
+	counts = listTags("?prefix=cloud-&trashed=true")
+	assert.Equal(t, map[string]float64{"cloud-a": 2, "cloud-b": 1}, counts)
+	counts = listTags("")
+	assert.Equal(t, float64(1), counts["other-c"])
+	assert.Equal(t, float64(1), counts["cloud-a"])
+}
+
+func TestDownloadContentTypeOverride(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=legacy.bin", "application/octet-stream", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-	defer res5.Body.Close()
+	fileID, _ := extractDirData(t, data)
+	base := "/files/download/" + fileID
 
-	var v struct {
-		Data []interface{} `json:"data"`
-	}
+	res, body := download(t, base+"?content_type=image/png", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+	assert.Equal(t, "foo", string(body))
 
-	err = json.NewDecoder(res5.Body).Decode(&v)
-	if !assert.NoError(t, err) {
-		return
-	}
+	res, _ = download(t, base+"?content_type="+url.QueryEscape("text/plain; charset=utf-8"), "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
 
-	assert.True(t, len(v.Data) == 0)
+	res, _ = download(t, base+"?content_type=text/html", "")
+	assert.Equal(t, 422, res.StatusCode)
+	res, _ = download(t, base+"?content_type=image/svg%2Bxml&disposition=inline", "")
+	assert.Equal(t, 422, res.StatusCode)
+	res, _ = download(t, base+"?content_type=text/html&disposition=attachment", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "text/html", res.Header.Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(res.Header.Get("Content-Disposition"), "attachment"))
+
+	res, _ = download(t, base+"?content_type=application/x-foo", "")
+	assert.Equal(t, 422, res.StatusCode)
+	res, _ = download(t, base+"?content_type=not-a-type", "")
+	assert.Equal(t, 422, res.StatusCode)
+	res, _ = download(t, base+"?content_type="+url.QueryEscape("image/png; foo=bar"), "")
+	assert.Equal(t, 422, res.StatusCode)
+
+	doc, err := testInstance.VFS().FileByID(fileID)
+	assert.NoError(t, err)
+	assert.Equal(t, "application/octet-stream", doc.Mime)
 }
 
-func TestDestroyFile(t *testing.T) {
-	body := "foo,bar"
-	res1, data1 := upload(t, "/files/?Type=file&Name=tolistfile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
-	if !assert.Equal(t, 201, res1.StatusCode) {
+func TestSandboxUnsafeInline(t *testing.T) {
+	conf := config.GetConfig()
+	previous := conf.Fs.UnsafeInlineTypes
+	conf.Fs.UnsafeInlineTypes = []string{"text/html", "image/svg+xml"}
+	defer func() { conf.Fs.UnsafeInlineTypes = previous }()
+
+	res, data := upload(t, "/files/?Type=file&Name=unsafe.html", "text/html", "<script>alert(1)</script>", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-
-	res2, data2 := createDir(t, "/files/?Name=tolistdir&Type=directory")
-	if !assert.Equal(t, 201, res2.StatusCode) {
+	htmlID, _ := extractDirData(t, data)
+	res, data = upload(t, "/files/?Type=file&Name=safe.txt", "text/plain", "<script>alert(1)</script>", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
+	textID, _ := extractDirData(t, data)
 
-	dirID, _ := extractDirData(t, data1)
-	fileID, _ := extractDirData(t, data2)
+	res, _ = download(t, "/files/download/"+htmlID, "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Content-Security-Policy"), "sandbox")
+	res, _ = download(t, "/files/download/"+htmlID+"?filename=other.html", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Content-Security-Policy"), "sandbox")
 
-	res3, _ := trash(t, "/files/"+dirID)
-	if !assert.Equal(t, 200, res3.StatusCode) {
+	res, _ = download(t, "/files/download/"+htmlID+"?disposition=attachment", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.NotContains(t, res.Header.Get("Content-Security-Policy"), "sandbox")
+	res, _ = download(t, "/files/download/"+textID, "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.NotContains(t, res.Header.Get("Content-Security-Policy"), "sandbox")
+
+	conf.Fs.UnsafeInlineTypes = []string{"text/*"}
+	res, _ = download(t, "/files/download/"+textID, "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Content-Security-Policy"), "sandbox")
+}
+
+func TestFileIcon(t *testing.T) {
+	res, data := upload(t, "/files/?Type=file&Name=icon.pdf", "application/pdf", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-
-	res4, _ := trash(t, "/files/"+fileID)
-	if !assert.Equal(t, 200, res4.StatusCode) {
+	pdfID, _ := extractDirData(t, data)
+	res, data = upload(t, "/files/?Type=file&Name=icon.png", "image/png", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
+	imgID, _ := extractDirData(t, data)
 
-	path := "/files/trash/" + fileID
-	req, err := http.NewRequest(http.MethodDelete, ts.URL+path, nil)
-	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
-	if !assert.NoError(t, err) {
-		return
+	icon := func(id, etag string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/files/"+id+"/icon", nil)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		if etag != "" {
+			req.Header.Add("If-None-Match", etag)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
 	}
 
-	_, err = http.DefaultClient.Do(req)
+	res, body := icon(pdfID, "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "image/svg+xml", res.Header.Get("Content-Type"))
+	assert.Contains(t, res.Header.Get("Cache-Control"), "max-age=")
+	assert.Contains(t, body, "PDF")
+	etag := res.Header.Get("Etag")
+	assert.NotEmpty(t, etag)
+
+	res, _ = icon(pdfID, etag)
+	assert.Equal(t, 304, res.StatusCode)
+
+	// No thumbnail has been generated for this image
+	res, body = icon(imgID, "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, body, "IMG")
+	assert.NotEqual(t, etag, res.Header.Get("Etag"))
+
+	res, _ = icon("unknown-id", "")
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestFilesCapabilities(t *testing.T) {
+	req, err := http.NewRequest(http.MethodOptions, ts.URL+"/files/", nil)
 	if !assert.NoError(t, err) {
 		return
 	}
-
-	res5, err := httpGet(ts.URL + "/files/trash")
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
 	if !assert.NoError(t, err) {
 		return
 	}
-	defer res5.Body.Close()
-
-	var v struct {
-		Data []interface{} `json:"data"`
-	}
-
-	err = json.NewDecoder(res5.Body).Decode(&v)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "HEAD, POST, OPTIONS", res.Header.Get("Allow"))
+	assert.Contains(t, res.Header.Get("Cozy-Files-Capabilities"), "locks")
+	assert.Contains(t, res.Header.Get("Cozy-Files-Capabilities"), "idempotency-keys")
+	assert.NotContains(t, res.Header.Get("Cozy-Files-Capabilities"), "encryption")
+	var body struct {
+		Meta map[string]interface{} `json:"meta"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal(t, []interface{}{"zip"}, body.Meta["archive_formats"])
+	assert.Equal(t, false, body.Meta["encryption"])
+	assert.Equal(t, false, body.Meta["resumable_uploads"])
+	assert.Equal(t, true, body.Meta["locks"])
+
+	req, err = http.NewRequest(http.MethodHead, ts.URL+"/files/", nil)
 	if !assert.NoError(t, err) {
 		return
 	}
-	assert.True(t, len(v.Data) == 1)
-
-	path = "/files/trash/" + dirID
-	req, err = http.NewRequest(http.MethodDelete, ts.URL+path, nil)
 	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res2, err := http.DefaultClient.Do(req)
 	if !assert.NoError(t, err) {
 		return
 	}
+	res2.Body.Close()
+	assert.Equal(t, 200, res2.StatusCode)
+	assert.Equal(t, res.Header.Get("Cozy-Files-Capabilities"), res2.Header.Get("Cozy-Files-Capabilities"))
 
-	_, err = http.DefaultClient.Do(req)
+	req, err = http.NewRequest(http.MethodHead, ts.URL+"/files/", nil)
 	if !assert.NoError(t, err) {
 		return
 	}
-
-	res5, err = httpGet(ts.URL + "/files/trash")
+	res3, err := http.DefaultClient.Do(req)
 	if !assert.NoError(t, err) {
 		return
 	}
-	defer res5.Body.Close()
+	res3.Body.Close()
+	assert.Equal(t, 401, res3.StatusCode)
+}
 
-	err = json.NewDecoder(res5.Body).Decode(&v)
-	if !assert.NoError(t, err) {
+func TestOptionsDirOrFile(t *testing.T) {
+	res, data := createDir(t, "/files/?Name=options-dir&Type=directory")
+	if !assert.Equal(t, 201, res.StatusCode) {
 		return
 	}
-	assert.True(t, len(v.Data) == 0)
+	dirID, _ := extractDirData(t, data)
+	res, data = upload(t, "/files/"+dirID+"?Type=file&Name=options-file", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data)
+
+	options := func(id string) *http.Response {
+		req, err := http.NewRequest(http.MethodOptions, ts.URL+"/files/"+id, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res = options(fileID)
+	assert.Equal(t, 204, res.StatusCode)
+	assert.Equal(t, "GET, HEAD, PUT, PATCH, DELETE, OPTIONS", res.Header.Get("Allow"))
+
+	res = options(dirID)
+	assert.Equal(t, 204, res.StatusCode)
+	assert.Equal(t, "GET, HEAD, POST, PATCH, DELETE, OPTIONS", res.Header.Get("Allow"))
+
+	res = options(consts.RootDirID)
+	assert.Equal(t, 204, res.StatusCode)
+	assert.Equal(t, "GET, HEAD, POST, OPTIONS", res.Header.Get("Allow"))
+
+	res = options("unknown-id")
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Equal(t, "", res.Header.Get("Allow"))
 }
 
-func TestThumbnail(t *testing.T) {
-	res1, _ := httpGet(ts.URL + "/files/" + imgID)
-	assert.Equal(t, 200, res1.StatusCode)
-	var obj map[string]interface{}
-	err := extractJSONRes(res1, &obj)
-	assert.NoError(t, err)
-	data := obj["data"].(map[string]interface{})
-	links := data["links"].(map[string]interface{})
-	large := links["large"].(string)
-	medium := links["medium"].(string)
-	small := links["small"].(string)
+func TestCORS(t *testing.T) {
+	app := testInstance.SubDomain("drive")
+	appOrigin := app.Scheme + "://" + app.Host
+	toolOrigin := "https://tool.example.com"
+	config.GetConfig().Fs.CORSOrigins = []string{toolOrigin}
+	defer func() { config.GetConfig().Fs.CORSOrigins = nil }()
+
+	doReq := func(method, origin string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+"/files/"+consts.RootDirID, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		req.Host = testInstance.Domain
+		req.Header.Add(echo.HeaderOrigin, origin)
+		if method == http.MethodOptions {
+			req.Header.Add(echo.HeaderAccessControlRequestMethod, http.MethodPut)
+			req.Header.Add(echo.HeaderAccessControlRequestHeaders, "If-Match,Content-MD5")
+		} else {
+			req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		res.Body.Close()
+		return res
+	}
 
-	res2, _ := download(t, large, "")
-	assert.Equal(t, 200, res2.StatusCode)
-	assert.True(t, strings.HasPrefix(res2.Header.Get("Content-Type"), "image/jpeg"))
-	res3, _ := download(t, medium, "")
-	assert.Equal(t, 200, res3.StatusCode)
-	assert.True(t, strings.HasPrefix(res3.Header.Get("Content-Type"), "image/jpeg"))
-	res4, _ := download(t, small, "")
-	assert.Equal(t, 200, res4.StatusCode)
-	assert.True(t, strings.HasPrefix(res4.Header.Get("Content-Type"), "image/jpeg"))
+	res := doReq(http.MethodOptions, appOrigin)
+	assert.Equal(t, 204, res.StatusCode)
+	assert.Equal(t, appOrigin, res.Header.Get(echo.HeaderAccessControlAllowOrigin))
+	assert.Equal(t, "true", res.Header.Get(echo.HeaderAccessControlAllowCredentials))
+	assert.Contains(t, res.Header.Get(echo.HeaderAccessControlAllowMethods), "PATCH")
+	assert.Contains(t, res.Header.Get(echo.HeaderAccessControlAllowHeaders), "If-Match")
+	assert.Contains(t, res.Header.Get(echo.HeaderAccessControlAllowHeaders), "Content-MD5")
+
+	res = doReq(http.MethodGet, appOrigin)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, appOrigin, res.Header.Get(echo.HeaderAccessControlAllowOrigin))
+	assert.Contains(t, res.Header.Get(echo.HeaderAccessControlExposeHeaders), "Etag")
+	assert.Contains(t, res.Header.Get(echo.HeaderAccessControlExposeHeaders), "Location")
+
+	res = doReq(http.MethodOptions, toolOrigin)
+	assert.Equal(t, 204, res.StatusCode)
+	assert.Equal(t, toolOrigin, res.Header.Get(echo.HeaderAccessControlAllowOrigin))
+	assert.Equal(t, "", res.Header.Get(echo.HeaderAccessControlAllowCredentials))
+
+	res = doReq(http.MethodGet, "https://evil.example.com")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "", res.Header.Get(echo.HeaderAccessControlAllowOrigin))
+	res = doReq(http.MethodOptions, "https://evil.example.com")
+	assert.Equal(t, "", res.Header.Get(echo.HeaderAccessControlAllowOrigin))
+	assert.Equal(t, "", res.Header.Get(echo.HeaderAccessControlAllowMethods))
 }
 
 func TestMain(m *testing.M) {
@@ -1775,12 +5733,14 @@ func TestMain(m *testing.M) {
 	client, tok := setup.GetTestClient(consts.Files)
 	clientID = client.ClientID
 	token = tok
+	_, otherToken = setup.GetTestClient(consts.Files)
 	ts = setup.GetTestServer("/files", Routes, func(r *echo.Echo) *echo.Echo {
 		secure := middlewares.Secure(&middlewares.SecureConfig{
 			CSPDefaultSrc: []middlewares.CSPSource{middlewares.CSPSrcSelf},
 			XFrameOptions: middlewares.XFrameDeny,
 		})
 		r.Use(secure)
+		r.Use(middlewares.CORS(CORSOptions()))
 		return r
 	})
 
@@ -0,0 +1,101 @@
+package files
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// classIconMaxAge is the duration for which the clients can cache the default
+// icon of a class, as these icons are static.
+const classIconMaxAge = 24 * time.Hour
+
+// iconTemplate is the SVG of a document, with a color and a short label. The
+// label is escaped for XML.
+const iconTemplate = `<svg xmlns="http://www.w3.org/2000/svg" width="32" height="32" viewBox="0 0 32 32">` +
+	`<path fill="#fff" stroke="%[1]s" d="M6.5 1.5h13l6 6v23h-19z"/>` +
+	`<path fill="%[1]s" d="M19 1v7h7z"/>` +
+	`<rect x="3" y="17" width="22" height="9" rx="1" fill="%[1]s"/>` +
+	`<text x="14" y="24" fill="#fff" font-family="sans-serif" font-size="7" font-weight="bold" text-anchor="middle">%[2]s</text>` +
+	`</svg>`
+
+type classIcon struct {
+	svg  []byte
+	etag string
+}
+
+func newClassIcon(color, label string) *classIcon {
+	svg := []byte(fmt.Sprintf(iconTemplate, color, label))
+	sum := md5.Sum(svg) // #nosec
+	return &classIcon{svg: svg, etag: hex.EncodeToString(sum[:])}
+}
+
+// fallbackIcon is the icon used for the classes without a specific icon.
+var fallbackIcon = newClassIcon("#95999d", "FILE")
+
+// classIcons are the default icons of the files, by class, used when a file
+// has no thumbnail.
+var classIcons = map[string]*classIcon{
+	"audio":       newClassIcon("#f1b00b", "AUD"),
+	"binary":      newClassIcon("#5d6165", "BIN"),
+	"code":        newClassIcon("#5d6165", "&lt;/&gt;"),
+	"image":       newClassIcon("#00b9f1", "IMG"),
+	"pdf":         newClassIcon("#f52d2d", "PDF"),
+	"slide":       newClassIcon("#ff7f1b", "PPT"),
+	"spreadsheet": newClassIcon("#35ce68", "XLS"),
+	"text":        newClassIcon("#297ef2", "TXT"),
+	"video":       newClassIcon("#a25fd2", "VID"),
+	"zip":         newClassIcon("#ffc83d", "ZIP"),
+}
+
+// IconHandler handles GET requests on /files/:file-id/icon. It serves the
+// thumbnail of an image or of a PDF, in the format given by the format
+// parameter (small by default), or the default icon of the class of the file.
+func IconHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+
+	if vfs.HasThumbnails(doc) {
+		format := c.QueryParam("format")
+		if format == "" {
+			format = "small"
+		}
+		if format != "small" && format != "medium" && format != "large" {
+			return jsonapi.InvalidParameter("format", fmt.Errorf("Invalid format %q", format))
+		}
+		// When the thumbnail has not been generated (yet), the default icon
+		// is served instead.
+		fs := instance.ThumbsFS()
+		if err = fs.ServeThumbContent(c.Response(), c.Request(), doc, format); err == nil {
+			return nil
+		}
+	}
+
+	serveClassIcon(c, doc)
+	return nil
+}
+
+// serveClassIcon sends the default icon of the class of the file.
+func serveClassIcon(c echo.Context, doc *vfs.FileDoc) {
+	icon, ok := classIcons[doc.Class]
+	if !ok {
+		icon = fallbackIcon
+	}
+	c.Response().Header().Set("Cache-Control",
+		fmt.Sprintf("private, max-age=%d", int(classIconMaxAge.Seconds())))
+	vfs.ServeContent(c.Response(), c.Request(), "icon.svg", time.Time{}, icon.etag, bytes.NewReader(icon.svg))
+}
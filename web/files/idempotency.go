@@ -0,0 +1,50 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// idempotencyKeyHeader is the header used by the clients to make a creation
+// request idempotent: a retry with the same key doesn't create a duplicate.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength is the maximal length of an idempotency key.
+const maxIdempotencyKeyLength = 255
+
+// idempotencyKeyFromReq returns the idempotency key of the request, or an
+// empty string if the request has none.
+func idempotencyKeyFromReq(c echo.Context) (string, error) {
+	key := c.Request().Header.Get(idempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		return "", jsonapi.InvalidParameter(idempotencyKeyHeader, errors.New("Invalid idempotency key"))
+	}
+	return key, nil
+}
+
+// replayCreation sends the response for a creation request that has already
+// been done with the same idempotency key: the document created by the first
+// request is returned, instead of creating a new one.
+func replayCreation(c echo.Context, docID string) error {
+	instance := middlewares.GetInstance(c)
+	dir, file, err := instance.VFS().DirOrFileByID(docID)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.POST, dir, file); err != nil {
+		return err
+	}
+	c.Response().Header().Set("Idempotent-Replayed", "true")
+	if file != nil {
+		return uploadData(c, http.StatusCreated, file)
+	}
+	if preferMinimal(c) {
+		return minimalData(c, http.StatusCreated, dir)
+	}
+	return jsonapi.Data(c, http.StatusCreated, newDir(dir), nil)
+}
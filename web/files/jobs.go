@@ -0,0 +1,85 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiJob struct {
+	*vfs.Job
+}
+
+func (j *apiJob) ID() string                             { return j.Job.ID }
+func (j *apiJob) Rev() string                            { return "" }
+func (j *apiJob) DocType() string                        { return consts.FilesJobs }
+func (j *apiJob) Clone() couchdb.Doc                     { cloned := *j; return &cloned }
+func (j *apiJob) SetID(_ string)                         {}
+func (j *apiJob) SetRev(_ string)                        {}
+func (j *apiJob) Relationships() jsonapi.RelationshipMap { return nil }
+func (j *apiJob) Included() []jsonapi.Object             { return nil }
+func (j *apiJob) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{
+		Self:    "/files/_jobs/" + j.Job.ID,
+		Related: j.Job.Related,
+	}
+}
+
+// MarshalJSON is used to hide the owner of the job in the responses
+func (j *apiJob) MarshalJSON() ([]byte, error) {
+	job := *j.Job
+	job.Owner = ""
+	return json.Marshal(&job)
+}
+
+// jobData responds with the status of an asynchronous job on the files
+func jobData(c echo.Context, statusCode int, job *vfs.Job) error {
+	return jsonapi.Data(c, statusCode, &apiJob{job}, nil)
+}
+
+// jobOwner returns the owner of the jobs started with the given permission:
+// its type, its source (the OAuth client, the application, etc.), and its
+// identifier for the permissions saved in CouchDB (like the share by links).
+func jobOwner(pdoc *pkgperm.Permission) string {
+	return pdoc.Type + "/" + pdoc.SourceID + "/" + pdoc.ID()
+}
+
+// startJob starts a job on the files of the instance, owned by the
+// permission of the request.
+func startJob(c echo.Context, operation string, fn vfs.JobFunc) (*vfs.Job, error) {
+	pdoc, err := permissions.GetPermission(c)
+	if err != nil {
+		return nil, err
+	}
+	instance := middlewares.GetInstance(c)
+	return vfs.StartJob(instance.Domain, jobOwner(pdoc), operation, fn)
+}
+
+// ReadJobHandler handles GET requests on /files/_jobs/:job-id. It returns the
+// status of an asynchronous operation on the files (state, progress, and
+// result when it is done). A job can only be read with the permission that
+// has started it.
+func ReadJobHandler(c echo.Context) error {
+	pdoc, err := permissions.GetPermission(c)
+	if err != nil {
+		return err
+	}
+	instance := middlewares.GetInstance(c)
+	job, err := vfs.GetStore().GetJob(instance.Domain, c.Param("job-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if job == nil || job.Owner != jobOwner(pdoc) {
+		return jsonapi.NotFound(errors.New("Job not found or expired"))
+	}
+	return jobData(c, http.StatusOK, job)
+}
@@ -0,0 +1,79 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// lockOwner returns the owner of the locks taken with the current request:
+// it is the source of the permission (the app or the OAuth client).
+func lockOwner(c echo.Context) string {
+	owner, _ := permissions.GetSourceID(c)
+	return owner
+}
+
+// checkFileLock returns a 423 Locked error if the file is locked by another
+// client than the one of the current request.
+func checkFileLock(c echo.Context, doc *vfs.FileDoc) error {
+	instance := middlewares.GetInstance(c)
+	err := vfs.CheckFileLock(instance.Domain, doc.ID(), lockOwner(c))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return nil
+}
+
+// LockFileHandler handles POST requests on /files/:file-id/lock. It takes
+// the lock on the file for the client, or renews it if the client already
+// holds it. The duration of the lock can be given, in seconds, with the ttl
+// parameter.
+func LockFileHandler(c echo.Context) error {
+	var ttl time.Duration
+	if param := c.QueryParam("ttl"); param != "" {
+		seconds, err := strconv.Atoi(param)
+		if err != nil || seconds <= 0 {
+			return jsonapi.InvalidParameter("ttl", errors.New("Invalid ttl"))
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.PUT, nil, doc); err != nil {
+		return err
+	}
+
+	if _, err = vfs.LockFile(instance.Domain, doc.ID(), lockOwner(c), ttl); err != nil {
+		return WrapVfsError(err)
+	}
+	return fileData(c, http.StatusOK, doc, nil)
+}
+
+// UnlockFileHandler handles DELETE requests on /files/:file-id/lock. It
+// releases the lock taken by the client on the file.
+func UnlockFileHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.PUT, nil, doc); err != nil {
+		return err
+	}
+
+	if err = vfs.UnlockFile(instance.Domain, doc.ID(), lockOwner(c)); err != nil {
+		return WrapVfsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
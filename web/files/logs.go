@@ -0,0 +1,64 @@
+package files
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+	"github.com/sirupsen/logrus"
+)
+
+// Operations on the files and directories that are logged
+const (
+	opCreate    = "create"
+	opOverwrite = "overwrite"
+	opAppend    = "append"
+	opTrash     = "trash"
+	opMove      = "move"
+	opRestore   = "restore"
+)
+
+// logOperation logs a successful operation on a file or a directory, at the
+// info level. The fields are always the same, so that the logs can be parsed:
+// operation, doc_id, doc_type, size (0 for a directory) and duration_ms. The
+// path of the file or directory is added only at the debug level, for privacy.
+// The operation is also recorded in the audit trail, when it is enabled.
+func logOperation(c echo.Context, operation string, start time.Time, dir *vfs.DirDoc, file *vfs.FileDoc) {
+	if dir != nil {
+		auditOperation(c, operation, dir.ID())
+	} else {
+		auditOperation(c, operation, file.ID())
+	}
+
+	instance := middlewares.GetInstance(c)
+	log := instance.Logger().WithField("nspace", "files")
+	if log.Logger.Level < logrus.InfoLevel {
+		return
+	}
+
+	fields := logrus.Fields{
+		"operation":   operation,
+		"duration_ms": int64(time.Since(start) / time.Millisecond),
+	}
+	if dir != nil {
+		fields["doc_id"] = dir.ID()
+		fields["doc_type"] = dir.Type
+		fields["size"] = int64(0)
+	} else {
+		fields["doc_id"] = file.ID()
+		fields["doc_type"] = file.Type
+		fields["size"] = file.ByteSize
+	}
+
+	if logger.IsDebug(log) {
+		if dir != nil {
+			fields["path"] = dir.Fullpath
+		} else if fullpath, err := file.Path(instance.VFS()); err == nil {
+			fields["path"] = fullpath
+		}
+	}
+
+	log.WithFields(fields).Infof("%s %s", operation, fields["doc_type"])
+}
@@ -0,0 +1,86 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/echo"
+)
+
+// mergePatchContentType is the content type of a JSON merge patch (RFC 7396),
+// that can be used instead of a JSON-API document to modify the metadata of
+// a file or directory.
+const mergePatchContentType = "application/merge-patch+json"
+
+// isMergePatch returns true if the body of the request is a JSON merge patch.
+func isMergePatch(c echo.Context) bool {
+	mediaType, _, err := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	return err == nil && mediaType == mergePatchContentType
+}
+
+// getMergePatch reads a JSON merge patch from the body of the request. Only
+// the mutable attributes can be in the patch. A null value resets the tags
+// and the flags, but the name, the parent and the date can't be removed.
+func getMergePatch(c echo.Context) (*vfs.DocPatch, error) {
+	var attrs map[string]json.RawMessage
+	if err := json.NewDecoder(c.Request().Body).Decode(&attrs); err != nil {
+		return nil, jsonapi.BadJSON()
+	}
+
+	var patch vfs.DocPatch
+	for key, value := range attrs {
+		var dest interface{}
+		switch key {
+		case "name":
+			dest = &patch.Name
+		case "dir_id":
+			dest = &patch.DirID
+		case "parent_path":
+			dest = &patch.ParentPath
+		case "updated_at":
+			dest = &patch.UpdatedAt
+		case "tags":
+			dest = &patch.Tags
+		case "executable":
+			dest = &patch.Executable
+		case "starred":
+			dest = &patch.Starred
+		case "inherit_tags":
+			dest = &patch.InheritTags
+		default:
+			return nil, jsonapi.InvalidAttribute(key, errors.New("This attribute can't be modified"))
+		}
+		if err := json.Unmarshal(value, dest); err != nil {
+			return nil, jsonapi.InvalidAttribute(key, err)
+		}
+	}
+
+	// A null value has left the field to nil
+	removed := func(key string, isNil bool) bool {
+		_, ok := attrs[key]
+		return ok && isNil
+	}
+	if removed("name", patch.Name == nil) ||
+		removed("dir_id", patch.DirID == nil) ||
+		removed("parent_path", patch.ParentPath == nil) ||
+		removed("updated_at", patch.UpdatedAt == nil) {
+		return nil, jsonapi.InvalidAttribute("data", errors.New("The name, the parent and the date can't be removed"))
+	}
+	no := false
+	if removed("tags", patch.Tags == nil) {
+		patch.Tags = &[]string{}
+	}
+	if removed("executable", patch.Executable == nil) {
+		patch.Executable = &no
+	}
+	if removed("starred", patch.Starred == nil) {
+		patch.Starred = &no
+	}
+	if removed("inherit_tags", patch.InheritTags == nil) {
+		patch.InheritTags = &no
+	}
+	return &patch, nil
+}
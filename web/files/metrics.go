@@ -0,0 +1,89 @@
+package files
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/metrics"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/echo"
+)
+
+const (
+	opDownload   = "download"
+	opUploadPart = "upload_part"
+)
+
+// instrument returns a middleware that records the prometheus metrics of an
+// operation on the files: its count and duration by status code, and for the
+// uploads and downloads (direction is not empty), the number of bytes
+// transferred and the number of transfers in progress.
+func instrument(operation, direction string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			transfer := direction
+			// The creation of a directory is not a transfer
+			if c.QueryParam("Type") == consts.DirType {
+				transfer = ""
+			}
+			var body *countingReader
+			if transfer == metrics.FilesTransferUpload {
+				req := c.Request()
+				body = &countingReader{ReadCloser: req.Body}
+				req.Body = body
+			}
+			if transfer != "" {
+				gauge := metrics.FilesActiveTransfers.WithLabelValues(transfer)
+				gauge.Inc()
+				defer gauge.Dec()
+			}
+
+			start := time.Now()
+			err := next(c)
+			code := strconv.Itoa(statusCode(c, err))
+			metrics.FilesOperationsCounter.WithLabelValues(operation, code).Inc()
+			metrics.FilesOperationsDurations.WithLabelValues(operation, code).
+				Observe(time.Since(start).Seconds())
+
+			switch transfer {
+			case metrics.FilesTransferUpload:
+				metrics.FilesTransferSizes.WithLabelValues(operation).Observe(float64(body.n))
+			case metrics.FilesTransferDownload:
+				metrics.FilesTransferSizes.WithLabelValues(operation).Observe(float64(c.Response().Size))
+			}
+			return err
+		}
+	}
+}
+
+// statusCode returns the status code of the response, or the one that will
+// be sent for the error returned by the handler.
+func statusCode(c echo.Context, err error) int {
+	switch e := err.(type) {
+	case nil:
+		if status := c.Response().Status; status != 0 {
+			return status
+		}
+		return http.StatusOK
+	case *jsonapi.Error:
+		return e.Status
+	case *echo.HTTPError:
+		return e.Code
+	}
+	return http.StatusInternalServerError
+}
+
+// countingReader counts the bytes read from the body of a request.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,291 @@
+package files
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// The multipart uploads are used to send a large file in several requests.
+// The parts are written in the temporary directory of the stack, and the file
+// is created in the VFS only when the upload is completed, by streaming the
+// parts one after the other. So, the memory used by an upload is bounded, and
+// an interrupted upload doesn't leave a partial file in the VFS: its parts
+// are removed by the sweeper of the temporary directory.
+
+var (
+	// ErrUploadNotFound is used when a multipart upload does not exist, or
+	// has expired
+	ErrUploadNotFound = errors.New("The upload does not exist or has expired")
+	// ErrUploadPartInvalid is used when the number of a part is not valid
+	ErrUploadPartInvalid = fmt.Errorf("The part number must be between 1 and %d", maxUploadParts)
+	// ErrUploadIncomplete is used when a multipart upload is completed, but
+	// its parts are not numbered from 1 without a gap
+	ErrUploadIncomplete = errors.New("The parts of the upload must be numbered from 1 without a gap")
+)
+
+const (
+	// maxUploadParts is the maximal number of parts of a multipart upload.
+	maxUploadParts = 10000
+	// uploadIDLength is the number of random bytes of the id of an upload.
+	uploadIDLength = 16
+	// uploadDirPrefix is the prefix of the directories of the uploads in the
+	// temporary directory.
+	uploadDirPrefix = "upload-"
+	// uploadPartPrefix is the prefix of the files of the parts in the
+	// directory of an upload.
+	uploadPartPrefix = "part-"
+	// uploadPendingPrefix is the prefix of the files of the parts that are
+	// being written.
+	uploadPendingPrefix = "pending-"
+)
+
+// uploadDir returns the directory of the parts of a multipart upload.
+func uploadDir(domain, uploadID string) (string, error) {
+	if b, err := hex.DecodeString(uploadID); err != nil || len(b) != uploadIDLength {
+		return "", ErrUploadNotFound
+	}
+	dir := vfs.TempPath(domain, uploadDirPrefix+uploadID)
+	if infos, err := os.Stat(dir); err != nil || !infos.IsDir() {
+		return "", ErrUploadNotFound
+	}
+	return dir, nil
+}
+
+// uploadParts returns the paths of the parts of a multipart upload, in order,
+// and their total size.
+func uploadParts(dir string) ([]string, int64, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, 0, ErrUploadNotFound
+	}
+	var size int64
+	var paths []string
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), uploadPartPrefix) {
+			paths = append(paths, filepath.Join(dir, info.Name()))
+			size += info.Size()
+		}
+	}
+	sort.Strings(paths)
+	return paths, size, nil
+}
+
+func uploadPartName(num int) string {
+	return fmt.Sprintf("%s%05d", uploadPartPrefix, num)
+}
+
+// partsReader reads the parts of a multipart upload one after the other,
+// with only one file opened at a time.
+type partsReader struct {
+	paths []string
+	cur   *os.File
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(r.paths[0])
+			if err != nil {
+				return 0, err
+			}
+			r.cur = f
+			r.paths = r.paths[1:]
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close() // #nosec
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
+
+// CreateUploadHandler handles POST requests on /files/_uploads. It starts a
+// multipart upload, and sends its id.
+func CreateUploadHandler(c echo.Context) error {
+	if _, err := permissions.GetPermission(c); err != nil {
+		return err
+	}
+	instance := middlewares.GetInstance(c)
+	id := hex.EncodeToString(crypto.GenerateRandomBytes(uploadIDLength))
+	if err := os.MkdirAll(vfs.TempPath(instance.Domain, uploadDirPrefix+id), 0700); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, echo.Map{"id": id})
+}
+
+// UploadPartHandler handles PUT requests on /files/_uploads/:upload-id/:part
+// to send a part of a multipart upload. A part sent again replaces the
+// previous one.
+func UploadPartHandler(c echo.Context) error {
+	if _, err := permissions.GetPermission(c); err != nil {
+		return err
+	}
+	instance := middlewares.GetInstance(c)
+	num, err := strconv.Atoi(c.Param("part"))
+	if err != nil || num < 1 || num > maxUploadParts {
+		return WrapVfsError(ErrUploadPartInvalid)
+	}
+	dir, err := uploadDir(instance.Domain, c.Param("upload-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+
+	header := c.Request().Header
+	size, err := parseContentLength(header.Get("Content-Length"))
+	if err != nil {
+		return jsonapi.InvalidParameter("Content-Length", err)
+	}
+	var md5Sum []byte
+	if md5Str := header.Get("Content-MD5"); md5Str != "" {
+		if md5Sum, err = parseMD5Hash(md5Str); err != nil {
+			return jsonapi.InvalidParameter("Content-MD5", err)
+		}
+	}
+
+	// The maximal size of an upload is checked with the parts already sent,
+	// so that the temporary directory is not filled with a too large upload.
+	var body io.Reader = c.Request().Body
+	if max := vfs.MaxUploadSize(); max >= 0 {
+		_, current, _ := uploadParts(dir)
+		if current > max || (size >= 0 && current+size > max) {
+			return WrapVfsError(vfs.ErrUploadTooBig)
+		}
+		body = io.LimitReader(body, max-current+1)
+	}
+
+	tmp, err := ioutil.TempFile(dir, uploadPendingPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // #nosec
+	h := md5.New()              // #nosec
+	written, err := io.Copy(io.MultiWriter(tmp, h), body)
+	if errc := tmp.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		if err == io.ErrUnexpectedEOF && size >= 0 {
+			err = vfs.ErrContentLengthMismatch
+		}
+		return WrapVfsError(err)
+	}
+	sum := h.Sum(nil)
+	switch {
+	case size >= 0 && written != size:
+		return WrapVfsError(vfs.ErrContentLengthMismatch)
+	case md5Sum != nil && string(md5Sum) != string(sum):
+		return WrapVfsError(vfs.ErrInvalidHash)
+	}
+	if max := vfs.MaxUploadSize(); max >= 0 {
+		if _, current, _ := uploadParts(dir); current+written > max {
+			return WrapVfsError(vfs.ErrUploadTooBig)
+		}
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(dir, uploadPartName(num))); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"part":   num,
+		"size":   written,
+		"md5sum": base64.StdEncoding.EncodeToString(sum),
+	})
+}
+
+// AbortUploadHandler handles DELETE requests on /files/_uploads/:upload-id to
+// cancel a multipart upload and remove its parts.
+func AbortUploadHandler(c echo.Context) error {
+	if _, err := permissions.GetPermission(c); err != nil {
+		return err
+	}
+	instance := middlewares.GetInstance(c)
+	dir, err := uploadDir(instance.Domain, c.Param("upload-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// completeUpload creates a file from the parts of a multipart upload, given
+// by the UploadID parameter: they are streamed as the body of the request to
+// the next handler. So, the file is created with the same checks as a normal
+// upload, and the Content-MD5 header, if any, is the md5sum of the whole
+// file, checked by the VFS against the assembled content. The parts are
+// removed when the file has been created, and kept for another try if it has
+// failed.
+func completeUpload(c echo.Context, uploadID string, next echo.HandlerFunc) error {
+	if c.QueryParam("Type") != consts.FileType || c.QueryParam("Source") != "" {
+		return jsonapi.InvalidParameter("UploadID",
+			errors.New("UploadID can only be used to upload a file"))
+	}
+	instance := middlewares.GetInstance(c)
+	dir, err := uploadDir(instance.Domain, uploadID)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	paths, size, err := uploadParts(dir)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	for i, p := range paths {
+		if filepath.Base(p) != uploadPartName(i+1) {
+			return WrapVfsError(ErrUploadIncomplete)
+		}
+	}
+	if len(paths) == 0 {
+		return WrapVfsError(ErrUploadIncomplete)
+	}
+
+	body := &partsReader{paths: paths}
+	defer body.Close()
+	req := c.Request()
+	req.Body = body
+	req.ContentLength = size
+	req.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	if err = next(c); err != nil {
+		return err
+	}
+	if c.Response().Status < 300 {
+		os.RemoveAll(dir) // #nosec
+	}
+	return nil
+}
@@ -2,57 +2,127 @@ package files
 
 // Links is used to generate a JSON-API link for the directory (part of
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/cozy/echo"
 )
 
 const (
-	defPerPage = 30
+	// maxIncludedContents is the maximal number of children of a directory
+	// that are included in its JSON-API document: the next ones must be
+	// fetched with the pagination.
+	maxIncludedContents = 1000
+)
+
+// The relationships that can be included in a compound document
+const (
+	includeParent   = "parent"
+	includeContents = "contents"
 )
 
 type dir struct {
 	doc      *vfs.DirDoc
 	rel      jsonapi.RelationshipMap
 	included []jsonapi.Object
+	fields   map[string]bool // sparse fieldset, nil for all the attributes
 }
 
 type file struct {
 	doc      *vfs.FileDoc
 	instance *instance.Instance
+	lock     *vfs.FileLock
+	included []jsonapi.Object
+	fields   map[string]bool    // sparse fieldset, nil for all the attributes
+	links    *jsonapi.LinksList // computed only once, as they contain a secret
 }
 
 type apiArchive struct {
 	*vfs.Archive
 }
 
+// archiveFile is a file of the manifest of an archive
+type archiveFile struct {
+	vfs.ArchiveFile
+}
+
 func newDir(doc *vfs.DirDoc) *dir {
 	return &dir{doc: doc}
 }
 
-func getDirData(c echo.Context, doc *vfs.DirDoc) (int, couchdb.Cursor, []vfs.DirOrFileDoc, error) {
+// getDirData returns a page of the children of a directory. If maxLimit is
+// positive, the number of children asked by the client is capped to it.
+func getDirData(c echo.Context, doc *vfs.DirDoc, maxLimit int) (int, couchdb.Cursor, []vfs.DirOrFileDoc, error) {
 	instance := middlewares.GetInstance(c)
 	fs := instance.VFS()
 
-	cursor, err := jsonapi.ExtractPaginationCursor(c, defPerPage)
+	cursor, err := jsonapi.ExtractPaginationCursor(c, 0)
 	if err != nil {
 		return 0, nil, nil, err
 	}
+	if maxLimit > 0 {
+		capCursorLimit(cursor, maxLimit)
+	}
 
-	count, err := fs.DirLength(doc)
+	trashed, err := trashedFilterFromReq(c)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	updatedSince, err := dateFilterFromReq(c, "updated_since")
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	createdSince, err := dateFilterFromReq(c, "created_since")
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	classes := classFilterFromReq(c)
+	trashedAtSort, err := trashSortFromReq(c, doc)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if updatedSince != nil || createdSince != nil || len(classes) > 0 || trashedAtSort != "" {
+		filter := &vfs.DirFilter{
+			Trashed:       trashed,
+			UpdatedSince:  updatedSince,
+			CreatedSince:  createdSince,
+			Classes:       classes,
+			TrashedAtSort: trashedAtSort,
+		}
+		return getFilteredDirData(fs, doc, cursor, filter)
+	}
+
+	var count int
+	if trashed == nil {
+		count, err = fs.DirLength(doc)
+	} else {
+		count, err = fs.DirLengthTrashed(doc, *trashed)
+	}
 	if err != nil {
 		return 0, nil, nil, err
 	}
 
 	// Hide the trash folder when listing the root directory.
+	hideTrash := doc.ID() == consts.RootDirID && (trashed == nil || !*trashed)
 	var limit int
-	if doc.ID() == consts.RootDirID {
+	if hideTrash {
 		if count > 0 {
 			count--
 		}
@@ -72,12 +142,17 @@ func getDirData(c echo.Context, doc *vfs.DirDoc) (int, couchdb.Cursor, []vfs.Dir
 		}
 	}
 
-	children, err := fs.DirBatch(doc, cursor)
+	var children []vfs.DirOrFileDoc
+	if trashed == nil {
+		children, err = fs.DirBatch(doc, cursor)
+	} else {
+		children, err = fs.DirBatchTrashed(doc, *trashed, cursor)
+	}
 	if err != nil {
 		return 0, nil, nil, err
 	}
 
-	if doc.ID() == consts.RootDirID {
+	if hideTrash {
 		switch c := cursor.(type) {
 		case *couchdb.StartKeyCursor:
 			c.Limit = limit
@@ -90,21 +165,197 @@ func getDirData(c echo.Context, doc *vfs.DirDoc) (int, couchdb.Cursor, []vfs.Dir
 	return count, cursor, children, nil
 }
 
+// getFilteredDirData is used for the date and class filters, and for the sort
+// of the trash, that are applied with a mango query. It only works with a
+// skip cursor, and the total number of children is not known (the same
+// convention as for _find is used).
+func getFilteredDirData(fs vfs.VFS, doc *vfs.DirDoc, cursor couchdb.Cursor, filter *vfs.DirFilter) (int, couchdb.Cursor, []vfs.DirOrFileDoc, error) {
+	var skipCursor *couchdb.SkipCursor
+	switch c := cursor.(type) {
+	case *couchdb.SkipCursor:
+		skipCursor = c
+	case *couchdb.StartKeyCursor:
+		if c.NextKey != nil {
+			return 0, nil, nil, jsonapi.InvalidParameter("page[cursor]",
+				errors.New("page[skip] must be used with the filters"))
+		}
+		skipCursor = couchdb.NewSkipCursor(c.Limit, 0).(*couchdb.SkipCursor)
+	}
+
+	skip := skipCursor.Skip
+	children, err := fs.DirBatchFiltered(doc, filter, skipCursor)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	var count int
+	if skipCursor.HasMore() {
+		count = math.MaxInt32 - 1 // we dont know the actual number
+	} else {
+		count = skip + len(children)
+	}
+	return count, skipCursor, children, nil
+}
+
+// cursorLimit returns the number of items per page of a cursor.
+func cursorLimit(cursor couchdb.Cursor) int {
+	switch c := cursor.(type) {
+	case *couchdb.StartKeyCursor:
+		return c.Limit
+	case *couchdb.SkipCursor:
+		return c.Limit
+	}
+	return 0
+}
+
+// capCursorLimit reduces the limit of a cursor to the given maximum.
+func capCursorLimit(cursor couchdb.Cursor, max int) {
+	switch c := cursor.(type) {
+	case *couchdb.StartKeyCursor:
+		if c.Limit <= 0 || c.Limit > max {
+			c.Limit = max
+		}
+	case *couchdb.SkipCursor:
+		if c.Limit <= 0 || c.Limit > max {
+			c.Limit = max
+		}
+	}
+}
+
+// dateFilterFromReq parses the query parameter with the given name as a
+// RFC3339 date, used to filter the children of a directory.
+func dateFilterFromReq(c echo.Context, param string) (*time.Time, error) {
+	value := c.QueryParam(param)
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, jsonapi.InvalidParameter(param, err)
+	}
+	return &t, nil
+}
+
+// classFilterFromReq reads the class query parameter used to filter the
+// children of a directory. Several classes can be given, separated by commas
+// or by repeating the parameter.
+func classFilterFromReq(c echo.Context) []string {
+	var classes []string
+	for _, value := range c.QueryParams()["class"] {
+		for _, class := range strings.Split(value, ",") {
+			if class = strings.TrimSpace(class); class != "" {
+				classes = append(classes, class)
+			}
+		}
+	}
+	return classes
+}
+
+// trashSortFromReq reads the sort query parameter. The only supported sort is
+// on the date of the deletion, for the trash: trashed_at for the oldest first,
+// and -trashed_at for the most recent first.
+func trashSortFromReq(c echo.Context, doc *vfs.DirDoc) (mango.SortDirection, error) {
+	var direction mango.SortDirection
+	switch c.QueryParam("sort") {
+	case "":
+		return "", nil
+	case "trashed_at":
+		direction = mango.Asc
+	case "-trashed_at":
+		direction = mango.Desc
+	default:
+		return "", jsonapi.InvalidParameter("sort",
+			errors.New("sort must be trashed_at or -trashed_at"))
+	}
+	if doc.ID() != consts.TrashDirID {
+		return "", jsonapi.InvalidParameter("sort",
+			errors.New("sort can only be used for the trash"))
+	}
+	return direction, nil
+}
+
+// trashedFilterFromReq reads the trashed query parameter used to filter the
+// children of a directory: it can be include (the default), exclude or only.
+// A nil value means that no filter should be applied.
+func trashedFilterFromReq(c echo.Context) (*bool, error) {
+	var trashed bool
+	switch c.QueryParam("trashed") {
+	case "", "include":
+		return nil, nil
+	case "exclude":
+		trashed = false
+	case "only":
+		trashed = true
+	default:
+		return nil, jsonapi.InvalidParameter("trashed",
+			errors.New("trashed must be include, exclude or only"))
+	}
+	return &trashed, nil
+}
+
+// paginationParams returns the query parameters for the next page of the
+// children of a directory.
+func paginationParams(c echo.Context, cursor couchdb.Cursor) (url.Values, error) {
+	params, err := jsonapi.PaginationCursorToParams(cursor)
+	if err != nil {
+		return nil, err
+	}
+	for _, filter := range []string{"trashed", "updated_since", "created_since", "sort", "include", "fields[" + consts.Files + "]"} {
+		if value := c.QueryParam(filter); value != "" {
+			params.Set(filter, value)
+		}
+	}
+	if classes := classFilterFromReq(c); len(classes) > 0 {
+		params.Set("class", strings.Join(classes, ","))
+	}
+	return params, nil
+}
+
+// dirData sends the JSON-API document for a directory. Its children are
+// included, unless the include parameter asks only for the parent.
 func dirData(c echo.Context, statusCode int, doc *vfs.DirDoc) error {
 	instance := middlewares.GetInstance(c)
-	count, cursor, children, err := getDirData(c, doc)
+	include, err := includeFromReq(c)
+	if err != nil {
+		return err
+	}
+	count, cursor, children, err := getDirData(c, doc, maxIncludedContents)
 	if err != nil {
 		return err
 	}
+	limit := cursorLimit(cursor)
+
+	var parentDir *dir
+	if include[includeParent] && doc.ID() != consts.RootDirID {
+		parentDir = includedParent(c, doc.DirID)
+	}
+
+	if c.Request().Method == http.MethodGet {
+		var parentDoc *vfs.DirDoc
+		if parentDir != nil {
+			parentDoc = parentDir.doc
+		}
+		etag := listingETag(c, doc, parentDoc, count, children)
+		c.Response().Header().Set("Etag", etag)
+		if checkIfNoneMatch(c, etag) {
+			return c.NoContent(http.StatusNotModified)
+		}
+	}
 
 	relsData := make([]couchdb.DocReference, 0)
 	included := make([]jsonapi.Object, 0)
+	if parentDir != nil {
+		included = append(included, parentDir)
+	}
 
 	for _, child := range children {
 		if child.ID() == consts.TrashDirID {
 			continue
 		}
 		relsData = append(relsData, couchdb.DocReference{ID: child.ID(), Type: child.DocType()})
+		if include != nil && !include[includeContents] {
+			continue
+		}
 		d, f := child.Refine()
 		if d != nil {
 			included = append(included, newDir(d))
@@ -128,7 +379,7 @@ func dirData(c echo.Context, statusCode int, doc *vfs.DirDoc) error {
 	rel := jsonapi.RelationshipMap{
 		"parent": parent,
 		"contents": jsonapi.Relationship{
-			Meta: &jsonapi.RelationshipMeta{Count: &count},
+			Meta: &jsonapi.RelationshipMeta{Count: &count, Limit: &limit},
 			Links: &jsonapi.LinksList{
 				Self: "/files/" + doc.DocID + "/relationships/contents",
 			},
@@ -143,7 +394,7 @@ func dirData(c echo.Context, statusCode int, doc *vfs.DirDoc) error {
 
 	var links jsonapi.LinksList
 	if cursor.HasMore() {
-		params, err := jsonapi.PaginationCursorToParams(cursor)
+		params, err := paginationParams(c, cursor)
 		if err != nil {
 			return err
 		}
@@ -152,22 +403,31 @@ func dirData(c echo.Context, statusCode int, doc *vfs.DirDoc) error {
 		links.Next = "/files/" + doc.DocID + "?" + params.Encode()
 	}
 
+	fields := fieldsFromReq(c)
 	d := &dir{
 		doc:      doc,
 		rel:      rel,
-		included: included,
+		included: withFields(included, fields),
+		fields:   fields,
 	}
 
+	preloadThumbnails(c, d.included)
 	return jsonapi.Data(c, statusCode, d, &links)
 }
 
 func dirDataList(c echo.Context, statusCode int, doc *vfs.DirDoc) error {
 	instance := middlewares.GetInstance(c)
-	count, cursor, children, err := getDirData(c, doc)
+	count, cursor, children, err := getDirData(c, doc, 0)
 	if err != nil {
 		return err
 	}
 
+	etag := listingETag(c, doc, nil, count, children)
+	c.Response().Header().Set("Etag", etag)
+	if checkIfNoneMatch(c, etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
 	included := make([]jsonapi.Object, 0)
 	for _, child := range children {
 		if child.ID() == consts.TrashDirID {
@@ -183,7 +443,7 @@ func dirDataList(c echo.Context, statusCode int, doc *vfs.DirDoc) error {
 
 	var links jsonapi.LinksList
 	if cursor.HasMore() {
-		params, err := jsonapi.PaginationCursorToParams(cursor)
+		params, err := paginationParams(c, cursor)
 		if err != nil {
 			return err
 		}
@@ -191,21 +451,156 @@ func dirDataList(c echo.Context, statusCode int, doc *vfs.DirDoc) error {
 		links.Next = next
 	}
 
-	return jsonapi.DataListWithTotal(c, statusCode, count, included, &links)
+	included = withFields(included, fieldsFromReq(c))
+	preloadThumbnails(c, included)
+	return jsonapi.DataListPage(c, statusCode, count, cursorLimit(cursor), included, &links)
+}
+
+// preloadThumbnails adds a Link header to preload the small thumbnail of the
+// images in a directory listing, so that a gallery view can fetch them
+// without waiting for the JSON-API document to be parsed. The number of
+// headers is limited by the fs.preload_thumbnails parameter of the config.
+func preloadThumbnails(c echo.Context, objs []jsonapi.Object) {
+	max := config.GetConfig().Fs.PreloadThumbnails
+	header := c.Response().Header()
+	count := 0
+	for _, o := range objs {
+		if count >= max {
+			return
+		}
+		f, ok := o.(*file)
+		if !ok || f.doc.Class != "image" {
+			continue
+		}
+		if small := f.Links().Small; small != "" {
+			header.Add("Link", "<"+small+">; rel=preload; as=image")
+			count++
+		}
+	}
+}
+
+// listingETag returns a weak ETag for a page of the children of a directory.
+// It is computed from the revision of the directory (and of its parent if it
+// is included), the path and query string (for the pagination, filters and
+// fields), the total number of children, and the identifiers and revisions of
+// the children in the page. So, it changes when a child of the page is
+// modified, or when a child is added or removed.
+//
+// The links to the thumbnails have secrets that expire: when the page has
+// such links, the ETag also changes every half of the TTL of the secrets, so
+// that a response validated with a 304 still has links valid for at least
+// this half.
+func listingETag(c echo.Context, doc, parent *vfs.DirDoc, count int, children []vfs.DirOrFileDoc) string {
+	h := md5.New()
+	u := c.Request().URL
+	fmt.Fprintf(h, "%s\n%s\n%s\n%d\n", doc.Rev(), u.Path, u.RawQuery, count)
+	if parent != nil {
+		fmt.Fprintf(h, "parent %s %s\n", parent.ID(), parent.Rev())
+	}
+	thumbnails := false
+	for _, child := range children {
+		fmt.Fprintf(h, "%s %s\n", child.ID(), child.Rev())
+		if _, f := child.Refine(); f != nil && vfs.HasThumbnails(f) {
+			thumbnails = true
+		}
+	}
+	if thumbnails {
+		period := vfs.SecretTTL() / 2
+		fmt.Fprintf(h, "secrets %d\n", time.Now().Truncate(period).Unix())
+	}
+	return fmt.Sprintf(`W/"%s"`, hex.EncodeToString(h.Sum(nil)))
 }
 
 // newFile creates an instance of file struct from a vfs.FileDoc document.
 func newFile(doc *vfs.FileDoc, i *instance.Instance) *file {
-	return &file{doc, i}
+	return &file{doc: doc, instance: i}
 }
 
+// fileData sends the JSON-API document for a file. The lock on the file, if
+// any, is added to its attributes, and its parent directory is included if
+// asked with the include parameter.
 func fileData(c echo.Context, statusCode int, doc *vfs.FileDoc, links *jsonapi.LinksList) error {
 	instance := middlewares.GetInstance(c)
-	return jsonapi.Data(c, statusCode, newFile(doc, instance), links)
+	include, err := includeFromReq(c)
+	if err != nil {
+		return err
+	}
+	f := newFileWithLock(instance, doc)
+	f.fields = fieldsFromReq(c)
+	if include[includeParent] {
+		if parent := includedParent(c, doc.DirID); parent != nil {
+			f.included = withFields([]jsonapi.Object{parent}, f.fields)
+		}
+	}
+	return jsonapi.Data(c, statusCode, f, links)
+}
+
+// newFileWithLock creates an instance of file struct, with the lock on the
+// file if any.
+func newFileWithLock(i *instance.Instance, doc *vfs.FileDoc) *file {
+	f := newFile(doc, i)
+	if lock, err := vfs.GetFileLock(i.Domain, doc.ID()); err == nil {
+		f.lock = lock
+	}
+	return f
+}
+
+// includeFromReq returns the relationships to include in the compound
+// document, asked with the include parameter, or nil if the parameter is
+// absent. The contents of a file are ignored, as it has no children.
+func includeFromReq(c echo.Context) (map[string]bool, error) {
+	include := jsonapi.ExtractInclude(c)
+	for rel := range include {
+		if rel != includeParent && rel != includeContents {
+			return nil, jsonapi.InvalidParameter("include",
+				errors.New("include must be parent and/or contents"))
+		}
+	}
+	return include, nil
+}
+
+// includedParent returns the parent directory to include in a compound
+// document, or nil if the client is not allowed to read it.
+func includedParent(c echo.Context, dirID string) *dir {
+	if dirID == "" {
+		return nil
+	}
+	parent, err := middlewares.GetInstance(c).VFS().DirByID(dirID)
+	if err != nil {
+		return nil
+	}
+	if err = checkPerm(c, permissions.GET, parent, nil); err != nil {
+		return nil
+	}
+	return newDir(parent)
+}
+
+// fieldsFromReq returns the sparse fieldset asked by the client with the
+// fields[io.cozy.files] parameter, or nil for all the attributes.
+func fieldsFromReq(c echo.Context) map[string]bool {
+	return jsonapi.ExtractFields(c, consts.Files)
+}
+
+// withFields restricts the attributes of the files and directories to the
+// given sparse fieldset.
+func withFields(objs []jsonapi.Object, fields map[string]bool) []jsonapi.Object {
+	if fields == nil {
+		return objs
+	}
+	for _, o := range objs {
+		switch o := o.(type) {
+		case *dir:
+			o.fields = fields
+		case *file:
+			o.fields = fields
+		}
+	}
+	return objs
 }
 
 var (
 	_ jsonapi.Object = (*apiArchive)(nil)
+	_ jsonapi.Object = (*archiveFile)(nil)
 	_ jsonapi.Object = (*dir)(nil)
 	_ jsonapi.Object = (*file)(nil)
 )
@@ -218,7 +613,13 @@ func (d *dir) DocType() string                        { return d.doc.DocType() }
 func (d *dir) Clone() couchdb.Doc                     { cloned := *d; return &cloned }
 func (d *dir) Relationships() jsonapi.RelationshipMap { return d.rel }
 func (d *dir) Included() []jsonapi.Object             { return d.included }
-func (d *dir) MarshalJSON() ([]byte, error)           { return json.Marshal(d.doc) }
+func (d *dir) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(d.doc)
+	if err != nil || d.fields == nil {
+		return b, err
+	}
+	return jsonapi.FilterAttributes(b, d.fields)
+}
 func (d *dir) Links() *jsonapi.LinksList {
 	return &jsonapi.LinksList{Self: "/files/" + d.doc.DocID}
 }
@@ -230,6 +631,33 @@ func (a *apiArchive) Links() *jsonapi.LinksList {
 	return &jsonapi.LinksList{Self: "/files/archive/" + a.Secret}
 }
 
+func (a *archiveFile) ID() string                             { return a.File.ID() }
+func (a *archiveFile) Rev() string                            { return a.File.Rev() }
+func (a *archiveFile) SetID(_ string)                         {}
+func (a *archiveFile) SetRev(_ string)                        {}
+func (a *archiveFile) DocType() string                        { return consts.Files }
+func (a *archiveFile) Clone() couchdb.Doc                     { cloned := *a; return &cloned }
+func (a *archiveFile) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *archiveFile) Included() []jsonapi.Object             { return nil }
+func (a *archiveFile) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/" + a.File.DocID}
+}
+func (a *archiveFile) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Path      string    `json:"path"`
+		Name      string    `json:"name"`
+		Size      int64     `json:"size,string"`
+		MD5Sum    []byte    `json:"md5sum"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}{
+		Path:      a.Name,
+		Name:      a.File.DocName,
+		Size:      a.File.ByteSize,
+		MD5Sum:    a.File.MD5Sum,
+		UpdatedAt: a.File.UpdatedAt,
+	})
+}
+
 func (f *file) ID() string         { return f.doc.ID() }
 func (f *file) Rev() string        { return f.doc.Rev() }
 func (f *file) SetID(id string)    { f.doc.SetID(id) }
@@ -255,17 +683,37 @@ func (f *file) Relationships() jsonapi.RelationshipMap {
 		},
 	}
 }
-func (f *file) Included() []jsonapi.Object { return []jsonapi.Object{} }
+func (f *file) Included() []jsonapi.Object {
+	if f.included == nil {
+		return []jsonapi.Object{}
+	}
+	return f.included
+}
 func (f *file) MarshalJSON() ([]byte, error) {
 	ref := f.doc.ReferencedBy
 	f.doc.ReferencedBy = nil
-	res, err := json.Marshal(f.doc)
-	f.doc.ReferencedBy = ref
-	return res, err
+	defer func() { f.doc.ReferencedBy = ref }()
+	var b []byte
+	var err error
+	if f.lock == nil {
+		b, err = json.Marshal(f.doc)
+	} else {
+		b, err = json.Marshal(struct {
+			*vfs.FileDoc
+			Lock *vfs.FileLock `json:"lock"`
+		}{f.doc, f.lock})
+	}
+	if err != nil || f.fields == nil {
+		return b, err
+	}
+	return jsonapi.FilterAttributes(b, f.fields)
 }
 func (f *file) Links() *jsonapi.LinksList {
+	if f.links != nil {
+		return f.links
+	}
 	links := jsonapi.LinksList{Self: "/files/" + f.doc.DocID}
-	if f.doc.Class == "image" {
+	if vfs.HasThumbnails(f.doc) {
 		if path, err := f.doc.Path(f.instance.VFS()); err == nil {
 			if secret, err := vfs.GetStore().AddFile(f.instance.Domain, path); err == nil {
 				links.Small = "/files/" + f.doc.DocID + "/thumbnails/" + secret + "/small"
@@ -274,5 +722,6 @@ func (f *file) Links() *jsonapi.LinksList {
 			}
 		}
 	}
-	return &links
+	f.links = &links
+	return f.links
 }
@@ -0,0 +1,62 @@
+package files
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/echo"
+)
+
+const (
+	// preferHeader is the header used by the clients to ask for a minimal
+	// response to a write request (RFC 7240).
+	preferHeader = "Prefer"
+	// preferenceAppliedHeader is the header that tells the client that its
+	// preference has been honored.
+	preferenceAppliedHeader = "Preference-Applied"
+	// returnMinimal is the preference for a response without the attributes
+	// of the document.
+	returnMinimal = "return=minimal"
+)
+
+// apiMinimal is the JSON-API object sent for a minimal response: only the
+// type, the id and the revision of the document.
+type apiMinimal struct {
+	Type string       `json:"type"`
+	ID   string       `json:"id"`
+	Meta jsonapi.Meta `json:"meta"`
+}
+
+// preferMinimal returns true if the client has asked for a minimal response,
+// with a Prefer: return=minimal header.
+func preferMinimal(c echo.Context) bool {
+	for _, value := range c.Request().Header[preferHeader] {
+		for _, pref := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), returnMinimal) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// minimalData sends a JSON-API document with only the id and revision of the
+// written document, for the clients that don't need the full representation.
+func minimalData(c echo.Context, statusCode int, doc couchdb.Doc) error {
+	resp := c.Response()
+	resp.Header().Set(preferenceAppliedHeader, returnMinimal)
+	resp.Header().Set(echo.HeaderContentType, jsonapi.ContentType)
+	resp.WriteHeader(statusCode)
+	return json.NewEncoder(resp).Encode(struct {
+		Data apiMinimal `json:"data"`
+	}{
+		Data: apiMinimal{
+			Type: consts.Files,
+			ID:   doc.ID(),
+			Meta: jsonapi.Meta{Rev: doc.Rev()},
+		},
+	})
+}
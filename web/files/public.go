@@ -0,0 +1,238 @@
+package files
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const (
+	defaultPublicAccessesLimit = 100
+	maxPublicAccessesLimit     = 1000
+)
+
+type apiPublicLink struct {
+	*vfs.PublicLink
+}
+
+func (p *apiPublicLink) Relationships() jsonapi.RelationshipMap { return nil }
+func (p *apiPublicLink) Included() []jsonapi.Object             { return nil }
+func (p *apiPublicLink) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{
+		Self:    "/files/" + p.FileID() + "/share/public",
+		Related: "/files/public/" + p.Token,
+	}
+}
+func (p *apiPublicLink) Clone() couchdb.Doc {
+	cloned := *p.PublicLink
+	return &apiPublicLink{&cloned}
+}
+
+type apiPublicAccess struct {
+	*vfs.PublicAccess
+}
+
+func (a *apiPublicAccess) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiPublicAccess) Included() []jsonapi.Object             { return nil }
+func (a *apiPublicAccess) Links() *jsonapi.LinksList              { return nil }
+func (a *apiPublicAccess) Clone() couchdb.Doc {
+	cloned := *a.PublicAccess
+	return &apiPublicAccess{&cloned}
+}
+
+// CreatePublicLinkHandler handles POST requests on
+// /files/:file-id/share/public. It returns the public link of the file, and
+// creates it if the file has no public link yet.
+func CreatePublicLinkHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.PATCH, nil, doc); err != nil {
+		return err
+	}
+	if doc.Trashed {
+		return WrapVfsError(vfs.ErrFileInTrash)
+	}
+	link, created, err := vfs.CreatePublicLink(instance, doc.ID())
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	return jsonapi.Data(c, status, &apiPublicLink{link}, nil)
+}
+
+// ReadPublicLinkHandler handles GET requests on /files/:file-id/share/public.
+// It returns the public link of the file.
+func ReadPublicLinkHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+	link, err := vfs.GetPublicLink(instance, doc.ID())
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiPublicLink{link}, nil)
+}
+
+// RevokePublicLinkHandler handles DELETE requests on
+// /files/:file-id/share/public. The public link can no longer be used to
+// access the file.
+func RevokePublicLinkHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.PATCH, nil, doc); err != nil {
+		return err
+	}
+	link, err := vfs.GetPublicLink(instance, doc.ID())
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = vfs.RevokePublicLink(instance, link); err != nil {
+		return WrapVfsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ListPublicAccessesHandler handles GET requests on
+// /files/:file-id/share/public/accesses. It returns the records of the
+// accesses to the file via its public link, the most recent first.
+func ListPublicAccessesHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+	limit, err := limitFromReq(c, defaultPublicAccessesLimit, maxPublicAccessesLimit)
+	if err != nil {
+		return err
+	}
+	accesses, err := vfs.PublicAccesses(instance, doc.ID(), limit)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	objs := make([]jsonapi.Object, len(accesses))
+	for i, access := range accesses {
+		objs[i] = &apiPublicAccess{access}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// PublicLinkHandler handles GET requests on /files/public/:token. It serves
+// the content of the file shared with this public link, without requiring a
+// permission, and records the access.
+func PublicLinkHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	link, err := vfs.PublicLinkByToken(instance, c.Param("token"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	doc, err := instance.VFS().FileByID(link.FileID())
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if doc.Trashed {
+		return WrapVfsError(os.ErrNotExist)
+	}
+	if err = sendFile(c, doc, false); err != nil {
+		return err
+	}
+	ip := clientIP(c.Request())
+	go func() {
+		if err := vfs.WritePublicAccess(instance, instance.PublicAccessSecret(), doc.ID(), ip); err != nil {
+			instance.Logger().WithField("nspace", "files").
+				Warnf("Cannot record the access to %s: %s", doc.ID(), err)
+		}
+	}()
+	return nil
+}
+
+// clientIP returns the IP address of the client. The X-Forwarded-For header
+// can be forged by the client, so it is used only when the request comes from
+// one of the reverse proxies of the fs.trusted_proxies parameter: the address
+// is then the last one of the header that is not a trusted proxy.
+func clientIP(req *http.Request) string {
+	ip := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	proxies := trustedProxies()
+	if !inNetworks(ip, proxies) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		candidate := strings.TrimSpace(forwarded[i])
+		if candidate == "" {
+			continue
+		}
+		ip = candidate
+		if !inNetworks(candidate, proxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// trustedProxies returns the networks of the fs.trusted_proxies parameter,
+// where an item can be an IP address or a CIDR range. The invalid items are
+// ignored.
+func trustedProxies() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, item := range config.GetConfig().Fs.TrustedProxies {
+		item = strings.TrimSpace(item)
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if _, network, err := net.ParseCIDR(item); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+func inNetworks(addr string, networks []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
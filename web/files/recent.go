@@ -0,0 +1,52 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const (
+	defaultRecentLimit = 20
+	maxRecentLimit     = 100
+)
+
+// ListRecentHandler handles GET requests on /files/_recent. It returns the
+// most recently updated files (not the directories) that are not in the
+// trash. The class parameter can be used to keep only the files of a class.
+func ListRecentHandler(c echo.Context) error {
+	if err := permissions.AllowWholeType(c, permissions.GET, consts.Files); err != nil {
+		return err
+	}
+
+	limit := defaultRecentLimit
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return jsonapi.InvalidParameter("limit", errors.New("Invalid limit"))
+		}
+		if n < maxRecentLimit {
+			limit = n
+		} else {
+			limit = maxRecentLimit
+		}
+	}
+
+	instance := middlewares.GetInstance(c)
+	files, err := vfs.RecentFiles(instance, c.QueryParam("class"), limit)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	objs := make([]jsonapi.Object, len(files))
+	for i, doc := range files {
+		objs[i] = newFile(doc, instance)
+	}
+	return jsonapi.DataList(c, http.StatusOK, withFields(objs, fieldsFromReq(c)), nil)
+}
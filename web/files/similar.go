@@ -0,0 +1,120 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// defaultSimilarDistance is the maximal Hamming distance between the
+// perceptual hashes of two images for them to be considered as similar
+const defaultSimilarDistance = 10
+
+// maxSimilarImages is the maximal number of images returned as similar
+const maxSimilarImages = 100
+
+// similarScanPageSize is the number of rows of the by-phash view that are
+// loaded in memory at once when looking for the similar images
+const similarScanPageSize = 1000
+
+// ErrNotAnImage is used when looking for the similar images of a file that
+// is not an image
+var ErrNotAnImage = errors.New("The file is not an image")
+
+// SimilarImagesHandler handles GET requests on /files/:file-id/similar. It
+// returns the other images that look like the given one, by comparing their
+// perceptual hashes.
+func SimilarImagesHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+	if doc.Class != "image" {
+		return jsonapi.InvalidParameter("file-id", ErrNotAnImage)
+	}
+
+	distance := defaultSimilarDistance
+	if d := c.QueryParam("distance"); d != "" {
+		distance, err = strconv.Atoi(d)
+		if err != nil || distance < 0 || distance > 64 {
+			return jsonapi.InvalidParameter("distance", errors.New("Invalid distance"))
+		}
+	}
+
+	objs := []jsonapi.Object{}
+	phash, _ := doc.Metadata["phash"].(string)
+	if phash == "" {
+		return jsonapi.DataList(c, http.StatusOK, objs, nil)
+	}
+
+	// The hashes are compared in memory, page by page, and only the documents
+	// of the images that are close enough are then fetched. The scan stops
+	// when enough hashes have been found.
+	var keys []interface{}
+	seen := make(map[string]struct{})
+	cursor := couchdb.NewKeyCursor(similarScanPageSize, nil, "")
+	for len(keys) < maxSimilarImages {
+		req := &couchdb.ViewRequest{}
+		cursor.ApplyTo(req)
+		var res couchdb.ViewResponse
+		if err = couchdb.ExecView(instance, consts.FilesByPHashView, req, &res); err != nil {
+			return err
+		}
+		cursor.UpdateFrom(&res)
+		for _, row := range res.Rows {
+			key, ok := row.Key.(string)
+			if !ok || row.ID == doc.ID() {
+				continue
+			}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			if d, errd := vfs.PHashDistance(phash, key); errd == nil && d <= distance {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+		if !cursor.HasMore() {
+			break
+		}
+	}
+	if len(keys) == 0 {
+		return jsonapi.DataList(c, http.StatusOK, objs, nil)
+	}
+
+	req := &couchdb.ViewRequest{Keys: keys, IncludeDocs: true}
+	var res couchdb.ViewResponse
+	if err = couchdb.ExecView(instance, consts.FilesByPHashView, req, &res); err != nil {
+		return err
+	}
+	for _, row := range res.Rows {
+		if row.ID == doc.ID() {
+			continue
+		}
+		var similar vfs.FileDoc
+		if err = json.Unmarshal(row.Doc, &similar); err != nil {
+			return err
+		}
+		if checkPerm(c, permissions.GET, nil, &similar) != nil {
+			continue
+		}
+		objs = append(objs, newFile(&similar, instance))
+		if len(objs) >= maxSimilarImages {
+			break
+		}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
@@ -0,0 +1,417 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"io"
+	mimetype "mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+var (
+	// ErrSourceInvalid is used when the URL given in the Source parameter
+	// cannot be fetched by the stack
+	ErrSourceInvalid = errors.New("The source must be an absolute http or https URL")
+	// ErrSourceForbidden is used when the URL of the source is resolved to
+	// an address of a private network
+	ErrSourceForbidden = errors.New("The source is on a private network")
+	// ErrSourceNotAllowed is used when the scheme or the host of the source
+	// is not allowed by the configuration
+	ErrSourceNotAllowed = errors.New("The source is not allowed by the configuration")
+	// ErrSourceUnreachable is used when the content of the source cannot be
+	// fetched
+	ErrSourceUnreachable = errors.New("The source is unreachable")
+	// ErrSourceTooManyRedirects is used when the source redirects too many
+	// times
+	ErrSourceTooManyRedirects = errors.New("The source has too many redirects")
+	// ErrSourceTooBig is used when the content of the source is larger than
+	// the maximal size of an import
+	ErrSourceTooBig = errors.New("The source is too big")
+)
+
+// sourceNotAllowedCode is the code of the error sent when the source is not
+// allowed by the configuration, for the clients to explain it to the user.
+const sourceNotAllowedCode = "source_not_allowed"
+
+const (
+	// sourceMaxRedirects is the maximal number of redirects followed when
+	// fetching a source.
+	sourceMaxRedirects = 5
+	// sourceDefaultTimeout is the maximal duration of the download of a
+	// source, if it is not configured.
+	sourceDefaultTimeout = 10 * time.Minute
+	// sourceDefaultName is the name of the file when it can't be found in
+	// the response or the URL.
+	sourceDefaultName = "download"
+)
+
+// privateNetworks are the IP ranges that the stack won't contact for
+// importing a file, to avoid Server-Side Request Forgery.
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// isPublicIP returns true if the given IP can be contacted to fetch a source.
+// It is a variable to allow the tests to use a local server.
+var isPublicIP = func(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublicOnly resolves the host and checks that all its addresses are
+// public before connecting, so that a DNS record can't be used to reach the
+// private network.
+func dialPublicOnly(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if !isPublicIP(a.IP) {
+			return nil, ErrSourceForbidden
+		}
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	var conn net.Conn
+	err = ErrSourceUnreachable
+	for _, a := range addrs {
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// sourceClient is the HTTP client used to fetch the sources. It doesn't use
+// the proxy from the environment, as the addresses are checked on dial. The
+// timeout is given by the context of the request.
+var sourceClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:           dialPublicOnly,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= sourceMaxRedirects {
+			return ErrSourceTooManyRedirects
+		}
+		return checkSourceURL(req.URL)
+	},
+}
+
+// checkSourceURL checks that an URL can be used as a source: it must be an
+// http or https URL, and its scheme and host must be allowed by the config.
+func checkSourceURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrSourceInvalid
+	}
+	if u.Host == "" {
+		return ErrSourceInvalid
+	}
+	fsConf := config.GetConfig().Fs
+	schemes := fsConf.ImportSchemes
+	if len(schemes) == 0 {
+		schemes = []string{"https"}
+	}
+	if !utils.IsInArray(u.Scheme, schemes) {
+		return ErrSourceNotAllowed
+	}
+	host := strings.ToLower(u.Hostname())
+	if matchHost(host, fsConf.ImportDeniedHosts) {
+		return ErrSourceNotAllowed
+	}
+	if len(fsConf.ImportAllowedHosts) > 0 && !matchHost(host, fsConf.ImportAllowedHosts) {
+		return ErrSourceNotAllowed
+	}
+	return nil
+}
+
+// matchHost returns true if the host is in the list. An item starting with
+// *. matches the sub-domains of the rest of the item.
+func matchHost(host string, list []string) bool {
+	for _, item := range list {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if strings.HasPrefix(item, "*.") {
+			if strings.HasSuffix(host, item[1:]) {
+				return true
+			}
+		} else if host == item {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchSource starts the download of the given source. The caller must close
+// the body of the response.
+func fetchSource(ctx context.Context, source string) (*http.Response, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, ErrSourceInvalid
+	}
+	if err = checkSourceURL(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, ErrSourceInvalid
+	}
+	req = req.WithContext(ctx)
+	res, err := sourceClient.Do(req)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		switch err {
+		case ErrSourceInvalid, ErrSourceForbidden, ErrSourceNotAllowed, ErrSourceTooManyRedirects:
+			return nil, err
+		}
+		return nil, ErrSourceUnreachable
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, ErrSourceUnreachable
+	}
+	return res, nil
+}
+
+// sourceMaxSize returns the maximal size of a file imported from a source,
+// or -1 if there is no limit other than the disk quota.
+func sourceMaxSize() int64 {
+	max := config.GetConfig().Fs.ImportMaxSize
+	if max <= 0 {
+		max = -1
+	}
+	if m := vfs.MaxUploadSize(); m >= 0 && (max < 0 || m < max) {
+		max = m
+	}
+	return max
+}
+
+// sourceTimeout returns the maximal duration of the download of a source.
+func sourceTimeout() time.Duration {
+	if timeout := config.GetConfig().Fs.ImportTimeout; timeout > 0 {
+		return timeout
+	}
+	return sourceDefaultTimeout
+}
+
+// sourceFileName returns the name of the file for a source, from the
+// Content-Disposition header of the response or else from its URL.
+func sourceFileName(res *http.Response) string {
+	if disposition := res.Header.Get("Content-Disposition"); disposition != "" {
+		if _, params, err := mimetype.ParseMediaType(disposition); err == nil {
+			if name := cleanSourceName(params["filename"]); name != "" {
+				return name
+			}
+		}
+	}
+	if res.Request != nil && res.Request.URL != nil {
+		if name := cleanSourceName(res.Request.URL.Path); name != "" {
+			return name
+		}
+	}
+	return sourceDefaultName
+}
+
+func cleanSourceName(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	return strings.TrimSpace(name)
+}
+
+// downloadSource copies the content of a source in a file of the temporary
+// directory, so that an interrupted download doesn't create a truncated file
+// in the VFS. The caller must close and remove the returned file.
+func downloadSource(domain string, res *http.Response, max int64) (*os.File, int64, error) {
+	tmp, err := vfs.CreateTempFile(domain, "source-")
+	if err != nil {
+		return nil, 0, err
+	}
+	var body io.Reader = res.Body
+	if max >= 0 {
+		body = io.LimitReader(res.Body, max+1)
+	}
+	size, err := io.Copy(tmp, body)
+	switch {
+	case err != nil:
+		err = ErrSourceUnreachable
+	case max >= 0 && size > max:
+		err = ErrSourceTooBig
+	case res.ContentLength >= 0 && size != res.ContentLength:
+		err = ErrSourceUnreachable
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()           // #nosec
+		os.Remove(tmp.Name()) // #nosec
+		return nil, 0, err
+	}
+	return tmp, size, nil
+}
+
+// createFileFromSourceHandler creates a file with the content downloaded by
+// the stack from the URL in the Source parameter. The name and the mime type
+// are taken from the response if they are not given in the request.
+func createFileFromSourceHandler(c echo.Context, fs vfs.VFS, strategy vfs.ConflictStrategy) (f *file, err error) {
+	instance := middlewares.GetInstance(c)
+	tags := strings.Split(c.QueryParam("Tags"), TagSeparator)
+
+	// The permission on the parent directory is checked before fetching the
+	// source, and the one on the file once its name is known.
+	dirID := c.Param("file-id")
+	if dirID == "" {
+		dirID = consts.RootDirID
+	}
+	parent, err := fs.DirByID(dirID)
+	if err != nil {
+		return
+	}
+	if err = checkPerm(c, "POST", parent, nil); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), sourceTimeout())
+	defer cancel()
+	res, err := fetchSource(ctx, c.QueryParam("Source"))
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	max := sourceMaxSize()
+	if max >= 0 && res.ContentLength > max {
+		return nil, ErrSourceTooBig
+	}
+
+	name := c.QueryParam("Name")
+	if name == "" {
+		name = sourceFileName(res)
+	}
+	var doc *vfs.FileDoc
+	doc, err = FileDocFromReq(c, name, dirID, tags)
+	if err != nil {
+		return
+	}
+	if c.Request().Header.Get("Content-Type") == "" {
+		contentType := res.Header.Get("Content-Type")
+		if contentType != "" && !strings.HasPrefix(contentType, "application/octet-stream") {
+			doc.Mime, doc.Class = vfs.ExtractMimeAndClassWithRules(contentType, instance.FileClassRules())
+		}
+	}
+
+	if err = checkPerm(c, "POST", nil, doc); err != nil {
+		return
+	}
+	vfs.InheritTags(doc, parent)
+
+	var exists bool
+	if strategy == vfs.ConflictRename || hasExistencePreconditions(c) {
+		exists, err = fs.DirChildExists(doc.DirID, doc.DocName)
+		if err != nil {
+			return
+		}
+		if err = checkExistencePreconditions(c, exists); err != nil {
+			return
+		}
+	}
+	if exists && strategy == vfs.ConflictRename {
+		if doc.DocName, err = vfs.UniqueName(fs, doc.DirID, doc.DocName); err != nil {
+			return
+		}
+		doc.ResetFullpath()
+	}
+
+	tmp, size, err := downloadSource(instance.Domain, res, max)
+	if err != nil {
+		instance.Logger().WithField("nspace", "files").
+			Infof("Error on downloading the source: %s", err)
+		return
+	}
+	defer func() {
+		tmp.Close()           // #nosec
+		os.Remove(tmp.Name()) // #nosec
+	}()
+	doc.ByteSize = size
+
+	body, err := checkUploadPolicy(instance, doc, tmp)
+	if err != nil {
+		return
+	}
+
+	file, err := fs.CreateFile(doc, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	if _, err = io.Copy(file, body); err != nil {
+		instance.Logger().WithField("nspace", "files").
+			Warnf("Error on importing file from source (copy): %s", err)
+		return
+	}
+	f = newFile(doc, instance)
+	return
+}
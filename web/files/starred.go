@@ -0,0 +1,56 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const (
+	defaultStarredLimit = 100
+	maxStarredLimit     = 1000
+)
+
+// ListStarredHandler handles GET requests on /files/_starred. It returns the
+// starred files and directories, the most recently updated first.
+func ListStarredHandler(c echo.Context) error {
+	if err := permissions.AllowWholeType(c, permissions.GET, consts.Files); err != nil {
+		return err
+	}
+
+	limit := defaultStarredLimit
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return jsonapi.InvalidParameter("limit", errors.New("Invalid limit"))
+		}
+		if n < maxStarredLimit {
+			limit = n
+		} else {
+			limit = maxStarredLimit
+		}
+	}
+
+	instance := middlewares.GetInstance(c)
+	docs, err := vfs.StarredDocs(instance, limit)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	objs := make([]jsonapi.Object, len(docs))
+	for i, doc := range docs {
+		d, f := doc.Refine()
+		if d != nil {
+			objs[i] = newDir(d)
+		} else {
+			objs[i] = newFile(f, instance)
+		}
+	}
+	return jsonapi.DataList(c, http.StatusOK, withFields(objs, fieldsFromReq(c)), nil)
+}
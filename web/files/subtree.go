@@ -0,0 +1,32 @@
+package files
+
+import (
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// pathResolver finds the documents from their paths. It is implemented by
+// the VFS, and by vfs.Subtree for the paths relative to a directory.
+type pathResolver interface {
+	DirByPath(name string) (*vfs.DirDoc, error)
+	FileByPath(name string) (*vfs.FileDoc, error)
+	DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, error)
+}
+
+// pathResolverFromReq returns the VFS of the instance, or a subtree of it
+// when the Root parameter is given with the id of a directory: the Path
+// parameter is then resolved relatively to this directory, and it can't
+// escape it (".." on the root is the root itself).
+func pathResolverFromReq(c echo.Context) (pathResolver, error) {
+	fs := middlewares.GetInstance(c).VFS()
+	rootID := c.QueryParam("Root")
+	if rootID == "" {
+		return fs, nil
+	}
+	root, err := fs.DirByID(rootID)
+	if err != nil {
+		return nil, err
+	}
+	return vfs.NewSubtree(fs, root), nil
+}
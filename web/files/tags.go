@@ -0,0 +1,115 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiTag struct {
+	*vfs.TagCount
+}
+
+func (t *apiTag) ID() string                             { return t.Name }
+func (t *apiTag) Rev() string                            { return "" }
+func (t *apiTag) DocType() string                        { return consts.FilesTags }
+func (t *apiTag) Clone() couchdb.Doc                     { cloned := *t; return &cloned }
+func (t *apiTag) SetID(_ string)                         {}
+func (t *apiTag) SetRev(_ string)                        {}
+func (t *apiTag) Relationships() jsonapi.RelationshipMap { return nil }
+func (t *apiTag) Included() []jsonapi.Object             { return nil }
+func (t *apiTag) Links() *jsonapi.LinksList              { return nil }
+
+// ListTagsHandler handles GET requests on /files/_tags. It returns the tags
+// of the files, with the number of files for each tag. The prefix parameter
+// can be used for an autocompletion, and the trashed files are counted only
+// with trashed=true.
+func ListTagsHandler(c echo.Context) error {
+	if err := permissions.AllowWholeType(c, permissions.GET, consts.Files); err != nil {
+		return err
+	}
+
+	instance := middlewares.GetInstance(c)
+	prefix := c.QueryParam("prefix")
+	withTrashed := c.QueryParam("trashed") == "true"
+	tags, err := vfs.TagsCounts(instance, prefix, withTrashed)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	objs := make([]jsonapi.Object, len(tags))
+	for i := range tags {
+		objs[i] = &apiTag{&tags[i]}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// renameTagResult is the result of the renaming of a tag, sent as the meta
+// of the response, or as the result of the job.
+type renameTagResult struct {
+	Count int `json:"count"`
+}
+
+// RenameTagHandler handles POST requests on /files/_tags/rename. It replaces
+// a tag by another one on all the files and directories of the instance. With
+// async=true, the renaming is done in a job.
+func RenameTagHandler(c echo.Context) error {
+	if err := permissions.AllowWholeType(c, permissions.PATCH, consts.Files); err != nil {
+		return err
+	}
+
+	var body struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return jsonapi.BadJSON()
+	}
+	from := strings.TrimSpace(body.From)
+	to := strings.TrimSpace(body.To)
+	if from == "" {
+		return jsonapi.InvalidParameter("from", errors.New("The tag to rename is missing"))
+	}
+	if to == "" {
+		return jsonapi.InvalidParameter("to", errors.New("The new tag is missing"))
+	}
+	if strings.Contains(to, TagSeparator) {
+		return jsonapi.InvalidParameter("to",
+			errors.New("The new tag must not contain the tag separator"))
+	}
+
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+	if c.QueryParam("async") == "true" {
+		job, err := startJob(c, "rename_tag", func(progress func(int)) (interface{}, string, error) {
+			count, err := vfs.RenameTag(fs, instance, from, to, progress)
+			return &renameTagResult{Count: count}, "", err
+		})
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		return jobData(c, http.StatusAccepted, job)
+	}
+
+	count, err := vfs.RenameTag(fs, instance, from, to, nil)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	doc := struct {
+		Meta renameTagResult `json:"meta"`
+	}{
+		Meta: renameTagResult{Count: count},
+	}
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, jsonapi.ContentType)
+	resp.WriteHeader(http.StatusOK)
+	return json.NewEncoder(resp).Encode(doc)
+}
@@ -0,0 +1,47 @@
+package files
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// UploadPolicyID is the id of the JSON-API response for the upload policy
+const UploadPolicyID = "io.cozy.files.upload_policy"
+
+type apiUploadPolicy struct {
+	vfs.UploadPolicy
+}
+
+func (a *apiUploadPolicy) ID() string                             { return UploadPolicyID }
+func (a *apiUploadPolicy) Rev() string                            { return "" }
+func (a *apiUploadPolicy) DocType() string                        { return consts.Files }
+func (a *apiUploadPolicy) Clone() couchdb.Doc                     { return a }
+func (a *apiUploadPolicy) SetID(_ string)                         {}
+func (a *apiUploadPolicy) SetRev(_ string)                        {}
+func (a *apiUploadPolicy) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiUploadPolicy) Included() []jsonapi.Object             { return nil }
+func (a *apiUploadPolicy) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/_upload_policy"}
+}
+
+// ReadUploadPolicyHandler handles GET requests on /files/_upload_policy. It
+// returns the rules used to restrict the types of the uploaded files, so that
+// the clients can check a file before uploading it.
+func ReadUploadPolicyHandler(c echo.Context) error {
+	if _, err := permissions.GetPermission(c); err != nil {
+		return err
+	}
+	instance := middlewares.GetInstance(c)
+	policy := &apiUploadPolicy{}
+	if p := instance.UploadPolicy(); p != nil {
+		policy.UploadPolicy = *p
+	}
+	return jsonapi.Data(c, http.StatusOK, policy, nil)
+}
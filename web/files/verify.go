@@ -0,0 +1,68 @@
+package files
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiVerification struct {
+	doc *vfs.FileDoc
+	*vfs.Verification
+}
+
+func (a *apiVerification) ID() string                             { return a.doc.ID() }
+func (a *apiVerification) Rev() string                            { return "" }
+func (a *apiVerification) DocType() string                        { return consts.FilesVerifications }
+func (a *apiVerification) Clone() couchdb.Doc                     { cloned := *a; return &cloned }
+func (a *apiVerification) SetID(_ string)                         {}
+func (a *apiVerification) SetRev(_ string)                        {}
+func (a *apiVerification) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiVerification) Included() []jsonapi.Object             { return nil }
+func (a *apiVerification) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Related: "/files/" + a.doc.ID()}
+}
+
+// VerifyFileHandler handles POST requests on /files/:file-id/verify. It reads
+// the content of the file, and compares its checksum with the md5sum of the
+// document. A file with a mismatch is flagged as corrupted: as the document
+// can be modified, a permission on the PATCH verb is required.
+func VerifyFileHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.PATCH, nil, doc); err != nil {
+		return err
+	}
+	v, err := vfs.VerifyFile(instance.VFS(), doc)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiVerification{doc, v}, nil)
+}
+
+// VerifyAllFilesHandler handles POST requests on /files/_verify. It starts a
+// job that verifies the content of all the files of the instance.
+func VerifyAllFilesHandler(c echo.Context) error {
+	if err := permissions.AllowWholeType(c, permissions.PATCH, consts.Files); err != nil {
+		return err
+	}
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+	job, err := startJob(c, "verify", func(progress func(int)) (interface{}, string, error) {
+		report, err := vfs.VerifyAllFiles(fs, progress)
+		return report, "", err
+	})
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return jobData(c, http.StatusAccepted, job)
+}
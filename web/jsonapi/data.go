@@ -22,6 +22,7 @@ type Meta struct {
 // RelationshipMeta is a container for the total number of elements
 type RelationshipMeta struct {
 	Count *int `json:"count,omitempty"`
+	Limit *int `json:"limit,omitempty"`
 }
 
 // LinksList is the common links used in JSON-API for the top-level or a
@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/echo"
 )
@@ -16,6 +18,12 @@ import (
 // ContentType is the official mime-type for JSON-API
 const ContentType = "application/vnd.api+json"
 
+// The sizes of the pages used when they are not configured
+const (
+	defaultPageSize    = 30
+	defaultMaxPageSize = 1000
+)
+
 // Document is JSON-API document, identified by the mediatype
 // application/vnd.api+json
 // See http://jsonapi.org/format/#document-structure
@@ -74,6 +82,17 @@ func DataList(c echo.Context, statusCode int, objs []Object, links *LinksList) e
 // DataListWithTotal can be called to send a list of Object with a different
 // meta:count, useful to indicate total number of results with pagination.
 func DataListWithTotal(c echo.Context, statusCode, total int, objs []Object, links *LinksList) error {
+	return dataList(c, statusCode, &RelationshipMeta{Count: &total}, objs, links)
+}
+
+// DataListPage can be called to send a page of a paginated list of Object,
+// with the total number of results in meta:count, and the number of results
+// per page that has been applied in meta:limit.
+func DataListPage(c echo.Context, statusCode, total, limit int, objs []Object, links *LinksList) error {
+	return dataList(c, statusCode, &RelationshipMeta{Count: &total, Limit: &limit}, objs, links)
+}
+
+func dataList(c echo.Context, statusCode int, meta *RelationshipMeta, objs []Object, links *LinksList) error {
 	objsMarshaled := make([]json.RawMessage, len(objs))
 	for i, o := range objs {
 		j, err := MarshalObject(o)
@@ -90,7 +109,7 @@ func DataListWithTotal(c echo.Context, statusCode, total int, objs []Object, lin
 
 	doc := Document{
 		Data:  (*json.RawMessage)(&data),
-		Meta:  &RelationshipMeta{Count: &total},
+		Meta:  meta,
 		Links: links,
 	}
 
@@ -236,7 +255,41 @@ func PaginationCursorToParams(cursor couchdb.Cursor) (url.Values, error) {
 	return v, nil
 }
 
-// ExtractPaginationCursor creates a Cursor from context Query.
+// DefaultPageSize returns the number of items in a page when the client has
+// not asked for a limit, as configured with pagination.default_page_size.
+func DefaultPageSize() int {
+	if conf := config.GetConfig(); conf != nil && conf.Pagination.DefaultPageSize > 0 {
+		return conf.Pagination.DefaultPageSize
+	}
+	return defaultPageSize
+}
+
+// MaxPageSize returns the maximal number of items in a page, as configured
+// with pagination.max_page_size.
+func MaxPageSize() int {
+	if conf := config.GetConfig(); conf != nil && conf.Pagination.MaxPageSize > 0 {
+		return conf.Pagination.MaxPageSize
+	}
+	return defaultMaxPageSize
+}
+
+// CapPageLimit returns the number of items to put in a page for the limit
+// asked by the client: the given default if there is no limit (or a limit
+// that is not positive), and at most the maximal page size. A limit too large
+// is capped, not rejected.
+func CapPageLimit(limit, defaultLimit int) int {
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if max := MaxPageSize(); limit <= 0 || limit > max {
+		limit = max
+	}
+	return limit
+}
+
+// ExtractPaginationCursor creates a Cursor from context Query. The default
+// page size is used if defaultLimit is 0, and the limit is capped to the
+// maximal page size.
 func ExtractPaginationCursor(c echo.Context, defaultLimit int) (couchdb.Cursor, error) {
 
 	var limit int
@@ -247,9 +300,11 @@ func ExtractPaginationCursor(c echo.Context, defaultLimit int) (couchdb.Cursor,
 			return nil, NewError(http.StatusBadRequest, "page limit is not a number")
 		}
 		limit = int(reqLimit)
-	} else {
-		limit = defaultLimit
 	}
+	if defaultLimit <= 0 {
+		defaultLimit = DefaultPageSize()
+	}
+	limit = CapPageLimit(limit, defaultLimit)
 
 	if cursor := c.QueryParam("page[cursor]"); cursor != "" {
 		var parts []interface{}
@@ -280,3 +335,54 @@ func ExtractPaginationCursor(c echo.Context, defaultLimit int) (couchdb.Cursor,
 
 	return couchdb.NewKeyCursor(limit, nil, ""), nil
 }
+
+// ExtractFields returns the sparse fieldset asked for the given doctype with
+// the fields[doctype] query parameter, like fields[io.cozy.files]=name,size.
+// It returns nil if the parameter is absent, to send all the attributes.
+func ExtractFields(c echo.Context, doctype string) map[string]bool {
+	values, ok := c.QueryParams()["fields["+doctype+"]"]
+	if !ok {
+		return nil
+	}
+	return splitList(values)
+}
+
+// ExtractInclude returns the relationships to include in a compound document,
+// asked with the include query parameter, like include=parent,contents. It
+// returns nil if the parameter is absent.
+func ExtractInclude(c echo.Context) map[string]bool {
+	values, ok := c.QueryParams()["include"]
+	if !ok {
+		return nil
+	}
+	return splitList(values)
+}
+
+// splitList returns the set of the comma-separated names in the values of a
+// query parameter.
+func splitList(values []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				set[name] = true
+			}
+		}
+	}
+	return set
+}
+
+// FilterAttributes keeps only the given fields in the JSON attributes of an
+// object. The fields that are not in the attributes are ignored.
+func FilterAttributes(attrs []byte, fields map[string]bool) ([]byte, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(attrs, &m); err != nil {
+		return nil, err
+	}
+	for k := range m {
+		if !fields[k] {
+			delete(m, k)
+		}
+	}
+	return json.Marshal(m)
+}
@@ -183,6 +183,55 @@ func TestPaginationWithCursor(t *testing.T) {
 
 }
 
+func TestPaginationWithLimitTooLarge(t *testing.T) {
+	max := config.GetConfig().Pagination.MaxPageSize
+	defer func() { config.GetConfig().Pagination.MaxPageSize = max }()
+	config.GetConfig().Pagination.MaxPageSize = 50
+
+	res, err := http.Get(ts.URL + "/paginated?page[limit]=1000000&page[skip]=10")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	var c string
+	json.NewDecoder(res.Body).Decode(&c)
+	assert.Equal(t, "key 50 10", c)
+
+	assert.Equal(t, 50, CapPageLimit(0, 100))
+	assert.Equal(t, 20, CapPageLimit(20, 100))
+	assert.Equal(t, 30, CapPageLimit(-1, DefaultPageSize()))
+}
+
+func TestExtractFields(t *testing.T) {
+	res, err := http.Get(ts.URL + "/fields?fields[io.cozy.foos]=bar,%20baz&fields[io.cozy.files]=name")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	var fields map[string]bool
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&fields))
+	assert.Equal(t, map[string]bool{"bar": true, "baz": true}, fields)
+
+	res2, err := http.Get(ts.URL + "/fields")
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	fields = nil
+	assert.NoError(t, json.NewDecoder(res2.Body).Decode(&fields))
+	assert.Nil(t, fields)
+}
+
+func TestExtractInclude(t *testing.T) {
+	res, err := http.Get(ts.URL + "/include?include=parent,contents&include=parent")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	var include map[string]bool
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&include))
+	assert.Equal(t, map[string]bool{"parent": true, "contents": true}, include)
+}
+
+func TestFilterAttributes(t *testing.T) {
+	attrs := []byte(`{"bar":"baz","qux":1,"quux":{"a":true}}`)
+	filtered, err := FilterAttributes(attrs, map[string]bool{"qux": true, "unknown": true})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"qux":1}`, string(filtered))
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	router := echo.New()
@@ -190,6 +239,12 @@ func TestMain(m *testing.M) {
 		courge := &Foo{FID: "courge", FRev: "1-abc", Bar: "baz"}
 		return Data(c, 200, courge, nil)
 	})
+	router.GET("/fields", func(c echo.Context) error {
+		return c.JSON(200, ExtractFields(c, "io.cozy.foos"))
+	})
+	router.GET("/include", func(c echo.Context) error {
+		return c.JSON(200, ExtractInclude(c))
+	})
 	router.GET("/paginated", func(c echo.Context) error {
 		cursor, err := ExtractPaginationCursor(c, 13)
 		if err != nil {
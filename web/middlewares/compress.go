@@ -0,0 +1,223 @@
+package middlewares
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/echo"
+)
+
+// CompressOptions contains the options for the Compress middleware.
+type CompressOptions struct {
+	// MinSize is the size (in bytes) under which a response is sent without
+	// compression, as it is not worth it.
+	MinSize int
+	// ContentTypes is the list of the media types of the responses that can
+	// be compressed. The other responses, like the downloads of files, are
+	// left untouched.
+	ContentTypes []string
+}
+
+// Compress returns a middleware that compresses the responses with gzip when
+// the client accepts it. Only the successful responses with one of the
+// content types of the options are compressed: the partial contents (range
+// requests), the responses without a body (304 Not Modified), and the
+// responses that already have a Content-Encoding are sent as is.
+//
+// The ETag of a compressed response is made weak, as its bytes are not the
+// same as the ones of the identity response: the conditional requests still
+// work, as If-None-Match uses the weak comparison. A Vary header is added to
+// the responses that can be compressed.
+func Compress(opts CompressOptions) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Method == http.MethodHead {
+				return next(c)
+			}
+			res := c.Response()
+			cw := &compressWriter{
+				ResponseWriter: res.Writer,
+				opts:           &opts,
+				accept:         acceptGzip(req),
+				ifNoneMatch:    req.Header.Get("If-None-Match"),
+			}
+			res.Writer = cw
+			defer func() {
+				res.Writer = cw.ResponseWriter
+			}()
+			err := next(c)
+			if errc := cw.finish(); err == nil {
+				err = errc
+			}
+			return err
+		}
+	}
+}
+
+// acceptGzip returns true if the Accept-Encoding header of the request allows
+// the gzip content-coding.
+func acceptGzip(req *http.Request) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+// compressWriter is an http.ResponseWriter that buffers the beginning of an
+// eligible response, until MinSize bytes have been written, to know if it is
+// worth compressing it.
+type compressWriter struct {
+	http.ResponseWriter
+	opts        *CompressOptions
+	accept      bool
+	ifNoneMatch string
+
+	code     int          // the status code, not sent while buffering
+	buffered bool         // true while the response is buffered
+	buf      bytes.Buffer // the beginning of the response
+	gz       *gzip.Writer // not nil if the response is compressed
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.code != 0 {
+		return
+	}
+	w.code = code
+	if code == http.StatusNotModified && w.accept {
+		// The client has validated a compressed response if it has sent
+		// the weak form of the ETag
+		if etag := w.Header().Get("Etag"); etag != "" &&
+			strings.Contains(w.ifNoneMatch, weakETag(etag)) {
+			w.Header().Set("Etag", weakETag(etag))
+		}
+	}
+	if !w.eligible() {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+	if !w.accept {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.buffered = true
+}
+
+// eligible returns true if the response can be compressed.
+func (w *compressWriter) eligible() bool {
+	if w.code < 200 || w.code >= 300 || w.code == http.StatusNoContent ||
+		w.code == http.StatusPartialContent {
+		return false
+	}
+	header := w.Header()
+	if header.Get(echo.HeaderContentEncoding) != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	contentType := header.Get(echo.HeaderContentType)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(contentType)
+	for _, typ := range w.opts.ContentTypes {
+		if typ == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	if !w.buffered {
+		return w.ResponseWriter.Write(p)
+	}
+	n, _ := w.buf.Write(p)
+	if w.buf.Len() < w.opts.MinSize {
+		return n, nil
+	}
+	if err := w.startCompression(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// startCompression sends the headers for a compressed response, and the
+// buffered content through the gzip writer.
+func (w *compressWriter) startCompression() error {
+	header := w.Header()
+	header.Set(echo.HeaderContentEncoding, "gzip")
+	header.Del(echo.HeaderContentLength)
+	if etag := header.Get("Etag"); etag != "" {
+		header.Set("Etag", weakETag(etag))
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+	w.buffered = false
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	_, err := w.gz.Write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+// weakETag returns the weak form of an ETag.
+func weakETag(etag string) string {
+	if strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return "W/" + etag
+}
+
+// finish sends what is still buffered, or completes the gzip stream.
+func (w *compressWriter) finish() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	if w.buffered {
+		w.buffered = false
+		w.Header().Set(echo.HeaderContentLength, strconv.Itoa(w.buf.Len()))
+		w.ResponseWriter.WriteHeader(w.code)
+		_, err := w.ResponseWriter.Write(w.buf.Bytes())
+		return err
+	}
+	return nil
+}
+
+func (w *compressWriter) Flush() {
+	if w.buffered && w.buf.Len() > 0 {
+		w.startCompression() // #nosec
+	}
+	if w.gz != nil {
+		w.gz.Flush() // #nosec
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
@@ -0,0 +1,55 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cozy/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressWeakETag(t *testing.T) {
+	body := strings.Repeat("foo ", 100)
+	h := Compress(CompressOptions{
+		MinSize:      10,
+		ContentTypes: []string{"text/plain"},
+	})(func(c echo.Context) error {
+		c.Response().Header().Set("Etag", `"123"`)
+		if strings.Contains(c.Request().Header.Get("If-None-Match"), `"123"`) {
+			return c.NoContent(http.StatusNotModified)
+		}
+		return c.String(http.StatusOK, body)
+	})
+
+	serve := func(encoding, ifNoneMatch string) *httptest.ResponseRecorder {
+		e := echo.New()
+		req, _ := http.NewRequest(echo.GET, "http://cozy.local/files/123", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		assert.NoError(t, h(e.NewContext(req, rec)))
+		return rec
+	}
+
+	rec := serve("identity", "")
+	assert.Equal(t, 200, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, `"123"`, rec.Header().Get("Etag"))
+
+	rec = serve("gzip", "")
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, `W/"123"`, rec.Header().Get("Etag"))
+
+	rec = serve("gzip", `W/"123"`)
+	assert.Equal(t, 304, rec.Code)
+	assert.Equal(t, `W/"123"`, rec.Header().Get("Etag"))
+
+	rec = serve("gzip", `"123"`)
+	assert.Equal(t, 304, rec.Code)
+	assert.Equal(t, `"123"`, rec.Header().Get("Etag"))
+}
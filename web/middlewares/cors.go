@@ -14,9 +14,23 @@ const MaxAgeCORS = "43200"
 
 // CORSOptions contains different options to create a CORS middleware.
 type CORSOptions struct {
-	MaxAge         time.Duration
-	BlackList      []string
+	MaxAge    time.Duration
+	BlackList []string
+	// Routes, when not empty, restricts the middleware to the paths starting
+	// with one of these prefixes.
+	Routes         []string
 	AllowedMethods []string
+	// AllowedHeaders is the list of the headers accepted for a preflight
+	// request. By default, all the requested headers are accepted.
+	AllowedHeaders []string
+	// ExposedHeaders is the list of the headers of the response that can be
+	// read by the client.
+	ExposedHeaders []string
+	// AllowOrigin can be used to check the origin of a request. It returns
+	// if the origin is allowed, and if the credentials (cookies) can be sent
+	// from this origin. By default, all the origins are allowed, with
+	// credentials.
+	AllowOrigin func(c echo.Context, origin string) (allowed, credentials bool)
 }
 
 // CORS returns a Cross-Origin Resource Sharing (CORS) middleware.
@@ -29,8 +43,8 @@ func CORS(opts CORSOptions) echo.MiddlewareFunc {
 		maxAge = MaxAgeCORS
 	}
 
-	var allowedMethods []string
-	if opts.AllowedMethods == nil {
+	allowedMethods := opts.AllowedMethods
+	if allowedMethods == nil {
 		allowedMethods = []string{
 			echo.GET,
 			echo.HEAD,
@@ -42,6 +56,8 @@ func CORS(opts CORSOptions) echo.MiddlewareFunc {
 	}
 
 	allowMethods := strings.Join(allowedMethods, ",")
+	allowHeaders := strings.Join(opts.AllowedHeaders, ",")
+	exposeHeaders := strings.Join(opts.ExposedHeaders, ",")
 
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
@@ -59,12 +75,39 @@ func CORS(opts CORSOptions) echo.MiddlewareFunc {
 					return next(c)
 				}
 			}
+			if len(opts.Routes) > 0 {
+				matched := false
+				for _, route := range opts.Routes {
+					if strings.HasPrefix(path, route) {
+						matched = true
+						break
+					}
+				}
+				if !matched {
+					return next(c)
+				}
+			}
+
+			credentials := true
+			if opts.AllowOrigin != nil {
+				var allowed bool
+				allowed, credentials = opts.AllowOrigin(c, origin)
+				if !allowed {
+					res.Header().Add(echo.HeaderVary, echo.HeaderOrigin)
+					return next(c)
+				}
+			}
 
 			// Simple request
 			if req.Method != echo.OPTIONS {
 				res.Header().Add(echo.HeaderVary, echo.HeaderOrigin)
 				res.Header().Set(echo.HeaderAccessControlAllowOrigin, origin)
-				res.Header().Set(echo.HeaderAccessControlAllowCredentials, "true")
+				if credentials {
+					res.Header().Set(echo.HeaderAccessControlAllowCredentials, "true")
+				}
+				if exposeHeaders != "" {
+					res.Header().Set(echo.HeaderAccessControlExposeHeaders, exposeHeaders)
+				}
 				return next(c)
 			}
 
@@ -74,10 +117,13 @@ func CORS(opts CORSOptions) echo.MiddlewareFunc {
 			res.Header().Add(echo.HeaderVary, echo.HeaderAccessControlRequestHeaders)
 			res.Header().Set(echo.HeaderAccessControlAllowOrigin, origin)
 			res.Header().Set(echo.HeaderAccessControlAllowMethods, allowMethods)
-			res.Header().Set(echo.HeaderAccessControlAllowCredentials, "true")
+			if credentials {
+				res.Header().Set(echo.HeaderAccessControlAllowCredentials, "true")
+			}
 
-			h := req.Header.Get(echo.HeaderAccessControlRequestHeaders)
-			if h != "" {
+			if allowHeaders != "" {
+				res.Header().Set(echo.HeaderAccessControlAllowHeaders, allowHeaders)
+			} else if h := req.Header.Get(echo.HeaderAccessControlRequestHeaders); h != "" {
 				res.Header().Set(echo.HeaderAccessControlAllowHeaders, h)
 			}
 
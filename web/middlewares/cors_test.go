@@ -31,3 +31,54 @@ func TestCORSMiddlewareNotAuth(t *testing.T) {
 	h(c)
 	assert.Equal(t, "", rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
 }
+
+func TestCORSMiddlewareRoutes(t *testing.T) {
+	e := echo.New()
+	req, _ := http.NewRequest(echo.GET, "http://cozy.local/data/io.cozy.files", nil)
+	req.Header.Set("Origin", "fakecozy.local")
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetPath(req.URL.Path)
+	h := CORS(CORSOptions{Routes: []string{"/files/"}})(echo.NotFoundHandler)
+	h(c)
+	assert.Equal(t, "", rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+}
+
+func TestCORSMiddlewareAllowOrigin(t *testing.T) {
+	opts := CORSOptions{
+		AllowedMethods: []string{echo.GET, echo.PUT},
+		AllowedHeaders: []string{"Authorization", "If-Match"},
+		ExposedHeaders: []string{"Etag", "Location"},
+		AllowOrigin: func(c echo.Context, origin string) (bool, bool) {
+			return origin != "evil.local", origin == "app.cozy.local"
+		},
+	}
+	e := echo.New()
+
+	req, _ := http.NewRequest(echo.OPTIONS, "http://cozy.local/files/123", nil)
+	req.Header.Set("Origin", "app.cozy.local")
+	req.Header.Set(echo.HeaderAccessControlRequestHeaders, "X-Foo")
+	rec := httptest.NewRecorder()
+	h := CORS(opts)(echo.NotFoundHandler)
+	h(e.NewContext(req, rec))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "app.cozy.local", rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+	assert.Equal(t, "true", rec.Header().Get(echo.HeaderAccessControlAllowCredentials))
+	assert.Equal(t, "GET,PUT", rec.Header().Get(echo.HeaderAccessControlAllowMethods))
+	assert.Equal(t, "Authorization,If-Match", rec.Header().Get(echo.HeaderAccessControlAllowHeaders))
+
+	req, _ = http.NewRequest(echo.GET, "http://cozy.local/files/123", nil)
+	req.Header.Set("Origin", "tool.local")
+	rec = httptest.NewRecorder()
+	h(e.NewContext(req, rec))
+	assert.Equal(t, "tool.local", rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+	assert.Equal(t, "", rec.Header().Get(echo.HeaderAccessControlAllowCredentials))
+	assert.Equal(t, "Etag,Location", rec.Header().Get(echo.HeaderAccessControlExposeHeaders))
+
+	req, _ = http.NewRequest(echo.OPTIONS, "http://cozy.local/files/123", nil)
+	req.Header.Set("Origin", "evil.local")
+	rec = httptest.NewRecorder()
+	h(e.NewContext(req, rec))
+	assert.Equal(t, "", rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+	assert.Equal(t, "", rec.Header().Get(echo.HeaderAccessControlAllowMethods))
+}
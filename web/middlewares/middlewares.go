@@ -1,6 +1,7 @@
 package middlewares
 
 import (
+	"net/url"
 	"strings"
 
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -33,3 +34,47 @@ func SplitHost(host string) (instanceHost, appSlug, siblings string) {
 	}
 	return parts[0], "", ""
 }
+
+// OriginKind is the relation between an origin and an instance.
+type OriginKind int
+
+const (
+	// OriginExternal is an origin that is not part of the instance.
+	OriginExternal OriginKind = iota
+	// OriginInstance is the origin of the instance itself.
+	OriginInstance
+	// OriginSibling is the origin of an application of the instance, on a
+	// subdomain (nested or flat).
+	OriginSibling
+)
+
+// ClassifyHost tells if the given host is the host of the instance, the host
+// of one of its applications, or an external host. For an application, its
+// slug is also returned. It uses the same rules as SplitHost, that is used
+// for the CSP, so that CORS, embedding, and the CSP agree on what is part of
+// the instance.
+func ClassifyHost(instanceHost, host string) (OriginKind, string) {
+	instanceHost = strings.ToLower(instanceHost)
+	host = strings.ToLower(host)
+	if host == "" || instanceHost == "" {
+		return OriginExternal, ""
+	}
+	if host == instanceHost {
+		return OriginInstance, ""
+	}
+	if parent, slug, _ := SplitHost(host); slug != "" && parent == instanceHost {
+		return OriginSibling, slug
+	}
+	return OriginExternal, ""
+}
+
+// ClassifyOrigin is like ClassifyHost, but for the value of an Origin header,
+// like https://joe-calendar.example.net. The origins that are not http(s),
+// like null, are external.
+func ClassifyOrigin(instanceHost, origin string) (OriginKind, string) {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return OriginExternal, ""
+	}
+	return ClassifyHost(instanceHost, u.Host)
+}
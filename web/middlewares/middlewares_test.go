@@ -35,3 +35,48 @@ func TestSplitHost(t *testing.T) {
 	assert.Equal(t, "", app)
 	assert.Equal(t, "", siblings)
 }
+
+func TestClassifyOrigin(t *testing.T) {
+	config.UseTestFile()
+	cfg := config.GetConfig()
+	was := cfg.Subdomains
+	defer func() { cfg.Subdomains = was }()
+
+	kind, slug := ClassifyOrigin("joe.example.co.uk", "https://joe.example.co.uk")
+	assert.Equal(t, OriginInstance, kind)
+	assert.Equal(t, "", slug)
+	kind, _ = ClassifyOrigin("joe.example.co.uk", "https://JOE.example.co.uk")
+	assert.Equal(t, OriginInstance, kind)
+	kind, _ = ClassifyOrigin("joe.example.co.uk:8080", "http://joe.example.co.uk:8080")
+	assert.Equal(t, OriginInstance, kind)
+	kind, _ = ClassifyOrigin("joe.example.co.uk:8080", "http://joe.example.co.uk")
+	assert.Equal(t, OriginExternal, kind)
+	kind, _ = ClassifyOrigin("joe.example.co.uk", "null")
+	assert.Equal(t, OriginExternal, kind)
+	kind, _ = ClassifyOrigin("joe.example.co.uk", "ftp://joe.example.co.uk")
+	assert.Equal(t, OriginExternal, kind)
+
+	cfg.Subdomains = config.NestedSubdomains
+	kind, slug = ClassifyOrigin("joe.example.co.uk", "https://calendar.joe.example.co.uk")
+	assert.Equal(t, OriginSibling, kind)
+	assert.Equal(t, "calendar", slug)
+	kind, _ = ClassifyOrigin("joe.example.co.uk", "https://a.calendar.joe.example.co.uk")
+	assert.Equal(t, OriginExternal, kind)
+	kind, _ = ClassifyOrigin("joe.example.co.uk", "https://calendar.jane.example.co.uk")
+	assert.Equal(t, OriginExternal, kind)
+	kind, _ = ClassifyOrigin("joe.example.co.uk", "https://calendar.joe.example.co.uk.evil.com")
+	assert.Equal(t, OriginExternal, kind)
+	kind, _ = ClassifyOrigin("joe.example.co.uk", "https://joe-calendar.example.co.uk")
+	assert.Equal(t, OriginExternal, kind)
+
+	cfg.Subdomains = config.FlatSubdomains
+	kind, slug = ClassifyOrigin("joe.example.co.uk", "https://joe-calendar.example.co.uk")
+	assert.Equal(t, OriginSibling, kind)
+	assert.Equal(t, "calendar", slug)
+	kind, _ = ClassifyOrigin("joe.example.co.uk", "https://jane-calendar.example.co.uk")
+	assert.Equal(t, OriginExternal, kind)
+	kind, _ = ClassifyOrigin("joe.example.co.uk", "https://calendar.joe.example.co.uk")
+	assert.Equal(t, OriginExternal, kind)
+	kind, _ = ClassifyOrigin("joe.example.co.uk", "https://joe-calendar.example.co.uk.evil.com")
+	assert.Equal(t, OriginExternal, kind)
+}
@@ -3,6 +3,7 @@ package middlewares
 import (
 	"fmt"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 
@@ -47,6 +48,19 @@ type (
 
 		XFrameOptions XFrameOption
 		XFrameAllowed string
+
+		// CrossOriginResourcePolicy is the value of the
+		// Cross-Origin-Resource-Policy header: same-origin, same-site or
+		// cross-origin. The header is not sent if it is empty.
+		CrossOriginResourcePolicy string
+		// CrossOriginOpenerPolicy is the value of the Cross-Origin-Opener-Policy
+		// header: same-origin, same-origin-allow-popups or unsafe-none. The
+		// header is not sent if it is empty.
+		CrossOriginOpenerPolicy string
+		// CrossOriginEmbedderPolicy is the value of the
+		// Cross-Origin-Embedder-Policy header: require-corp or unsafe-none. The
+		// header is not sent if it is empty.
+		CrossOriginEmbedderPolicy string
 	}
 )
 
@@ -81,8 +95,104 @@ const (
 	CSPWhitelist
 )
 
+// The names of the headers for the cross-origin isolation
+const (
+	// HeaderCrossOriginResourcePolicy is the name of the header that tells
+	// which origins can load a resource.
+	HeaderCrossOriginResourcePolicy = "Cross-Origin-Resource-Policy"
+	// HeaderCrossOriginOpenerPolicy is the name of the header that isolates a
+	// document from the cross-origin windows that open it or that it opens.
+	HeaderCrossOriginOpenerPolicy = "Cross-Origin-Opener-Policy"
+	// HeaderCrossOriginEmbedderPolicy is the name of the header that restricts
+	// the cross-origin resources that a document can load.
+	HeaderCrossOriginEmbedderPolicy = "Cross-Origin-Embedder-Policy"
+)
+
+const (
+	cspHeaderKey   = "csp_header"
+	cspOverrideKey = "csp_override"
+)
+
+// CSPOverride is a change of the Content-Security-Policy for a single
+// response, for the routes that need a tighter or looser policy than the one
+// of the SecureConfig, like an embedded viewer.
+type CSPOverride struct {
+	// Directives are the directives to change, with their sources, like
+	// "frame-ancestors": "'self'". An empty value removes the directive.
+	Directives map[string]string
+	// Replace tells to discard the directives computed from the
+	// SecureConfig, and to send only the directives of the override.
+	Replace bool
+}
+
+// SetCSPOverride sets the override of the Content-Security-Policy for the
+// current request. It can be called by a middleware that runs before Secure,
+// or by a handler: the header is then computed again. The precedence is:
+//
+//   - the directives are computed from the SecureConfig,
+//   - without Replace, a directive of the override takes the place of the
+//     directive with the same name, and the new ones are added at the end,
+//   - with Replace, only the directives of the override are kept,
+//   - when SetCSPOverride is called several times, the last call wins.
+func SetCSPOverride(c echo.Context, override *CSPOverride) {
+	c.Set(cspOverrideKey, override)
+	if c.Get(cspHeaderKey) != nil {
+		setCSPHeader(c)
+	}
+}
+
+// setCSPHeader sets the Content-Security-Policy header from the directives
+// computed by the Secure middleware and the override of the request.
+func setCSPHeader(c echo.Context) {
+	cspHeader, _ := c.Get(cspHeaderKey).(string)
+	if override, ok := c.Get(cspOverrideKey).(*CSPOverride); ok && override != nil {
+		cspHeader = applyCSPOverride(cspHeader, override)
+	}
+	h := c.Response().Header()
+	if cspHeader != "" {
+		h.Set(echo.HeaderContentSecurityPolicy, cspHeader)
+	} else {
+		h.Del(echo.HeaderContentSecurityPolicy)
+	}
+}
+
+func applyCSPOverride(cspHeader string, override *CSPOverride) string {
+	var result string
+	seen := make(map[string]bool)
+	if !override.Replace {
+		for _, directive := range strings.Split(cspHeader, ";") {
+			fields := strings.Fields(directive)
+			if len(fields) == 0 {
+				continue
+			}
+			name := fields[0]
+			seen[name] = true
+			sources, ok := override.Directives[name]
+			if !ok {
+				result += strings.Join(fields, " ") + ";"
+			} else if sources != "" {
+				result += name + " " + sources + ";"
+			}
+		}
+	}
+	names := make([]string, 0, len(override.Directives))
+	for name := range override.Directives {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if sources := override.Directives[name]; sources != "" {
+			result += name + " " + sources + ";"
+		}
+	}
+	return result
+}
+
 // Secure returns a Middlefunc that can be used to define all the necessary
-// secure headers. It is configurable with a SecureConfig object.
+// secure headers. It is configurable with a SecureConfig object. The
+// Content-Security-Policy can be changed for a request with SetCSPOverride.
 func Secure(conf *SecureConfig) echo.MiddlewareFunc {
 	var hstsHeader string
 	if conf.HSTSMaxAge > 0 {
@@ -136,6 +246,15 @@ func Secure(conf *SecureConfig) echo.MiddlewareFunc {
 			if xFrameHeader != "" {
 				h.Set(echo.HeaderXFrameOptions, xFrameHeader)
 			}
+			if conf.CrossOriginResourcePolicy != "" {
+				h.Set(HeaderCrossOriginResourcePolicy, conf.CrossOriginResourcePolicy)
+			}
+			if conf.CrossOriginOpenerPolicy != "" {
+				h.Set(HeaderCrossOriginOpenerPolicy, conf.CrossOriginOpenerPolicy)
+			}
+			if conf.CrossOriginEmbedderPolicy != "" {
+				h.Set(HeaderCrossOriginEmbedderPolicy, conf.CrossOriginEmbedderPolicy)
+			}
 			var cspHeader string
 			parent, _, siblings := SplitHost(c.Request().Host)
 			if len(conf.CSPDefaultSrc) > 0 {
@@ -171,9 +290,8 @@ func Secure(conf *SecureConfig) echo.MiddlewareFunc {
 			if len(conf.CSPWorkerSrc) > 0 {
 				cspHeader += makeCSPHeader(parent, siblings, "worker-src", conf.CSPWorkerSrcWhitelist, conf.CSPWorkerSrc, isSecure)
 			}
-			if cspHeader != "" {
-				h.Set(echo.HeaderContentSecurityPolicy, cspHeader)
-			}
+			c.Set(cspHeaderKey, cspHeader)
+			setCSPHeader(c)
 			h.Set(echo.HeaderXContentTypeOptions, "nosniff")
 			return next(c)
 		}
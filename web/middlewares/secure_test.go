@@ -22,6 +22,38 @@ func TestSecureMiddlewareHSTS(t *testing.T) {
 	assert.Equal(t, "max-age=3600; includeSubDomains", rec.Header().Get(echo.HeaderStrictTransportSecurity))
 }
 
+func TestSecureMiddlewareCrossOrigin(t *testing.T) {
+	run := func(conf *SecureConfig) http.Header {
+		e := echo.New()
+		req, _ := http.NewRequest(echo.GET, "http://app.cozy.local/", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		h := Secure(conf)(echo.NotFoundHandler)
+		h(c)
+		return rec.Header()
+	}
+
+	h1 := run(&SecureConfig{})
+	assert.Equal(t, "", h1.Get(HeaderCrossOriginResourcePolicy))
+	assert.Equal(t, "", h1.Get(HeaderCrossOriginOpenerPolicy))
+	assert.Equal(t, "", h1.Get(HeaderCrossOriginEmbedderPolicy))
+
+	h2 := run(&SecureConfig{CrossOriginResourcePolicy: "same-origin"})
+	assert.Equal(t, "same-origin", h2.Get(HeaderCrossOriginResourcePolicy))
+	assert.Equal(t, "", h2.Get(HeaderCrossOriginOpenerPolicy))
+	assert.Equal(t, "", h2.Get(HeaderCrossOriginEmbedderPolicy))
+
+	h3 := run(&SecureConfig{CrossOriginOpenerPolicy: "same-origin-allow-popups"})
+	assert.Equal(t, "", h3.Get(HeaderCrossOriginResourcePolicy))
+	assert.Equal(t, "same-origin-allow-popups", h3.Get(HeaderCrossOriginOpenerPolicy))
+	assert.Equal(t, "", h3.Get(HeaderCrossOriginEmbedderPolicy))
+
+	h4 := run(&SecureConfig{CrossOriginEmbedderPolicy: "require-corp"})
+	assert.Equal(t, "", h4.Get(HeaderCrossOriginResourcePolicy))
+	assert.Equal(t, "", h4.Get(HeaderCrossOriginOpenerPolicy))
+	assert.Equal(t, "require-corp", h4.Get(HeaderCrossOriginEmbedderPolicy))
+}
+
 func TestSecureMiddlewareCSP(t *testing.T) {
 	e1 := echo.New()
 	req1, _ := http.NewRequest(echo.GET, "http://app.cozy.local/", nil)
@@ -61,6 +93,52 @@ func TestSecureMiddlewareCSP(t *testing.T) {
 	assert.Equal(t, "script-src https://*.cozy.local;frame-src *;connect-src https://cozy.local 'self';", rec3.Header().Get(echo.HeaderContentSecurityPolicy))
 }
 
+func TestSecureMiddlewareCSPOverride(t *testing.T) {
+	conf := &SecureConfig{
+		CSPDefaultSrc: []CSPSource{CSPSrcSelf},
+		CSPFrameSrc:   []CSPSource{CSPSrcAny},
+	}
+	run := func(before, after *CSPOverride) string {
+		e := echo.New()
+		req, _ := http.NewRequest(echo.GET, "http://app.cozy.local/", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if before != nil {
+			SetCSPOverride(c, before)
+		}
+		h := Secure(conf)(func(c echo.Context) error {
+			if after != nil {
+				SetCSPOverride(c, after)
+			}
+			return c.NoContent(http.StatusOK)
+		})
+		assert.NoError(t, h(c))
+		return rec.Header().Get(echo.HeaderContentSecurityPolicy)
+	}
+
+	assert.Equal(t, "default-src 'self';frame-src * 'self';", run(nil, nil))
+
+	merged := &CSPOverride{Directives: map[string]string{
+		"frame-src":       "'none'",
+		"frame-ancestors": "'self'",
+	}}
+	assert.Equal(t, "default-src 'self';frame-src 'none';frame-ancestors 'self';", run(merged, nil))
+	assert.Equal(t, "default-src 'self';frame-src 'none';frame-ancestors 'self';", run(nil, merged))
+
+	removed := &CSPOverride{Directives: map[string]string{"frame-src": ""}}
+	assert.Equal(t, "default-src 'self';", run(nil, removed))
+
+	replaced := &CSPOverride{
+		Directives: map[string]string{"default-src": "'none'"},
+		Replace:    true,
+	}
+	assert.Equal(t, "default-src 'none';", run(nil, replaced))
+	assert.Equal(t, "default-src 'none';", run(merged, replaced))
+
+	emptied := &CSPOverride{Replace: true}
+	assert.Equal(t, "", run(nil, emptied))
+}
+
 func TestSecureMiddlewareXFrame(t *testing.T) {
 	e1 := echo.New()
 	req1, _ := http.NewRequest(echo.GET, "http://app.cozy.local/", nil)
@@ -0,0 +1,357 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+	"github.com/gorilla/websocket"
+)
+
+// eventTrash is the event sent for a file or directory that has been put in
+// the trash, instead of UPDATED
+const eventTrash = "TRASHED"
+
+// filesCommand is a command sent by the client on the websocket for the
+// files. The payload can have the id of a directory, to receive only the
+// events for the files and directories inside it.
+type filesCommand struct {
+	Method  string `json:"method"`
+	Payload struct {
+		DirID string `json:"dir_id"`
+	} `json:"payload"`
+}
+
+// subtree is a directory watched by a client, with its path at the time of
+// the subscription. The zero value is used for the whole tree.
+type subtree struct {
+	id   string
+	path string
+}
+
+// fileEventDoc has the fields of a file or a directory used to know if an
+// event is inside a subtree. The documents of the events can be vfs.FileDoc
+// and vfs.DirDoc, or JSON documents when they come from redis, so they are
+// converted via JSON.
+type fileEventDoc struct {
+	ID       string `json:"_id"`
+	Type     string `json:"type"`
+	DirID    string `json:"dir_id"`
+	Fullpath string `json:"path"`
+	Trashed  bool   `json:"trashed"`
+}
+
+func toFileEventDoc(doc realtime.Doc) *fileEventDoc {
+	if doc == nil {
+		return nil
+	}
+	if v := reflect.ValueOf(doc); v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil
+	}
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		return nil
+	}
+	var fd fileEventDoc
+	if err = json.Unmarshal(buf, &fd); err != nil {
+		return nil
+	}
+	return &fd
+}
+
+func (fd *fileEventDoc) isTrashed() bool {
+	return fd.Trashed || strings.HasPrefix(fd.Fullpath, vfs.TrashDirName)
+}
+
+// maxResolvedEvents is the number of recent events for which the paths of
+// the parent directories are kept.
+const maxResolvedEvents = 128
+
+// dirPathResolver resolves the paths of the parent directories of the files
+// of the events. The same event is sent to all the websockets of an instance:
+// the paths are kept for the recent events, so that they are not fetched
+// again from CouchDB for each websocket.
+type dirPathResolver struct {
+	mu     sync.Mutex
+	events []*realtime.Event                     // in the order of resolution
+	paths  map[*realtime.Event]map[string]string // event -> dir_id -> path
+}
+
+var dirPaths = &dirPathResolver{
+	paths: make(map[*realtime.Event]map[string]string),
+}
+
+func (r *dirPathResolver) get(e *realtime.Event, dirID string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.paths[e][dirID]
+	return p, ok
+}
+
+func (r *dirPathResolver) set(e *realtime.Event, dirID, p string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	byDir, ok := r.paths[e]
+	if !ok {
+		if len(r.events) >= maxResolvedEvents {
+			delete(r.paths, r.events[0])
+			r.events = r.events[1:]
+		}
+		r.events = append(r.events, e)
+		byDir = make(map[string]string)
+		r.paths[e] = byDir
+	}
+	byDir[dirID] = p
+}
+
+// dirPath returns the path of the directory of a file, or the path of a
+// directory.
+func (r *dirPathResolver) dirPath(fs vfs.VFS, e *realtime.Event, fd *fileEventDoc) string {
+	if fd.Type != consts.FileType {
+		return fd.Fullpath
+	}
+	if p, ok := r.get(e, fd.DirID); ok {
+		return p
+	}
+	p := ""
+	if parent, err := fs.DirByID(fd.DirID); err == nil {
+		p = parent.Fullpath
+	}
+	r.set(e, fd.DirID, p)
+	return p
+}
+
+// contains returns true if the file or directory is inside the subtree (or is
+// the root of the subtree).
+func (s subtree) contains(fd *fileEventDoc, dirPath string) bool {
+	if s.id == "" || fd.ID == s.id || fd.DirID == s.id {
+		return true
+	}
+	if dirPath == "" {
+		return false
+	}
+	prefix := s.path
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return dirPath == s.path || strings.HasPrefix(dirPath, prefix)
+}
+
+func inSubtrees(fs vfs.VFS, subs []subtree, e *realtime.Event, fd *fileEventDoc) bool {
+	if fd == nil {
+		return false
+	}
+	dirPath := ""
+	computed := false
+	for _, s := range subs {
+		if s.id != "" && !computed {
+			dirPath = dirPaths.dirPath(fs, e, fd)
+			computed = true
+		}
+		if s.contains(fd, dirPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// filesResponse returns the message to send on the websocket for an event on
+// the files, or nil if the event is not inside the subtrees watched by the
+// client. A file moved out of a subtree is still sent, as the client must
+// know that it is no longer here.
+func filesResponse(fs vfs.VFS, subs []subtree, e *realtime.Event) *wsResponse {
+	doc := toFileEventDoc(e.Doc)
+	if doc == nil {
+		return nil
+	}
+	old := toFileEventDoc(e.OldDoc)
+	if !inSubtrees(fs, subs, e, doc) && !inSubtrees(fs, subs, e, old) {
+		return nil
+	}
+	event := e.Verb
+	if event == realtime.EventUpdate && old != nil && doc.isTrashed() && !old.isTrashed() {
+		event = eventTrash
+	}
+	return &wsResponse{
+		Event: event,
+		Payload: wsResponsePayload{
+			Type: consts.Files,
+			ID:   e.Doc.ID(),
+			Doc:  e.Doc,
+		},
+	}
+}
+
+func forbiddenDir(cmd *filesCommand) *wsError {
+	title := "The application can't subscribe to the files"
+	if cmd.Payload.DirID != "" {
+		title = "The application can't subscribe to the directory " + cmd.Payload.DirID
+	}
+	return &wsError{
+		Event: "error",
+		Payload: wsErrorPayload{
+			Status: "403 Forbidden",
+			Code:   "forbidden",
+			Title:  title,
+			Source: cmd,
+		},
+	}
+}
+
+func dirNotFound(cmd *filesCommand) *wsError {
+	return &wsError{
+		Event: "error",
+		Payload: wsErrorPayload{
+			Status: "404 Page Not Found",
+			Code:   "page not found",
+			Title:  "The directory " + cmd.Payload.DirID + " does not exist",
+			Source: cmd,
+		},
+	}
+}
+
+// subtreeFromCommand checks that the client can subscribe to the directory
+// of the command, and returns the subtree to watch.
+func subtreeFromCommand(fs vfs.VFS, pdoc *permissions.Permission, cmd *filesCommand) (subtree, *wsError) {
+	if cmd.Payload.DirID == "" {
+		if !pdoc.Permissions.AllowWholeType(permissions.GET, consts.Files) {
+			return subtree{}, forbiddenDir(cmd)
+		}
+		return subtree{}, nil
+	}
+	dir, err := fs.DirByID(cmd.Payload.DirID)
+	if err != nil {
+		return subtree{}, dirNotFound(cmd)
+	}
+	if err = vfs.Allows(fs, pdoc.Permissions, permissions.GET, dir); err != nil {
+		return subtree{}, forbiddenDir(cmd)
+	}
+	return subtree{id: dir.ID(), path: dir.Fullpath}, nil
+}
+
+func readFilesPump(ctx context.Context, c echo.Context, i *instance.Instance, ws *websocket.Conn,
+	ds *realtime.DynamicSubscriber, subc chan subtree, errc chan *wsError) {
+	defer close(errc)
+
+	pdoc, e := authenticate(c, i, ws)
+	if e != nil {
+		sendErr(ctx, errc, e)
+		return
+	}
+
+	subscribed := false
+	for {
+		cmd := &filesCommand{}
+		if err := ws.ReadJSON(cmd); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				logger.WithDomain(ds.Domain).WithField("nspace", "realtime").Infof("Error: %s", err)
+			}
+			break
+		}
+
+		if strings.ToUpper(cmd.Method) != "SUBSCRIBE" {
+			sendErr(ctx, errc, unknownMethod(cmd.Method, cmd))
+			continue
+		}
+		sub, e := subtreeFromCommand(i.VFS(), pdoc, cmd)
+		if e != nil {
+			sendErr(ctx, errc, e)
+			continue
+		}
+
+		// The subtree is given to the writer before the subscription, so that
+		// no event is lost
+		select {
+		case subc <- sub:
+		case <-ctx.Done():
+			return
+		}
+		if !subscribed {
+			if err := ds.Subscribe(consts.Files); err != nil {
+				logger.WithDomain(ds.Domain).WithField("nspace", "realtime").Warnf("Error: %s", err)
+				continue
+			}
+			subscribed = true
+		}
+	}
+}
+
+// wsFiles is a websocket for the changes on the files and directories of the
+// instance. A client can subscribe to the whole tree, or to some directories
+// with their content, and it receives the CREATED, UPDATED, TRASHED and
+// DELETED events for them.
+func wsFiles(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	ws.SetReadLimit(maxMessageSize)
+	if err = ws.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+		return nil
+	}
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	ds := realtime.GetHub().Subscriber(instance.Domain)
+	defer ds.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan *wsError)
+	subc := make(chan subtree)
+	go readFilesPump(ctx, c, instance, ws, ds, subc, errc)
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	var subs []subtree
+	for {
+		select {
+		case e, ok := <-errc:
+			if !ok { // Websocket has been closed by the client
+				return nil
+			}
+			if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+				return nil
+			}
+			if err := ws.WriteJSON(e); err != nil {
+				return nil
+			}
+		case sub := <-subc:
+			subs = append(subs, sub)
+		case e := <-ds.Channel:
+			res := filesResponse(instance.VFS(), subs, e)
+			if res == nil {
+				continue
+			}
+			if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+				return err
+			}
+			if err := ws.WriteJSON(res); err != nil {
+				return nil
+			}
+		case <-ticker.C:
+			if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+				return err
+			}
+			if err := ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				return nil
+			}
+		}
+	}
+}
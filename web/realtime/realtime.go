@@ -125,29 +125,37 @@ func sendErr(ctx context.Context, errc chan *wsError, e *wsError) {
 	}
 }
 
-func readPump(ctx context.Context, c echo.Context, i *instance.Instance, ws *websocket.Conn,
-	ds *realtime.DynamicSubscriber, errc chan *wsError) {
-	defer close(errc)
-
+// authenticate reads the first message of the websocket, that must be an AUTH
+// with a token, and returns the permission for this token.
+func authenticate(c echo.Context, i *instance.Instance, ws *websocket.Conn) (*permissions.Permission, *wsError) {
 	var auth map[string]string
 	if err := ws.ReadJSON(&auth); err != nil {
-		sendErr(ctx, errc, unknownMethod(auth["method"], auth))
-		return
+		return nil, unknownMethod(auth["method"], auth)
 	}
 	if strings.ToUpper(auth["method"]) != "AUTH" {
-		sendErr(ctx, errc, unknownMethod(auth["method"], auth))
-		return
+		return nil, unknownMethod(auth["method"], auth)
 	}
 	if auth["payload"] == "" {
-		sendErr(ctx, errc, unauthorized(auth))
-		return
+		return nil, unauthorized(auth)
 	}
 	pdoc, err := webpermissions.ParseJWT(c, i, auth["payload"])
 	if err != nil {
-		sendErr(ctx, errc, unauthorized(auth))
+		return nil, unauthorized(auth)
+	}
+	return pdoc, nil
+}
+
+func readPump(ctx context.Context, c echo.Context, i *instance.Instance, ws *websocket.Conn,
+	ds *realtime.DynamicSubscriber, errc chan *wsError) {
+	defer close(errc)
+
+	pdoc, e := authenticate(c, i, ws)
+	if e != nil {
+		sendErr(ctx, errc, e)
 		return
 	}
 
+	var err error
 	for {
 		cmd := &command{}
 		if err = ws.ReadJSON(cmd); err != nil {
@@ -249,4 +257,5 @@ func ws(c echo.Context) error {
 // Routes set the routing for the realtime service
 func Routes(router *echo.Group) {
 	router.GET("/", ws)
+	router.GET("/files", wsFiles)
 }
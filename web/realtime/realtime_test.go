@@ -9,8 +9,10 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
@@ -174,12 +176,112 @@ func TestWSSuccess(t *testing.T) {
 	assert.Equal(t, "bar-one", payload["id"])
 }
 
+func TestDirPathResolver(t *testing.T) {
+	fs := inst.VFS()
+	dir, err := vfs.Mkdir(fs, "/realtime-resolved", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	e := &realtime.Event{Domain: inst.Domain}
+	fd := &fileEventDoc{ID: "resolved-file", Type: consts.FileType, DirID: dir.ID()}
+	assert.Equal(t, "/realtime-resolved", dirPaths.dirPath(fs, e, fd))
+	// The path is kept for the event, without asking the VFS again
+	assert.Equal(t, "/realtime-resolved", dirPaths.dirPath(nil, e, fd))
+}
+
+func TestWSFilesSubtree(t *testing.T) {
+	fs := inst.VFS()
+	watched, err := vfs.Mkdir(fs, "/realtime-watched", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	other, err := vfs.Mkdir(fs, "/realtime-other", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	u := strings.Replace(ts.URL+"/realtime/files", "http", "ws", 1)
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	assert.NoError(t, err)
+	defer c.Close()
+
+	auth := fmt.Sprintf(`{"method": "AUTH", "payload": "%s"}`, token)
+	err = c.WriteMessage(websocket.TextMessage, []byte(auth))
+	assert.NoError(t, err)
+
+	msg := `{"method": "SUBSCRIBE", "payload": { "dir_id": "not-a-dir" }}`
+	err = c.WriteMessage(websocket.TextMessage, []byte(msg))
+	assert.NoError(t, err)
+	var res map[string]interface{}
+	err = c.ReadJSON(&res)
+	assert.NoError(t, err)
+	assert.Equal(t, "error", res["event"])
+	payload := res["payload"].(map[string]interface{})
+	assert.Equal(t, "404 Page Not Found", payload["status"])
+
+	msg = fmt.Sprintf(`{"method": "SUBSCRIBE", "payload": { "dir_id": "%s" }}`, watched.ID())
+	err = c.WriteMessage(websocket.TextMessage, []byte(msg))
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	// waitEvent reads the messages until the given event for the given id,
+	// and fails if a message is received for a file outside the subtree
+	var outside *vfs.FileDoc
+	waitEvent := func(event, id string) {
+		for {
+			var res map[string]interface{}
+			if err := c.ReadJSON(&res); !assert.NoError(t, err) {
+				return
+			}
+			payload := res["payload"].(map[string]interface{})
+			assert.Equal(t, "io.cozy.files", payload["type"])
+			if outside != nil && !assert.NotEqual(t, outside.ID(), payload["id"]) {
+				return
+			}
+			if res["event"] == event && payload["id"] == id {
+				return
+			}
+		}
+	}
+
+	createFile := func(dir *vfs.DirDoc, name string) *vfs.FileDoc {
+		doc, err := vfs.NewFileDoc(name, dir.ID(), -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		f, err := fs.CreateFile(doc, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		_, err = f.Write([]byte("foo"))
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+		return doc
+	}
+
+	outside = createFile(other, "outside.txt")
+	sub, err := vfs.Mkdir(fs, "/realtime-watched/sub", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	waitEvent("CREATED", sub.ID())
+
+	inside := createFile(sub, "inside.txt")
+	waitEvent("CREATED", inside.ID())
+
+	inside, err = fs.FileByID(inside.ID())
+	assert.NoError(t, err)
+	_, err = vfs.TrashFile(fs, inside)
+	assert.NoError(t, err)
+	waitEvent("TRASHED", inside.ID())
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
 	setup := testutils.NewSetup(m, "realtime_test")
 	inst = setup.GetTestInstance()
-	_, token = setup.GetTestClient("io.cozy.foos io.cozy.bars")
+	_, token = setup.GetTestClient("io.cozy.foos io.cozy.bars io.cozy.files")
 	ts = setup.GetTestServer("/realtime", Routes)
 	os.Exit(setup.Run())
 }
@@ -114,13 +114,17 @@ func SetupRoutes(router *echo.Echo) error {
 			HSTSMaxAge:    hstsMaxAge,
 			CSPDefaultSrc: []middlewares.CSPSource{middlewares.CSPSrcSelf},
 			XFrameOptions: middlewares.XFrameDeny,
+			// The applications are on sibling domains and load the content of
+			// the files (thumbnails, downloads), but other sites can't.
+			CrossOriginResourcePolicy: "same-site",
 		})
 		router.Use(secure)
 	}
 
 	router.Use(middlewares.CORS(middlewares.CORSOptions{
-		BlackList: []string{"/auth/"},
+		BlackList: []string{"/auth/", "/files/"},
 	}))
+	router.Use(middlewares.CORS(files.CORSOptions()))
 
 	// non-authentified HTML routes for authentication (login, OAuth, ...)
 	{
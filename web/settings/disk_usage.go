@@ -14,8 +14,9 @@ import (
 )
 
 type apiDiskUsage struct {
-	Used  int64 `json:"used,string"`
-	Quota int64 `json:"quota,string,omitempty"`
+	Used         int64 `json:"used,string"`
+	Quota        int64 `json:"quota,string,omitempty"`
+	DedupSavings int64 `json:"dedup_savings,string,omitempty"`
 }
 
 func (j *apiDiskUsage) ID() string                             { return consts.DiskUsageID }
@@ -53,7 +54,13 @@ func diskUsage(c echo.Context) error {
 
 	quota := fs.DiskQuota()
 
+	savings, err := fs.DedupSavings()
+	if err != nil {
+		return err
+	}
+
 	result.Used = used
 	result.Quota = quota
+	result.DedupSavings = savings
 	return jsonapi.Data(c, http.StatusOK, &result, nil)
 }
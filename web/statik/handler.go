@@ -15,7 +15,6 @@ import (
 	"github.com/cozy/cozy-stack/pkg/i18n"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/web/middlewares"
-	web_utils "github.com/cozy/cozy-stack/web/utils"
 	"github.com/cozy/statik/fs"
 	"github.com/cozy/echo"
 )
@@ -288,7 +287,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	checkETag := id == ""
-	if checkETag && web_utils.CheckPreconditions(w, r, f.Etag()) {
+	if checkETag && utils.CheckPreconditions(w, r, f.Etag()) {
 		return
 	}
 